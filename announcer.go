@@ -0,0 +1,318 @@
+package bt
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// AnnounceParams are the values sent to a tracker in an announce.
+type AnnounceParams struct {
+	InfoHash [20]byte
+	PeerID   [20]byte
+	Port     int
+	// Our public addresses, if known. Sent as ipv4= and ipv6=, see BEP 7.
+	IPv4 netip.Addr
+	IPv6 netip.Addr
+	// Random value identifying us to the tracker across address changes
+	Key        uint32
+	Uploaded   int64
+	Downloaded int64
+	Left       int64
+	Event      string
+	// Number of peers wanted. Negative for the tracker's default.
+	NumWant int
+	// Echoed back from a previous response's "tracker id", if any
+	TrackerID string
+}
+
+// Query encodes p as HTTP announce parameters.
+func (p AnnounceParams) Query() url.Values {
+	v := url.Values{}
+	v.Set("info_hash", string(p.InfoHash[:]))
+	v.Set("peer_id", string(p.PeerID[:]))
+	if p.IPv4.Is4() {
+		v.Set("ipv4", p.IPv4.String())
+	}
+	if p.IPv6.Is6() {
+		v.Set("ipv6", p.IPv6.String())
+	}
+	v.Set("port", fmt.Sprint(p.Port))
+	v.Set("uploaded", fmt.Sprint(p.Uploaded))
+	v.Set("downloaded", fmt.Sprint(p.Downloaded))
+	v.Set("left", fmt.Sprint(p.Left))
+	v.Set("compact", "1")
+	v.Set("key", fmt.Sprintf("%08x", p.Key))
+	if p.Event != EventNone {
+		v.Set("event", p.Event)
+	}
+	if p.NumWant >= 0 {
+		v.Set("numwant", fmt.Sprint(p.NumWant))
+	}
+	if p.TrackerID != "" {
+		v.Set("trackerid", p.TrackerID)
+	}
+	return v
+}
+
+// trackerClient makes HTTP tracker requests, so a tracker that stops responding can't hold up announces forever.
+var trackerClient = &http.Client{Timeout: 30 * time.Second}
+
+// AnnounceHTTP sends a single announce to an HTTP(S) tracker.
+func AnnounceHTTP(ctx context.Context, announceURL string, p AnnounceParams) (*TrackerResponse, error) {
+	sep := "?"
+	if strings.Contains(announceURL, "?") {
+		sep = "&"
+	}
+	u := announceURL + sep + p.Query().Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, fmt.Errorf("GET %s: %w", announceURL, err)
+	}
+	r, err := trackerClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("GET %s: %w", announceURL, err)
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: expected 200 OK, got %s", announceURL, r.Status)
+	}
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, fmt.Errorf("GET %s: reading body: %w", announceURL, err)
+	}
+	return ParseTrackerResponse(data)
+}
+
+// TransferStats reports running totals of a download for announces.
+type TransferStats interface {
+	// Bytes uploaded and downloaded since the "started" event, and bytes left to download.
+	Stats() (uploaded, downloaded, left int64)
+}
+
+// Announcer manages the announce lifecycle of a single torrent with a single tracker.
+//
+// Run announces "started" immediately, then re-announces on the tracker's interval,
+// backing off exponentially on failure. Completed and NeedPeers trigger early announces,
+// and cancelling Run's context sends "stopped".
+//
+// Each successful response is delivered on Responses, after the Announcer has applied
+// its "min interval" and "tracker id" and logged any "warning message".
+type Announcer struct {
+	URL string
+	// Template for each announce. Stats and Event are filled in per announce.
+	Params AnnounceParams
+	Stats  TransferStats
+	// Lower bound on time between announces, unless announcing an event.
+	// Raised by the tracker's "min interval", if given.
+	MinInterval time.Duration
+	// Interval used until the tracker tells us otherwise
+	DefaultInterval time.Duration
+	// Delay before the first retry after a failure. Doubles on each failure, up to the interval.
+	RetryBackoff time.Duration
+	// Timeout for the final "stopped" announce
+	StopTimeout time.Duration
+
+	responses chan *TrackerResponse
+	completed chan struct{}
+	needPeers chan struct{}
+	udp       *UDPTrackerClient
+}
+
+func NewAnnouncer(announceURL string, params AnnounceParams, stats TransferStats) *Announcer {
+	return &Announcer{
+		URL:             announceURL,
+		Params:          params,
+		Stats:           stats,
+		MinInterval:     time.Minute,
+		DefaultInterval: 30 * time.Minute,
+		RetryBackoff:    15 * time.Second,
+		StopTimeout:     5 * time.Second,
+		responses:       make(chan *TrackerResponse, 1),
+		completed:       make(chan struct{}, 1),
+		needPeers:       make(chan struct{}, 1),
+	}
+}
+
+// Responses receives each successful announce response.
+//
+// If the previous response hasn't been read by the next announce, it's replaced.
+func (a *Announcer) Responses() <-chan *TrackerResponse {
+	return a.responses
+}
+
+// Completed schedules an immediate "completed" announce. Only the first call has any effect.
+func (a *Announcer) Completed() {
+	select {
+	case a.completed <- struct{}{}:
+	default:
+	}
+}
+
+// NeedPeers requests an announce as soon as MinInterval allows, to find more peers.
+func (a *Announcer) NeedPeers() {
+	select {
+	case a.needPeers <- struct{}{}:
+	default:
+	}
+}
+
+// Run announces until ctx is cancelled, then announces "stopped" if "started" ever succeeded.
+func (a *Announcer) Run(ctx context.Context) {
+	defer func() {
+		if a.udp != nil {
+			a.udp.Close()
+		}
+	}()
+	var (
+		event      = EventStarted
+		started    bool
+		completed  bool // Completed() has been called
+		sentDone   bool // "completed" has been announced
+		failures   int
+		last       time.Time
+		interval   = a.DefaultInterval
+		timer      = time.NewTimer(0)
+		completeCh = a.completed
+	)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if started {
+				a.announceStopped()
+			}
+			return
+		case <-completeCh:
+			completeCh = nil // Only once
+			completed = true
+			if started && event == EventNone {
+				event = EventCompleted
+				resetTimer(timer, 0)
+			}
+			continue
+		case <-a.needPeers:
+			if !started || event != EventNone || failures > 0 {
+				continue // Already announcing soon
+			}
+			resetTimer(timer, time.Until(last.Add(a.MinInterval)))
+			continue
+		case <-timer.C:
+		}
+
+		resp, err := a.announce(ctx, event)
+		if ctx.Err() != nil {
+			continue // Announce "stopped" instead
+		}
+		if err == nil && resp.Reason != nil {
+			err = fmt.Errorf("tracker failure: %s", *resp.Reason)
+		}
+		if err != nil {
+			failures++
+			backoff := a.RetryBackoff << (failures - 1)
+			if backoff > interval || backoff <= 0 {
+				backoff = interval
+			}
+			log.Printf("Announcer: %s announce to %s failed (attempt %d, retrying in %s): %s", eventName(event), a.URL, failures, backoff, err)
+			timer.Reset(backoff)
+			continue
+		}
+		failures = 0
+		last = time.Now()
+		switch event {
+		case EventStarted:
+			started = true
+		case EventCompleted:
+			sentDone = true
+		}
+		if resp.Warning != nil {
+			log.Printf("Announcer: warning from %s: %s", a.URL, *resp.Warning)
+		}
+		if resp.TrackerID != nil {
+			a.Params.TrackerID = *resp.TrackerID
+		}
+		if resp.MinInterval != nil {
+			if floor := time.Duration(*resp.MinInterval) * time.Second; floor > a.MinInterval {
+				a.MinInterval = floor
+			}
+		}
+		if resp.Interval != nil && *resp.Interval > 0 {
+			interval = time.Duration(*resp.Interval) * time.Second
+		}
+		if interval < a.MinInterval {
+			interval = a.MinInterval
+		}
+		select {
+		case <-a.responses: // Drop stale response
+		default:
+		}
+		a.responses <- resp
+
+		if completed && !sentDone {
+			event = EventCompleted
+			timer.Reset(0)
+			continue
+		}
+		event = EventNone
+		timer.Reset(interval)
+	}
+}
+
+// announce sends one announce with the current stats, giving up if ctx is cancelled.
+func (a *Announcer) announce(ctx context.Context, event string) (*TrackerResponse, error) {
+	p := a.Params
+	p.Event = event
+	if a.Stats != nil {
+		p.Uploaded, p.Downloaded, p.Left = a.Stats.Stats()
+	}
+	if event == EventStopped {
+		p.NumWant = 0
+	}
+	if !strings.HasPrefix(a.URL, "udp://") {
+		return AnnounceHTTP(ctx, a.URL, p)
+	}
+	if a.udp == nil {
+		c, err := DialUDPTracker(a.URL)
+		if err != nil {
+			return nil, err
+		}
+		a.udp = c
+	}
+	return a.udp.Announce(ctx, p)
+}
+
+// announceStopped makes a best-effort "stopped" announce, cancelled after StopTimeout.
+func (a *Announcer) announceStopped() {
+	ctx, cancel := context.WithTimeout(context.Background(), a.StopTimeout)
+	defer cancel()
+	if _, err := a.announce(ctx, EventStopped); err != nil {
+		log.Printf("Announcer: stopped announce to %s failed: %s", a.URL, err)
+	}
+}
+
+func eventName(event string) string {
+	if event == EventNone {
+		return "regular"
+	}
+	return event
+}
+
+// resetTimer resets a timer that may or may not have fired, draining its channel.
+func resetTimer(t *time.Timer, d time.Duration) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+	if d < 0 {
+		d = 0
+	}
+	t.Reset(d)
+}
@@ -0,0 +1,257 @@
+package bt
+
+import (
+	"context"
+	"crypto/sha1"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// recordingStore passes announces through to a MemoryPeerStore, reporting each on a channel.
+type recordingStore struct {
+	*MemoryPeerStore
+	announces chan recordedAnnounce
+}
+
+type recordedAnnounce struct {
+	Event string
+	Left  int64
+}
+
+func (s *recordingStore) Announce(infoHash [20]byte, p TrackedPeer, event string) error {
+	s.announces <- recordedAnnounce{Event: event, Left: p.Left}
+	return s.MemoryPeerStore.Announce(infoHash, p, event)
+}
+
+type fixedStats struct {
+	left atomic.Int64
+}
+
+func (f *fixedStats) Stats() (uploaded, downloaded, left int64) {
+	return 0, 0, f.left.Load()
+}
+
+// newTestAnnouncer runs an Announcer against an in-process tracker, returning its recorded announces.
+func newTestAnnouncer(t *testing.T, stats TransferStats) (*Announcer, *TrackerServer, <-chan recordedAnnounce) {
+	t.Helper()
+	store := &recordingStore{NewMemoryPeerStore(), make(chan recordedAnnounce, 100)}
+	ts := NewTrackerServer(store)
+	ts.MinInterval = 0 // Let tests set the Announcer's MinInterval
+	srv := httptest.NewServer(ts)
+	t.Cleanup(srv.Close)
+	a := NewAnnouncer(srv.URL+"/announce", AnnounceParams{
+		InfoHash: sha1.Sum([]byte("infohash")),
+		PeerID:   sha1.Sum([]byte("peer")),
+		Port:     6881,
+		NumWant:  -1,
+	}, stats)
+	return a, ts, store.announces
+}
+
+func expectAnnounce(t *testing.T, announces <-chan recordedAnnounce, want string, within time.Duration) recordedAnnounce {
+	t.Helper()
+	select {
+	case got := <-announces:
+		if got.Event != want {
+			t.Fatalf("want %s announce, got %q", eventName(want), got.Event)
+		}
+		return got
+	case <-time.After(within):
+		t.Fatalf("no %s announce within %s", eventName(want), within)
+	}
+	return recordedAnnounce{}
+}
+
+func TestAnnouncerLifecycle(t *testing.T) {
+	stats := &fixedStats{}
+	stats.left.Store(1000)
+	a, _, announces := newTestAnnouncer(t, stats)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		a.Run(ctx)
+		close(done)
+	}()
+
+	if got := expectAnnounce(t, announces, EventStarted, time.Second); got.Left != 1000 {
+		t.Fatalf("want left=1000, got %d", got.Left)
+	}
+	select {
+	case resp := <-a.Responses():
+		if resp.ExternalIP != netip.MustParseAddr("127.0.0.1") {
+			t.Fatalf("want external ip 127.0.0.1, got %s", resp.ExternalIP)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no response delivered after started announce")
+	}
+
+	stats.left.Store(0)
+	a.Completed()
+	if got := expectAnnounce(t, announces, EventCompleted, time.Second); got.Left != 0 {
+		t.Fatalf("want left=0, got %d", got.Left)
+	}
+	// Only the first Completed counts
+	a.Completed()
+
+	cancel()
+	expectAnnounce(t, announces, EventStopped, time.Second)
+	<-done
+	select {
+	case got := <-announces:
+		t.Fatalf("unexpected announce after stop: %v", got)
+	default:
+	}
+}
+
+func TestAnnouncerInterval(t *testing.T) {
+	a, ts, announces := newTestAnnouncer(t, nil)
+	ts.Interval = 0 // Announcer falls back to DefaultInterval
+	a.DefaultInterval = 20 * time.Millisecond
+	a.MinInterval = 10 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go a.Run(ctx)
+
+	expectAnnounce(t, announces, EventStarted, time.Second)
+	for i := 0; i < 3; i++ {
+		expectAnnounce(t, announces, EventNone, time.Second)
+	}
+}
+
+func TestAnnouncerNeedPeers(t *testing.T) {
+	a, _, announces := newTestAnnouncer(t, nil)
+	a.MinInterval = 50 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go a.Run(ctx)
+
+	expectAnnounce(t, announces, EventStarted, time.Second)
+	start := time.Now()
+	a.NeedPeers()
+	expectAnnounce(t, announces, EventNone, time.Second)
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Fatalf("early announce ignored min interval, came after %s", elapsed)
+	}
+}
+
+func TestAnnouncerBackoff(t *testing.T) {
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	a := NewAnnouncer(srv.URL+"/announce", AnnounceParams{NumWant: -1}, nil)
+	a.RetryBackoff = 10 * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), 160*time.Millisecond)
+	defer cancel()
+	a.Run(ctx)
+
+	// Attempts at 0, 10, 30, 70, and 150ms. Without backoff there'd be about 16.
+	if got := hits.Load(); got < 3 || got > 6 {
+		t.Fatalf("want about 5 attempts with backoff, got %d", got)
+	}
+}
+
+func TestAnnouncerUnresponsiveTracker(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer conn.Close()
+
+	for _, u := range []string{srv.URL + "/announce", "udp://" + conn.LocalAddr().String()} {
+		a := NewAnnouncer(u, AnnounceParams{NumWant: -1}, nil)
+		a.StopTimeout = 50 * time.Millisecond
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		start := time.Now()
+		a.Run(ctx)
+		cancel()
+		// Neither the HTTP timeout nor the UDP retries hold up cancellation
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("%s: Run took %s to return after cancellation", u, elapsed)
+		}
+	}
+}
+
+func TestAnnouncerStopTimeout(t *testing.T) {
+	abandoned := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("event") != EventStopped {
+			w.Write([]byte("d8:intervali1800e5:peers0:e"))
+			return
+		}
+		<-r.Context().Done()
+		close(abandoned)
+	}))
+	defer srv.Close()
+	a := NewAnnouncer(srv.URL+"/announce", AnnounceParams{NumWant: -1}, nil)
+	a.StopTimeout = 50 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		a.Run(ctx)
+		close(done)
+	}()
+	<-a.Responses()
+	cancel()
+	<-done
+	// The stopped announce is cancelled, not left running after Run returns
+	select {
+	case <-abandoned:
+	case <-time.After(time.Second):
+		t.Fatal("stopped announce still running after Run returned")
+	}
+}
+
+func TestAnnouncerTrackerIDAndMinInterval(t *testing.T) {
+	var calls atomic.Int32
+	trackerIDs := make(chan string, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		trackerIDs <- r.URL.Query().Get("trackerid")
+		w.Write([]byte(`d8:intervali0e12:min intervali1e10:tracker id3:abc15:warning message4:hmm!5:peers0:e`))
+	}))
+	defer srv.Close()
+	a := NewAnnouncer(srv.URL+"/announce", AnnounceParams{NumWant: -1}, nil)
+	a.MinInterval = time.Millisecond
+	a.DefaultInterval = time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go a.Run(ctx)
+
+	if got := <-trackerIDs; got != "" {
+		t.Fatalf("want no trackerid on first announce, got %q", got)
+	}
+	resp := <-a.Responses()
+	if resp.Warning == nil || *resp.Warning != "hmm!" {
+		t.Fatalf("want warning message, got %v", resp.Warning)
+	}
+	// The tracker's 1s min interval overrides our 1ms
+	time.Sleep(200 * time.Millisecond)
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("want 1 announce within min interval, got %d", n)
+	}
+	select {
+	case got := <-trackerIDs:
+		if got != "abc" {
+			t.Fatalf("want trackerid=abc, got %q", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no announce after min interval")
+	}
+}
@@ -0,0 +1,296 @@
+package bt
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"net/netip"
+	"sync"
+)
+
+// BlockSize is the amount requested at a time. Most clients refuse requests for more than 16KiB.
+const BlockSize = 16 * 1024
+
+// DefaultPipelineDepth is the number of requests kept outstanding with each peer.
+const DefaultPipelineDepth = 10
+
+// DefaultEndgameFanout is the most peers asked for the same block in endgame.
+const DefaultEndgameFanout = 3
+
+// ErrPieceHashMismatch is returned when a completed piece doesn't match its SHA1 from the metainfo.
+var ErrPieceHashMismatch = errors.New("piece failed hash check")
+
+// partialPiece is a piece we've started requesting but not yet verified.
+type partialPiece struct {
+	data     []byte
+	received []bool
+	// Number of outstanding requests for each block
+	requests  []int
+	remaining int
+}
+
+// PieceAssembler decides which blocks to request from each peer and assembles the responses into pieces.
+//
+// Peers are identified by address. Each piece is split into BlockSize blocks (the last may be shorter),
+// and up to PipelineDepth requests are kept outstanding with each peer.
+// Completed pieces are checked against Info.Pieces and handed to the verified callback.
+//
+// Once every remaining block has been requested, the assembler enters endgame:
+// blocks still outstanding are requested from other peers too, up to EndgameFanout peers per block,
+// so the download doesn't wait on the slowest peer. When one copy arrives, the others should be cancelled.
+type PieceAssembler struct {
+	PipelineDepth int
+	// Set to 1 to disable endgame
+	EndgameFanout int
+	// Chooses which pieces to start. Peers' pieces must be reported to it as they're learned.
+	Picker *PiecePicker
+
+	info *Info
+	// Called with each verified piece, without holding the assembler's lock
+	verified func(index int, data []byte) error
+
+	mu sync.Mutex
+	// Pieces that have been verified. Guarded by mu.
+	have    *BField
+	partial map[int]*partialPiece
+	// Outstanding requests by peer
+	outstanding map[netip.AddrPort]map[BlockRequest]struct{}
+}
+
+// NewPieceAssembler assembles the pieces of info that aren't in have.
+// have is copied; the assembler tracks its own progress afterward.
+func NewPieceAssembler(info *Info, have *BField, verified func(index int, data []byte) error) *PieceAssembler {
+	haveCopy, _ := NewBitfield(have.Bytes(), have.Length())
+	return &PieceAssembler{
+		PipelineDepth: DefaultPipelineDepth,
+		EndgameFanout: DefaultEndgameFanout,
+		Picker:        NewPiecePicker(info, haveCopy),
+		info:          info,
+		verified:      verified,
+		have:          haveCopy,
+		partial:       make(map[int]*partialPiece),
+		outstanding:   make(map[netip.AddrPort]map[BlockRequest]struct{}),
+	}
+}
+
+// numBlocks is the number of blocks in piece index
+func (a *PieceAssembler) numBlocks(index int) int {
+	return (a.info.PieceSize(index) + BlockSize - 1) / BlockSize
+}
+
+// block returns the request for block b of piece index
+func (a *PieceAssembler) block(index, b int) BlockRequest {
+	begin := b * BlockSize
+	length := a.info.PieceSize(index) - begin
+	if length > BlockSize {
+		length = BlockSize
+	}
+	return BlockRequest{Index: uint32(index), Begin: uint32(begin), Length: uint32(length)}
+}
+
+// Interesting reports whether the peer has any piece we still want.
+func (a *PieceAssembler) Interesting(peerHas *BField) bool {
+	return a.Picker.Interesting(peerHas)
+}
+
+// Fill returns new requests to send to peer, bringing its outstanding requests up to PipelineDepth.
+//
+// Blocks of partially downloaded pieces are requested before starting new pieces, which are chosen by Picker.
+func (a *PieceAssembler) Fill(peer netip.AddrPort, peerHas *BField) []BlockRequest {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	pending := a.outstanding[peer]
+	if pending == nil {
+		pending = make(map[BlockRequest]struct{})
+		a.outstanding[peer] = pending
+	}
+	n := a.PipelineDepth - len(pending)
+	if n <= 0 {
+		return nil
+	}
+	var out []BlockRequest
+	request := func(index int, pp *partialPiece) {
+		for b := range pp.received {
+			if len(out) == n {
+				return
+			}
+			if pp.received[b] || pp.requests[b] > 0 {
+				continue
+			}
+			r := a.block(index, b)
+			pp.requests[b]++
+			pending[r] = struct{}{}
+			out = append(out, r)
+		}
+	}
+
+	for _, index := range a.Picker.Partial(peerHas) {
+		request(index, a.partial[index])
+	}
+	for len(out) < n {
+		index, ok := a.Picker.Pick(peerHas)
+		if !ok {
+			break
+		}
+		pp := a.startPiece(index)
+		request(index, pp)
+	}
+	if len(out) < n && a.inEndgame() {
+		out = a.fillEndgame(peerHas, pending, out, n)
+	}
+	return out
+}
+
+// inEndgame reports whether every wanted block has been requested. Must hold a.mu.
+func (a *PieceAssembler) inEndgame() bool {
+	if len(a.partial) == 0 || a.Picker.Unstarted() > 0 {
+		return false
+	}
+	for _, pp := range a.partial {
+		for b := range pp.received {
+			if !pp.received[b] && pp.requests[b] == 0 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// fillEndgame adds duplicate requests for outstanding blocks, up to n, preferring the least requested. Must hold a.mu.
+func (a *PieceAssembler) fillEndgame(peerHas *BField, pending map[BlockRequest]struct{}, out []BlockRequest, n int) []BlockRequest {
+	for copies := 1; copies < a.EndgameFanout; copies++ {
+		for _, index := range a.Picker.Partial(peerHas) {
+			pp := a.partial[index]
+			for b := range pp.received {
+				if len(out) == n {
+					return out
+				}
+				r := a.block(index, b)
+				if _, dup := pending[r]; dup || pp.received[b] || pp.requests[b] != copies {
+					continue
+				}
+				pp.requests[b]++
+				pending[r] = struct{}{}
+				out = append(out, r)
+			}
+		}
+	}
+	return out
+}
+
+// startPiece allocates a piece to be assembled. Must hold a.mu.
+func (a *PieceAssembler) startPiece(index int) *partialPiece {
+	blocks := a.numBlocks(index)
+	pp := &partialPiece{
+		data:      make([]byte, a.info.PieceSize(index)),
+		received:  make([]bool, blocks),
+		requests:  make([]int, blocks),
+		remaining: blocks,
+	}
+	a.partial[index] = pp
+	a.Picker.Started(index)
+	return pp
+}
+
+// release forgets an outstanding request, so its block may be requested again. Must hold a.mu.
+func (a *PieceAssembler) release(peer netip.AddrPort, r BlockRequest) bool {
+	pending := a.outstanding[peer]
+	if _, ok := pending[r]; !ok {
+		return false
+	}
+	delete(pending, r)
+	if pp, ok := a.partial[int(r.Index)]; ok {
+		pp.requests[r.Begin/BlockSize]--
+	}
+	return true
+}
+
+// Cancelled forgets a request we've cancelled, so its block may be requested from another peer.
+func (a *PieceAssembler) Cancelled(peer netip.AddrPort, r BlockRequest) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.release(peer, r)
+}
+
+// DropPeer forgets all of peer's outstanding requests.
+// Call it when the peer chokes us (discarding our requests) or disconnects.
+func (a *PieceAssembler) DropPeer(peer netip.AddrPort) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for r := range a.outstanding[peer] {
+		a.release(peer, r)
+	}
+	delete(a.outstanding, peer)
+}
+
+// Outstanding is the number of requests to peer we're waiting on.
+func (a *PieceAssembler) Outstanding(peer netip.AddrPort) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.outstanding[peer])
+}
+
+// Received stores a block from a Piece message, reporting whether it completed and verified its piece.
+// In endgame, cancel lists the other peers the block was requested from, which should be sent a Cancel.
+// Their requests are forgotten.
+//
+// Blocks we didn't ask for or already have are ignored.
+// If the completed piece fails its hash check, it's discarded and ErrPieceHashMismatch is returned.
+func (a *PieceAssembler) Received(peer netip.AddrPort, index, begin uint32, block []byte) (cancel []netip.AddrPort, completed bool, err error) {
+	a.mu.Lock()
+	r := BlockRequest{Index: index, Begin: begin, Length: uint32(len(block))}
+	a.release(peer, r)
+	pp, ok := a.partial[int(index)]
+	if !ok || begin%BlockSize != 0 || int(begin/BlockSize) >= len(pp.received) {
+		a.mu.Unlock()
+		return nil, false, nil
+	}
+	b := int(begin / BlockSize)
+	if r != a.block(int(index), b) {
+		a.mu.Unlock()
+		return nil, false, fmt.Errorf("block %d of piece %d: expected %d bytes, got %d", b, index, a.block(int(index), b).Length, len(block))
+	}
+	if pp.received[b] {
+		a.mu.Unlock()
+		return nil, false, nil
+	}
+	copy(pp.data[begin:], block)
+	pp.received[b] = true
+	pp.remaining--
+	if pp.requests[b] > 0 {
+		for other, pending := range a.outstanding {
+			if _, ok := pending[r]; ok {
+				a.release(other, r)
+				cancel = append(cancel, other)
+			}
+		}
+	}
+	if pp.remaining > 0 {
+		a.mu.Unlock()
+		return cancel, false, nil
+	}
+
+	delete(a.partial, int(index))
+	sum := sha1.Sum(pp.data)
+	if !bytes.Equal(sum[:], a.info.Pieces[index]) {
+		a.Picker.Reset(int(index))
+		a.mu.Unlock()
+		return cancel, false, fmt.Errorf("piece %d: %w", index, ErrPieceHashMismatch)
+	}
+	a.have.Set(int(index), true)
+	a.Picker.Completed(int(index))
+	a.mu.Unlock()
+
+	if a.verified != nil {
+		if err := a.verified(int(index), pp.data); err != nil {
+			// Download it again
+			a.mu.Lock()
+			a.have.Set(int(index), false)
+			a.Picker.Reset(int(index))
+			a.mu.Unlock()
+			return cancel, false, err
+		}
+	}
+	return cancel, true, nil
+}
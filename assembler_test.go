@@ -0,0 +1,340 @@
+package bt
+
+import (
+	"bytes"
+	"container/heap"
+	"crypto/sha1"
+	"errors"
+	"math/rand"
+	"net/netip"
+	"sort"
+	"testing"
+	"time"
+)
+
+// testTorrent generates random content and the Info describing it.
+func testTorrent(t testing.TB, pieceLength, length int) (*Info, []byte) {
+	t.Helper()
+	data := make([]byte, length)
+	rand.New(rand.NewSource(int64(length))).Read(data)
+	info := &Info{PieceLength: pieceLength, Length: &length}
+	for off := 0; off < length; off += pieceLength {
+		end := off + pieceLength
+		if end > length {
+			end = length
+		}
+		sum := sha1.Sum(data[off:end])
+		info.Pieces = append(info.Pieces, sum[:])
+	}
+	return info, data
+}
+
+// fullBitfield returns a bitfield with every piece set, as a seeder would have.
+func fullBitfield(t testing.TB, n int) *BField {
+	t.Helper()
+	b, err := NewEmptyBitfield(n)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	for i := 0; i < n; i++ {
+		b.Set(i, true)
+	}
+	return b
+}
+
+// serve answers a request from the torrent's content
+func serve(info *Info, data []byte, r BlockRequest) []byte {
+	off := int(r.Index)*info.PieceLength + int(r.Begin)
+	return data[off : off+int(r.Length)]
+}
+
+func TestPieceAssemblerBlocks(t *testing.T) {
+	t.Parallel()
+	// Pieces of 40000, 40000, and 10000 bytes: 3, 3, and 1 blocks
+	info, _ := testTorrent(t, 40000, 90000)
+	have, _ := NewEmptyBitfield(3)
+	a := NewPieceAssembler(info, have, nil)
+	a.PipelineDepth = 100
+	got := a.Fill(netip.MustParseAddrPort("10.0.0.1:6881"), fullBitfield(t, 3))
+	want := []BlockRequest{
+		{0, 0, BlockSize}, {0, BlockSize, BlockSize}, {0, 2 * BlockSize, 40000 - 2*BlockSize},
+		{1, 0, BlockSize}, {1, BlockSize, BlockSize}, {1, 2 * BlockSize, 40000 - 2*BlockSize},
+		{2, 0, 10000},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("want %d requests, got %d: %v", len(want), len(got), got)
+	}
+	// Pieces are picked in random order, but their blocks are requested in order
+	sort.SliceStable(got, func(i, j int) bool { return got[i].Index < got[j].Index })
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("request %d: want %v, got %v", i, want[i], got[i])
+		}
+	}
+}
+
+func TestPieceAssemblerPipeline(t *testing.T) {
+	t.Parallel()
+	info, data := testTorrent(t, 2*BlockSize, 10*BlockSize)
+	have, _ := NewEmptyBitfield(5)
+	a := NewPieceAssembler(info, have, nil)
+	a.PipelineDepth = 3
+	peer := netip.MustParseAddrPort("10.0.0.1:6881")
+	// The peer only has pieces 1 and 3
+	peerHas, _ := NewEmptyBitfield(5)
+	peerHas.Set(1, true)
+	peerHas.Set(3, true)
+
+	reqs := a.Fill(peer, peerHas)
+	if len(reqs) != 3 || a.Outstanding(peer) != 3 {
+		t.Fatalf("want 3 outstanding requests, got %v", reqs)
+	}
+	for _, r := range reqs {
+		if r.Index != 1 && r.Index != 3 {
+			t.Fatalf("requested piece %d, which the peer doesn't have", r.Index)
+		}
+	}
+	if more := a.Fill(peer, peerHas); len(more) != 0 {
+		t.Fatalf("want no requests beyond pipeline depth, got %v", more)
+	}
+	if _, _, err := a.Received(peer, reqs[0].Index, reqs[0].Begin, serve(info, data, reqs[0])); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if more := a.Fill(peer, peerHas); len(more) != 1 {
+		t.Fatalf("want 1 request to refill pipeline, got %v", more)
+	}
+}
+
+func TestPieceAssemblerVerify(t *testing.T) {
+	t.Parallel()
+	info, data := testTorrent(t, 2*BlockSize, 3*BlockSize+100)
+	have, _ := NewEmptyBitfield(2)
+	var verified []int
+	a := NewPieceAssembler(info, have, func(index int, piece []byte) error {
+		start := index * info.PieceLength
+		if !bytes.Equal(piece, data[start:start+len(piece)]) {
+			t.Errorf("piece %d: wrong data", index)
+		}
+		verified = append(verified, index)
+		return nil
+	})
+	peer := netip.MustParseAddrPort("10.0.0.1:6881")
+	peerHas := fullBitfield(t, 2)
+
+	// Corrupt the first piece once
+	reqs := a.Fill(peer, peerHas)
+	var hashErrs int
+	for _, r := range reqs {
+		block := append([]byte{}, serve(info, data, r)...)
+		if r.Index == 0 {
+			block[0] ^= 0xff
+		}
+		if _, _, err := a.Received(peer, r.Index, r.Begin, block); errors.Is(err, ErrPieceHashMismatch) {
+			hashErrs++
+		} else if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	if hashErrs != 1 || len(verified) != 1 || verified[0] != 1 {
+		t.Fatalf("want piece 0 rejected and piece 1 verified, got %d mismatches and %v", hashErrs, verified)
+	}
+	// Piece 0 is requested again
+	for _, r := range a.Fill(peer, peerHas) {
+		if r.Index != 0 {
+			t.Fatalf("want only piece 0 requested again, got %v", r)
+		}
+		if _, _, err := a.Received(peer, r.Index, r.Begin, serve(info, data, r)); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	if len(verified) != 2 || a.Interesting(peerHas) {
+		t.Fatalf("want both pieces verified, got %v", verified)
+	}
+	// Late and wrongly sized blocks
+	if _, done, err := a.Received(peer, 0, 0, serve(info, data, BlockRequest{0, 0, BlockSize})); done || err != nil {
+		t.Fatalf("want duplicate block ignored, got %t, %v", done, err)
+	}
+}
+
+func TestPieceAssemblerDropPeer(t *testing.T) {
+	t.Parallel()
+	info, _ := testTorrent(t, 4*BlockSize, 4*BlockSize)
+	have, _ := NewEmptyBitfield(1)
+	a := NewPieceAssembler(info, have, nil)
+	a.PipelineDepth = 2
+	peerHas := fullBitfield(t, 1)
+	slow := netip.MustParseAddrPort("10.0.0.1:6881")
+	fast := netip.MustParseAddrPort("10.0.0.2:6881")
+
+	first := a.Fill(slow, peerHas)
+	if got := a.Fill(fast, peerHas); len(got) != 2 || got[0] == first[0] || got[0] == first[1] {
+		t.Fatalf("want 2 different blocks for second peer, got %v after %v", got, first)
+	}
+	if got := a.Fill(fast, peerHas); len(got) != 0 {
+		t.Fatalf("want nothing left to request, got %v", got)
+	}
+
+	// A choke or disconnect returns blocks for other peers to request
+	a.DropPeer(slow)
+	a.PipelineDepth = 4
+	if got := a.Fill(fast, peerHas); len(got) != 2 || got[0] != first[0] || got[1] != first[1] {
+		t.Fatalf("want dropped blocks %v requested again, got %v", first, got)
+	}
+	a.Cancelled(fast, first[0])
+	if a.Outstanding(fast) != 3 {
+		t.Fatalf("want 3 outstanding after cancel, got %d", a.Outstanding(fast))
+	}
+}
+
+func TestPieceAssemblerEndgame(t *testing.T) {
+	t.Parallel()
+	info, data := testTorrent(t, 2*BlockSize, 2*BlockSize)
+	have, _ := NewEmptyBitfield(1)
+	a := NewPieceAssembler(info, have, nil)
+	a.PipelineDepth = 2
+	a.EndgameFanout = 2
+	peerHas := fullBitfield(t, 1)
+	peers := []netip.AddrPort{
+		netip.MustParseAddrPort("10.0.0.1:6881"),
+		netip.MustParseAddrPort("10.0.0.2:6881"),
+		netip.MustParseAddrPort("10.0.0.3:6881"),
+	}
+
+	first := a.Fill(peers[0], peerHas)
+	if len(first) != 2 {
+		t.Fatalf("want both blocks requested, got %v", first)
+	}
+	// Every block is requested, so the next peer gets duplicates, but no more than the fanout allows
+	if dups := a.Fill(peers[1], peerHas); len(dups) != 2 {
+		t.Fatalf("want 2 duplicate requests in endgame, got %v", dups)
+	}
+	if dups := a.Fill(peers[2], peerHas); len(dups) != 0 {
+		t.Fatalf("want no requests beyond endgame fanout, got %v", dups)
+	}
+
+	cancel, _, err := a.Received(peers[1], first[0].Index, first[0].Begin, serve(info, data, first[0]))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(cancel) != 1 || cancel[0] != peers[0] {
+		t.Fatalf("want cancel sent to %s, got %v", peers[0], cancel)
+	}
+	if a.Outstanding(peers[0]) != 1 || a.Outstanding(peers[1]) != 1 {
+		t.Fatalf("want received block forgotten for both peers, got %d and %d", a.Outstanding(peers[0]), a.Outstanding(peers[1]))
+	}
+	// The late copy is ignored
+	if _, done, err := a.Received(peers[0], first[0].Index, first[0].Begin, serve(info, data, first[0])); done || err != nil {
+		t.Fatalf("want late duplicate ignored, got %t, %v", done, err)
+	}
+}
+
+// simEvent is a block arriving from a simulated peer
+type simEvent struct {
+	at        time.Duration
+	peer      int
+	r         BlockRequest
+	cancelled bool
+}
+
+type simQueue []*simEvent
+
+func (q simQueue) Len() int            { return len(q) }
+func (q simQueue) Less(i, j int) bool  { return q[i].at < q[j].at }
+func (q simQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *simQueue) Push(x interface{}) { *q = append(*q, x.(*simEvent)) }
+func (q *simQueue) Pop() interface{} {
+	old := *q
+	e := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return e
+}
+
+// simulateSwarm downloads a torrent from seeders that each take the given time per block,
+// serving their requests one at a time. It returns the virtual time at which the last piece was verified.
+func simulateSwarm(t *testing.T, fanout int, perBlock []time.Duration) time.Duration {
+	t.Helper()
+	info, data := testTorrent(t, 4*BlockSize, 40*BlockSize)
+	have, _ := NewEmptyBitfield(len(info.Pieces))
+	var verified int
+	a := NewPieceAssembler(info, have, func(int, []byte) error {
+		verified++
+		return nil
+	})
+	a.PipelineDepth = 4
+	a.EndgameFanout = fanout
+	seeder := fullBitfield(t, len(info.Pieces))
+	addrs := make([]netip.AddrPort, len(perBlock))
+	for i := range addrs {
+		addrs[i] = netip.AddrPortFrom(netip.AddrFrom4([4]byte{10, 0, 0, byte(i + 1)}), 6881)
+		a.Picker.PeerBitfield(seeder)
+	}
+
+	var (
+		now       time.Duration
+		queue     simQueue
+		busyUntil = make([]time.Duration, len(perBlock))
+		inFlight  = make(map[netip.AddrPort]map[BlockRequest]*simEvent)
+	)
+	fill := func(peer int) {
+		for _, r := range a.Fill(addrs[peer], seeder) {
+			if busyUntil[peer] < now {
+				busyUntil[peer] = now
+			}
+			busyUntil[peer] += perBlock[peer]
+			e := &simEvent{at: busyUntil[peer], peer: peer, r: r}
+			if inFlight[addrs[peer]] == nil {
+				inFlight[addrs[peer]] = make(map[BlockRequest]*simEvent)
+			}
+			inFlight[addrs[peer]][r] = e
+			heap.Push(&queue, e)
+		}
+	}
+	for peer := range perBlock {
+		fill(peer)
+	}
+	for verified < len(info.Pieces) {
+		if queue.Len() == 0 {
+			t.Fatalf("download stalled with %d of %d pieces", verified, len(info.Pieces))
+		}
+		e := heap.Pop(&queue).(*simEvent)
+		if e.cancelled {
+			continue
+		}
+		now = e.at
+		delete(inFlight[addrs[e.peer]], e.r)
+		cancel, _, err := a.Received(addrs[e.peer], e.r.Index, e.r.Begin, serve(info, data, e.r))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		// A cancelled request doesn't free up the peer's time, since it may already be sending it
+		for _, addr := range cancel {
+			if other, ok := inFlight[addr][e.r]; ok {
+				other.cancelled = true
+				delete(inFlight[addr], e.r)
+			}
+		}
+		fill(e.peer)
+		for i, addr := range addrs {
+			if i != e.peer && a.Outstanding(addr) < a.PipelineDepth {
+				fill(i)
+			}
+		}
+	}
+	return now
+}
+
+func TestEndgameSimulatedSwarm(t *testing.T) {
+	t.Parallel()
+	// Three fast peers and one that's 100 times slower
+	perBlock := []time.Duration{10 * time.Millisecond, 10 * time.Millisecond, 10 * time.Millisecond, time.Second}
+	without := simulateSwarm(t, 1, perBlock)
+	with := simulateSwarm(t, DefaultEndgameFanout, perBlock)
+	t.Logf("download finished at %s without endgame, %s with endgame", without, with)
+	// Without endgame, the last blocks wait on the slow peer
+	if without < time.Second {
+		t.Fatalf("expected the slow peer to hold up the download without endgame, finished at %s", without)
+	}
+	if with > without/2 {
+		t.Fatalf("want endgame to at least halve completion time, got %s vs %s", with, without)
+	}
+}
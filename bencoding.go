@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"regexp"
+	"sort"
 	"strconv"
 )
 
@@ -199,3 +200,130 @@ func FromBencode[T any](bs []byte) (t T, err error) {
 	err = json.Unmarshal(js, &t)
 	return t, err
 }
+
+// ParseDictOnly parses bs as a single bencoded dictionary, erroring if anything else is found.
+//
+// Prefer this over FromBencode when values may hold raw bytes (infohashes, compact peers),
+// since the JSON round trip mangles strings that aren't valid UTF-8.
+func ParseDictOnly(bs []byte) (map[string]any, error) {
+	v, rest, err := ParseDict(bs)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) != 0 {
+		return nil, fmt.Errorf("expected EOF after dictionary, found %d bytes", len(rest))
+	}
+	return v.(map[string]any), nil
+}
+
+// dictInt looks up an integer value in a parsed dictionary.
+// ok is false if the key is missing; an error is returned if it has the wrong type.
+func dictInt(d map[string]any, key string) (n int, ok bool, err error) {
+	v, ok := d[key]
+	if !ok {
+		return 0, false, nil
+	}
+	n, isInt := v.(int)
+	if !isInt {
+		return 0, true, fmt.Errorf("expected integer for key %q, got %T", key, v)
+	}
+	return n, true, nil
+}
+
+// dictString looks up a string value in a parsed dictionary.
+// ok is false if the key is missing; an error is returned if it has the wrong type.
+func dictString(d map[string]any, key string) (s string, ok bool, err error) {
+	v, ok := d[key]
+	if !ok {
+		return "", false, nil
+	}
+	s, isString := v.(string)
+	if !isString {
+		return "", true, fmt.Errorf("expected string for key %q, got %T", key, v)
+	}
+	return s, true, nil
+}
+
+// Encode bencodes v, which may be built from the types produced by Parse
+// (int, string, []any, map[string]any) along with a few convenient extras:
+// other integer types, []byte, []string, and []map[string]any.
+//
+// Dictionary keys are written in sorted order, as the spec requires.
+func Encode(v any) ([]byte, error) {
+	return appendEncoded(nil, v)
+}
+
+func appendEncoded(b []byte, v any) ([]byte, error) {
+	var err error
+	switch x := v.(type) {
+	case int:
+		return appendInteger(b, int64(x)), nil
+	case int64:
+		return appendInteger(b, x), nil
+	case int32:
+		return appendInteger(b, int64(x)), nil
+	case uint16:
+		return appendInteger(b, int64(x)), nil
+	case uint32:
+		return appendInteger(b, int64(x)), nil
+	case bool: // Not part of the spec, but commonly encoded as 0 or 1
+		if x {
+			return appendInteger(b, 1), nil
+		}
+		return appendInteger(b, 0), nil
+	case string:
+		return appendString(b, x), nil
+	case []byte:
+		return appendString(b, string(x)), nil
+	case []string:
+		b = append(b, 'l')
+		for _, s := range x {
+			b = appendString(b, s)
+		}
+		return append(b, 'e'), nil
+	case []any:
+		b = append(b, 'l')
+		for _, item := range x {
+			if b, err = appendEncoded(b, item); err != nil {
+				return nil, err
+			}
+		}
+		return append(b, 'e'), nil
+	case []map[string]any:
+		b = append(b, 'l')
+		for _, item := range x {
+			if b, err = appendEncoded(b, item); err != nil {
+				return nil, err
+			}
+		}
+		return append(b, 'e'), nil
+	case map[string]any:
+		keys := make([]string, 0, len(x))
+		for k := range x {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		b = append(b, 'd')
+		for _, k := range keys {
+			b = appendString(b, k)
+			if b, err = appendEncoded(b, x[k]); err != nil {
+				return nil, fmt.Errorf("encoding value for key %s: %w", k, err)
+			}
+		}
+		return append(b, 'e'), nil
+	default:
+		return nil, fmt.Errorf("cannot bencode value of type %T", v)
+	}
+}
+
+func appendInteger(b []byte, n int64) []byte {
+	b = append(b, 'i')
+	b = strconv.AppendInt(b, n, 10)
+	return append(b, 'e')
+}
+
+func appendString(b []byte, s string) []byte {
+	b = strconv.AppendInt(b, int64(len(s)), 10)
+	b = append(b, ':')
+	return append(b, s...)
+}
@@ -394,3 +394,61 @@ func TestFromBencode(t *testing.T) {
 		}
 	}
 }
+
+func TestEncode(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		Name      string
+		Input     any
+		Want      []byte
+		WantError bool
+	}{
+		{
+			Name:  "Encodes integers",
+			Input: []any{0, -42, int64(1 << 40), uint16(6881)},
+			Want:  []byte(`li0ei-42ei1099511627776ei6881ee`),
+		},
+		{
+			Name:  "Encodes strings and bytes",
+			Input: []any{"spam", []byte{0xff, 0}, ""},
+			Want:  []byte("l4:spam2:\xff\x000:e"),
+		},
+		{
+			Name: "Encodes dict with sorted keys",
+			Input: map[string]any{
+				"spam": []string{"a", "b"},
+				"cow":  "moo",
+				"d":    map[string]any{},
+			},
+			Want: []byte(`d3:cow3:moo1:dde4:spaml1:a1:bee`),
+		},
+		{
+			Name:      "Fails on unsupported type",
+			Input:     map[string]any{"x": 1.5},
+			WantError: true,
+		},
+	}
+	for _, c := range cases {
+		c := c
+		t.Run(c.Name, func(t *testing.T) {
+			t.Parallel()
+			got, err := Encode(c.Input)
+			if c.WantError {
+				if err == nil {
+					t.Fatal("wanted error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !bytes.Equal(got, c.Want) {
+				t.Fatalf("want %q, got %q", c.Want, got)
+			}
+			// Round trip through Parse
+			if _, rest, err := Parse(got); err != nil || len(rest) != 0 {
+				t.Fatalf("failed to parse encoded value: %v (rest %q)", err, rest)
+			}
+		})
+	}
+}
@@ -139,6 +139,13 @@ func (b *BField) Length() int {
 	return b.length
 }
 
+// Bytes returns a copy of the underlying bytes, as sent in a Bitfield message.
+func (b *BField) Bytes() []byte {
+	out := make([]byte, len(b.bs))
+	copy(out, b.bs)
+	return out
+}
+
 // Searches for next 0 bit in BField, returns (index, done).
 //
 // When exhausted, done will equal BField.Length().
@@ -0,0 +1,152 @@
+package bt
+
+import (
+	"math/rand"
+	"net/netip"
+	"sort"
+	"time"
+)
+
+// Choker defaults, as suggested by BEP 3 and used by the reference client
+const (
+	DefaultUploadSlots        = 4
+	DefaultRechokeInterval    = 10 * time.Second
+	DefaultOptimisticInterval = 30 * time.Second
+	// A peer we're interested in that hasn't sent a block in this long is snubbing us
+	DefaultSnubTimeout = time.Minute
+)
+
+// ChokeCandidate is a snapshot of a connected peer, for the Choker.
+type ChokeCandidate struct {
+	Addr netip.AddrPort
+	// The peer is interested in us
+	Interested bool
+	// We're interested in the peer
+	AmInterested bool
+	// Running totals of block bytes exchanged with the peer
+	Downloaded int64
+	Uploaded   int64
+	// When the connection was made, and when the peer last sent us a block
+	ConnectedAt time.Time
+	LastBlock   time.Time
+}
+
+// Choker decides which peers to upload to, using BEP 3's tit-for-tat.
+//
+// Every RechokeInterval, the Slots interested peers with the best rates are unchoked:
+// the rate they upload to us while we're downloading, or the rate we upload to them while seeding.
+// Peers that aren't interested but have a better rate are unchoked too, so they can start right away if they become interested.
+// Peers snubbing us (sending nothing for SnubTimeout while we're interested) lose their regular slot.
+//
+// One more peer is unchoked optimistically, rotating every OptimisticInterval, to discover better partners.
+// Newly connected peers are three times as likely to be picked, since they have nothing to trade yet.
+type Choker struct {
+	Slots              int
+	OptimisticInterval time.Duration
+	SnubTimeout        time.Duration
+
+	rng            *rand.Rand
+	optimistic     netip.AddrPort
+	lastOptimistic time.Time
+	// Totals and time at the previous rechoke, for computing rates
+	lastRechoke time.Time
+	lastTotals  map[netip.AddrPort]int64
+}
+
+func NewChoker() *Choker {
+	return &Choker{
+		Slots:              DefaultUploadSlots,
+		OptimisticInterval: DefaultOptimisticInterval,
+		SnubTimeout:        DefaultSnubTimeout,
+		rng:                rand.New(rand.NewSource(time.Now().UnixNano())),
+		lastTotals:         make(map[netip.AddrPort]int64),
+	}
+}
+
+// Rechoke returns the peers to unchoke. All others should be choked.
+func (c *Choker) Rechoke(now time.Time, peers []ChokeCandidate, seeding bool) map[netip.AddrPort]bool {
+	elapsed := now.Sub(c.lastRechoke).Seconds()
+	rates := make(map[netip.AddrPort]float64, len(peers))
+	totals := make(map[netip.AddrPort]int64, len(peers))
+	for _, p := range peers {
+		total := p.Downloaded
+		if seeding {
+			total = p.Uploaded
+		}
+		totals[p.Addr] = total
+		if last, ok := c.lastTotals[p.Addr]; ok && elapsed > 0 {
+			rates[p.Addr] = float64(total-last) / elapsed
+		}
+	}
+	c.lastTotals = totals
+	c.lastRechoke = now
+
+	ranked := make([]ChokeCandidate, 0, len(peers))
+	for _, p := range peers {
+		if !seeding && c.snubbed(now, p) {
+			continue
+		}
+		ranked = append(ranked, p)
+	}
+	sort.SliceStable(ranked, func(i, j int) bool { return rates[ranked[i].Addr] > rates[ranked[j].Addr] })
+
+	unchoke := make(map[netip.AddrPort]bool)
+	interested := 0
+	for _, p := range ranked {
+		if interested == c.Slots {
+			break
+		}
+		unchoke[p.Addr] = true
+		if p.Interested {
+			interested++
+		}
+	}
+
+	connected := false
+	for _, p := range peers {
+		if p.Addr == c.optimistic {
+			connected = true
+		}
+	}
+	if !connected || unchoke[c.optimistic] || now.Sub(c.lastOptimistic) >= c.OptimisticInterval {
+		c.optimistic = c.pickOptimistic(now, peers, unchoke)
+		c.lastOptimistic = now
+	}
+	if c.optimistic.IsValid() {
+		unchoke[c.optimistic] = true
+	}
+	return unchoke
+}
+
+// snubbed reports whether we're interested in p but it hasn't sent us anything in SnubTimeout.
+func (c *Choker) snubbed(now time.Time, p ChokeCandidate) bool {
+	if !p.AmInterested {
+		return false
+	}
+	last := p.LastBlock
+	if last.Before(p.ConnectedAt) {
+		last = p.ConnectedAt
+	}
+	return now.Sub(last) > c.SnubTimeout
+}
+
+// pickOptimistic chooses a random choked, interested peer, weighting new connections 3 to 1.
+func (c *Choker) pickOptimistic(now time.Time, peers []ChokeCandidate, unchoked map[netip.AddrPort]bool) netip.AddrPort {
+	var candidates []netip.AddrPort
+	for _, p := range peers {
+		if !p.Interested || unchoked[p.Addr] {
+			continue
+		}
+		weight := 1
+		if now.Sub(p.ConnectedAt) < 3*c.OptimisticInterval {
+			weight = 3
+		}
+		for i := 0; i < weight; i++ {
+			candidates = append(candidates, p.Addr)
+		}
+	}
+	if len(candidates) == 0 {
+		return netip.AddrPort{}
+	}
+	return candidates[c.rng.Intn(len(candidates))]
+}
@@ -0,0 +1,117 @@
+package bt
+
+import (
+	"math/rand"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func chokerAddr(i int) netip.AddrPort {
+	return netip.AddrPortFrom(netip.AddrFrom4([4]byte{10, 0, 0, byte(i)}), 6881)
+}
+
+// rechokeAfter runs two rechokes 10s apart, with each peer having sent rates[i] bytes per second in between.
+func rechokeAfter(c *Choker, start time.Time, peers []ChokeCandidate, rates []int64, seeding bool) map[netip.AddrPort]bool {
+	c.Rechoke(start, peers, seeding)
+	for i := range peers {
+		peers[i].Downloaded += rates[i] * 10
+		peers[i].Uploaded += rates[i] * 10
+		peers[i].LastBlock = start.Add(10 * time.Second)
+	}
+	return c.Rechoke(start.Add(10*time.Second), peers, seeding)
+}
+
+func TestChokerTitForTat(t *testing.T) {
+	t.Parallel()
+	start := time.Now()
+	old := start.Add(-time.Hour)
+	peers := make([]ChokeCandidate, 7)
+	for i := range peers {
+		peers[i] = ChokeCandidate{Addr: chokerAddr(i), Interested: true, AmInterested: true, ConnectedAt: old}
+	}
+	// Peer 5 is the fastest, but not interested
+	peers[5].Interested = false
+	rates := []int64{100, 600, 200, 500, 400, 900, 300}
+	for _, seeding := range []bool{false, true} {
+		c := NewChoker()
+		c.Slots = 3
+		c.rng = rand.New(rand.NewSource(1))
+		unchoke := rechokeAfter(c, start, append([]ChokeCandidate{}, peers...), rates, seeding)
+		for _, i := range []int{1, 3, 4, 5} {
+			if !unchoke[chokerAddr(i)] {
+				t.Fatalf("seeding=%t: want peer %d unchoked, got %v", seeding, i, unchoke)
+			}
+		}
+		// Plus one optimistic unchoke of 0, 2, or 6
+		if len(unchoke) != 5 || !unchoke[c.optimistic] {
+			t.Fatalf("seeding=%t: want 4 regular and 1 optimistic unchoke, got %v", seeding, unchoke)
+		}
+	}
+}
+
+func TestChokerAntiSnubbing(t *testing.T) {
+	t.Parallel()
+	start := time.Now()
+	old := start.Add(-time.Hour)
+	c := NewChoker()
+	c.Slots = 1
+	peers := []ChokeCandidate{
+		{Addr: chokerAddr(1), Interested: true, AmInterested: true, ConnectedAt: old},
+		{Addr: chokerAddr(2), Interested: true, AmInterested: true, ConnectedAt: old},
+	}
+	c.Rechoke(start, peers, false)
+	// Peer 1 sent a lot early on, then nothing for over a minute
+	peers[0].Downloaded = 1 << 20
+	peers[0].LastBlock = start.Add(-2 * time.Minute)
+	peers[1].Downloaded = 1000
+	peers[1].LastBlock = start.Add(9 * time.Second)
+	c.optimistic = chokerAddr(1)
+	c.lastOptimistic = start
+	unchoke := c.Rechoke(start.Add(10*time.Second), peers, false)
+	if !unchoke[chokerAddr(2)] {
+		t.Fatalf("want non-snubbing peer given the regular slot, got %v", unchoke)
+	}
+	// Only the optimistic unchoke can go to the snubbing peer
+	if unchoke[chokerAddr(1)] && c.optimistic != chokerAddr(1) {
+		t.Fatalf("want snubbing peer choked, got %v", unchoke)
+	}
+}
+
+func TestChokerOptimisticRotation(t *testing.T) {
+	t.Parallel()
+	start := time.Now()
+	c := NewChoker()
+	c.Slots = 0
+	c.rng = rand.New(rand.NewSource(1))
+	peers := []ChokeCandidate{
+		{Addr: chokerAddr(1), Interested: true, ConnectedAt: start.Add(-time.Hour)},
+		{Addr: chokerAddr(2), Interested: true, ConnectedAt: start.Add(-time.Hour)},
+		{Addr: chokerAddr(3), Interested: false, ConnectedAt: start.Add(-time.Hour)},
+	}
+	first := c.Rechoke(start, peers, false)
+	if len(first) != 1 || first[chokerAddr(3)] {
+		t.Fatalf("want one interested peer unchoked optimistically, got %v", first)
+	}
+	// Kept until the interval passes
+	for s := 10; s < 30; s += 10 {
+		if got := c.Rechoke(start.Add(time.Duration(s)*time.Second), peers, false); !got[c.optimistic] || len(got) != 1 {
+			t.Fatalf("want optimistic unchoke kept within interval, got %v", got)
+		}
+	}
+
+	// New connections are three times as likely to be picked
+	peers = append(peers, ChokeCandidate{Addr: chokerAddr(4), Interested: true})
+	picks := make(map[netip.AddrPort]int)
+	now := start
+	for i := 0; i < 500; i++ {
+		now = now.Add(c.OptimisticInterval)
+		peers[3].ConnectedAt = now
+		c.Rechoke(now, peers, false)
+		picks[c.optimistic]++
+	}
+	// Expect 3/5 of picks
+	if picks[chokerAddr(4)] < 250 || picks[chokerAddr(1)] == 0 || picks[chokerAddr(3)] != 0 {
+		t.Fatalf("want new peer favored, got %v", picks)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+
+	"github.com/eenblam/bt"
+)
+
+const usage = `usage: bt <command> [arguments]
+
+commands:
+	scrape <torrent|magnet>    print swarm statistics from the first tracker that answers
+	tracker [flags]            run a tracker (see bt tracker -h)
+	version                    print our client version and peer id prefix
+`
+
+func main() {
+	log.SetFlags(0)
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	var err error
+	switch cmd, args := os.Args[1], os.Args[2:]; cmd {
+	case "scrape":
+		err = scrape(args)
+	case "tracker":
+		err = tracker(args)
+	case "version":
+		fmt.Printf("%s (peer id prefix %s)\n", bt.ClientVersion, bt.PeerPrefix[:])
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n%s", cmd, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatalf("bt %s: %s", os.Args[1], err)
+	}
+}
+
+// scrape prints swarm statistics for a .torrent file or magnet URI.
+// Trackers are tried tier by tier, as for announces (BEP 12), stopping at the first that answers.
+func scrape(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("expected exactly one torrent file or magnet URI, got %d arguments", len(args))
+	}
+	var infoHash [20]byte
+	var tiers [][]string
+	if strings.HasPrefix(args[0], "magnet:") {
+		m, err := bt.ParseMagnet(args[0])
+		if err != nil {
+			return err
+		}
+		infoHash = m.InfoHash
+		if len(m.Trackers) > 0 {
+			tiers = [][]string{m.Trackers}
+		}
+	} else {
+		m, err := bt.LoadMetaInfoFromFile(args[0])
+		if err != nil {
+			return err
+		}
+		infoHash, tiers = m.InfoShaSum, m.Tiers()
+	}
+	if len(tiers) == 0 {
+		return fmt.Errorf("no trackers found for %x", infoHash)
+	}
+	fmt.Printf("infohash %x\n", infoHash)
+	failed := 0
+	for _, tier := range tiers {
+		for _, tr := range tier {
+			resp, err := bt.Scrape(tr, infoHash)
+			if err != nil {
+				failed++
+				fmt.Printf("%s\terror: %s\n", tr, err)
+				continue
+			}
+			if resp.Reason != nil {
+				failed++
+				fmt.Printf("%s\tfailure: %s\n", tr, *resp.Reason)
+				continue
+			}
+			f, ok := resp.Files[infoHash]
+			if !ok {
+				fmt.Printf("%s\tnot tracked\n", tr)
+				return nil
+			}
+			fmt.Printf("%s\tseeders %d\tleechers %d\tcompleted %d\n", tr, f.Complete, f.Incomplete, f.Downloaded)
+			return nil
+		}
+	}
+	return fmt.Errorf("all %d trackers failed", failed)
+}
+
+// tracker runs an HTTP and UDP tracker until interrupted.
+func tracker(args []string) error {
+	fs := flag.NewFlagSet("tracker", flag.ExitOnError)
+	httpAddr := fs.String("http", ":6969", "HTTP listen address; empty to disable")
+	udpAddr := fs.String("udp", ":6969", "UDP listen address; empty to disable")
+	allow := fs.String("allow", "", "comma-separated hex infohashes to track; empty tracks all")
+	snapshot := fs.String("snapshot", "", "file to load swarms from at startup and save them to on exit")
+	fs.Parse(args)
+
+	store := bt.NewMemoryPeerStore()
+	if *snapshot != "" {
+		f, err := os.Open(*snapshot)
+		if err == nil {
+			err = store.ReadSnapshot(f)
+			f.Close()
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("loading snapshot: %w", err)
+		}
+	}
+	ts := bt.NewTrackerServer(store)
+	if *allow != "" {
+		ts.Allowlist = bt.NewAllowlist()
+		for _, s := range strings.Split(*allow, ",") {
+			bs, err := hex.DecodeString(s)
+			if err != nil || len(bs) != 20 {
+				return fmt.Errorf("invalid infohash %q", s)
+			}
+			ts.Allowlist.Add([20]byte(bs))
+		}
+	}
+
+	errs := make(chan error, 2)
+	if *httpAddr != "" {
+		log.Printf("HTTP tracker listening on %s", *httpAddr)
+		go func() { errs <- http.ListenAndServe(*httpAddr, ts) }()
+	}
+	if *udpAddr != "" {
+		conn, err := net.ListenPacket("udp", *udpAddr)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		log.Printf("UDP tracker listening on %s", conn.LocalAddr())
+		go func() { errs <- ts.ServeUDP(conn) }()
+	}
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	var err error
+	select {
+	case err = <-errs:
+	case <-interrupt:
+	}
+	if *snapshot != "" {
+		f, createErr := os.Create(*snapshot)
+		if createErr != nil {
+			return createErr
+		}
+		defer f.Close()
+		if saveErr := store.WriteSnapshot(f); saveErr != nil {
+			return fmt.Errorf("saving snapshot: %w", saveErr)
+		}
+	}
+	return err
+}
@@ -0,0 +1,55 @@
+package bt
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+)
+
+// The "compact" address format, used by trackers (BEP 23, BEP 7) among others,
+// is an IP address in network byte order followed by a 2-byte big-endian port:
+// 6 bytes for IPv4 and 18 bytes for IPv6.
+
+// ParseCompactAddrs parses a concatenation of compact addresses with ipLen-byte IPs (4 or 16).
+func ParseCompactAddrs(bs []byte, ipLen int) ([]netip.AddrPort, error) {
+	if ipLen != 4 && ipLen != 16 {
+		return nil, fmt.Errorf("expected IP length 4 or 16, got %d", ipLen)
+	}
+	size := ipLen + 2
+	if len(bs)%size != 0 {
+		return nil, fmt.Errorf("expected compact addresses to be divisible by %d, got %d", size, len(bs))
+	}
+	addrs := make([]netip.AddrPort, 0, len(bs)/size)
+	for i := 0; i < len(bs); i += size {
+		a, err := ParseCompactAddr(bs[i : i+size])
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, a)
+	}
+	return addrs, nil
+}
+
+// ParseCompactAddr parses a single 6 or 18 byte compact address.
+func ParseCompactAddr(bs []byte) (netip.AddrPort, error) {
+	var ip netip.Addr
+	switch len(bs) {
+	case 6:
+		ip = netip.AddrFrom4([4]byte(bs[:4]))
+	case 18:
+		ip = netip.AddrFrom16([16]byte(bs[:16]))
+	default:
+		return netip.AddrPort{}, fmt.Errorf("expected compact address of 6 or 18 bytes, got %d", len(bs))
+	}
+	port := binary.BigEndian.Uint16(bs[len(bs)-2:])
+	return netip.AddrPortFrom(ip, port), nil
+}
+
+// AppendCompactAddr appends the compact form of a to b.
+//
+// IPv4-mapped IPv6 addresses are written as 6-byte IPv4 addresses.
+func AppendCompactAddr(b []byte, a netip.AddrPort) []byte {
+	ip := a.Addr().Unmap()
+	b = append(b, ip.AsSlice()...)
+	return binary.BigEndian.AppendUint16(b, a.Port())
+}
@@ -0,0 +1,840 @@
+package bt
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DHT defaults, see BEP 5
+const (
+	// Queries in flight at once during a lookup
+	DefaultDHTAlpha = 3
+	// How long to wait for a response
+	DefaultDHTQueryTimeout = 5 * time.Second
+	// Announced peers are forgotten after this long
+	DefaultDHTPeerTTL = 30 * time.Minute
+	// How often a torrent's peers are looked up and we announce ourselves
+	DefaultDHTAnnounceInterval = 15 * time.Minute
+	// Tokens are valid for between one and two of these
+	dhtTokenRotation = 5 * time.Minute
+	// How often the routing table, tokens, and stored peers are maintained
+	dhtMaintenanceInterval = time.Minute
+	// Most peers returned for a get_peers query, to fit in a UDP packet
+	maxDHTValues = 50
+	// Limits on peers stored for others, so announces can't exhaust our memory
+	maxDHTPeersPerInfoHash = 1000
+	maxDHTInfoHashes       = 10000
+	// Distinct nodes that must report the same external IP for us to believe it
+	dhtExternalIPVotes = 5
+	// Votes are reset if they're spread over more IPs than this
+	maxDHTIPCandidates = 20
+)
+
+// DefaultDHTBootstrap are well known nodes for joining the mainline DHT.
+var DefaultDHTBootstrap = []string{
+	"router.bittorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+	"router.utorrent.com:6881",
+}
+
+// ErrDHTNoNodes is returned when a lookup has no nodes to start from.
+var ErrDHTNoNodes = errors.New("dht: no nodes in routing table")
+
+// DHT is a node in the mainline DHT, a Kademlia-style distributed peer tracker. See BEP 5.
+//
+// Create one with NewDHT, then Start it and Bootstrap it before doing lookups.
+type DHT struct {
+	// Our node id. Set before Start, or load one with LoadState.
+	// It's replaced if SetExternalIP finds it isn't secure (BEP 42), so use Self once started.
+	ID           NodeID
+	Alpha        int
+	QueryTimeout time.Duration
+	PeerTTL      time.Duration
+	// How often the infohashes we give sample_infohashes queries change (BEP 51)
+	SampleInterval time.Duration
+	// Ignore nodes whose ids aren't valid for their addresses, rather than only preferring secure nodes (BEP 42)
+	EnforceNodeIDs bool
+
+	conn  net.PacketConn
+	table *routingTable
+	done  chan struct{}
+	wg    sync.WaitGroup
+
+	mu sync.Mutex
+	// Outstanding queries by transaction id. Guarded by mu.
+	pending map[string]*dhtQuery
+	nextT   uint16
+	// Token secrets, rotated every dhtTokenRotation
+	secret, prevSecret NodeID
+	lastRotation       time.Time
+	// Peers announced to us
+	peers map[[20]byte]map[netip.AddrPort]time.Time
+	// Items put to us (BEP 44)
+	items map[NodeID]*dhtItem
+	// Our current sample of infohashes, as concatenated ids, and when it was taken (BEP 51)
+	samples   []byte
+	sampledAt time.Time
+	// Our external IP, and the IPs responders have told us we have, with the nodes that said so
+	externalIP netip.Addr
+	ipVotes    map[netip.Addr]map[netip.Addr]struct{}
+}
+
+type dhtQuery struct {
+	addr netip.AddrPort
+	resp chan *krpcMessage
+}
+
+// NewDHT creates a node with a random id, which will communicate over conn once started.
+func NewDHT(conn net.PacketConn) *DHT {
+	d := &DHT{
+		ID:             RandomNodeID(),
+		Alpha:          DefaultDHTAlpha,
+		QueryTimeout:   DefaultDHTQueryTimeout,
+		PeerTTL:        DefaultDHTPeerTTL,
+		SampleInterval: DefaultDHTSampleInterval,
+		conn:           conn,
+		done:           make(chan struct{}),
+		pending:        make(map[string]*dhtQuery),
+		peers:          make(map[[20]byte]map[netip.AddrPort]time.Time),
+		ipVotes:        make(map[netip.Addr]map[netip.Addr]struct{}),
+		items:          make(map[NodeID]*dhtItem),
+	}
+	d.table = newRoutingTable(d.ID)
+	d.rotateSecret(time.Now())
+	d.prevSecret = RandomNodeID()
+	return d
+}
+
+// Start answers queries and maintains the routing table until ctx is cancelled or Close is called.
+func (d *DHT) Start(ctx context.Context) {
+	if d.table.self != d.ID {
+		d.table = newRoutingTable(d.ID) // ID was changed after NewDHT
+	}
+	d.wg.Add(2)
+	go func() {
+		defer d.wg.Done()
+		d.readLoop()
+	}()
+	go func() {
+		defer d.wg.Done()
+		d.maintain(ctx)
+	}()
+	go func() {
+		select {
+		case <-ctx.Done():
+			d.Close()
+		case <-d.done:
+		}
+	}()
+}
+
+// Close stops the node and closes its connection.
+func (d *DHT) Close() error {
+	d.mu.Lock()
+	select {
+	case <-d.done:
+		d.mu.Unlock()
+		return nil
+	default:
+	}
+	close(d.done)
+	d.mu.Unlock()
+	err := d.conn.Close()
+	d.wg.Wait()
+	return err
+}
+
+// Self returns our node id.
+func (d *DHT) Self() NodeID {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.ID
+}
+
+// ExternalIP returns our external IP, if known.
+func (d *DHT) ExternalIP() netip.Addr {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.externalIP
+}
+
+// SetExternalIP records our external IP, e.g. as reported by a tracker.
+// If our id isn't secure for it, we switch to one that is (BEP 42), so other nodes don't pass us over.
+func (d *DHT) SetExternalIP(ip netip.Addr) {
+	ip = ip.Unmap()
+	if !ip.IsValid() {
+		return
+	}
+	d.mu.Lock()
+	d.externalIP = ip
+	if d.ID.SecureFor(ip) {
+		d.mu.Unlock()
+		return
+	}
+	d.ID = SecureNodeID(ip)
+	self := d.ID
+	d.mu.Unlock()
+	d.table.rekey(self, time.Now())
+}
+
+// voteExternalIP records that the node at voter says our IP is ip.
+// Once enough nodes agree, it's taken as our external IP.
+func (d *DHT) voteExternalIP(ip, voter netip.Addr) {
+	ip = ip.Unmap()
+	if !ip.IsValid() {
+		return
+	}
+	d.mu.Lock()
+	if ip == d.externalIP {
+		d.mu.Unlock()
+		return
+	}
+	if len(d.ipVotes) >= maxDHTIPCandidates {
+		d.ipVotes = make(map[netip.Addr]map[netip.Addr]struct{})
+	}
+	voters := d.ipVotes[ip]
+	if voters == nil {
+		voters = make(map[netip.Addr]struct{})
+		d.ipVotes[ip] = voters
+	}
+	voters[voter] = struct{}{}
+	agreed := len(voters) >= dhtExternalIPVotes
+	if agreed {
+		d.ipVotes = make(map[netip.Addr]map[netip.Addr]struct{})
+	}
+	d.mu.Unlock()
+	if agreed {
+		d.SetExternalIP(ip)
+	}
+}
+
+// Addr is the address the node is listening on.
+func (d *DHT) Addr() netip.AddrPort {
+	addr, _ := addrPortFromNet(d.conn.LocalAddr())
+	return addr
+}
+
+// Nodes returns the nodes in the routing table.
+func (d *DHT) Nodes() []NodeInfo {
+	return d.table.closest(d.Self(), 160*dhtK)
+}
+
+func (d *DHT) readLoop() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, from, err := d.conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-d.done:
+				return
+			default:
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		addr, err := addrPortFromNet(from)
+		if err != nil {
+			continue
+		}
+		m, err := parseKRPC(buf[:n])
+		if err != nil {
+			continue // Not worth replying to
+		}
+		if m.Y == "q" {
+			if resp := d.handleQuery(m, addr, time.Now()); resp != nil {
+				d.send(resp, addr)
+			}
+			continue
+		}
+		d.mu.Lock()
+		q, ok := d.pending[m.T]
+		if ok && q.addr == addr {
+			delete(d.pending, m.T)
+		}
+		d.mu.Unlock()
+		if ok && q.addr == addr {
+			q.resp <- m // Buffered
+		}
+	}
+}
+
+func (d *DHT) send(m *krpcMessage, to netip.AddrPort) error {
+	bs, err := m.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	_, err = d.conn.WriteTo(bs, net.UDPAddrFromAddrPort(to))
+	return err
+}
+
+// query sends a query to addr and waits for the response values.
+// The responding node is added to the routing table, and nodes that don't respond are marked as failing.
+func (d *DHT) query(ctx context.Context, addr netip.AddrPort, method string, args map[string]any) (map[string]any, error) {
+	self := d.Self()
+	args["id"] = self[:]
+	q := &dhtQuery{addr: unmapAddrPort(addr), resp: make(chan *krpcMessage, 1)}
+	d.mu.Lock()
+	d.nextT++
+	t := string(binary.BigEndian.AppendUint16(nil, d.nextT))
+	d.pending[t] = q
+	d.mu.Unlock()
+	defer func() {
+		d.mu.Lock()
+		delete(d.pending, t)
+		d.mu.Unlock()
+	}()
+
+	if err := d.send(&krpcMessage{T: t, Y: "q", Q: method, A: args}, q.addr); err != nil {
+		return nil, fmt.Errorf("dht: %s to %s: %w", method, addr, err)
+	}
+	timeout := time.NewTimer(d.QueryTimeout)
+	defer timeout.Stop()
+	select {
+	case m := <-q.resp:
+		if m.Y == "e" {
+			return nil, fmt.Errorf("dht: %s to %s: %w", method, addr, m.E)
+		}
+		id, err := dictNodeID(m.R, "id")
+		if err != nil {
+			return nil, fmt.Errorf("dht: %s to %s: %w", method, addr, err)
+		}
+		d.nodeSeen(NodeInfo{ID: id, Addr: q.addr})
+		if m.IP.IsValid() {
+			d.voteExternalIP(m.IP.Addr(), q.addr.Addr())
+		}
+		return m.R, nil
+	case <-timeout.C:
+		d.nodeFailed(q.addr)
+		return nil, fmt.Errorf("dht: %s to %s timed out", method, addr)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-d.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// nodeSeen adds a node that responded or queried us to the routing table,
+// pinging a questionable node if there's no room for it.
+func (d *DHT) nodeSeen(n NodeInfo) {
+	if d.EnforceNodeIDs && !n.ID.SecureFor(n.Addr.Addr()) {
+		return
+	}
+	if ping := d.table.seen(n, time.Now()); ping != nil {
+		go d.query(context.Background(), ping.Addr, "ping", map[string]any{}) // A timeout marks it as failing
+	}
+}
+
+// nodeFailed marks the node at addr as having failed a query.
+func (d *DHT) nodeFailed(addr netip.AddrPort) {
+	for _, n := range d.table.closest(d.Self(), 160*dhtK) {
+		if n.Addr == addr {
+			d.table.failed(n.ID, addr)
+		}
+	}
+}
+
+// handleQuery answers a query from addr, returning nil if there should be no reply.
+func (d *DHT) handleQuery(m *krpcMessage, addr netip.AddrPort, now time.Time) *krpcMessage {
+	reply := func(r map[string]any) *krpcMessage {
+		self := d.Self()
+		r["id"] = self[:]
+		return &krpcMessage{T: m.T, Y: "r", R: r, IP: addr}
+	}
+	fail := func(code int, msg string) *krpcMessage {
+		return &krpcMessage{T: m.T, Y: "e", E: &KRPCError{Code: code, Message: msg}, IP: addr}
+	}
+	id, err := dictNodeID(m.A, "id")
+	if err != nil {
+		return fail(KRPCProtocolError, err.Error())
+	}
+	if !m.ReadOnly {
+		d.nodeSeen(NodeInfo{ID: id, Addr: addr})
+	}
+
+	switch m.Q {
+	case "ping":
+		return reply(map[string]any{})
+	case "find_node":
+		target, err := dictNodeID(m.A, "target")
+		if err != nil {
+			return fail(KRPCProtocolError, err.Error())
+		}
+		return reply(d.nodesFor(target, addr))
+	case "get_peers":
+		infoHash, err := dictNodeID(m.A, "info_hash")
+		if err != nil {
+			return fail(KRPCProtocolError, err.Error())
+		}
+		r := d.nodesFor(infoHash, addr)
+		r["token"] = d.writeToken(addr.Addr())
+		if values := d.storedPeers(infoHash, addr.Addr().Is4(), now); len(values) > 0 {
+			r["values"] = values
+		}
+		return reply(r)
+	case "announce_peer":
+		infoHash, err := dictNodeID(m.A, "info_hash")
+		if err != nil {
+			return fail(KRPCProtocolError, err.Error())
+		}
+		token, _, err := dictString(m.A, "token")
+		if err != nil || !d.validToken(token, addr.Addr()) {
+			return fail(KRPCProtocolError, "bad token")
+		}
+		port := int(addr.Port())
+		if implied, _, _ := dictInt(m.A, "implied_port"); implied == 0 {
+			if port, _, err = dictInt(m.A, "port"); err != nil || port <= 0 || port > 65535 {
+				return fail(KRPCProtocolError, "bad port")
+			}
+		}
+		d.storePeer(infoHash, netip.AddrPortFrom(addr.Addr(), uint16(port)), now)
+		return reply(map[string]any{})
+	case "sample_infohashes":
+		target, err := dictNodeID(m.A, "target")
+		if err != nil {
+			return fail(KRPCProtocolError, err.Error())
+		}
+		r := d.nodesFor(target, addr)
+		samples, num := d.sampleInfohashes(now)
+		r["samples"] = samples
+		r["num"] = num
+		r["interval"] = d.sampleInterval(now)
+		return reply(r)
+	case "get":
+		target, err := dictNodeID(m.A, "target")
+		if err != nil {
+			return fail(KRPCProtocolError, err.Error())
+		}
+		r := d.nodesFor(target, addr)
+		r["token"] = d.writeToken(addr.Addr())
+		d.getItem(target, m.A, r)
+		return reply(r)
+	case "put":
+		token, _, err := dictString(m.A, "token")
+		if err != nil || !d.validToken(token, addr.Addr()) {
+			return fail(KRPCProtocolError, "bad token")
+		}
+		if err := d.putItem(m.A, now); err != nil {
+			return &krpcMessage{T: m.T, Y: "e", E: err, IP: addr}
+		}
+		return reply(map[string]any{})
+	default:
+		return fail(KRPCMethodUnknown, "method unknown")
+	}
+}
+
+// nodesFor returns the closest nodes to target, in the querier's address family.
+func (d *DHT) nodesFor(target NodeID, querier netip.AddrPort) map[string]any {
+	nodes := d.table.closest(target, dhtK*2)
+	if querier.Addr().Is4() {
+		return map[string]any{"nodes": appendCompactNodes(nil, nodes, false)}
+	}
+	return map[string]any{"nodes6": appendCompactNodes(nil, nodes, true)}
+}
+
+// token is the write token given to ip in get_peers responses.
+func (d *DHT) token(ip netip.Addr, secret NodeID) string {
+	h := sha1.New()
+	h.Write(secret[:])
+	h.Write(ip.AsSlice())
+	return string(h.Sum(nil))
+}
+
+// writeToken is the token to give ip in get_peers and get responses, for it to send back with announce_peer or put.
+func (d *DHT) writeToken(ip netip.Addr) string {
+	d.mu.Lock()
+	secret := d.secret
+	d.mu.Unlock()
+	return d.token(ip, secret)
+}
+
+// validToken accepts tokens made with the current or previous secret.
+func (d *DHT) validToken(token string, ip netip.Addr) bool {
+	d.mu.Lock()
+	secret, prev := d.secret, d.prevSecret
+	d.mu.Unlock()
+	return token == d.token(ip, secret) || token == d.token(ip, prev)
+}
+
+func (d *DHT) rotateSecret(now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if now.Sub(d.lastRotation) < dhtTokenRotation {
+		return
+	}
+	d.prevSecret = d.secret
+	d.secret = RandomNodeID()
+	d.lastRotation = now
+}
+
+func (d *DHT) storePeer(infoHash NodeID, addr netip.AddrPort, now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	peers := d.peers[infoHash]
+	if peers == nil {
+		if len(d.peers) >= maxDHTInfoHashes {
+			return
+		}
+		peers = make(map[netip.AddrPort]time.Time)
+		d.peers[infoHash] = peers
+	}
+	if _, ok := peers[addr]; !ok && len(peers) >= maxDHTPeersPerInfoHash {
+		return
+	}
+	peers[addr] = now
+}
+
+// storedPeers returns up to maxDHTValues compact addresses of peers announced for infoHash, in one address family.
+func (d *DHT) storedPeers(infoHash NodeID, ipv4 bool, now time.Time) []any {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var out []any
+	for addr, seen := range d.peers[infoHash] {
+		if len(out) == maxDHTValues {
+			break
+		}
+		if addr.Addr().Is4() == ipv4 && now.Sub(seen) < d.PeerTTL {
+			out = append(out, AppendCompactAddr(nil, addr))
+		}
+	}
+	return out
+}
+
+// maintain rotates tokens, expires stored peers and items, and refreshes stale buckets.
+func (d *DHT) maintain(ctx context.Context) {
+	ticker := time.NewTicker(dhtMaintenanceInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-d.done:
+			return
+		case now := <-ticker.C:
+			d.rotateSecret(now)
+			d.expirePeers(now)
+			d.expireItems(now)
+			for _, target := range d.table.staleBuckets(now) {
+				d.FindNode(ctx, target)
+			}
+		}
+	}
+}
+
+func (d *DHT) expirePeers(now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for infoHash, peers := range d.peers {
+		for addr, seen := range peers {
+			if now.Sub(seen) >= d.PeerTTL {
+				delete(peers, addr)
+			}
+		}
+		if len(peers) == 0 {
+			delete(d.peers, infoHash)
+		}
+	}
+}
+
+// Ping checks that the node at addr is up, adding it to the routing table.
+func (d *DHT) Ping(ctx context.Context, addr netip.AddrPort) (NodeID, error) {
+	r, err := d.query(ctx, addr, "ping", map[string]any{})
+	if err != nil {
+		return NodeID{}, err
+	}
+	return dictNodeID(r, "id")
+}
+
+// AddNode pings addr in the background, adding it to the routing table if it responds.
+// Use it for nodes learned elsewhere, e.g. from a peer's Port message.
+func (d *DHT) AddNode(addr netip.AddrPort) {
+	go d.Ping(context.Background(), addr)
+}
+
+// Bootstrap joins the DHT through the nodes at addrs (host:port).
+// It looks up our own id to find our neighbours, then refreshes the buckets further away, as in Kademlia.
+// It fails if none of the nodes respond.
+func (d *DHT) Bootstrap(ctx context.Context, addrs ...string) error {
+	var wg sync.WaitGroup
+	for _, a := range addrs {
+		udp, err := net.ResolveUDPAddr("udp", a)
+		if err != nil {
+			log.Printf("dht: bootstrap node %s: %s", a, err)
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d.Ping(ctx, unmapAddrPort(udp.AddrPort()))
+		}()
+	}
+	wg.Wait()
+	if d.table.len() == 0 {
+		return fmt.Errorf("dht: none of %d bootstrap nodes responded", len(addrs))
+	}
+	if _, err := d.FindNode(ctx, d.Self()); err != nil {
+		return err
+	}
+	for _, target := range d.table.sparseBuckets() {
+		wg.Add(1)
+		go func(target NodeID) {
+			defer wg.Done()
+			d.FindNode(ctx, target)
+		}(target)
+	}
+	wg.Wait()
+	return ctx.Err()
+}
+
+// lookupResult holds what an iterative lookup found.
+type lookupResult struct {
+	// The closest nodes that responded, nearest first
+	nodes []NodeInfo
+	// Write tokens from get_peers and get responses, by node address
+	tokens map[netip.AddrPort]string
+	// Peers from get_peers responses
+	peers []netip.AddrPort
+	// get responses with a value, unverified
+	items []map[string]any
+}
+
+// lookup runs an iterative find_node, get_peers, or get towards target.
+//
+// Up to Alpha queries are kept in flight, each to the closest node not yet queried,
+// until the dhtK closest nodes heard of have all responded or failed.
+func (d *DHT) lookup(ctx context.Context, target NodeID, method string) (*lookupResult, error) {
+	type candidate struct {
+		NodeInfo
+		queried, responded, failed bool
+	}
+	var shortlist []*candidate
+	known := make(map[netip.AddrPort]bool)
+	self := d.Self()
+	add := func(n NodeInfo) {
+		if known[n.Addr] || n.ID == self || d.EnforceNodeIDs && !n.ID.SecureFor(n.Addr.Addr()) {
+			return
+		}
+		known[n.Addr] = true
+		shortlist = append(shortlist, &candidate{NodeInfo: n})
+	}
+	for _, n := range d.table.closest(target, dhtK) {
+		add(n)
+	}
+	if len(shortlist) == 0 {
+		return nil, ErrDHTNoNodes
+	}
+
+	type response struct {
+		c   *candidate
+		r   map[string]any
+		err error
+	}
+	results := make(chan response)
+	inFlight := 0
+	res := &lookupResult{tokens: make(map[netip.AddrPort]string)}
+	seenPeers := make(map[netip.AddrPort]bool)
+	key := "target"
+	if method == "get_peers" {
+		key = "info_hash"
+	}
+	for {
+		sort.Slice(shortlist, func(i, j int) bool { return closer(target, shortlist[i].ID, shortlist[j].ID) })
+		// Query the closest unqueried nodes among the dhtK closest that haven't failed
+		considered := 0
+		for _, c := range shortlist {
+			if considered == dhtK || inFlight == d.Alpha {
+				break
+			}
+			if c.failed {
+				continue
+			}
+			considered++
+			if c.queried {
+				continue
+			}
+			c.queried = true
+			inFlight++
+			go func(c *candidate) {
+				r, err := d.query(ctx, c.Addr, method, map[string]any{key: target[:]})
+				select {
+				case results <- response{c, r, err}:
+				case <-ctx.Done():
+				case <-d.done:
+				}
+			}(c)
+		}
+		if inFlight == 0 {
+			break
+		}
+		var resp response
+		select {
+		case resp = <-results:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-d.done:
+			return nil, net.ErrClosed
+		}
+		inFlight--
+		if resp.err != nil {
+			resp.c.failed = true
+			continue
+		}
+		resp.c.responded = true
+		if nodes, err := dictNodes(resp.r); err == nil {
+			for _, n := range nodes {
+				add(n)
+			}
+		}
+		if token, _, _ := dictString(resp.r, "token"); token != "" {
+			res.tokens[resp.c.Addr] = token
+		}
+		if _, ok := resp.r["v"]; ok && method == "get" {
+			res.items = append(res.items, resp.r)
+		}
+		for _, p := range dictValues(resp.r) {
+			if !seenPeers[p] {
+				seenPeers[p] = true
+				res.peers = append(res.peers, p)
+			}
+		}
+	}
+	for _, c := range shortlist {
+		if c.responded && len(res.nodes) < dhtK {
+			res.nodes = append(res.nodes, c.NodeInfo)
+		}
+	}
+	return res, nil
+}
+
+// FindNode returns the dhtK nodes closest to target that responded to us.
+func (d *DHT) FindNode(ctx context.Context, target NodeID) ([]NodeInfo, error) {
+	res, err := d.lookup(ctx, target, "find_node")
+	if err != nil {
+		return nil, err
+	}
+	return res.nodes, nil
+}
+
+// GetPeers looks up peers for infoHash.
+func (d *DHT) GetPeers(ctx context.Context, infoHash [20]byte) ([]netip.AddrPort, error) {
+	res, err := d.lookup(ctx, infoHash, "get_peers")
+	if err != nil {
+		return nil, err
+	}
+	return res.peers, nil
+}
+
+// Announce tells the nodes closest to infoHash that we're a peer on port, returning the peers found on the way.
+// If port is 0, nodes use the source port of our DHT packets instead (implied_port).
+func (d *DHT) Announce(ctx context.Context, infoHash [20]byte, port int) ([]netip.AddrPort, error) {
+	res, err := d.lookup(ctx, infoHash, "get_peers")
+	if err != nil {
+		return nil, err
+	}
+	args := map[string]any{"info_hash": infoHash[:], "port": port}
+	if port == 0 {
+		args["implied_port"] = 1
+	}
+	if d.write(ctx, res, "announce_peer", args) == 0 {
+		return res.peers, fmt.Errorf("dht: no nodes accepted announce for %x", infoHash)
+	}
+	return res.peers, nil
+}
+
+// write sends a write query, such as announce_peer, to each node a lookup got a token from,
+// returning how many accepted it.
+func (d *DHT) write(ctx context.Context, res *lookupResult, method string, args map[string]any) int {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	accepted := 0
+	for _, n := range res.nodes {
+		token, ok := res.tokens[n.Addr]
+		if !ok {
+			continue
+		}
+		a := make(map[string]any, len(args)+2)
+		for k, v := range args {
+			a[k] = v
+		}
+		a["token"] = token
+		wg.Add(1)
+		go func(addr netip.AddrPort) {
+			defer wg.Done()
+			if _, err := d.query(ctx, addr, method, a); err == nil {
+				mu.Lock()
+				accepted++
+				mu.Unlock()
+			}
+		}(n.Addr)
+	}
+	wg.Wait()
+	return accepted
+}
+
+// SaveState writes our id and routing table to path, so a restarted node can rejoin without bootstrapping.
+func (d *DHT) SaveState(path string) error {
+	nodes := d.Nodes()
+	self := d.Self()
+	bs, err := Encode(map[string]any{
+		"id":     self[:],
+		"nodes":  appendCompactNodes(nil, nodes, false),
+		"nodes6": appendCompactNodes(nil, nodes, true),
+	})
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.part")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(bs); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// LoadState restores our id and routing table from a file written by SaveState. Call it before Start.
+// Loaded nodes are used for lookups, and dropped if they don't respond.
+func (d *DHT) LoadState(path string) error {
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	s, err := ParseDictOnly(bs)
+	if err != nil {
+		return fmt.Errorf("dht state %s: %w", path, err)
+	}
+	id, err := dictNodeID(s, "id")
+	if err != nil {
+		return fmt.Errorf("dht state %s: %w", path, err)
+	}
+	nodes, err := dictNodes(s)
+	if err != nil {
+		return fmt.Errorf("dht state %s: %w", path, err)
+	}
+	d.mu.Lock()
+	d.ID = id
+	d.table = newRoutingTable(id)
+	d.mu.Unlock()
+	for _, n := range nodes {
+		d.table.load(n)
+	}
+	return nil
+}
@@ -0,0 +1,337 @@
+package bt
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Storing arbitrary data in the DHT, see BEP 44.
+//
+// Immutable items are stored under the SHA-1 of their bencoded value.
+// Mutable items are signed with an ed25519 key, and stored under the SHA-1 of the public key and an optional salt,
+// so their owner can replace them with a higher sequence number.
+
+// BEP 44 limits
+const (
+	// Largest bencoded value, so items fit in a UDP packet
+	MaxDHTItemSize = 1000
+	MaxDHTSaltSize = 64
+	// Items not put again within this are dropped
+	dhtItemTTL = 2 * time.Hour
+	// Most items we store for others
+	maxDHTItems = 1000
+)
+
+// ErrDHTItemNotFound is returned when no node has an item.
+var ErrDHTItemNotFound = errors.New("dht: item not found")
+
+// MutableItem is a signed value in the DHT.
+type MutableItem struct {
+	PublicKey ed25519.PublicKey
+	// Lets one key store several items
+	Salt []byte
+	// Puts only replace an item with a higher Seq
+	Seq   int64
+	Value any
+	// Of Salt, Seq, and Value, see signedData
+	Signature []byte
+}
+
+// NewMutableItem signs value with key.
+func NewMutableItem(key ed25519.PrivateKey, salt []byte, seq int64, value any) (*MutableItem, error) {
+	if len(salt) > MaxDHTSaltSize {
+		return nil, fmt.Errorf("dht: salt of %d bytes longer than %d", len(salt), MaxDHTSaltSize)
+	}
+	v, err := encodeItemValue(value)
+	if err != nil {
+		return nil, err
+	}
+	return &MutableItem{
+		PublicKey: key.Public().(ed25519.PublicKey),
+		Salt:      salt,
+		Seq:       seq,
+		Value:     value,
+		Signature: ed25519.Sign(key, signedData(salt, seq, v)),
+	}, nil
+}
+
+// Target is the key the item is stored under.
+func (i *MutableItem) Target() NodeID {
+	return MutableTarget(i.PublicKey, i.Salt)
+}
+
+// Verify checks the item's signature and sizes.
+func (i *MutableItem) Verify() error {
+	if len(i.PublicKey) != ed25519.PublicKeySize {
+		return fmt.Errorf("dht: expected %d byte public key, got %d", ed25519.PublicKeySize, len(i.PublicKey))
+	}
+	if len(i.Salt) > MaxDHTSaltSize {
+		return fmt.Errorf("dht: salt of %d bytes longer than %d", len(i.Salt), MaxDHTSaltSize)
+	}
+	v, err := encodeItemValue(i.Value)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(i.PublicKey, signedData(i.Salt, i.Seq, v), i.Signature) {
+		return errors.New("dht: invalid signature")
+	}
+	return nil
+}
+
+// MutableTarget is the key a mutable item with the given public key and salt is stored under.
+func MutableTarget(publicKey ed25519.PublicKey, salt []byte) NodeID {
+	return sha1.Sum(append(append([]byte{}, publicKey...), salt...))
+}
+
+// ImmutableTarget is the key value is stored under: the SHA-1 of its bencoding.
+func ImmutableTarget(value any) (NodeID, error) {
+	v, err := encodeItemValue(value)
+	if err != nil {
+		return NodeID{}, err
+	}
+	return sha1.Sum(v), nil
+}
+
+// signedData is what's signed for a mutable item: its salt, seq, and value as they'd appear in a bencoded dictionary.
+func signedData(salt []byte, seq int64, v []byte) []byte {
+	var b []byte
+	if len(salt) > 0 {
+		b = fmt.Appendf(b, "4:salt%d:%s", len(salt), salt)
+	}
+	b = fmt.Appendf(b, "3:seqi%de1:v", seq)
+	return append(b, v...)
+}
+
+func encodeItemValue(value any) ([]byte, error) {
+	if value == nil {
+		return nil, errors.New("dht: item without a value")
+	}
+	v, err := Encode(value)
+	if err != nil {
+		return nil, fmt.Errorf("dht: %w", err)
+	}
+	if len(v) > MaxDHTItemSize {
+		return nil, fmt.Errorf("dht: value of %d bytes larger than %d", len(v), MaxDHTItemSize)
+	}
+	return v, nil
+}
+
+// parseMutableItem reads a mutable item from get response values or put arguments. It isn't verified.
+func parseMutableItem(d map[string]any) (*MutableItem, error) {
+	k, _, err := dictString(d, "k")
+	if err != nil {
+		return nil, err
+	}
+	sig, _, err := dictString(d, "sig")
+	if err != nil {
+		return nil, err
+	}
+	salt, _, err := dictString(d, "salt")
+	if err != nil {
+		return nil, err
+	}
+	seq, _, err := dictInt(d, "seq")
+	if err != nil {
+		return nil, err
+	}
+	if len(sig) != ed25519.SignatureSize {
+		return nil, fmt.Errorf("dht: expected %d byte signature, got %d", ed25519.SignatureSize, len(sig))
+	}
+	item := &MutableItem{PublicKey: ed25519.PublicKey(k), Seq: int64(seq), Value: d["v"], Signature: []byte(sig)}
+	if salt != "" {
+		item.Salt = []byte(salt)
+	}
+	return item, nil
+}
+
+// dhtItem is an item we store for others. Immutable items have no public key.
+type dhtItem struct {
+	MutableItem
+	stored time.Time
+}
+
+// getItem adds the item stored under target, if any, to get response values r.
+// If the query has a seq, a mutable item's value is only included if it's newer.
+func (d *DHT) getItem(target NodeID, args map[string]any, r map[string]any) {
+	d.mu.Lock()
+	item, ok := d.items[target]
+	d.mu.Unlock()
+	if !ok {
+		return
+	}
+	if item.PublicKey == nil {
+		r["v"] = item.Value
+		return
+	}
+	r["seq"] = item.Seq
+	if seq, ok, _ := dictInt(args, "seq"); ok && int64(seq) >= item.Seq {
+		return
+	}
+	r["k"] = []byte(item.PublicKey)
+	r["sig"] = item.Signature
+	r["v"] = item.Value
+	if len(item.Salt) > 0 {
+		r["salt"] = item.Salt
+	}
+}
+
+// putItem stores the item in put arguments, after checking its size, signature, and sequence number.
+func (d *DHT) putItem(args map[string]any, now time.Time) *KRPCError {
+	v, ok := args["v"]
+	if !ok {
+		return &KRPCError{Code: KRPCProtocolError, Message: "missing value"}
+	}
+	if encoded, err := Encode(v); err != nil || len(encoded) > MaxDHTItemSize {
+		return &KRPCError{Code: KRPCMessageTooBig, Message: "message too big"}
+	}
+	if _, mutable := args["k"]; !mutable {
+		target, _ := ImmutableTarget(v)
+		return d.storeItem(target, &dhtItem{MutableItem: MutableItem{Value: v}, stored: now}, nil)
+	}
+	item, err := parseMutableItem(args)
+	if err != nil {
+		return &KRPCError{Code: KRPCProtocolError, Message: err.Error()}
+	}
+	if len(item.Salt) > MaxDHTSaltSize {
+		return &KRPCError{Code: KRPCSaltTooBig, Message: "salt too big"}
+	}
+	if err := item.Verify(); err != nil {
+		return &KRPCError{Code: KRPCInvalidSignature, Message: "invalid signature"}
+	}
+	var cas *int64
+	if c, ok, err := dictInt(args, "cas"); err != nil {
+		return &KRPCError{Code: KRPCProtocolError, Message: err.Error()}
+	} else if ok {
+		c := int64(c)
+		cas = &c
+	}
+	return d.storeItem(item.Target(), &dhtItem{MutableItem: *item, stored: now}, cas)
+}
+
+func (d *DHT) storeItem(target NodeID, item *dhtItem, cas *int64) *KRPCError {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	existing, ok := d.items[target]
+	if !ok {
+		if len(d.items) >= maxDHTItems {
+			return &KRPCError{Code: KRPCServerError, Message: "storage full"}
+		}
+		d.items[target] = item
+		return nil
+	}
+	if item.PublicKey != nil {
+		if cas != nil && *cas != existing.Seq {
+			return &KRPCError{Code: KRPCCASMismatch, Message: "CAS mismatch"}
+		}
+		if item.Seq < existing.Seq {
+			return &KRPCError{Code: KRPCSeqTooLow, Message: "sequence number less than current"}
+		}
+		if item.Seq == existing.Seq && !bytes.Equal(item.Signature, existing.Signature) {
+			return &KRPCError{Code: KRPCSeqTooLow, Message: "sequence number not newer"}
+		}
+	}
+	d.items[target] = item
+	return nil
+}
+
+func (d *DHT) expireItems(now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for target, item := range d.items {
+		if now.Sub(item.stored) >= dhtItemTTL {
+			delete(d.items, target)
+		}
+	}
+}
+
+// PutImmutable stores value on the nodes closest to its SHA-1, returning the target to get it with.
+// Items expire unless put again every couple of hours.
+func (d *DHT) PutImmutable(ctx context.Context, value any) (NodeID, error) {
+	target, err := ImmutableTarget(value)
+	if err != nil {
+		return NodeID{}, err
+	}
+	res, err := d.lookup(ctx, target, "get")
+	if err != nil {
+		return NodeID{}, err
+	}
+	if d.write(ctx, res, "put", map[string]any{"v": value}) == 0 {
+		return target, fmt.Errorf("dht: no nodes accepted put for %s", target)
+	}
+	return target, nil
+}
+
+// GetImmutable looks up the value stored under target by PutImmutable.
+func (d *DHT) GetImmutable(ctx context.Context, target NodeID) (any, error) {
+	res, err := d.lookup(ctx, target, "get")
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range res.items {
+		// Nodes can't lie about immutable items, since the target is the value's hash
+		if t, err := ImmutableTarget(r["v"]); err == nil && t == target {
+			return r["v"], nil
+		}
+	}
+	return nil, ErrDHTItemNotFound
+}
+
+// PutMutable stores item on the nodes closest to its target.
+// If cas isn't nil, nodes only replace an item whose seq is *cas, so concurrent writers don't overwrite each other.
+func (d *DHT) PutMutable(ctx context.Context, item *MutableItem, cas *int64) error {
+	if err := item.Verify(); err != nil {
+		return err
+	}
+	target := item.Target()
+	res, err := d.lookup(ctx, target, "get")
+	if err != nil {
+		return err
+	}
+	args := map[string]any{
+		"k":   []byte(item.PublicKey),
+		"seq": item.Seq,
+		"sig": item.Signature,
+		"v":   item.Value,
+	}
+	if len(item.Salt) > 0 {
+		args["salt"] = item.Salt
+	}
+	if cas != nil {
+		args["cas"] = *cas
+	}
+	if d.write(ctx, res, "put", args) == 0 {
+		return fmt.Errorf("dht: no nodes accepted put for %s", target)
+	}
+	return nil
+}
+
+// GetMutable looks up the newest valid item for publicKey and salt.
+func (d *DHT) GetMutable(ctx context.Context, publicKey ed25519.PublicKey, salt []byte) (*MutableItem, error) {
+	target := MutableTarget(publicKey, salt)
+	res, err := d.lookup(ctx, target, "get")
+	if err != nil {
+		return nil, err
+	}
+	var newest *MutableItem
+	for _, r := range res.items {
+		item, err := parseMutableItem(r)
+		if err != nil || !bytes.Equal(item.PublicKey, publicKey) || !bytes.Equal(item.Salt, salt) {
+			continue
+		}
+		if item.Verify() != nil {
+			continue
+		}
+		if newest == nil || item.Seq > newest.Seq {
+			newest = item
+		}
+	}
+	if newest == nil {
+		return nil, ErrDHTItemNotFound
+	}
+	return newest, nil
+}
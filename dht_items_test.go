@@ -0,0 +1,220 @@
+package bt
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	bs, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	return bs
+}
+
+func TestMutableItemVectors(t *testing.T) {
+	t.Parallel()
+	// Test vectors from BEP 44
+	publicKey := "77ff84905a91936367c01360803104f92432fcd904a43511876df5cdf3e7e548"
+	cases := []struct {
+		Name       string
+		Salt       string
+		Signature  string
+		WantTarget string
+	}{
+		{
+			Name:       "no salt",
+			Signature:  "305ac8aeb6c9c151fa120f120ea2cfb923564e11552d06a5d856091e5e853cff1260d3f39e4999684aa92eb73ffd136e6f4f3ecbfda0ce53a1608ecd7ae21f01",
+			WantTarget: "4a533d47ec9c7d95b1ad75f576cffc641853b750",
+		},
+		{
+			Name:       "salt",
+			Salt:       "foobar",
+			Signature:  "6834284b6b24c3204eb2fea824d82f88883a3d95e8b4a21b8c0ded553d17d17ddf9a8a7104b1258f30bed3787e6cb896fca78c58f8e03b5f18f14951a87d9a08",
+			WantTarget: "411eba73b6f087ca51a3795d9c8c938d365e32c1",
+		},
+	}
+	for _, c := range cases {
+		c := c
+		t.Run(c.Name, func(t *testing.T) {
+			t.Parallel()
+			item := &MutableItem{
+				PublicKey: mustHex(t, publicKey),
+				Seq:       1,
+				Value:     "Hello World!",
+				Signature: mustHex(t, c.Signature),
+			}
+			if c.Salt != "" {
+				item.Salt = []byte(c.Salt)
+			}
+			if err := item.Verify(); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if got := item.Target().String(); got != c.WantTarget {
+				t.Fatalf("want target %s, got %s", c.WantTarget, got)
+			}
+			item.Seq = 2
+			if err := item.Verify(); err == nil {
+				t.Fatal("wanted error, got nil")
+			}
+		})
+	}
+
+	target, err := ImmutableTarget("Hello World!")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if want := "e5f96f6f38320f0f33959cb4d3d656452117aadb"; target.String() != want {
+		t.Fatalf("want immutable target %s, got %s", want, target)
+	}
+}
+
+func TestNewMutableItem(t *testing.T) {
+	t.Parallel()
+	_, key, _ := ed25519.GenerateKey(nil)
+	item, err := NewMutableItem(key, []byte("salt"), 5, map[string]any{"version": "1.2.3"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := item.Verify(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err := NewMutableItem(key, make([]byte, MaxDHTSaltSize+1), 1, "v"); err == nil {
+		t.Fatal("wanted error, got nil")
+	}
+	if _, err := NewMutableItem(key, nil, 1, strings.Repeat("x", MaxDHTItemSize)); err == nil {
+		t.Fatal("wanted error, got nil")
+	}
+	if _, err := NewMutableItem(key, nil, 1, nil); err == nil {
+		t.Fatal("wanted error, got nil")
+	}
+}
+
+func TestDHTPutItemErrors(t *testing.T) {
+	t.Parallel()
+	d := newTestDHT(t)
+	_, key, _ := ed25519.GenerateKey(nil)
+	item, _ := NewMutableItem(key, nil, 2, "v")
+	args := func(item *MutableItem) map[string]any {
+		a := map[string]any{"k": string(item.PublicKey), "seq": int(item.Seq), "sig": string(item.Signature), "v": item.Value}
+		if len(item.Salt) > 0 {
+			a["salt"] = string(item.Salt)
+		}
+		return a
+	}
+	now := time.Now()
+	if err := d.putItem(args(item), now); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	older, _ := NewMutableItem(key, nil, 1, "old")
+	forged := args(item)
+	forged["v"] = "forged"
+	cas := args(item)
+	cas["cas"] = 1
+	saltTooBig := args(item)
+	saltTooBig["salt"] = strings.Repeat("s", MaxDHTSaltSize+1)
+	sameSeq, _ := NewMutableItem(key, nil, 2, "different")
+	cases := []struct {
+		Name     string
+		Args     map[string]any
+		WantCode int
+	}{
+		{"too big", map[string]any{"v": strings.Repeat("x", MaxDHTItemSize)}, KRPCMessageTooBig},
+		{"no value", map[string]any{}, KRPCProtocolError},
+		{"bad signature", forged, KRPCInvalidSignature},
+		{"salt too big", saltTooBig, KRPCSaltTooBig},
+		{"cas mismatch", cas, KRPCCASMismatch},
+		{"older seq", args(older), KRPCSeqTooLow},
+		{"same seq, different value", args(sameSeq), KRPCSeqTooLow},
+	}
+	for _, c := range cases {
+		err := d.putItem(c.Args, now)
+		if err == nil || err.Code != c.WantCode {
+			t.Errorf("%s: want error %d, got %v", c.Name, c.WantCode, err)
+		}
+	}
+	// Putting the same item again refreshes it
+	if err := d.putItem(args(item), now); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	d.expireItems(now.Add(dhtItemTTL))
+	r := map[string]any{}
+	d.getItem(item.Target(), map[string]any{}, r)
+	if len(r) != 0 {
+		t.Fatalf("want item expired, got %v", r)
+	}
+}
+
+func TestDHTItems(t *testing.T) {
+	t.Parallel()
+	nodes := newTestDHTNetwork(t, 16)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	t.Run("immutable", func(t *testing.T) {
+		value := map[string]any{"artifact": "bt-linux-amd64", "sha256": strings.Repeat("ab", 32)}
+		target, err := nodes[2].PutImmutable(ctx, value)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		got, err := nodes[9].GetImmutable(ctx, target)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if gotTarget, _ := ImmutableTarget(got); gotTarget != target {
+			t.Fatalf("want %v, got %v", value, got)
+		}
+		if _, err := nodes[9].GetImmutable(ctx, RandomNodeID()); !errors.Is(err, ErrDHTItemNotFound) {
+			t.Fatalf("want %s, got %v", ErrDHTItemNotFound, err)
+		}
+	})
+
+	t.Run("mutable", func(t *testing.T) {
+		public, key, _ := ed25519.GenerateKey(nil)
+		salt := []byte("latest")
+		v1, _ := NewMutableItem(key, salt, 1, "v1.0.0")
+		if err := nodes[3].PutMutable(ctx, v1, nil); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		got, err := nodes[11].GetMutable(ctx, public, salt)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if got.Seq != 1 || got.Value != "v1.0.0" {
+			t.Fatalf("want seq 1 v1.0.0, got %d %v", got.Seq, got.Value)
+		}
+		// The same key without salt is another item
+		if _, err := nodes[11].GetMutable(ctx, public, nil); !errors.Is(err, ErrDHTItemNotFound) {
+			t.Fatalf("want %s, got %v", ErrDHTItemNotFound, err)
+		}
+
+		v2, _ := NewMutableItem(key, salt, 2, "v1.1.0")
+		stale := int64(0)
+		if err := nodes[3].PutMutable(ctx, v2, &stale); err == nil {
+			t.Fatal("wanted CAS error, got nil")
+		}
+		current := int64(1)
+		if err := nodes[3].PutMutable(ctx, v2, &current); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		// Every node that stored v2 rejects it
+		if err := nodes[3].PutMutable(ctx, v1, nil); err == nil {
+			t.Fatal("wanted error putting an older item, got nil")
+		}
+		got, err = nodes[12].GetMutable(ctx, public, salt)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if got.Seq != 2 || got.Value != "v1.1.0" {
+			t.Fatalf("want seq 2 v1.1.0, got %d %v", got.Seq, got.Value)
+		}
+	})
+}
@@ -0,0 +1,210 @@
+package bt
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// Infohash indexing, see BEP 51.
+
+const (
+	// How long we keep answering sample_infohashes with the same sample, so crawlers can't fetch every infohash at once
+	DefaultDHTSampleInterval = 6 * time.Hour
+	// Most infohashes in a sample, to fit in a UDP packet alongside nodes
+	maxDHTSamples = 20
+	// The largest interval BEP 51 allows
+	maxDHTSampleInterval = 6 * time.Hour
+	// Time between a Crawler's queries
+	DefaultCrawlInterval = 100 * time.Millisecond
+)
+
+// InfohashSample is a node's response to sample_infohashes.
+type InfohashSample struct {
+	// Until the node will return a new sample
+	Interval time.Duration
+	// How many infohashes the node stores
+	Num     int
+	Samples [][20]byte
+	// Nodes close to the query's target, to continue crawling with
+	Nodes []NodeInfo
+}
+
+// sampleInfohashes returns a random sample of the infohashes we store peers for, and how many there are.
+// The sample only changes every SampleInterval, except that an empty sample is replaced as soon as we store an infohash.
+func (d *DHT) sampleInfohashes(now time.Time) (samples []byte, num int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.samples) == 0 || now.Sub(d.sampledAt) >= d.SampleInterval {
+		d.samples = make([]byte, 0, maxDHTSamples*20)
+		// Map iteration order is random enough for a sample
+		for infoHash := range d.peers {
+			if len(d.samples) == maxDHTSamples*20 {
+				break
+			}
+			d.samples = append(d.samples, infoHash[:]...)
+		}
+		// Left expired while empty, so sampleInterval tells crawlers there's nothing to wait for
+		if len(d.samples) > 0 {
+			d.sampledAt = now
+		}
+	}
+	return d.samples, len(d.peers)
+}
+
+// sampleInterval is how long until our sample changes, in seconds, as sent in sample_infohashes responses.
+func (d *DHT) sampleInterval(now time.Time) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	left := d.SampleInterval - now.Sub(d.sampledAt)
+	if left < 0 {
+		left = 0
+	}
+	if left > maxDHTSampleInterval {
+		left = maxDHTSampleInterval
+	}
+	return int(left / time.Second)
+}
+
+// SampleInfohashes asks the node at addr for a sample of the infohashes it stores, and the nodes it knows closest to target.
+func (d *DHT) SampleInfohashes(ctx context.Context, addr netip.AddrPort, target NodeID) (*InfohashSample, error) {
+	r, err := d.query(ctx, addr, "sample_infohashes", map[string]any{"target": target[:]})
+	if err != nil {
+		return nil, err
+	}
+	return parseInfohashSample(r)
+}
+
+func parseInfohashSample(r map[string]any) (*InfohashSample, error) {
+	s := &InfohashSample{}
+	interval, _, err := dictInt(r, "interval")
+	if err != nil {
+		return nil, fmt.Errorf("sample_infohashes: %w", err)
+	}
+	if interval < 0 || time.Duration(interval)*time.Second > maxDHTSampleInterval {
+		return nil, fmt.Errorf("sample_infohashes: interval %d out of range", interval)
+	}
+	s.Interval = time.Duration(interval) * time.Second
+	if s.Num, _, err = dictInt(r, "num"); err != nil {
+		return nil, fmt.Errorf("sample_infohashes: %w", err)
+	}
+	samples, _, err := dictString(r, "samples")
+	if err != nil {
+		return nil, fmt.Errorf("sample_infohashes: %w", err)
+	}
+	if len(samples)%20 != 0 {
+		return nil, fmt.Errorf("sample_infohashes: expected samples to be divisible by 20, got %d bytes", len(samples))
+	}
+	for i := 0; i < len(samples); i += 20 {
+		s.Samples = append(s.Samples, [20]byte([]byte(samples[i:i+20])))
+	}
+	if s.Nodes, err = dictNodes(r); err != nil {
+		return nil, fmt.Errorf("sample_infohashes: %w", err)
+	}
+	return s, nil
+}
+
+// Crawler walks the DHT with sample_infohashes queries, collecting the infohashes nodes store (BEP 51).
+//
+// Each Run queries every node it can reach once, with random targets so it's told about nodes all over the keyspace.
+// Nodes are skipped on later runs until the interval they asked for has passed.
+type Crawler struct {
+	DHT *DHT
+	// Time between queries
+	Interval time.Duration
+	// Stop a run after querying this many nodes, or 0 for no limit
+	MaxNodes int
+
+	mu sync.Mutex
+	// When each node said it would have a new sample
+	nextVisit map[netip.AddrPort]time.Time
+}
+
+func NewCrawler(d *DHT) *Crawler {
+	return &Crawler{
+		DHT:       d,
+		Interval:  DefaultCrawlInterval,
+		nextVisit: make(map[netip.AddrPort]time.Time),
+	}
+}
+
+// Run crawls until every reachable node has been queried, MaxNodes is reached, or ctx is cancelled.
+// found is called once for each infohash sampled, from one goroutine at a time. It returns the number of nodes queried.
+func (c *Crawler) Run(ctx context.Context, found func(infoHash [20]byte)) (int, error) {
+	seen := make(map[netip.AddrPort]bool)
+	seenInfoHashes := make(map[[20]byte]bool)
+	var queue []NodeInfo
+	self := c.DHT.Self()
+	enqueue := func(nodes []NodeInfo) {
+		now := time.Now()
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for _, n := range nodes {
+			if n.ID == self || seen[n.Addr] || now.Before(c.nextVisit[n.Addr]) {
+				continue
+			}
+			seen[n.Addr] = true
+			queue = append(queue, n)
+		}
+	}
+	enqueue(c.DHT.Nodes())
+
+	type result struct {
+		addr   netip.AddrPort
+		sample *InfohashSample
+		err    error
+	}
+	alpha := c.DHT.Alpha
+	if alpha < 1 {
+		alpha = 1
+	}
+	results := make(chan result, alpha)
+	inFlight, queried := 0, 0
+	ticker := time.NewTicker(c.Interval)
+	defer ticker.Stop()
+	ready := true // The first query needn't wait
+	for {
+		// Start a query if we're allowed one, there's someone to ask, and we're under both limits
+		if ready && len(queue) > 0 && inFlight < alpha && (c.MaxNodes == 0 || queried < c.MaxNodes) {
+			n := queue[0]
+			queue = queue[1:]
+			inFlight++
+			queried++
+			ready = false
+			go func() {
+				s, err := c.DHT.SampleInfohashes(ctx, n.Addr, RandomNodeID())
+				results <- result{n.Addr, s, err}
+			}()
+			continue
+		}
+		if inFlight == 0 && (len(queue) == 0 || c.MaxNodes != 0 && queried >= c.MaxNodes) {
+			return queried, nil
+		}
+		select {
+		case <-ctx.Done():
+			for ; inFlight > 0; inFlight-- {
+				<-results
+			}
+			return queried, ctx.Err()
+		case <-ticker.C:
+			ready = true
+		case r := <-results:
+			inFlight--
+			if r.err != nil {
+				continue
+			}
+			c.mu.Lock()
+			c.nextVisit[r.addr] = time.Now().Add(r.sample.Interval)
+			c.mu.Unlock()
+			enqueue(r.sample.Nodes)
+			for _, infoHash := range r.sample.Samples {
+				if !seenInfoHashes[infoHash] {
+					seenInfoHashes[infoHash] = true
+					found(infoHash)
+				}
+			}
+		}
+	}
+}
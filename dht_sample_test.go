@@ -0,0 +1,142 @@
+package bt
+
+import (
+	"context"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDHTSampleInfohashes(t *testing.T) {
+	t.Parallel()
+	d := newTestDHT(t)
+	now := time.Now()
+	for i := 0; i < 30; i++ {
+		d.storePeer(RandomNodeID(), netip.MustParseAddrPort("1.2.3.4:6881"), now)
+	}
+	query := &krpcMessage{T: "aa", Y: "q", Q: "sample_infohashes", A: map[string]any{"id": "abcdefghij0123456789", "target": string(make([]byte, 20))}}
+	m := d.handleQuery(query, netip.MustParseAddrPort("127.0.0.1:1"), now)
+	if m.Y != "r" {
+		t.Fatalf("want response, got %+v", m)
+	}
+	// Round trip the response values, as a crawler would see them
+	bs, _ := Encode(m.R)
+	r, _ := ParseDictOnly(bs)
+	s, err := parseInfohashSample(r)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if s.Num != 30 || len(s.Samples) != maxDHTSamples || s.Interval != DefaultDHTSampleInterval {
+		t.Fatalf("want 30 infohashes, %d samples, and interval %s, got %d, %d, %s", maxDHTSamples, DefaultDHTSampleInterval, s.Num, len(s.Samples), s.Interval)
+	}
+	// The sample doesn't change until the interval has passed
+	samples, _ := d.sampleInfohashes(now.Add(time.Hour))
+	if string(samples) != string(m.R["samples"].([]byte)) {
+		t.Fatal("want the same sample within the interval")
+	}
+	if got := d.sampleInterval(now.Add(time.Hour)); got != int((DefaultDHTSampleInterval - time.Hour).Seconds()) {
+		t.Fatalf("want interval %s, got %ds", DefaultDHTSampleInterval-time.Hour, got)
+	}
+}
+
+func TestDHTSampleInfohashesEmpty(t *testing.T) {
+	t.Parallel()
+	d := newTestDHT(t)
+	now := time.Now()
+	if samples, num := d.sampleInfohashes(now); len(samples) != 0 || num != 0 {
+		t.Fatalf("want empty sample, got %d bytes of %d", len(samples), num)
+	}
+	if got := d.sampleInterval(now); got != 0 {
+		t.Fatalf("want interval 0 for an empty sample, got %ds", got)
+	}
+	// The empty sample isn't kept for the interval
+	infoHash := RandomNodeID()
+	d.storePeer(infoHash, netip.MustParseAddrPort("1.2.3.4:6881"), now)
+	samples, num := d.sampleInfohashes(now.Add(time.Minute))
+	if string(samples) != string(infoHash[:]) || num != 1 {
+		t.Fatalf("want sample of the stored infohash, got %x of %d", samples, num)
+	}
+}
+
+func TestParseInfohashSample(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		Name      string
+		Input     map[string]any
+		WantError bool
+	}{
+		{Name: "empty", Input: map[string]any{}},
+		{Name: "samples", Input: map[string]any{"samples": string(make([]byte, 40)), "num": 2, "interval": 60}},
+		{Name: "bad samples length", Input: map[string]any{"samples": "abc"}, WantError: true},
+		{Name: "interval too long", Input: map[string]any{"interval": 21601}, WantError: true},
+		{Name: "negative interval", Input: map[string]any{"interval": -1}, WantError: true},
+		{Name: "bad num", Input: map[string]any{"num": "x"}, WantError: true},
+	}
+	for _, c := range cases {
+		c := c
+		t.Run(c.Name, func(t *testing.T) {
+			t.Parallel()
+			_, err := parseInfohashSample(c.Input)
+			if c.WantError {
+				if err == nil {
+					t.Fatal("wanted error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+		})
+	}
+}
+
+func TestCrawler(t *testing.T) {
+	t.Parallel()
+	nodes := newTestDHTNetwork(t, 16)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	want := make(map[[20]byte]bool)
+	for i := 0; i < 10; i++ {
+		infoHash := [20]byte(RandomNodeID())
+		want[infoHash] = true
+		if _, err := nodes[i].Announce(ctx, infoHash, 6881+i); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	c := NewCrawler(nodes[15])
+	c.Interval = time.Millisecond
+	var mu sync.Mutex
+	found := make(map[[20]byte]bool)
+	queried, err := c.Run(ctx, func(infoHash [20]byte) {
+		mu.Lock()
+		defer mu.Unlock()
+		if found[infoHash] {
+			t.Errorf("%x found twice", infoHash)
+		}
+		found[infoHash] = true
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if queried != len(nodes)-1 {
+		t.Fatalf("want %d nodes queried, got %d", len(nodes)-1, queried)
+	}
+	for infoHash := range want {
+		if !found[infoHash] {
+			t.Fatalf("%x not found, got %d of %d", infoHash, len(found), len(want))
+		}
+	}
+
+	// Nodes aren't queried again until their interval passes
+	if queried, err := c.Run(ctx, func([20]byte) {}); err != nil || queried != 0 {
+		t.Fatalf("want no nodes queried, got %d, %v", queried, err)
+	}
+	c = NewCrawler(nodes[15])
+	c.Interval = time.Millisecond
+	c.MaxNodes = 3
+	if queried, err := c.Run(ctx, func([20]byte) {}); err != nil || queried != 3 {
+		t.Fatalf("want 3 nodes queried, got %d, %v", queried, err)
+	}
+}
@@ -0,0 +1,68 @@
+package bt
+
+import (
+	"hash/crc32"
+	"net/netip"
+)
+
+// Node ids are tied to IPs to make it costly to place many nodes near a target, see BEP 42.
+
+var (
+	castagnoli = crc32.MakeTable(crc32.Castagnoli)
+	// Bits of the IP that go into the id's prefix
+	secureIDMask4 = []byte{0x03, 0x0f, 0x3f, 0xff}
+	secureIDMask6 = []byte{0x01, 0x03, 0x07, 0x0f, 0x1f, 0x3f, 0x7f, 0xff}
+)
+
+// SecureNodeID returns a random node id that's valid for ip.
+func SecureNodeID(ip netip.Addr) NodeID {
+	id := RandomNodeID()
+	return secureNodeID(ip, id[19], id)
+}
+
+// secureNodeID derives an id from ip and the random byte r, filling the rest of it from random.
+func secureNodeID(ip netip.Addr, r byte, random NodeID) NodeID {
+	prefix := secureIDPrefix(ip, r)
+	id := random
+	id[0] = byte(prefix >> 24)
+	id[1] = byte(prefix >> 16)
+	id[2] = byte(prefix>>8)&0xf8 | random[2]&0x07
+	id[19] = r
+	return id
+}
+
+// secureIDPrefix is the CRC32-C of ip's masked bits, with the low three bits of r mixed in.
+// The top 21 bits are the start of a valid node id.
+func secureIDPrefix(ip netip.Addr, r byte) uint32 {
+	ip = ip.Unmap()
+	var masked []byte
+	if ip.Is4() {
+		b := ip.As4()
+		masked = b[:]
+		for i, m := range secureIDMask4 {
+			masked[i] &= m
+		}
+	} else {
+		b := ip.As16()
+		masked = b[:8]
+		for i, m := range secureIDMask6 {
+			masked[i] &= m
+		}
+	}
+	masked[0] |= (r & 0x07) << 5
+	return crc32.Checksum(masked, castagnoli)
+}
+
+// SecureFor reports whether id is valid for a node at ip.
+// Every id is valid for local addresses, which aren't globally unique.
+func (id NodeID) SecureFor(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if !ip.IsValid() {
+		return false
+	}
+	if ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+		return true
+	}
+	prefix := secureIDPrefix(ip, id[19])
+	return id[0] == byte(prefix>>24) && id[1] == byte(prefix>>16) && id[2]&0xf8 == byte(prefix>>8)&0xf8
+}
@@ -0,0 +1,74 @@
+package bt
+
+import (
+	"encoding/hex"
+	"net/netip"
+	"testing"
+)
+
+func TestSecureNodeID(t *testing.T) {
+	t.Parallel()
+	// Test vectors from BEP 42. Only the first 21 bits and the last byte are determined by the IP and r.
+	cases := []struct {
+		IP   string
+		R    byte
+		Want string
+	}{
+		{"124.31.75.21", 1, "5fbfbff10c5d6a4ec8a88e4c6ab4c28b95eee401"},
+		{"21.75.31.124", 86, "5a3ce9c14e7a08645677bbd1cfe7d8f956d53256"},
+		{"65.23.51.170", 22, "a5d43220bc8f112a3d426c84764f8c2a1150e616"},
+		{"84.124.73.14", 65, "1b0321dd1bb1fe518101ceef99462b947a01ff41"},
+		{"43.213.53.83", 90, "e56f6cbf5b7c4be0237986d5243b87aa6d51305a"},
+	}
+	for _, c := range cases {
+		c := c
+		t.Run(c.IP, func(t *testing.T) {
+			t.Parallel()
+			ip := netip.MustParseAddr(c.IP)
+			bs, _ := hex.DecodeString(c.Want)
+			want := NodeID(bs)
+			if !want.SecureFor(ip) {
+				t.Fatalf("want %s valid for %s", want, ip)
+			}
+			got := secureNodeID(ip, c.R, RandomNodeID())
+			if got[0] != want[0] || got[1] != want[1] || got[2]&0xf8 != want[2]&0xf8 || got[19] != want[19] {
+				t.Fatalf("want %s, got %s", want, got)
+			}
+			if !got.SecureFor(ip) {
+				t.Fatalf("want %s valid for %s", got, ip)
+			}
+			// Only the low bits of the first octets count
+			other := ip.As4()
+			other[0] ^= 0x80
+			if !got.SecureFor(netip.AddrFrom4(other)) {
+				t.Fatalf("want %s valid for %s", got, netip.AddrFrom4(other))
+			}
+			other[3]++
+			if got.SecureFor(netip.AddrFrom4(other)) {
+				t.Fatalf("want %s invalid for %s", got, netip.AddrFrom4(other))
+			}
+		})
+	}
+}
+
+func TestSecureFor(t *testing.T) {
+	t.Parallel()
+	id := NodeID{0xff}
+	for _, ip := range []string{"10.1.2.3", "192.168.0.1", "172.16.5.5", "127.0.0.1", "169.254.1.1", "::1", "fd00::1"} {
+		if !id.SecureFor(netip.MustParseAddr(ip)) {
+			t.Errorf("want any id valid for local address %s", ip)
+		}
+	}
+	for _, ip := range []string{"1.2.3.4", "2001:db8::1"} {
+		addr := netip.MustParseAddr(ip)
+		if id.SecureFor(addr) {
+			t.Errorf("want %s invalid for %s", id, ip)
+		}
+		if secure := SecureNodeID(addr); !secure.SecureFor(addr) {
+			t.Errorf("want %s valid for %s", secure, ip)
+		}
+	}
+	if id.SecureFor(netip.Addr{}) {
+		t.Error("want invalid address rejected")
+	}
+}
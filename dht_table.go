@@ -0,0 +1,348 @@
+package bt
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"math/bits"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// Nodes per bucket, and the number of closest nodes a lookup converges on
+	dhtK = 8
+	// Nodes that have responded or queried us within this are good. Older ones are questionable.
+	dhtGoodNodeAge = 15 * time.Minute
+	// Nodes that fail this many queries in a row are bad, and replaced when something better comes along
+	dhtMaxFailures = 2
+	// Buckets unchanged for this long are refreshed with a lookup
+	dhtBucketRefresh = 15 * time.Minute
+)
+
+// NodeID identifies a DHT node, and is in the same 160 bit space as infohashes.
+type NodeID [20]byte
+
+// RandomNodeID returns a random node id.
+func RandomNodeID() NodeID {
+	var id NodeID
+	if _, err := rand.Read(id[:]); err != nil {
+		panic(err) // Only fails if the system's randomness source is broken
+	}
+	return id
+}
+
+func (id NodeID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// Distance is the XOR metric between two ids. Compare distances with bytes.Compare.
+func (id NodeID) Distance(other NodeID) NodeID {
+	var d NodeID
+	for i := range id {
+		d[i] = id[i] ^ other[i]
+	}
+	return d
+}
+
+// commonPrefixLen is the number of leading bits a and b share.
+func commonPrefixLen(a, b NodeID) int {
+	for i := range a {
+		if x := a[i] ^ b[i]; x != 0 {
+			return i*8 + bits.LeadingZeros8(x)
+		}
+	}
+	return 160
+}
+
+// closer reports whether a is closer to target than b.
+func closer(target, a, b NodeID) bool {
+	da, db := target.Distance(a), target.Distance(b)
+	return bytes.Compare(da[:], db[:]) < 0
+}
+
+// NodeInfo is a DHT node's id and address.
+type NodeInfo struct {
+	ID   NodeID
+	Addr netip.AddrPort
+}
+
+type dhtNode struct {
+	NodeInfo
+	// When the node last responded to us or queried us. Zero if it never has, e.g. if loaded from disk.
+	lastSeen time.Time
+	failures int
+	// The id is valid for the address (BEP 42)
+	secure bool
+}
+
+func (n *dhtNode) good(now time.Time) bool {
+	return n.failures == 0 && now.Sub(n.lastSeen) < dhtGoodNodeAge
+}
+
+type bucket struct {
+	// Least recently seen first
+	nodes []*dhtNode
+	// Recently seen nodes to take the place of bad ones, most recent last
+	replacements []*dhtNode
+	lastChanged  time.Time
+}
+
+// routingTable holds the nodes we know of, more of them the closer they are to us.
+//
+// Bucket i holds up to dhtK nodes whose ids share exactly i leading bits with ours.
+// This is equivalent to Kademlia's splitting buckets, since only the bucket containing our own id is ever split.
+type routingTable struct {
+	self NodeID
+
+	mu      sync.Mutex
+	buckets [160]bucket
+}
+
+func newRoutingTable(self NodeID) *routingTable {
+	t := &routingTable{self: self}
+	// Empty buckets aren't refreshed until they've had a chance to fill
+	now := time.Now()
+	for i := range t.buckets {
+		t.buckets[i].lastChanged = now
+	}
+	return t
+}
+
+func (t *routingTable) bucketFor(id NodeID) *bucket {
+	return &t.buckets[commonPrefixLen(t.self, id)]
+}
+
+// seen records a node that responded to us or queried us.
+//
+// If its bucket is full, it takes the place of a bad node, or failing that a node whose id isn't secure if its own is.
+// Otherwise it's kept as a replacement and the least recently seen questionable node,
+// if any, is returned to be pinged: if that ping fails, the node is replaced.
+func (t *routingTable) seen(n NodeInfo, now time.Time) (ping *NodeInfo) {
+	if !n.Addr.IsValid() || n.Addr.Port() == 0 {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if n.ID == t.self {
+		return nil
+	}
+	b := t.bucketFor(n.ID)
+	for i, existing := range b.nodes {
+		if existing.ID != n.ID {
+			continue
+		}
+		if existing.Addr != n.Addr {
+			// Don't let another address take over an id we can still reach
+			if existing.good(now) {
+				return nil
+			}
+			existing.Addr = n.Addr
+			existing.secure = n.ID.SecureFor(n.Addr.Addr())
+		}
+		existing.lastSeen = now
+		existing.failures = 0
+		b.nodes = append(append(b.nodes[:i], b.nodes[i+1:]...), existing)
+		b.lastChanged = now
+		return nil
+	}
+	node := &dhtNode{NodeInfo: n, lastSeen: now, secure: n.ID.SecureFor(n.Addr.Addr())}
+	if len(b.nodes) < dhtK {
+		b.nodes = append(b.nodes, node)
+		b.lastChanged = now
+		return nil
+	}
+	for i, existing := range b.nodes {
+		if existing.failures >= dhtMaxFailures || node.secure && !existing.secure {
+			b.nodes = append(append(b.nodes[:i], b.nodes[i+1:]...), node)
+			b.lastChanged = now
+			return nil
+		}
+	}
+	b.addReplacement(node)
+	for _, existing := range b.nodes {
+		if !existing.good(now) {
+			info := existing.NodeInfo
+			return &info
+		}
+	}
+	return nil
+}
+
+// load adds a node that hasn't been heard from yet, if there's room for it.
+func (t *routingTable) load(n NodeInfo) {
+	if !n.Addr.IsValid() || n.Addr.Port() == 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if n.ID == t.self {
+		return
+	}
+	b := t.bucketFor(n.ID)
+	if len(b.nodes) >= dhtK {
+		return
+	}
+	for _, existing := range b.nodes {
+		if existing.ID == n.ID {
+			return
+		}
+	}
+	b.nodes = append([]*dhtNode{{NodeInfo: n, secure: n.ID.SecureFor(n.Addr.Addr())}}, b.nodes...)
+}
+
+// rekey changes our own id, moving every node to the bucket for the new one.
+// Nodes that no longer fit are kept as replacements, and good nodes are kept over others.
+func (t *routingTable) rekey(self NodeID, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var nodes, replacements []*dhtNode
+	for i := range t.buckets {
+		nodes = append(nodes, t.buckets[i].nodes...)
+		replacements = append(replacements, t.buckets[i].replacements...)
+		t.buckets[i] = bucket{lastChanged: now}
+	}
+	t.self = self
+	sort.SliceStable(nodes, func(i, j int) bool { return nodes[i].good(now) && !nodes[j].good(now) })
+	for _, n := range nodes {
+		if n.ID == self {
+			continue
+		}
+		if b := t.bucketFor(n.ID); len(b.nodes) < dhtK {
+			b.nodes = append(b.nodes, n)
+		} else {
+			b.addReplacement(n)
+		}
+	}
+	for _, n := range replacements {
+		if n.ID != self {
+			t.bucketFor(n.ID).addReplacement(n)
+		}
+	}
+	for i := range t.buckets {
+		b := t.buckets[i].nodes
+		sort.SliceStable(b, func(i, j int) bool { return b[i].lastSeen.Before(b[j].lastSeen) })
+	}
+}
+
+func (b *bucket) addReplacement(n *dhtNode) {
+	for i, r := range b.replacements {
+		if r.ID == n.ID {
+			b.replacements = append(b.replacements[:i], b.replacements[i+1:]...)
+			break
+		}
+	}
+	b.replacements = append(b.replacements, n)
+	if len(b.replacements) > dhtK {
+		b.replacements = b.replacements[1:]
+	}
+}
+
+// failed records a query to the node at addr that went unanswered.
+// Bad nodes are swapped for the most recent replacement, if there is one, preferring those with secure ids.
+func (t *routingTable) failed(id NodeID, addr netip.AddrPort) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	b := t.bucketFor(id)
+	for i, n := range b.nodes {
+		if n.ID != id || n.Addr != addr {
+			continue
+		}
+		n.failures++
+		if n.failures >= dhtMaxFailures && len(b.replacements) > 0 {
+			r := len(b.replacements) - 1
+			for j := r; j >= 0; j-- {
+				if b.replacements[j].secure {
+					r = j
+					break
+				}
+			}
+			b.nodes = append(append(b.nodes[:i], b.nodes[i+1:]...), b.replacements[r])
+			b.replacements = append(b.replacements[:r], b.replacements[r+1:]...)
+		}
+		return
+	}
+}
+
+// closest returns up to n nodes nearest target, excluding bad ones.
+func (t *routingTable) closest(target NodeID, n int) []NodeInfo {
+	t.mu.Lock()
+	var out []NodeInfo
+	for i := range t.buckets {
+		for _, node := range t.buckets[i].nodes {
+			if node.failures < dhtMaxFailures {
+				out = append(out, node.NodeInfo)
+			}
+		}
+	}
+	t.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return closer(target, out[i].ID, out[j].ID) })
+	if len(out) > n {
+		out = out[:n]
+	}
+	return out
+}
+
+// len is the number of nodes in the table.
+func (t *routingTable) len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := 0
+	for i := range t.buckets {
+		n += len(t.buckets[i].nodes)
+	}
+	return n
+}
+
+// staleBuckets returns a random id in each bucket that hasn't changed in dhtBucketRefresh,
+// up to the deepest non-empty bucket, for refreshing with find_node.
+func (t *routingTable) staleBuckets(now time.Time) []NodeID {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var out []NodeID
+	for i := 0; i <= t.deepest(); i++ {
+		if now.Sub(t.buckets[i].lastChanged) >= dhtBucketRefresh {
+			t.buckets[i].lastChanged = now
+			out = append(out, t.randomIDInBucket(i))
+		}
+	}
+	return out
+}
+
+// sparseBuckets returns a random id in each bucket that isn't full, up to the deepest non-empty bucket,
+// for filling the table after bootstrapping.
+func (t *routingTable) sparseBuckets() []NodeID {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var out []NodeID
+	for i := t.deepest() - 1; i >= 0; i-- {
+		if len(t.buckets[i].nodes) < dhtK {
+			out = append(out, t.randomIDInBucket(i))
+		}
+	}
+	return out
+}
+
+// deepest is the index of the deepest non-empty bucket, or -1 if the table is empty. Must hold t.mu.
+func (t *routingTable) deepest() int {
+	for i := len(t.buckets) - 1; i >= 0; i-- {
+		if len(t.buckets[i].nodes) > 0 {
+			return i
+		}
+	}
+	return -1
+}
+
+// randomIDInBucket returns an id sharing exactly i leading bits with ours.
+func (t *routingTable) randomIDInBucket(i int) NodeID {
+	id := RandomNodeID()
+	for bit := 0; bit < i; bit++ {
+		mask := byte(0x80 >> (bit % 8))
+		id[bit/8] = id[bit/8]&^mask | t.self[bit/8]&mask
+	}
+	mask := byte(0x80 >> (i % 8))
+	id[i/8] = id[i/8]&^mask | ^t.self[i/8]&mask
+	return id
+}
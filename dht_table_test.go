@@ -0,0 +1,182 @@
+package bt
+
+import (
+	"fmt"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestCommonPrefixLen(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		A, B NodeID
+		Want int
+	}{
+		{NodeID{}, NodeID{}, 160},
+		{NodeID{}, NodeID{0x80}, 0},
+		{NodeID{}, NodeID{0x01}, 7},
+		{NodeID{0xff, 0xff}, NodeID{0xff, 0xfe}, 15},
+		{NodeID{19: 1}, NodeID{}, 159},
+	}
+	for _, c := range cases {
+		if got := commonPrefixLen(c.A, c.B); got != c.Want {
+			t.Errorf("%s, %s: want %d, got %d", c.A, c.B, c.Want, got)
+		}
+	}
+}
+
+func TestRandomIDInBucket(t *testing.T) {
+	t.Parallel()
+	table := newRoutingTable(RandomNodeID())
+	for _, i := range []int{0, 1, 7, 8, 100, 159} {
+		if got := commonPrefixLen(table.self, table.randomIDInBucket(i)); got != i {
+			t.Errorf("bucket %d: got an id sharing %d bits", i, got)
+		}
+	}
+}
+
+// testNode returns a node in bucket 0 of a table for the zero id.
+func testNode(i int) NodeInfo {
+	return NodeInfo{
+		ID:   NodeID{0x80, byte(i)},
+		Addr: netip.MustParseAddrPort(fmt.Sprintf("10.0.0.%d:6881", i)),
+	}
+}
+
+func TestRoutingTableSeen(t *testing.T) {
+	t.Parallel()
+	table := newRoutingTable(NodeID{})
+	now := time.Now()
+	for i := 0; i < dhtK; i++ {
+		if ping := table.seen(testNode(i), now); ping != nil {
+			t.Fatalf("unexpected ping of %v", ping)
+		}
+	}
+	// Full of good nodes
+	if ping := table.seen(testNode(dhtK), now); ping != nil {
+		t.Fatalf("unexpected ping of %v", ping)
+	}
+	if n := table.len(); n != dhtK {
+		t.Fatalf("want %d nodes, got %d", dhtK, n)
+	}
+	// Our own id and unusable addresses are ignored
+	table.seen(NodeInfo{ID: NodeID{}, Addr: testNode(0).Addr}, now)
+	table.seen(NodeInfo{ID: NodeID{1}}, now)
+	if n := table.len(); n != dhtK {
+		t.Fatalf("want %d nodes, got %d", dhtK, n)
+	}
+
+	// Later, everything's questionable, so the least recently seen node is pinged
+	later := now.Add(dhtGoodNodeAge)
+	table.seen(testNode(0), later)
+	ping := table.seen(testNode(dhtK+1), later)
+	if ping == nil || *ping != testNode(1) {
+		t.Fatalf("want ping of %v, got %v", testNode(1), ping)
+	}
+	// It doesn't respond, so the most recent replacement takes its place
+	table.failed(ping.ID, ping.Addr)
+	table.failed(ping.ID, ping.Addr)
+	got := table.closest(testNode(1).ID, 1)
+	if len(got) != 1 || got[0] == testNode(1) {
+		t.Fatalf("want %v replaced, got %v", testNode(1), got)
+	}
+	found := false
+	for _, n := range table.closest(NodeID{}, dhtK) {
+		found = found || n == testNode(dhtK+1)
+	}
+	if !found {
+		t.Fatalf("want %v in table", testNode(dhtK+1))
+	}
+
+	// A good node's address can't be taken over
+	spoof := testNode(0)
+	spoof.Addr = netip.MustParseAddrPort("10.9.9.9:1")
+	table.seen(spoof, later)
+	if got := table.closest(spoof.ID, 1); got[0] != testNode(0) {
+		t.Fatalf("want %v, got %v", testNode(0), got[0])
+	}
+}
+
+func TestRoutingTableClosest(t *testing.T) {
+	t.Parallel()
+	self := RandomNodeID()
+	table := newRoutingTable(self)
+	now := time.Now()
+	for i := 0; i < 500; i++ {
+		addr := netip.AddrPortFrom(netip.AddrFrom4([4]byte{10, 0, byte(i >> 8), byte(i)}), 6881)
+		table.seen(NodeInfo{ID: RandomNodeID(), Addr: addr}, now)
+	}
+	// Buckets near us aren't full, so the table should hold more than a few buckets' worth
+	if n := table.len(); n <= 3*dhtK {
+		t.Fatalf("want more than %d nodes, got %d", 3*dhtK, n)
+	}
+	target := RandomNodeID()
+	got := table.closest(target, dhtK)
+	if len(got) != dhtK {
+		t.Fatalf("want %d nodes, got %d", dhtK, len(got))
+	}
+	for i := 1; i < len(got); i++ {
+		if closer(target, got[i].ID, got[i-1].ID) {
+			t.Fatalf("nodes out of order at %d", i)
+		}
+	}
+	if stale := table.staleBuckets(now); len(stale) != 0 {
+		t.Fatalf("want no stale buckets, got %d", len(stale))
+	}
+	if stale := table.staleBuckets(now.Add(dhtBucketRefresh)); len(stale) == 0 {
+		t.Fatal("want stale buckets, got none")
+	}
+}
+
+func TestRoutingTablePrefersSecure(t *testing.T) {
+	t.Parallel()
+	table := newRoutingTable(NodeID{})
+	now := time.Now()
+	// Public addresses, so these random ids aren't secure
+	for i := 0; i < dhtK; i++ {
+		addr := netip.MustParseAddrPort(fmt.Sprintf("1.2.3.%d:6881", i))
+		table.seen(NodeInfo{ID: NodeID{0x80, byte(i)}, Addr: addr}, now)
+	}
+	ip := netip.MustParseAddr("5.6.7.8")
+	id := SecureNodeID(ip)
+	for id[0]&0x80 == 0 {
+		id = SecureNodeID(ip) // Until it's in bucket 0
+	}
+	secure := NodeInfo{ID: id, Addr: netip.AddrPortFrom(ip, 6881)}
+	if ping := table.seen(secure, now); ping != nil {
+		t.Fatalf("unexpected ping of %v", ping)
+	}
+	if n := table.len(); n != dhtK {
+		t.Fatalf("want %d nodes, got %d", dhtK, n)
+	}
+	if got := table.closest(id, 1); got[0] != secure {
+		t.Fatalf("want %v to replace an insecure node, got %v", secure, got[0])
+	}
+}
+
+func TestRoutingTableRekey(t *testing.T) {
+	t.Parallel()
+	table := newRoutingTable(RandomNodeID())
+	now := time.Now()
+	for i := 0; i < 200; i++ {
+		addr := netip.AddrPortFrom(netip.AddrFrom4([4]byte{10, 0, byte(i >> 8), byte(i)}), 6881)
+		table.seen(NodeInfo{ID: RandomNodeID(), Addr: addr}, now)
+	}
+	before := table.len()
+	self := RandomNodeID()
+	table.rekey(self, now)
+	if table.self != self {
+		t.Fatalf("want self %s, got %s", self, table.self)
+	}
+	if n := table.len(); n == 0 || n > before {
+		t.Fatalf("want between 1 and %d nodes, got %d", before, n)
+	}
+	for i := range table.buckets {
+		for _, n := range table.buckets[i].nodes {
+			if got := commonPrefixLen(self, n.ID); got != i {
+				t.Fatalf("node %s in bucket %d, want %d", n.ID, i, got)
+			}
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package bt
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestDHT starts a node on loopback, closed when the test ends.
+func newTestDHT(t *testing.T) *DHT {
+	t.Helper()
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	d := NewDHT(conn)
+	d.QueryTimeout = 500 * time.Millisecond
+	d.Start(context.Background())
+	t.Cleanup(func() { d.Close() })
+	return d
+}
+
+// newTestDHTNetwork starts n nodes, all bootstrapped from the first.
+func newTestDHTNetwork(t *testing.T, n int) []*DHT {
+	t.Helper()
+	nodes := make([]*DHT, n)
+	for i := range nodes {
+		nodes[i] = newTestDHT(t)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	// The first node only learns of others as they bootstrap
+	if err := nodes[1].Bootstrap(ctx, nodes[0].Addr().String()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	errs := make(chan error, n)
+	for _, d := range nodes[2:] {
+		d := d
+		go func() { errs <- d.Bootstrap(ctx, nodes[0].Addr().String()) }()
+	}
+	for range nodes[2:] {
+		if err := <-errs; err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	return nodes
+}
+
+func TestDHTNetwork(t *testing.T) {
+	t.Parallel()
+	nodes := newTestDHTNetwork(t, 32)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	for _, d := range nodes {
+		if len(d.Nodes()) == 0 {
+			t.Fatalf("node %s: empty routing table", d.ID)
+		}
+	}
+
+	t.Run("find_node", func(t *testing.T) {
+		target := nodes[20]
+		got, err := nodes[5].FindNode(ctx, target.ID)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if len(got) == 0 || got[0].ID != target.ID || got[0].Addr != target.Addr() {
+			t.Fatalf("want %s at %s first, got %v", target.ID, target.Addr(), got)
+		}
+	})
+
+	t.Run("announce and get_peers", func(t *testing.T) {
+		infoHash := [20]byte(RandomNodeID())
+		peers, err := nodes[3].GetPeers(ctx, infoHash)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if len(peers) != 0 {
+			t.Fatalf("want no peers, got %v", peers)
+		}
+		if _, err := nodes[3].Announce(ctx, infoHash, 1234); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		// Implied port uses the DHT node's port
+		if _, err := nodes[7].Announce(ctx, infoHash, 0); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		peers, err = nodes[30].GetPeers(ctx, infoHash)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		want := map[netip.AddrPort]bool{
+			netip.MustParseAddrPort("127.0.0.1:1234"): true,
+			nodes[7].Addr(): true,
+		}
+		for _, p := range peers {
+			delete(want, p)
+		}
+		if len(want) != 0 {
+			t.Fatalf("missing peers %v, got %v", want, peers)
+		}
+	})
+
+	t.Run("bad token", func(t *testing.T) {
+		target := nodes[10]
+		conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		defer conn.Close()
+		id := RandomNodeID()
+		q := &krpcMessage{T: "xy", Y: "q", Q: "announce_peer", A: map[string]any{
+			"id":        id[:],
+			"info_hash": id[:],
+			"port":      1234,
+			"token":     "forged",
+		}}
+		bs, _ := q.MarshalBinary()
+		if _, err := conn.WriteTo(bs, net.UDPAddrFromAddrPort(target.Addr())); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 1500)
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		resp, err := parseKRPC(buf[:n])
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if resp.T != "xy" || resp.Y != "e" || resp.E.Code != KRPCProtocolError {
+			t.Fatalf("want protocol error, got %+v", resp)
+		}
+		// Responses tell us our address
+		if want := conn.LocalAddr().(*net.UDPAddr).AddrPort(); resp.IP != want {
+			t.Fatalf("want ip %s, got %s", want, resp.IP)
+		}
+	})
+
+	t.Run("persistence", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "dht.dat")
+		saved := nodes[12]
+		if err := saved.SaveState(path); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		d := NewDHT(conn)
+		d.QueryTimeout = 500 * time.Millisecond
+		defer d.Close()
+		if err := d.LoadState(path); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if d.ID != saved.ID {
+			t.Fatalf("want id %s, got %s", saved.ID, d.ID)
+		}
+		if want, got := len(saved.Nodes()), len(d.Nodes()); want != got {
+			t.Fatalf("want %d nodes, got %d", want, got)
+		}
+		// No bootstrapping needed
+		d.Start(ctx)
+		target := nodes[25]
+		got, err := d.FindNode(ctx, target.ID)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if len(got) == 0 || got[0].ID != target.ID {
+			t.Fatalf("want %s first, got %v", target.ID, got)
+		}
+	})
+}
+
+func TestDHTUnknownMethod(t *testing.T) {
+	t.Parallel()
+	d := newTestDHT(t)
+	id := RandomNodeID()
+	m := d.handleQuery(&krpcMessage{T: "aa", Y: "q", Q: "vote", A: map[string]any{"id": string(id[:])}}, netip.MustParseAddrPort("127.0.0.1:1"), time.Now())
+	if m.Y != "e" || m.E.Code != KRPCMethodUnknown {
+		t.Fatalf("want method unknown error, got %+v", m)
+	}
+	m = d.handleQuery(&krpcMessage{T: "aa", Y: "q", Q: "ping", A: map[string]any{"id": "short"}}, netip.MustParseAddrPort("127.0.0.1:1"), time.Now())
+	if m.Y != "e" || m.E.Code != KRPCProtocolError {
+		t.Fatalf("want protocol error, got %+v", m)
+	}
+}
+
+func TestDHTBootstrapFails(t *testing.T) {
+	t.Parallel()
+	d := newTestDHT(t)
+	d.QueryTimeout = 50 * time.Millisecond
+	// Nothing listens on the discard port
+	if err := d.Bootstrap(context.Background(), "127.0.0.1:9"); err == nil {
+		t.Fatal("wanted error, got nil")
+	}
+	if _, err := d.FindNode(context.Background(), d.ID); err != ErrDHTNoNodes {
+		t.Fatalf("want %s, got %v", ErrDHTNoNodes, err)
+	}
+}
+
+func TestDHTExternalIP(t *testing.T) {
+	t.Parallel()
+	d := newTestDHT(t)
+	for i := 0; i < 3; i++ {
+		d.nodeSeen(NodeInfo{ID: RandomNodeID(), Addr: netip.AddrPortFrom(netip.AddrFrom4([4]byte{10, 0, 0, byte(i)}), 6881)})
+	}
+	ip := netip.MustParseAddr("1.2.3.4")
+	// Votes from one IP count once
+	for i := 0; i < dhtExternalIPVotes; i++ {
+		d.voteExternalIP(ip, netip.MustParseAddr("9.9.9.9"))
+	}
+	if got := d.ExternalIP(); got.IsValid() {
+		t.Fatalf("want no external IP, got %s", got)
+	}
+	for i := 0; i < dhtExternalIPVotes; i++ {
+		d.voteExternalIP(ip, netip.AddrFrom4([4]byte{9, 9, 9, byte(i)}))
+	}
+	if got := d.ExternalIP(); got != ip {
+		t.Fatalf("want external IP %s, got %s", ip, got)
+	}
+	if !d.Self().SecureFor(ip) {
+		t.Fatalf("want id %s secure for %s", d.Self(), ip)
+	}
+	if n := len(d.Nodes()); n != 3 {
+		t.Fatalf("want nodes kept after changing id, got %d", n)
+	}
+	// Already secure, so the id doesn't change
+	self := d.Self()
+	d.SetExternalIP(ip)
+	if d.Self() != self {
+		t.Fatalf("want id %s kept, got %s", self, d.Self())
+	}
+}
+
+func TestDHTEnforceNodeIDs(t *testing.T) {
+	t.Parallel()
+	d := newTestDHT(t)
+	d.EnforceNodeIDs = true
+	ip := netip.MustParseAddr("1.2.3.4")
+	d.nodeSeen(NodeInfo{ID: NodeID{0xff}, Addr: netip.AddrPortFrom(ip, 6881)})
+	if n := len(d.Nodes()); n != 0 {
+		t.Fatalf("want insecure node ignored, got %d nodes", n)
+	}
+	d.nodeSeen(NodeInfo{ID: SecureNodeID(ip), Addr: netip.AddrPortFrom(ip, 6881)})
+	// Local addresses are exempt
+	d.nodeSeen(NodeInfo{ID: NodeID{0xff}, Addr: netip.MustParseAddrPort("192.168.1.1:6881")})
+	if n := len(d.Nodes()); n != 2 {
+		t.Fatalf("want 2 nodes, got %d", n)
+	}
+}
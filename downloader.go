@@ -1,22 +1,28 @@
 package bt
 
 import (
+	"bytes"
+	"context"
 	"crypto/rand"
+	"encoding/binary"
+	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net"
-	"net/http"
-	"net/url"
+	"net/netip"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Using Azureus-style peer id.
 // `EE` for eenblam. BT and EB are already in use.
-// Remaining 4 chars are version.
+// Remaining 4 chars are version, from Version.
 // See https://wiki.theory.org/BitTorrentSpecification#peer_id
-var PeerPrefix = [8]byte{'-', 'E', 'E', '0', '0', '0', '0', '-'}
+var PeerPrefix = azureusPrefix("EE", buildVersion())
 
 // Generate a 20-byte peerId
 func GenPeerId() ([20]byte, error) {
@@ -35,16 +41,64 @@ type Downloader struct {
 	MetaInfo  MetaInfo
 	PeerId    [20]byte
 	LocalPort int
+	// Our public addresses, if known. Sent to trackers as ipv4= and ipv6=, see BEP 7.
+	IPv4 netip.Addr
+	IPv6 netip.Addr
 	// Where pieces will be downloaded to
-	PiecesDir   string
+	PiecesDir string
+	// Where verified pieces are written. Defaults to a PieceDirStorage in PiecesDir.
+	Storage Storage
+	// Peers we've heard of, from the tracker and elsewhere
+	Candidates *PeerPool
+	// When fewer than MinPeers candidates are in use, ask the tracker for more early
+	MinPeers int
+	// Decides which peers we upload to
+	Choker *Choker
+	// Extension Protocol messages we handle (BEP 10). Register extensions before Start.
+	Extensions *ExtensionRegistry
+	// Finds peers and announces us on the DHT, if set. Start and bootstrap it separately, since it can be shared by torrents.
+	// Unused for private torrents.
+	DHT *DHT
+	// Finds peers on the local network and announces us to them, if set (BEP 14).
+	// Start it separately, since it can be shared by torrents. Unused for private torrents.
+	LSD *LSD
+	// Socket for uTP connections, if set. Peers we're introduced to for holepunching (BEP 55) are dialed over it as well as TCP,
+	// so it should be bound to the port we announce. Pass its incoming connections to HandleIncoming.
+	UTP *UTPSocket
+	// How the connections we make are encrypted, and which incoming connections we accept
+	Encryption  EncryptionPolicy
 	isMultifile bool
-	downloaded  int
-	uploaded    int
+	downloaded  atomic.Int64
+	uploaded    atomic.Int64
 	// The number of bytes this peer still has to download, encoded in base ten ascii.
 	// Note that this can't be computed from downloaded and the file length since it might be a resume,
 	// and there's a chance that some of the downloaded data failed an integrity check and had to be re-downloaded.
-	left     int
-	listener *net.TCPListener
+	left atomic.Int64
+	// Random value sent to the tracker to identify us across address changes
+	key uint32
+	// Latest seeder and leecher counts from the tracker, or -1 if unknown
+	seeders  atomic.Int64
+	leechers atomic.Int64
+	// Our address as reported by the tracker (BEP 24). Guarded by mu.
+	externalIP netip.Addr
+
+	mu sync.Mutex
+	// The pieces we have. Guarded by mu.
+	pieces *BField
+	// Connected peers, by address. Guarded by mu.
+	peers map[netip.AddrPort]*PeerConn
+	// The peers we've told each connected peer about over PEX. Guarded by mu.
+	pexSent map[netip.AddrPort]map[netip.AddrPort]struct{}
+	// Peers we're holepunching to, receiving their connection to us if it arrives first. Guarded by mu.
+	punching map[netip.AddrPort]chan *PeerConn
+
+	assembler *PieceAssembler
+	listener  *net.TCPListener
+	announcer *Announcer
+	// Set by Start, and cancelled by Close
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
 }
 
 func NewDownloader(filename string) (*Downloader, error) {
@@ -62,53 +116,945 @@ func NewDownloader(filename string) (*Downloader, error) {
 		return nil, err
 	}
 
-	return &Downloader{
+	pieces, err := NewEmptyBitfield(len(m.Info.Pieces))
+	if err != nil {
+		return nil, err
+	}
+	var key [4]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return nil, fmt.Errorf("failed to read random bytes: %w", err)
+	}
+
+	d := &Downloader{
 		MetaInfo:    *m,
 		PeerId:      peerId,
+		IPv4:        publicAddr("udp4"),
+		IPv6:        publicAddr("udp6"),
 		PiecesDir:   piecesDir,
+		Storage:     &PieceDirStorage{Dir: piecesDir},
+		Candidates:  NewPeerPool(),
+		MinPeers:    20,
+		Choker:      NewChoker(),
+		Extensions:  NewExtensionRegistry(),
 		isMultifile: m.Info.Files != nil,
-	}, nil
+		key:         binary.BigEndian.Uint32(key[:]),
+		pieces:      pieces,
+	}
+	d.assembler = NewPieceAssembler(&d.MetaInfo.Info, pieces, d.storePiece)
+	if err := d.registerExtensions(); err != nil {
+		return nil, err
+	}
+	d.left.Store(int64(m.Info.TotalLength()))
+	d.seeders.Store(-1)
+	d.leechers.Store(-1)
+	return d, nil
+}
+
+// publicAddr finds the local address we'd use to reach the internet over network ("udp4" or "udp6"),
+// returning the zero Addr if there's no route or the address isn't publicly routable (e.g. behind NAT).
+//
+// No packets are sent: connecting a UDP socket only selects a route.
+func publicAddr(network string) netip.Addr {
+	// Any public address will do. These are a.root-servers.net.
+	remote := "198.41.0.4:53"
+	if network == "udp6" {
+		remote = "[2001:503:ba3e::2:30]:53"
+	}
+	conn, err := net.Dial(network, remote)
+	if err != nil {
+		return netip.Addr{}
+	}
+	defer conn.Close()
+	local := conn.LocalAddr().(*net.UDPAddr).AddrPort().Addr().Unmap()
+	if !local.IsGlobalUnicast() || local.IsPrivate() {
+		return netip.Addr{}
+	}
+	return local
+}
+
+// Stats reports transfer totals for tracker announces. See TransferStats.
+func (d *Downloader) Stats() (uploaded, downloaded, left int64) {
+	return d.uploaded.Load(), d.downloaded.Load(), d.left.Load()
+}
+
+// announceParams builds the announce for event from our current state.
+func (d *Downloader) announceParams(event string) AnnounceParams {
+	uploaded, downloaded, left := d.Stats()
+	return AnnounceParams{
+		InfoHash:   d.MetaInfo.InfoShaSum,
+		PeerID:     d.PeerId,
+		Port:       d.LocalPort,
+		IPv4:       d.IPv4,
+		IPv6:       d.IPv6,
+		Key:        d.key,
+		Uploaded:   uploaded,
+		Downloaded: downloaded,
+		Left:       left,
+		Event:      event,
+		NumWant:    -1,
+	}
 }
 
+// MakeTrackerQuery encodes our initial "started" announce as HTTP query parameters.
 func (d *Downloader) MakeTrackerQuery() (string, error) {
-	// info_hash
-	// peer_id - generate string of length 20 at random. Generate this elsewhere later.
-	// ip - ignore?
-	// port - need to bind one
-	// uploaded - 0 for now
-	// downloaded - 0 for now
-	// left - whatever amounts to "all"
-	// event - for first request, should be "started"
-	v := url.Values{}
-	v.Set("info_hash", string(d.MetaInfo.InfoShaSum[:]))
-	v.Set("peer_id", string(d.PeerId[:]))
-	//v.Set("ip", "")
-	v.Set("port", fmt.Sprint(d.LocalPort))
-	v.Set("uploaded", fmt.Sprint(d.uploaded))
-	v.Set("downloaded", fmt.Sprint(d.downloaded))
-	v.Set("left", fmt.Sprint(d.left))
-	v.Set("event", "started")
-	return v.Encode(), nil
+	return d.announceParams(EventStarted).Query().Encode(), nil
 }
 
+// QueryTracker sends a single "started" announce. Start manages announces for the lifetime of a download.
 func (d *Downloader) QueryTracker() (*TrackerResponse, error) {
-	q, err := d.MakeTrackerQuery()
+	if strings.HasPrefix(d.MetaInfo.Announce, "udp://") {
+		c, err := DialUDPTracker(d.MetaInfo.Announce)
+		if err != nil {
+			return nil, err
+		}
+		defer c.Close()
+		return c.Announce(context.Background(), d.announceParams(EventStarted))
+	}
+	return AnnounceHTTP(context.Background(), d.MetaInfo.Announce, d.announceParams(EventStarted))
+}
+
+// Start announces to the tracker until Close, adding the peers it returns to Candidates.
+// If Listen or ListenPort was called, peers connecting to us are served too.
+func (d *Downloader) Start(ctx context.Context) {
+	if d.Candidates == nil {
+		d.Candidates = NewPeerPool()
+	}
+	ctx, d.cancel = context.WithCancel(ctx)
+	d.ctx = ctx
+	params := d.announceParams(EventStarted)
+	d.announcer = NewAnnouncer(d.MetaInfo.Announce, params, d)
+	d.wg.Add(3)
+	go func() {
+		defer d.wg.Done()
+		d.announcer.Run(ctx)
+	}()
+	if d.MetaInfo.Info.Private == 0 {
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+			d.runPEX(ctx)
+		}()
+	}
+	if d.useDHT() {
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+			d.runDHT(ctx)
+		}()
+	}
+	if d.LSD != nil && d.MetaInfo.Info.Private == 0 {
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+			d.runLSD(ctx)
+		}()
+	}
+	go func() {
+		defer d.wg.Done()
+		d.runChoker(ctx)
+	}()
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		d.runConnector(ctx)
+	}()
+	if d.listener != nil {
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+			d.acceptPeers(ctx)
+		}()
+	}
+	go func() {
+		defer d.wg.Done()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case resp := <-d.announcer.Responses():
+				d.handleTrackerResponse(resp)
+			}
+		}
+	}()
+}
+
+// handleTrackerResponse records what a tracker told us about the swarm and ourselves.
+func (d *Downloader) handleTrackerResponse(resp *TrackerResponse) {
+	d.Candidates.Add(SourceTracker, resp.Peers...)
+	if resp.Complete != nil {
+		d.seeders.Store(int64(*resp.Complete))
+	}
+	if resp.Incomplete != nil {
+		d.leechers.Store(int64(*resp.Incomplete))
+	}
+	if resp.ExternalIP.IsValid() {
+		d.mu.Lock()
+		d.externalIP = resp.ExternalIP
+		d.mu.Unlock()
+		if d.DHT != nil {
+			d.DHT.SetExternalIP(resp.ExternalIP)
+		}
+	}
+}
+
+// SwarmStats returns the latest seeder and leecher counts from the tracker, or -1 if unknown.
+func (d *Downloader) SwarmStats() (seeders, leechers int) {
+	return int(d.seeders.Load()), int(d.leechers.Load())
+}
+
+// ExternalIP is our address as last reported by a tracker, or the zero Addr if unknown.
+func (d *Downloader) ExternalIP() netip.Addr {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.externalIP
+}
+
+// markPiece records that we've downloaded and verified piece index.
+// When every piece is present, the tracker is told we've completed.
+func (d *Downloader) markPiece(index int) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	had, err := d.pieces.Get(index)
+	if err != nil {
+		return err
+	}
+	if had {
+		return nil
+	}
+	if err := d.pieces.Set(index, true); err != nil {
+		return err
+	}
+	d.left.Add(-int64(d.MetaInfo.Info.PieceSize(index)))
+	if d.isComplete() && d.announcer != nil {
+		d.announcer.Completed()
+	}
+	return nil
+}
+
+// storePiece writes a verified piece to Storage and marks it as present.
+func (d *Downloader) storePiece(index int, data []byte) error {
+	if err := d.Storage.WritePiece(index, data); err != nil {
+		return err
+	}
+	return d.markPiece(index)
+}
+
+// Handshake is the handshake we send peers, advertising the extensions we support.
+func (d *Downloader) Handshake() Handshake {
+	h := Handshake{InfoHash: d.MetaInfo.InfoShaSum, PeerID: d.PeerId}
+	h.Reserved.Set(FastBit)
+	h.Reserved.Set(ExtensionProtocolBit)
+	if d.useDHT() {
+		h.Reserved.Set(DHTBit)
+	}
+	return h
+}
+
+// useDHT reports whether we find peers on the DHT. Private torrents only use their trackers (BEP 27).
+func (d *Downloader) useDHT() bool {
+	return d.DHT != nil && d.MetaInfo.Info.Private == 0
+}
+
+// registerExtensions adds the extensions we support to d.Extensions.
+// PEX and holepunching are left out for private torrents.
+func (d *Downloader) registerExtensions() error {
+	if d.MetaInfo.Info.Private != 0 {
+		return nil
+	}
+	if _, err := d.Extensions.Register(PEXExtension, d.handlePEX); err != nil {
+		return err
+	}
+	_, err := d.Extensions.Register(HolepunchExtension, d.handleHolepunch)
+	return err
+}
+
+// ClientVersion is sent to peers in the extended handshake.
+var ClientVersion = "eenblam/bt " + buildVersion()
+
+// sendExtendedHandshake advertises our extensions to a peer that supports the Extension Protocol.
+func (d *Downloader) sendExtendedHandshake(p *PeerConn) error {
+	h := d.Extensions.Handshake()
+	h.V = ClientVersion
+	h.P = uint16(d.LocalPort)
+	h.Reqq = maxQueuedUploads
+	h.YourIP = p.Addr.Addr()
+	h.MetadataSize = len(d.MetaInfo.RawInfo)
+	payload, err := h.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return p.Send(NewExtended(0, payload))
+}
+
+// announcePieces tells a newly connected peer which pieces we have.
+// With the Fast Extension, that's HaveAll or HaveNone where possible, followed by our allowed fast set for the peer.
+func (d *Downloader) announcePieces(p *PeerConn) error {
+	d.mu.Lock()
+	pieces, _ := NewBitfield(d.pieces.Bytes(), d.pieces.Length())
+	d.mu.Unlock()
+	_, none := pieces.NextTrue()
+	_, all := pieces.NextFalse()
+	var err error
+	switch {
+	case p.Fast && all:
+		err = p.Send(NewMessage(HaveAll, nil))
+	case p.Fast && none:
+		err = p.Send(NewMessage(HaveNone, nil))
+	case !none:
+		err = p.Send(NewBitfieldMessage(pieces))
+	}
+	if err != nil || !p.Fast {
+		return err
+	}
+	for _, index := range AllowedFastSet(p.Addr.Addr(), d.MetaInfo.InfoShaSum, pieces.Length(), DefaultAllowedFast) {
+		if have, _ := pieces.Get(int(index)); !have {
+			continue
+		}
+		if err := p.Send(NewAllowedFast(index)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handlePeer exchanges blocks with a connected peer until its connection ends, then closes it.
+//
+// Requests are kept pipelined while the peer has pieces we want and isn't choking us,
+// or while it's choking us but has allowed us some pieces fast.
+// Blocks requested from the peer are returned to the assembler when it chokes us (rejects them, with the Fast Extension) or disconnects.
+// The peer's requests are queued for serveRequests. Invalid requests, or requests for pieces we don't have, disconnect the peer.
+func (d *Downloader) handlePeer(p *PeerConn) error {
+	defer p.Close()
+	// The pieces we've counted towards availability, from the messages we've handled.
+	// p.PeerPieces may be ahead of these.
+	counted, err := NewEmptyBitfield(len(d.MetaInfo.Info.Pieces))
+	if err != nil {
+		return err
+	}
+	d.mu.Lock()
+	if d.peers == nil {
+		d.peers = make(map[netip.AddrPort]*PeerConn)
+	}
+	d.peers[p.Addr] = p
+	d.mu.Unlock()
+	defer func() {
+		d.mu.Lock()
+		if d.peers[p.Addr] == p {
+			delete(d.peers, p.Addr)
+			delete(d.pexSent, p.Addr)
+		}
+		d.mu.Unlock()
+		d.assembler.DropPeer(p.Addr)
+		d.assembler.Picker.PeerGone(counted)
+	}()
+	if p.Extended {
+		if err := d.sendExtendedHandshake(p); err != nil {
+			return err
+		}
+	}
+	if err := d.announcePieces(p); err != nil {
+		return err
+	}
+	if d.useDHT() && p.Remote.Reserved.Has(DHTBit) {
+		if err := p.Send(NewPort(d.DHT.Addr().Port())); err != nil {
+			return err
+		}
+	}
+	uploads := make(chan BlockRequest, maxQueuedUploads)
+	defer close(uploads)
+	go d.serveRequests(p, uploads)
+
+	for m := range p.Events() {
+		switch m.Type {
+		case Request:
+			r, _ := m.BlockRequest() // Validated by PeerConn
+			if err := d.validateRequest(r); err != nil {
+				return fmt.Errorf("peer %s: %w", p.Addr, err)
+			}
+			select {
+			case uploads <- r:
+			default:
+				return fmt.Errorf("peer %s: more than %d requests queued", p.Addr, maxQueuedUploads)
+			}
+		case Bitfield, HaveAll, Have:
+			if m.Type == Bitfield {
+				counted, _ = m.Bitfield(counted.Length()) // Validated by PeerConn
+				d.assembler.Picker.PeerBitfield(counted)
+			} else if m.Type == HaveAll {
+				for i := 0; i < counted.Length(); i++ {
+					counted.Set(i, true)
+				}
+				d.assembler.Picker.PeerBitfield(counted)
+			} else {
+				index, _ := m.Have()
+				counted.Set(int(index), true)
+				d.assembler.Picker.PeerHave(int(index))
+			}
+			if err := p.SetInterested(d.assembler.Interesting(p.PeerPieces())); err != nil {
+				return err
+			}
+		case Choke:
+			if !p.Fast {
+				d.assembler.DropPeer(p.Addr)
+			}
+		case RejectRequest:
+			r, _ := m.BlockRequest()
+			d.assembler.Cancelled(p.Addr, r)
+		case Port:
+			if port, err := m.PortNumber(); err == nil && port != 0 && d.useDHT() {
+				d.DHT.AddNode(netip.AddrPortFrom(p.Addr.Addr(), port))
+			}
+		case Extended:
+			if err := d.Extensions.Dispatch(p, m); err != nil {
+				return fmt.Errorf("peer %s: %w", p.Addr, err)
+			}
+		case Piece:
+			index, begin, block, _ := m.BlockPayload() // Validated by PeerConn
+			d.downloaded.Add(int64(len(block)))
+			cancel, completed, err := d.assembler.Received(p.Addr, index, begin, block)
+			d.cancelRequests(cancel, BlockRequest{index, begin, uint32(len(block))})
+			if errors.Is(err, ErrPieceHashMismatch) {
+				log.Printf("peer %s: %s", p.Addr, err)
+			} else if err != nil {
+				return err
+			}
+			if completed && !d.assembler.Interesting(p.PeerPieces()) {
+				if err := p.SetInterested(false); err != nil {
+					return err
+				}
+			}
+		}
+		if !p.State().AmInterested {
+			continue
+		}
+		for _, r := range d.assembler.Fill(p.Addr, p.Requestable()) {
+			if err := p.Send(NewRequest(r.Index, r.Begin, r.Length)); err != nil {
+				return err
+			}
+		}
+	}
+	return p.Err()
+}
+
+// Peers may have this many requests queued before they're disconnected. Most clients advertise a limit of 250 (BEP 10 reqq).
+const maxQueuedUploads = 250
+
+// validateRequest checks a peer's request against the torrent's layout and the pieces we have.
+func (d *Downloader) validateRequest(r BlockRequest) error {
+	info := &d.MetaInfo.Info
+	if int(r.Index) >= len(info.Pieces) {
+		return fmt.Errorf("request for piece %d of %d", r.Index, len(info.Pieces))
+	}
+	if r.Length == 0 || r.Length > maxBlockLength {
+		return fmt.Errorf("request for %d bytes, want 1 to %d", r.Length, maxBlockLength)
+	}
+	if size := info.PieceSize(int(r.Index)); int(r.Begin)+int(r.Length) > size {
+		return fmt.Errorf("request for %d bytes at %d past end of %d byte piece %d", r.Length, r.Begin, size, r.Index)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if have, _ := d.pieces.Get(int(r.Index)); !have {
+		return fmt.Errorf("request for piece %d, which we don't have", r.Index)
+	}
+	return nil
+}
+
+// serveRequests answers a peer's queued requests from Storage, until uploads is closed.
+// Requests cancelled or dropped by a Choke while queued are skipped.
+func (d *Downloader) serveRequests(p *PeerConn, uploads <-chan BlockRequest) {
+	for r := range uploads {
+		if !p.Requested(r) {
+			continue
+		}
+		block := make([]byte, r.Length)
+		if err := d.Storage.ReadBlock(int(r.Index), int(r.Begin), block); err != nil {
+			log.Printf("peer %s: %s", p.Addr, err)
+			p.closeWithError(err)
+			continue
+		}
+		if err := p.Send(NewPiece(r.Index, r.Begin, block)); err != nil {
+			continue // Gone; drain until handlePeer returns
+		}
+		d.uploaded.Add(int64(r.Length))
+	}
+}
+
+// cancelRequests sends Cancel for r to each of peers, after an endgame block arrived from another peer.
+func (d *Downloader) cancelRequests(peers []netip.AddrPort, r BlockRequest) {
+	for _, addr := range peers {
+		d.mu.Lock()
+		p := d.peers[addr]
+		d.mu.Unlock()
+		if p != nil {
+			p.Send(NewCancel(r.Index, r.Begin, r.Length)) // Fails only if the peer is gone anyway
+		}
+	}
+}
+
+// runChoker rechokes our peers every DefaultRechokeInterval until ctx is cancelled.
+func (d *Downloader) runChoker(ctx context.Context) {
+	if d.Choker == nil {
+		d.Choker = NewChoker()
+	}
+	ticker := time.NewTicker(DefaultRechokeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			d.rechoke(now)
+		}
+	}
+}
+
+// rechoke applies the Choker's decision to every connected peer.
+func (d *Downloader) rechoke(now time.Time) {
+	d.mu.Lock()
+	seeding := d.isComplete()
+	conns := make([]*PeerConn, 0, len(d.peers))
+	for _, p := range d.peers {
+		conns = append(conns, p)
+	}
+	d.mu.Unlock()
+
+	candidates := make([]ChokeCandidate, len(conns))
+	for i, p := range conns {
+		state := p.State()
+		candidates[i] = ChokeCandidate{
+			Addr:         p.Addr,
+			Interested:   state.PeerInterested,
+			AmInterested: state.AmInterested,
+			Downloaded:   p.Downloaded(),
+			Uploaded:     p.Uploaded(),
+			ConnectedAt:  p.ConnectedAt,
+			LastBlock:    p.LastBlock(),
+		}
+	}
+	unchoke := d.Choker.Rechoke(now, candidates, seeding)
+	for _, p := range conns {
+		p.SetChoking(!unchoke[p.Addr]) // Fails only if the peer is gone
+	}
+}
+
+// runPEX sends each peer that supports ut_pex the changes to our connected peers, every DefaultPEXInterval.
+func (d *Downloader) runPEX(ctx context.Context) {
+	ticker := time.NewTicker(DefaultPEXInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			d.sendPEX()
+		}
+	}
+}
+
+// sendPEX sends one round of PEX messages. Peers with nothing new aren't sent anything.
+func (d *Downloader) sendPEX() {
+	d.mu.Lock()
+	conns := make([]*PeerConn, 0, len(d.peers))
+	for _, p := range d.peers {
+		conns = append(conns, p)
+	}
+	d.mu.Unlock()
+
+	current := make(map[netip.AddrPort]byte, len(conns))
+	for _, p := range conns {
+		var flags byte
+		if _, all := p.PeerPieces().NextFalse(); all {
+			flags |= PEXSeed
+		}
+		if p.Encrypted {
+			flags |= PEXPrefersEncryption
+		}
+		if p.UTP {
+			flags |= PEXSupportsUTP
+		}
+		if p.Outgoing {
+			flags |= PEXReachable
+		}
+		if h, ok := p.PeerExtensions(); ok && h.M[HolepunchExtension] != 0 {
+			flags |= PEXHolepunch
+		}
+		current[pexAddr(p)] = flags
+	}
+	for _, p := range conns {
+		if h, ok := p.PeerExtensions(); !ok || h.M[PEXExtension] == 0 {
+			continue
+		}
+		others := make(map[netip.AddrPort]byte, len(current))
+		for addr, flags := range current {
+			if addr != pexAddr(p) {
+				others[addr] = flags
+			}
+		}
+		d.mu.Lock()
+		if d.pexSent == nil {
+			d.pexSent = make(map[netip.AddrPort]map[netip.AddrPort]struct{})
+		}
+		sent := d.pexSent[p.Addr]
+		if sent == nil {
+			sent = make(map[netip.AddrPort]struct{})
+			d.pexSent[p.Addr] = sent
+		}
+		m := pexDelta(others, sent)
+		d.mu.Unlock()
+		if len(m.Added) == 0 && len(m.Dropped) == 0 {
+			continue
+		}
+		payload, err := m.MarshalBinary()
+		if err != nil {
+			log.Printf("peer %s: %s", p.Addr, err)
+			continue
+		}
+		p.SendExtended(PEXExtension, payload) // Fails only if the peer is gone
+	}
+}
+
+// pexAddr is the address other peers can reach p at: its listen port from the extended handshake, if it sent one.
+func pexAddr(p *PeerConn) netip.AddrPort {
+	if h, ok := p.PeerExtensions(); ok && h.P != 0 {
+		return netip.AddrPortFrom(p.Addr.Addr(), h.P)
+	}
+	return p.Addr
+}
+
+// handlePEX adds the peers in a ut_pex message to our candidates.
+func (d *Downloader) handlePEX(p *PeerConn, payload []byte) error {
+	m, err := ParsePEXMessage(payload)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create tracker query: %w", err)
+		return err
 	}
-	u := fmt.Sprintf("%s?%s", d.MetaInfo.Announce, q)
-	r, err := http.Get(u)
+	if len(m.Added) > maxPEXPeers {
+		m.Added = m.Added[:maxPEXPeers]
+	}
+	peers := make([]Peer, len(m.Added))
+	for i, added := range m.Added {
+		peers[i] = Peer{Addr: added.Addr, Crypto: added.Flags&PEXPrefersEncryption != 0}
+	}
+	d.Candidates.Add(SourcePEX, peers...)
+	return nil
+}
+
+// Time allowed for a holepunched connection, including its handshake
+const holepunchTimeout = 30 * time.Second
+
+// Holepunch asks relay, a connected peer, to introduce us to target, a peer it's connected to that we can't reach directly (BEP 55).
+// If it can, we both connect to each other at once. Errors from the relay are logged.
+func (d *Downloader) Holepunch(relay, target netip.AddrPort) error {
+	d.mu.Lock()
+	p := d.peers[relay]
+	d.mu.Unlock()
+	if p == nil {
+		return fmt.Errorf("holepunch: not connected to %s", relay)
+	}
+	payload, err := HolepunchMessage{Type: HolepunchRendezvous, Addr: target}.MarshalBinary()
 	if err != nil {
-		return nil, fmt.Errorf("GET %s: %w", u, err)
+		return err
 	}
-	if r.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("GET %s: expected 200 OK, got %s", u, r.Status)
+	return p.SendExtended(HolepunchExtension, payload)
+}
+
+// handleHolepunch relays rendezvous between our peers, and connects to the peers a relay introduces us to.
+func (d *Downloader) handleHolepunch(p *PeerConn, payload []byte) error {
+	m, err := ParseHolepunchMessage(payload)
+	if err != nil {
+		return err
+	}
+	switch m.Type {
+	case HolepunchRendezvous:
+		d.rendezvous(p, m.Addr)
+	case HolepunchConnect:
+		d.holepunchConnect(m.Addr)
+	case HolepunchErr:
+		log.Printf("peer %s: rendezvous with %s: %s", p.Addr, m.Addr, m.Err)
+	}
+	return nil
+}
+
+// rendezvous introduces p to target, if it's a connected peer that supports holepunching, or tells p why not.
+func (d *Downloader) rendezvous(p *PeerConn, target netip.AddrPort) {
+	send := func(to *PeerConn, m HolepunchMessage) {
+		if payload, err := m.MarshalBinary(); err == nil {
+			to.SendExtended(HolepunchExtension, payload) // Fails only if the peer is gone
+		}
 	}
-	data, err := io.ReadAll(r.Body)
+	fail := func(code HolepunchError) {
+		send(p, HolepunchMessage{Type: HolepunchErr, Addr: target, Err: code})
+	}
+	if target.Addr().IsUnspecified() || target.Port() == 0 {
+		fail(HolepunchNoSuchPeer)
+		return
+	}
+	if d.isOurAddr(p, target) {
+		fail(HolepunchNoSelf)
+		return
+	}
+	var q *PeerConn
+	d.mu.Lock()
+	for _, c := range d.peers {
+		if c != p && (c.Addr == target || pexAddr(c) == target) {
+			q = c
+			break
+		}
+	}
+	d.mu.Unlock()
+	if q == nil {
+		fail(HolepunchNotConnected)
+		return
+	}
+	if h, ok := q.PeerExtensions(); !ok || h.M[HolepunchExtension] == 0 {
+		fail(HolepunchNoSupport)
+		return
+	}
+	send(p, HolepunchMessage{Type: HolepunchConnect, Addr: pexAddr(q)})
+	send(q, HolepunchMessage{Type: HolepunchConnect, Addr: pexAddr(p)})
+}
+
+// isOurAddr reports whether addr is our listen address, as we know it or as p sees it.
+func (d *Downloader) isOurAddr(p *PeerConn, addr netip.AddrPort) bool {
+	if int(addr.Port()) != d.LocalPort {
+		return false
+	}
+	ours := []netip.Addr{d.ExternalIP(), d.IPv4, d.IPv6}
+	if h, ok := p.PeerExtensions(); ok {
+		ours = append(ours, h.YourIP)
+	}
+	if local, err := addrPortFromNet(p.conn.LocalAddr()); err == nil {
+		ours = append(ours, local.Addr())
+	}
+	for _, ip := range ours {
+		if ip.IsValid() && ip.Unmap() == addr.Addr().Unmap() {
+			return true
+		}
+	}
+	return false
+}
+
+// holepunchConnect connects to addr, which a relay has introduced us to, unless we're connected or connecting already.
+//
+// addr connects to us at the same time, so we may end up with two connections.
+// Both sides keep the one made by the peer with the lower id.
+func (d *Downloader) holepunchConnect(addr netip.AddrPort) {
+	if d.ctx == nil || addr.Addr().IsUnspecified() || addr.Port() == 0 {
+		return
+	}
+	d.mu.Lock()
+	_, connected := d.peers[addr]
+	_, punching := d.punching[addr]
+	if connected || punching {
+		d.mu.Unlock()
+		return
+	}
+	if d.punching == nil {
+		d.punching = make(map[netip.AddrPort]chan *PeerConn)
+	}
+	incoming := make(chan *PeerConn, 1)
+	d.punching[addr] = incoming
+	d.mu.Unlock()
+
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		ctx, cancel := context.WithTimeout(d.ctx, holepunchTimeout)
+		p, err := dialHolepunch(ctx, addr, d.UTP, d.listenPort(), d.Handshake(), len(d.MetaInfo.Info.Pieces), d.dialPolicy(Peer{Addr: addr}))
+		cancel()
+		d.mu.Lock()
+		delete(d.punching, addr)
+		d.mu.Unlock()
+		var in *PeerConn
+		select {
+		case in = <-incoming:
+		default:
+		}
+		switch {
+		case p == nil && in == nil:
+			log.Printf("peer %s: %s", addr, err)
+			return
+		case p == nil:
+			p = in
+		case in != nil:
+			if d.keepIncoming(in) {
+				p.Close()
+				p = in
+			} else {
+				in.Close()
+			}
+		}
+		d.Candidates.MarkInUse(Peer{Peer: string(p.Remote.PeerID[:]), Addr: p.Addr})
+		if err := d.runPeer(d.ctx, p); err != nil && d.ctx.Err() == nil {
+			log.Printf("peer %s: %s", p.Addr, err)
+		}
+	}()
+}
+
+// HandleIncoming exchanges handshakes with a peer that connected to us, then exchanges blocks with it until the connection ends.
+// Connections from peers we're holepunching are paired up with ours, see holepunchConnect. conn is closed when done.
+func (d *Downloader) HandleIncoming(ctx context.Context, conn net.Conn) error {
+	// Give up on the handshake if ctx is cancelled
+	handshook := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-handshook:
+		}
+	}()
+	p, err := AcceptPeer(conn, d.Handshake(), len(d.MetaInfo.Info.Pieces), d.Encryption)
+	close(handshook)
 	if err != nil {
-		return nil, fmt.Errorf("GET %s: reading body: %w", u, err)
+		conn.Close()
+		return err
+	}
+	d.mu.Lock()
+	if incoming, ok := d.punching[p.Addr]; ok {
+		select {
+		case incoming <- p:
+			d.mu.Unlock()
+			return nil
+		default:
+		}
+	}
+	existing := d.peers[p.Addr]
+	d.mu.Unlock()
+	// Our holepunched connection to the peer beat this one
+	if existing != nil && existing.Remote.PeerID == p.Remote.PeerID {
+		if !d.keepIncoming(p) {
+			p.Close()
+			return nil
+		}
+		existing.Close()
+	}
+	d.Candidates.MarkInUse(Peer{Peer: string(p.Remote.PeerID[:]), Addr: p.Addr})
+	err = d.runPeer(ctx, p)
+	// The connection came from an ephemeral port, but peers that told us their listen port can be dialed later
+	if listen := pexAddr(p); listen != p.Addr {
+		d.Candidates.Add(SourceIncoming, Peer{Peer: string(p.Remote.PeerID[:]), Addr: listen})
+	}
+	return err
+}
+
+// keepIncoming decides between p, an incoming connection, and ours to the same peer: the one made by the peer with the lower id is kept.
+func (d *Downloader) keepIncoming(p *PeerConn) bool {
+	return bytes.Compare(p.Remote.PeerID[:], d.PeerId[:]) < 0
+}
+
+// runPeer starts p and exchanges blocks with it until its connection ends, then releases it to Candidates.
+// p should be in use in Candidates, from Next or MarkInUse.
+// Connections that end without exchanging any blocks count as failures, so peers that accept us and hang up are eventually forgotten.
+func (d *Downloader) runPeer(ctx context.Context, p *PeerConn) error {
+	p.Start(ctx)
+	defer func() {
+		d.peerReleased(p.Addr, p.Downloaded() == 0 && p.Uploaded() == 0)
+	}()
+	return d.handlePeer(p)
+}
+
+// We dial candidates until this many are in use, counting incoming connections
+const maxPeerConns = 50
+
+// How often runConnector checks Candidates for peers to dial
+const connectInterval = time.Second
+
+// runConnector dials peers from Candidates until ctx is cancelled, keeping up to maxPeerConns in use.
+func (d *Downloader) runConnector(ctx context.Context) {
+	ticker := time.NewTicker(connectInterval)
+	defer ticker.Stop()
+	for {
+		for d.Candidates.InUse() < maxPeerConns {
+			peer, ok := d.Candidates.Next()
+			if !ok {
+				break
+			}
+			d.wg.Add(1)
+			go func() {
+				defer d.wg.Done()
+				d.connectPeer(ctx, peer)
+			}()
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// connectPeer dials peer, a candidate handed out by Candidates.Next, and exchanges blocks with it until the connection ends.
+// Failed dials and handshakes count against the candidate.
+func (d *Downloader) connectPeer(ctx context.Context, peer Peer) {
+	dialCtx, cancel := context.WithTimeout(ctx, peerHandshakeTimeout)
+	p, err := DialPeer(dialCtx, peer.Addr, d.Handshake(), len(d.MetaInfo.Info.Pieces), d.dialPolicy(peer))
+	cancel()
+	if err != nil {
+		d.peerReleased(peer.Addr, ctx.Err() == nil)
+		return
+	}
+	if err := d.runPeer(ctx, p); err != nil && ctx.Err() == nil {
+		log.Printf("peer %s: %s", p.Addr, err)
+	}
+}
+
+// dialPolicy is the encryption policy for dialing peer.
+// With EncryptionEnabled, that's plaintext unless the peer told a tracker or PEX that it prefers encryption.
+func (d *Downloader) dialPolicy(peer Peer) EncryptionPolicy {
+	if d.Encryption == EncryptionEnabled && peer.Crypto {
+		return EncryptionPreferred
+	}
+	return d.Encryption
+}
+
+// runDHT looks up peers on the DHT and announces us every DefaultDHTAnnounceInterval,
+// after bootstrapping from the metainfo's nodes if it has any.
+func (d *Downloader) runDHT(ctx context.Context) {
+	if len(d.MetaInfo.Nodes) > 0 {
+		if err := d.DHT.Bootstrap(ctx, d.MetaInfo.Nodes...); err != nil {
+			log.Printf("dht: %s", err)
+		}
+	}
+	ticker := time.NewTicker(DefaultDHTAnnounceInterval)
+	defer ticker.Stop()
+	for {
+		peers, err := d.DHT.Announce(ctx, d.MetaInfo.InfoShaSum, d.LocalPort)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("dht: %s", err)
+		}
+		found := make([]Peer, len(peers))
+		for i, addr := range peers {
+			found[i] = Peer{Addr: addr}
+		}
+		d.Candidates.Add(SourceDHT, found...)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// runLSD announces us on the local network until ctx is cancelled, adding the peers that announce this torrent to Candidates.
+func (d *Downloader) runLSD(ctx context.Context) {
+	remove := d.LSD.Add(d.MetaInfo.InfoShaSum, d.LocalPort, func(p Peer) {
+		d.Candidates.Add(SourceLSD, p)
+	})
+	defer remove()
+	<-ctx.Done()
+}
+
+// isComplete reports whether every piece is present. Must hold d.mu.
+func (d *Downloader) isComplete() bool {
+	_, done := d.pieces.NextFalse()
+	return done
+}
+
+// peerReleased returns a candidate to the pool when its connection ends or its dial fails,
+// asking the tracker for more peers if we're running low.
+func (d *Downloader) peerReleased(addr netip.AddrPort, failed bool) {
+	if d.Candidates.Release(addr, failed) < d.MinPeers && d.announcer != nil {
+		d.announcer.NeedPeers()
 	}
-	return ParseTrackerResponse(data)
 }
 
 // If needed, creates directories required for download based on environment variable.
@@ -144,11 +1090,7 @@ func (d *Downloader) Listen() error {
 	var err error
 	for port := 6881; port < 6890; port++ {
 		// Try to listen on port
-		listener, err = net.ListenTCP("tcp", &net.TCPAddr{
-			IP:   nil,
-			Port: port,
-			Zone: "", //TODO support IPv6
-		})
+		listener, err = listenTCP(port)
 		if err == nil {
 			log.Printf("listening on port %d", port)
 			d.listener = listener
@@ -161,11 +1103,7 @@ func (d *Downloader) Listen() error {
 
 // ListenPort attempts to listen specifically on a given port
 func (d *Downloader) ListenPort(port int) error {
-	listener, err := net.ListenTCP("tcp", &net.TCPAddr{
-		IP:   nil,
-		Port: port,
-		Zone: "", //TODO support IPv6
-	})
+	listener, err := listenTCP(port)
 	if err != nil {
 		return fmt.Errorf("couldn't listen on port %d: %w", port, err)
 	}
@@ -175,7 +1113,56 @@ func (d *Downloader) ListenPort(port int) error {
 	return nil
 }
 
-// Close underlying TCPListener
+// listenTCP listens on all interfaces for both IPv4 and IPv6 connections.
+//
+// With no IP given, the "tcp" network binds the IPv6 wildcard address with IPV6_V6ONLY disabled,
+// so IPv4 peers arrive as IPv4-mapped addresses. On IPv4-only hosts, it falls back to 0.0.0.0.
+// The port can be shared with holepunch dials, see dialHolepunch.
+func listenTCP(port int) (*net.TCPListener, error) {
+	lc := net.ListenConfig{Control: reusePort}
+	l, err := lc.Listen(context.Background(), "tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, err
+	}
+	return l.(*net.TCPListener), nil
+}
+
+// listenPort is the port our TCP listener is bound to, or 0 if we aren't listening.
+func (d *Downloader) listenPort() int {
+	if d.listener == nil {
+		return 0
+	}
+	return d.listener.Addr().(*net.TCPAddr).Port
+}
+
+// Close stops announcing, telling the tracker we've stopped, and closes the underlying TCPListener.
 func (d *Downloader) Close() {
-	d.listener.Close()
+	// Closed first, to stop acceptPeers
+	if d.listener != nil {
+		d.listener.Close()
+	}
+	if d.cancel != nil {
+		d.cancel()
+		d.wg.Wait()
+	}
+}
+
+// acceptPeers runs each connection to our listener through HandleIncoming, until the listener is closed.
+func (d *Downloader) acceptPeers(ctx context.Context) {
+	for {
+		conn, err := d.listener.Accept()
+		if err != nil {
+			if ctx.Err() == nil && !errors.Is(err, net.ErrClosed) {
+				log.Printf("accepting peers: %s", err)
+			}
+			return
+		}
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+			if err := d.HandleIncoming(ctx, conn); err != nil && ctx.Err() == nil {
+				log.Printf("peer %s: %s", conn.RemoteAddr(), err)
+			}
+		}()
+	}
 }
@@ -0,0 +1,818 @@
+package bt
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMakeTrackerQueryAddresses(t *testing.T) {
+	d := &Downloader{
+		IPv4: netip.MustParseAddr("203.0.113.7"),
+		IPv6: netip.MustParseAddr("2001:db8::7"),
+	}
+	q, err := d.MakeTrackerQuery()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	v, err := url.ParseQuery(q)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got := v.Get("ipv4"); got != "203.0.113.7" {
+		t.Fatalf("want ipv4=203.0.113.7, got %q", got)
+	}
+	if got := v.Get("ipv6"); got != "2001:db8::7" {
+		t.Fatalf("want ipv6=2001:db8::7, got %q", got)
+	}
+
+	// Unknown addresses are omitted
+	q, _ = (&Downloader{}).MakeTrackerQuery()
+	v, _ = url.ParseQuery(q)
+	if v.Has("ipv4") || v.Has("ipv6") {
+		t.Fatalf("expected no address params, got %s", q)
+	}
+}
+
+func TestListenDualStack(t *testing.T) {
+	d := &Downloader{}
+	if err := d.ListenPort(0); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer d.Close()
+	port := d.listener.Addr().(*net.TCPAddr).Port
+	for _, host := range []string{"127.0.0.1", "::1"} {
+		conn, err := net.Dial("tcp", net.JoinHostPort(host, fmt.Sprint(port)))
+		if err != nil {
+			if host == "::1" {
+				t.Logf("skipping IPv6 loopback: %s", err)
+				continue
+			}
+			t.Fatalf("dialing %s: %s", host, err)
+		}
+		conn.Close()
+		accepted, err := d.listener.Accept()
+		if err != nil {
+			t.Fatalf("accepting from %s: %s", host, err)
+		}
+		accepted.Close()
+	}
+}
+
+func TestDownloaderMarkPieceCompletes(t *testing.T) {
+	length := 25
+	pieces, _ := NewEmptyBitfield(3)
+	d := &Downloader{
+		MetaInfo: MetaInfo{Info: Info{PieceLength: 10, Length: &length, Pieces: make([][]byte, 3)}},
+		pieces:   pieces,
+	}
+	d.left.Store(int64(length))
+	a, _, announces := newTestAnnouncer(t, d)
+	d.announcer = a
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go a.Run(ctx)
+	expectAnnounce(t, announces, EventStarted, time.Second)
+
+	for _, i := range []int{2, 0, 0} {
+		if err := d.markPiece(i); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	if _, _, left := d.Stats(); left != 10 {
+		t.Fatalf("want 10 bytes left, got %d", left)
+	}
+	d.markPiece(1)
+	if got := expectAnnounce(t, announces, EventCompleted, time.Second); got.Left != 0 {
+		t.Fatalf("want left=0 in completed announce, got %d", got.Left)
+	}
+}
+
+func TestDownloaderStartComplete(t *testing.T) {
+	store := &recordingStore{NewMemoryPeerStore(), make(chan recordedAnnounce, 100)}
+	srv := httptest.NewServer(NewTrackerServer(store))
+	defer srv.Close()
+	info, _ := testTorrent(t, BlockSize, 2*BlockSize)
+	pieces, _ := NewBitfield([]byte{0b11000000}, 2)
+	d := &Downloader{MetaInfo: MetaInfo{Announce: srv.URL + "/announce", Info: *info}, LocalPort: 6881, pieces: pieces, Choker: NewChoker()}
+	d.Start(context.Background())
+	defer d.Close()
+
+	// Seeding what we had before starting isn't completing a download
+	if got := expectAnnounce(t, store.announces, EventStarted, time.Second); got.Left != 0 {
+		t.Fatalf("want left=0 in started announce, got %d", got.Left)
+	}
+	select {
+	case got := <-store.announces:
+		t.Fatalf("want no more announces, got %s", eventName(got.Event))
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestDownloaderAcceptsPeers(t *testing.T) {
+	srv := httptest.NewServer(NewTrackerServer(NewMemoryPeerStore()))
+	defer srv.Close()
+	info, _ := testTorrent(t, BlockSize, 2*BlockSize)
+	pieces, _ := NewBitfield([]byte{0b11000000}, 2)
+	d := &Downloader{MetaInfo: MetaInfo{Announce: srv.URL + "/announce", Info: *info}, pieces: pieces, Choker: NewChoker(), Extensions: NewExtensionRegistry()}
+	d.assembler = NewPieceAssembler(&d.MetaInfo.Info, pieces, d.storePiece)
+	if err := d.ListenPort(0); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	addr := netip.MustParseAddrPort(d.listener.Addr().String())
+	addr = netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), addr.Port())
+	d.LocalPort = int(addr.Port())
+	d.Start(context.Background())
+
+	// A peer that never sends its handshake doesn't hold up Close
+	stalled, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer stalled.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	h := d.Handshake()
+	h.PeerID = [20]byte{1}
+	p, err := DialPeer(ctx, addr, h, 2, EncryptionDisabled)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	p.Start(ctx)
+	defer p.Close()
+	expectEvent(t, p, Extended)
+	expectEvent(t, p, HaveAll)
+
+	start := time.Now()
+	d.Close()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Close took %s", elapsed)
+	}
+}
+
+func TestPeerPool(t *testing.T) {
+	p := NewPeerPool()
+	a := Peer{Addr: netip.MustParseAddrPort("1.1.1.1:1")}
+	b := Peer{Addr: netip.MustParseAddrPort("[::ffff:2.2.2.2]:2")}
+	if n := p.Add(SourceTracker, a, b, a); n != 2 {
+		t.Fatalf("want 2 new peers, got %d", n)
+	}
+	got, _ := p.Next()
+	if got.Addr != a.Addr {
+		t.Fatalf("want %s first, got %s", a.Addr, got.Addr)
+	}
+	got, _ = p.Next()
+	if got.Addr != netip.MustParseAddrPort("2.2.2.2:2") {
+		t.Fatalf("want unmapped 2.2.2.2:2, got %s", got.Addr)
+	}
+	if _, ok := p.Next(); ok {
+		t.Fatal("expected no candidates while both are in use")
+	}
+	// Failing maxPeerFailures times forgets a candidate
+	for i := 0; i < maxPeerFailures; i++ {
+		if n := p.Release(a.Addr, true); n != 1 {
+			t.Fatalf("want 1 in use, got %d", n)
+		}
+		if i < maxPeerFailures-1 {
+			p.Next()
+		}
+	}
+	if p.Len() != 1 {
+		t.Fatalf("want failed peer forgotten, got %d known", p.Len())
+	}
+
+	// Incoming connections aren't queued for dialing, unless we knew the address already
+	in := Peer{Addr: netip.MustParseAddrPort("3.3.3.3:50123")}
+	p.MarkInUse(in)
+	p.MarkInUse(b)
+	if n := p.Release(in.Addr, false); n != 1 {
+		t.Fatalf("want 1 in use, got %d", n)
+	}
+	p.Release(b.Addr, false)
+	if got, ok := p.Next(); !ok || got.Addr != netip.MustParseAddrPort("2.2.2.2:2") {
+		t.Fatalf("want known peer requeued, got %+v (%t)", got, ok)
+	}
+	if p.Len() != 1 {
+		t.Fatalf("want incoming address forgotten, got %d known", p.Len())
+	}
+
+	// Another source telling us a known peer prefers encryption is remembered
+	p = NewPeerPool()
+	p.Add(SourceTracker, a)
+	p.Add(SourcePEX, Peer{Addr: a.Addr, Crypto: true})
+	if got, _ := p.Next(); !got.Crypto {
+		t.Fatal("want peer marked as preferring encryption")
+	}
+}
+
+// memStorage keeps pieces in memory
+type memStorage struct {
+	mu     sync.Mutex
+	pieces map[int][]byte
+}
+
+func (s *memStorage) WritePiece(index int, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pieces[index] = append([]byte{}, data...)
+	return nil
+}
+
+func (s *memStorage) ReadBlock(index, begin int, buf []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	copy(buf, s.pieces[index][begin:])
+	return nil
+}
+
+// seed serves the torrent's content to whoever is on the other end of p.
+func seed(p *PeerConn, have *BField, info *Info, data []byte) {
+	p.Send(NewBitfieldMessage(have))
+	for m := range p.Events() {
+		switch m.Type {
+		case Interested:
+			p.SetChoking(false)
+		case Request:
+			r, _ := m.BlockRequest()
+			p.Send(NewPiece(r.Index, r.Begin, serve(info, data, r)))
+		}
+	}
+}
+
+func TestDownloaderNeedPeers(t *testing.T) {
+	info, _ := testTorrent(t, BlockSize, 4*BlockSize)
+	d := &Downloader{MetaInfo: MetaInfo{Info: *info}, Candidates: NewPeerPool(), MinPeers: 2}
+	a, _, announces := newTestAnnouncer(t, d)
+	a.MinInterval = 10 * time.Millisecond
+	d.announcer = a
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go a.Run(ctx)
+	expectAnnounce(t, announces, EventStarted, time.Second)
+
+	// Nothing listens on closed, so dialing it fails
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	closed := netip.MustParseAddrPort(l.Addr().String())
+	l.Close()
+	d.Candidates.MarkInUse(Peer{Addr: netip.MustParseAddrPort("192.0.2.1:6881")})
+	d.Candidates.MarkInUse(Peer{Addr: netip.MustParseAddrPort("192.0.2.2:6881")})
+	d.Candidates.Add(SourceTracker, Peer{Addr: closed})
+	go d.runConnector(ctx)
+	// With two peers in use, the failed dial doesn't need more
+	select {
+	case got := <-announces:
+		t.Fatalf("want no announce at %d peers, got %q", d.Candidates.InUse(), got.Event)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Dropping below MinPeers does
+	d.peerReleased(netip.MustParseAddrPort("192.0.2.1:6881"), false)
+	expectAnnounce(t, announces, EventNone, time.Second)
+	if n := d.Candidates.InUse(); n != 1 {
+		t.Fatalf("want 1 peer in use, got %d", n)
+	}
+}
+
+func TestDownloaderForgetsPeersThatHangUp(t *testing.T) {
+	info, _ := testTorrent(t, BlockSize, 4*BlockSize)
+	pieces, _ := NewEmptyBitfield(4)
+	d := &Downloader{MetaInfo: MetaInfo{Info: *info}, pieces: pieces, Candidates: NewPeerPool(), Extensions: NewExtensionRegistry()}
+	d.assembler = NewPieceAssembler(&d.MetaInfo.Info, pieces, d.storePiece)
+	// The peer completes the handshake, then hangs up without sending anything
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			AcceptPeer(conn, d.Handshake(), 4, EncryptionDisabled)
+			conn.Close()
+		}
+	}()
+	d.Candidates.Add(SourceTracker, Peer{Addr: netip.MustParseAddrPort(l.Addr().String())})
+	for i := 0; i < maxPeerFailures; i++ {
+		peer, ok := d.Candidates.Next()
+		if !ok {
+			t.Fatalf("peer forgotten after %d connections", i)
+		}
+		d.connectPeer(context.Background(), peer)
+	}
+	if n := d.Candidates.Len(); n != 0 {
+		t.Fatalf("want peer forgotten after %d empty connections, got %d candidates", maxPeerFailures, n)
+	}
+}
+
+func TestDownloaderEncryptsForPeersThatPreferIt(t *testing.T) {
+	info, _ := testTorrent(t, BlockSize, 4*BlockSize)
+	pieces, _ := NewEmptyBitfield(4)
+	d := &Downloader{MetaInfo: MetaInfo{Info: *info}, pieces: pieces, Candidates: NewPeerPool(), Extensions: NewExtensionRegistry(), Encryption: EncryptionEnabled}
+	d.assembler = NewPieceAssembler(&d.MetaInfo.Info, pieces, d.storePiece)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer l.Close()
+	accepted := make(chan error)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			_, err = AcceptPeer(conn, d.Handshake(), 4, EncryptionRequired)
+			conn.Close()
+			accepted <- err
+		}
+	}()
+	addr := netip.MustParseAddrPort(l.Addr().String())
+
+	go d.connectPeer(context.Background(), Peer{Addr: addr, Crypto: true})
+	if err := <-accepted; err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	// Peers that didn't ask for encryption are dialed in plaintext
+	go d.connectPeer(context.Background(), Peer{Addr: addr})
+	if err := <-accepted; !errors.Is(err, ErrEncryptionRequired) {
+		t.Fatalf("want %s, got %v", ErrEncryptionRequired, err)
+	}
+}
+
+func TestDownloaderIncomingCandidate(t *testing.T) {
+	info, _ := testTorrent(t, BlockSize, 4*BlockSize)
+	pieces, _ := NewEmptyBitfield(4)
+	d := &Downloader{MetaInfo: MetaInfo{Info: *info}, pieces: pieces, Candidates: NewPeerPool(), Extensions: NewExtensionRegistry()}
+	d.assembler = NewPieceAssembler(&d.MetaInfo.Info, pieces, d.storePiece)
+	ca, cb := newTCPConnPair(t)
+	done := make(chan error, 1)
+	go func() { done <- d.HandleIncoming(context.Background(), cb) }()
+	theirs, err := NewPeerConn(ca, d.Handshake(), 4)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	theirs.Start(context.Background())
+	h, _ := ExtendedHandshake{P: 7001}.MarshalBinary()
+	theirs.Send(NewExtended(0, h))
+	// Wait until d has the handshake
+	for {
+		d.mu.Lock()
+		p := d.peers[netip.MustParseAddrPort(ca.LocalAddr().String())]
+		d.mu.Unlock()
+		if p != nil {
+			if _, ok := p.PeerExtensions(); ok {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+	}
+	theirs.Close()
+	<-done
+
+	// Only the listen port the peer told us is kept for dialing
+	peer, ok := d.Candidates.Next()
+	if !ok || peer.Addr != netip.MustParseAddrPort("127.0.0.1:7001") {
+		t.Fatalf("want listen address as candidate, got %+v (%t)", peer, ok)
+	}
+	if n := d.Candidates.Len(); n != 1 {
+		t.Fatalf("want 1 candidate, got %d", n)
+	}
+}
+
+func TestDownloaderDownload(t *testing.T) {
+	info, data := testTorrent(t, 3*BlockSize, 20*BlockSize+1234)
+	pieces, _ := NewEmptyBitfield(len(info.Pieces))
+	storage := &memStorage{pieces: make(map[int][]byte)}
+	d := &Downloader{MetaInfo: MetaInfo{Info: *info}, Storage: storage, pieces: pieces}
+	d.left.Store(int64(len(data)))
+	d.assembler = NewPieceAssembler(&d.MetaInfo.Info, pieces, d.storePiece)
+
+	ours, theirs := newPeerConnPair(t, len(info.Pieces))
+	go seed(theirs, fullBitfield(t, len(info.Pieces)), info, data)
+	done := make(chan error, 1)
+	go func() { done <- d.handlePeer(ours) }()
+
+	deadline := time.After(5 * time.Second)
+	for {
+		if _, _, left := d.Stats(); left == 0 {
+			break
+		}
+		select {
+		case err := <-done:
+			t.Fatalf("download ended early: %v", err)
+		case <-deadline:
+			t.Fatal("download didn't finish within 5s")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	var got []byte
+	for i := range info.Pieces {
+		got = append(got, storage.pieces[i]...)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("downloaded data doesn't match")
+	}
+	if _, downloaded, _ := d.Stats(); downloaded != int64(len(data)) {
+		t.Fatalf("want %d bytes downloaded, got %d", len(data), downloaded)
+	}
+	if ours.State().AmInterested {
+		t.Fatal("want not interested after download completes")
+	}
+	ours.Close()
+	<-done
+}
+
+func TestPieceDirStorage(t *testing.T) {
+	s := &PieceDirStorage{Dir: t.TempDir()}
+	if err := s.WritePiece(3, []byte("hello world")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	buf := make([]byte, 5)
+	if err := s.ReadBlock(3, 6, buf); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(buf) != "world" {
+		t.Fatalf("want world, got %q", buf)
+	}
+	if err := s.ReadBlock(3, 8, buf); err == nil {
+		t.Fatal("wanted error reading past end of piece, got nil")
+	}
+	if err := s.ReadBlock(4, 0, buf); err == nil {
+		t.Fatal("wanted error for missing piece, got nil")
+	}
+}
+
+// gatedStorage blocks reads until released
+type gatedStorage struct {
+	Storage
+	gate chan struct{}
+}
+
+func (s *gatedStorage) ReadBlock(index, begin int, buf []byte) error {
+	<-s.gate
+	return s.Storage.ReadBlock(index, begin, buf)
+}
+
+// newTestSeeder returns a Downloader with every piece of info, serving its peer side of a connection pair.
+func newTestSeeder(t *testing.T, info *Info, data []byte, storage Storage) (d *Downloader, seeder, leecher *PeerConn, done <-chan error) {
+	t.Helper()
+	have := fullBitfield(t, len(info.Pieces))
+	d = &Downloader{MetaInfo: MetaInfo{Info: *info}, Storage: storage, pieces: have}
+	d.assembler = NewPieceAssembler(&d.MetaInfo.Info, have, d.storePiece)
+	leecher, seeder = newPeerConnPair(t, len(info.Pieces))
+	errs := make(chan error, 1)
+	go func() { errs <- d.handlePeer(seeder) }()
+	// handlePeer announces our pieces
+	expectEvent(t, leecher, Bitfield)
+	seeder.SetChoking(false)
+	expectEvent(t, leecher, Unchoke)
+	return d, seeder, leecher, errs
+}
+
+func TestDownloaderServeRequests(t *testing.T) {
+	info, data := testTorrent(t, 2*BlockSize, 3*BlockSize)
+	mem := &memStorage{pieces: map[int][]byte{0: data[:2*BlockSize], 1: data[2*BlockSize:]}}
+	gated := &gatedStorage{Storage: mem, gate: make(chan struct{})}
+	d, seeder, leecher, _ := newTestSeeder(t, info, data, gated)
+
+	// The first read blocks, so the other two requests stay queued
+	leecher.Send(NewRequest(0, 0, BlockSize))
+	leecher.Send(NewRequest(0, BlockSize, BlockSize))
+	leecher.Send(NewRequest(1, 0, BlockSize))
+	leecher.Send(NewCancel(0, BlockSize, BlockSize))
+	// Wait until the seeder has handled the Cancel
+	for !seeder.Requested(BlockRequest{1, 0, BlockSize}) || seeder.Requested(BlockRequest{0, BlockSize, BlockSize}) {
+		time.Sleep(time.Millisecond)
+	}
+	close(gated.gate)
+
+	for _, want := range []BlockRequest{{0, 0, BlockSize}, {1, 0, BlockSize}} {
+		m := expectEvent(t, leecher, Piece)
+		index, begin, block, _ := m.BlockPayload()
+		if index != want.Index || begin != want.Begin {
+			t.Fatalf("want block %d at %d, got %d at %d", want.Index, want.Begin, index, begin)
+		}
+		if !bytes.Equal(block, serve(info, data, want)) {
+			t.Fatalf("block %d at %d: wrong data", index, begin)
+		}
+	}
+	if uploaded, _, _ := d.Stats(); uploaded != 2*BlockSize {
+		t.Fatalf("want %d bytes uploaded, got %d", 2*BlockSize, uploaded)
+	}
+}
+
+func TestDownloaderRejectsBadRequests(t *testing.T) {
+	info, data := testTorrent(t, 2*BlockSize, 3*BlockSize)
+	cases := []struct {
+		Name    string
+		Request *Message
+	}{
+		{Name: "piece out of range", Request: NewRequest(2, 0, BlockSize)},
+		{Name: "past end of piece", Request: NewRequest(1, 1, BlockSize)},
+		{Name: "empty", Request: NewRequest(0, 0, 0)},
+		{Name: "missing piece", Request: NewRequest(0, 0, BlockSize)},
+	}
+	for _, c := range cases {
+		c := c
+		t.Run(c.Name, func(t *testing.T) {
+			t.Parallel()
+			mem := &memStorage{pieces: map[int][]byte{0: data[:2*BlockSize], 1: data[2*BlockSize:]}}
+			d, _, leecher, done := newTestSeeder(t, info, data, mem)
+			if c.Name == "missing piece" {
+				d.mu.Lock()
+				d.pieces.Set(0, false)
+				d.mu.Unlock()
+			}
+			leecher.Send(c.Request)
+			select {
+			case err := <-done:
+				if err == nil {
+					t.Fatal("wanted error, got nil")
+				}
+			case <-time.After(time.Second):
+				t.Fatal("want peer disconnected after bad request")
+			}
+		})
+	}
+}
+
+// newTCPConnPair connects two TCP sockets over loopback, so PeerConn.Addr is set.
+func newTCPConnPair(t *testing.T) (a, b net.Conn) {
+	t.Helper()
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := l.Accept()
+		accepted <- conn
+	}()
+	a, err = net.Dial("tcp4", l.Addr().String())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	b = <-accepted
+	if b == nil {
+		t.Fatal("accept failed")
+	}
+	return a, b
+}
+
+func TestDownloaderAllowedFast(t *testing.T) {
+	info, data := testTorrent(t, BlockSize, 20*BlockSize)
+	mem := &memStorage{pieces: make(map[int][]byte)}
+	for i := range info.Pieces {
+		mem.pieces[i] = data[i*BlockSize : (i+1)*BlockSize]
+	}
+	seeder := &Downloader{MetaInfo: MetaInfo{Info: *info}, Storage: mem, pieces: fullBitfield(t, 20)}
+	seeder.assembler = NewPieceAssembler(&seeder.MetaInfo.Info, seeder.pieces, seeder.storePiece)
+	empty, _ := NewEmptyBitfield(20)
+	storage := &memStorage{pieces: make(map[int][]byte)}
+	leecher := &Downloader{MetaInfo: MetaInfo{Info: *info}, Storage: storage, pieces: empty}
+	leecher.left.Store(int64(len(data)))
+	leecher.assembler = NewPieceAssembler(&leecher.MetaInfo.Info, empty, leecher.storePiece)
+
+	ca, cb := newTCPConnPair(t)
+	ours, theirs := startPeerConnPair(t, ca, cb, 20, leecher.Handshake().Reserved, seeder.Handshake().Reserved)
+	go seeder.handlePeer(theirs)
+	go leecher.handlePeer(ours)
+
+	// The seeder never unchokes us, but lets us have its allowed fast pieces
+	allowed := AllowedFastSet(netip.MustParseAddr("127.0.0.1"), seeder.MetaInfo.InfoShaSum, 20, DefaultAllowedFast)
+	want := int64(len(data) - len(allowed)*BlockSize)
+	deadline := time.After(5 * time.Second)
+	for {
+		if _, _, left := leecher.Stats(); left == want {
+			break
+		}
+		select {
+		case <-deadline:
+			t.Fatalf("allowed fast pieces not downloaded within 5s, %d bytes left", leecher.left.Load())
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	if !ours.State().PeerChoking {
+		t.Fatal("want leecher still choked")
+	}
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	for _, i := range allowed {
+		if !bytes.Equal(storage.pieces[int(i)], data[int(i)*BlockSize:int(i+1)*BlockSize]) {
+			t.Fatalf("allowed fast piece %d missing or wrong", i)
+		}
+	}
+}
+
+func TestDownloaderExtensions(t *testing.T) {
+	info, _ := testTorrent(t, BlockSize, 4*BlockSize)
+	pieces, _ := NewEmptyBitfield(4)
+	d := &Downloader{MetaInfo: MetaInfo{Info: *info, RawInfo: []byte("d4:name4:teste")}, LocalPort: 6881, pieces: pieces, Extensions: NewExtensionRegistry()}
+	d.assembler = NewPieceAssembler(&d.MetaInfo.Info, pieces, d.storePiece)
+	got := make(chan string, 1)
+	if _, err := d.Extensions.Register("ut_test", func(p *PeerConn, payload []byte) error {
+		got <- string(payload)
+		return nil
+	}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	ours, theirs := startPipePair(t, 4, d.Handshake().Reserved, d.Handshake().Reserved)
+	go d.handlePeer(ours)
+	if _, _, err := expectEvent(t, theirs, Extended).ExtendedPayload(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	h, ok := theirs.PeerExtensions()
+	if !ok || h.M["ut_test"] != 1 || h.P != 6881 || h.Reqq != maxQueuedUploads || h.V != ClientVersion || h.MetadataSize != 14 {
+		t.Fatalf("want our extended handshake, got %+v", h)
+	}
+
+	// The peer picks its own ids, but sends ours
+	theirHandshake, _ := ExtendedHandshake{M: map[string]uint8{"ut_test": 5}}.MarshalBinary()
+	theirs.Send(NewExtended(0, theirHandshake))
+	if err := theirs.SendExtended("ut_test", []byte("hello")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	select {
+	case payload := <-got:
+		if payload != "hello" {
+			t.Fatalf("want hello, got %q", payload)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("extended message not dispatched within 1s")
+	}
+}
+
+// connectPEXPeer connects a raw PeerConn to d over loopback, advertising ut_pex and listenPort.
+// d sees the connection as over uTP, or made by d, if flags has PEXSupportsUTP or PEXReachable.
+func connectPEXPeer(t *testing.T, d *Downloader, listenPort uint16, flags byte) *PeerConn {
+	t.Helper()
+	ca, cb := newTCPConnPair(t)
+	ours, theirs := startPeerConnPair(t, ca, cb, len(d.MetaInfo.Info.Pieces), d.Handshake().Reserved, d.Handshake().Reserved)
+	ours.UTP = flags&PEXSupportsUTP != 0
+	ours.Outgoing = flags&PEXReachable != 0
+	go d.handlePeer(ours)
+	h, _ := ExtendedHandshake{M: map[string]uint8{PEXExtension: 1}, P: listenPort}.MarshalBinary()
+	theirs.Send(NewExtended(0, h))
+	expectEvent(t, theirs, Extended)
+	// Wait until d has the handshake
+	for {
+		if _, ok := ours.PeerExtensions(); ok {
+			return theirs
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// expectPEX waits for a ut_pex message on p.
+func expectPEX(t *testing.T, p *PeerConn) *PEXMessage {
+	t.Helper()
+	for {
+		m := <-p.Events()
+		if m == nil {
+			t.Fatalf("connection closed waiting for PEX: %v", p.Err())
+		}
+		if m.Type != Extended {
+			continue
+		}
+		id, payload, _ := m.ExtendedPayload()
+		if id != 1 {
+			continue
+		}
+		pex, err := ParsePEXMessage(payload)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		return pex
+	}
+}
+
+func TestDownloaderPEX(t *testing.T) {
+	info, _ := testTorrent(t, BlockSize, 4*BlockSize)
+	pieces, _ := NewEmptyBitfield(4)
+	d := &Downloader{MetaInfo: MetaInfo{Info: *info}, pieces: pieces, Candidates: NewPeerPool(), Extensions: NewExtensionRegistry()}
+	d.assembler = NewPieceAssembler(&d.MetaInfo.Info, pieces, d.storePiece)
+	if err := d.registerExtensions(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	a := connectPEXPeer(t, d, 7001, 0)
+	b := connectPEXPeer(t, d, 7002, PEXSupportsUTP|PEXReachable)
+
+	d.sendPEX()
+	got := expectPEX(t, a)
+	if len(got.Added) != 1 || got.Added[0].Addr != netip.MustParseAddrPort("127.0.0.1:7002") {
+		t.Fatalf("want b's listen address sent to a, got %+v", got)
+	}
+	if got.Added[0].Flags != PEXSupportsUTP|PEXReachable {
+		t.Fatalf("want b flagged uTP and reachable, got flags %x", got.Added[0].Flags)
+	}
+	got = expectPEX(t, b)
+	if len(got.Added) != 1 || got.Added[0].Addr.Port() != 7001 {
+		t.Fatalf("want a's listen address sent to b, got %+v", got)
+	}
+	if got.Added[0].Flags != 0 {
+		t.Fatalf("want no flags for a, got %x", got.Added[0].Flags)
+	}
+
+	b.Close()
+	for {
+		d.mu.Lock()
+		n := len(d.peers)
+		d.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	d.sendPEX()
+	if got := expectPEX(t, a); len(got.Added) != 0 || len(got.Dropped) != 1 || got.Dropped[0].Port() != 7002 {
+		t.Fatalf("want b dropped, got %+v", got)
+	}
+
+	// Peers we hear of become candidates
+	payload, _ := PEXMessage{Added: []PEXPeer{{Addr: netip.MustParseAddrPort("192.0.2.1:6881"), Flags: PEXPrefersEncryption}}}.MarshalBinary()
+	a.SendExtended(PEXExtension, payload)
+	for d.Candidates.Len() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if peer, ok := d.Candidates.Next(); !ok || peer.Addr != netip.MustParseAddrPort("192.0.2.1:6881") || !peer.Crypto {
+		t.Fatalf("want PEX peer as candidate, got %+v (%t)", peer, ok)
+	}
+}
+
+func TestDownloaderPrivateDisablesPEX(t *testing.T) {
+	info, _ := testTorrent(t, BlockSize, 4*BlockSize)
+	info.Private = 1
+	d := &Downloader{MetaInfo: MetaInfo{Info: *info}, Extensions: NewExtensionRegistry()}
+	if err := d.registerExtensions(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if h := d.Extensions.Handshake(); len(h.M) != 0 {
+		t.Fatalf("want no extensions for a private torrent, got %v", h.M)
+	}
+}
+
+func TestDownloaderDHTPort(t *testing.T) {
+	info, _ := testTorrent(t, BlockSize, 4*BlockSize)
+	pieces, _ := NewEmptyBitfield(4)
+	d := &Downloader{MetaInfo: MetaInfo{Info: *info}, pieces: pieces, DHT: newTestDHT(t)}
+	d.assembler = NewPieceAssembler(&d.MetaInfo.Info, pieces, d.storePiece)
+	if !d.Handshake().Reserved.Has(DHTBit) {
+		t.Fatal("want DHT bit set")
+	}
+
+	ca, cb := newTCPConnPair(t)
+	ours, theirs := startPeerConnPair(t, ca, cb, 4, d.Handshake().Reserved, d.Handshake().Reserved)
+	go d.handlePeer(ours)
+	var port uint16
+	var err error
+	for m := range theirs.Events() {
+		if m.Type == Port {
+			port, err = m.PortNumber()
+			break
+		}
+	}
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if port != d.DHT.Addr().Port() {
+		t.Fatalf("want port %d, got %d", d.DHT.Addr().Port(), port)
+	}
+
+	// The peer's DHT node is pinged and added to our routing table
+	other := newTestDHT(t)
+	theirs.Send(NewPort(other.Addr().Port()))
+	deadline := time.After(5 * time.Second)
+	for {
+		if nodes := d.DHT.Nodes(); len(nodes) == 1 && nodes[0].ID == other.ID {
+			break
+		}
+		select {
+		case <-deadline:
+			t.Fatalf("peer's DHT node not added within 5s, got %v", d.DHT.Nodes())
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	// Private torrents don't use the DHT
+	d.MetaInfo.Info.Private = 1
+	if d.Handshake().Reserved.Has(DHTBit) {
+		t.Fatal("want DHT bit unset for a private torrent")
+	}
+}
@@ -0,0 +1,199 @@
+package bt
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"sync"
+)
+
+// ErrExtensionUnsupported is returned when sending an extended message the peer hasn't advertised.
+var ErrExtensionUnsupported = errors.New("extension not supported by peer")
+
+// ExtendedHandshake is the payload of extended message 0,
+// sent after the handshake by peers that set ExtensionProtocolBit. See BEP 10.
+//
+// Every field is optional. A peer may send it again later to update any of them.
+type ExtendedHandshake struct {
+	// Extension names mapped to the ids the sender wants them sent as. An id of 0 disables an extension.
+	M map[string]uint8
+	// Client name and version
+	V string
+	// The sender's listen port
+	P uint16
+	// How many outstanding requests the sender will queue
+	Reqq int
+	// The receiver's address, as seen by the sender
+	YourIP netip.Addr
+	// Size of the info dictionary, for fetching metadata (BEP 9)
+	MetadataSize int
+}
+
+// MarshalBinary bencodes h. Zero fields are left out, except m.
+func (h ExtendedHandshake) MarshalBinary() ([]byte, error) {
+	m := make(map[string]any, len(h.M))
+	for name, id := range h.M {
+		m[name] = int(id)
+	}
+	d := map[string]any{"m": m}
+	if h.V != "" {
+		d["v"] = h.V
+	}
+	if h.P != 0 {
+		d["p"] = h.P
+	}
+	if h.Reqq != 0 {
+		d["reqq"] = h.Reqq
+	}
+	if h.YourIP.IsValid() {
+		d["yourip"] = h.YourIP.Unmap().AsSlice()
+	}
+	if h.MetadataSize != 0 {
+		d["metadata_size"] = h.MetadataSize
+	}
+	return Encode(d)
+}
+
+// ParseExtendedHandshake parses the payload of extended message 0.
+// Unknown keys are ignored, as is a yourip that isn't 4 or 16 bytes.
+func ParseExtendedHandshake(bs []byte) (*ExtendedHandshake, error) {
+	d, err := ParseDictOnly(bs)
+	if err != nil {
+		return nil, fmt.Errorf("extended handshake: %w", err)
+	}
+	h := &ExtendedHandshake{M: make(map[string]uint8)}
+	if v, ok := d["m"]; ok {
+		m, isDict := v.(map[string]any)
+		if !isDict {
+			return nil, fmt.Errorf("extended handshake: expected dictionary for key \"m\", got %T", v)
+		}
+		for name := range m {
+			id, _, err := dictInt(m, name)
+			if err != nil {
+				return nil, fmt.Errorf("extended handshake: %w", err)
+			}
+			if id < 0 || id > 255 {
+				return nil, fmt.Errorf("extended handshake: id %d for %s out of range", id, name)
+			}
+			h.M[name] = uint8(id)
+		}
+	}
+	if h.V, _, err = dictString(d, "v"); err != nil {
+		return nil, fmt.Errorf("extended handshake: %w", err)
+	}
+	port, _, err := dictInt(d, "p")
+	if err != nil {
+		return nil, fmt.Errorf("extended handshake: %w", err)
+	}
+	if port < 0 || port > 65535 {
+		return nil, fmt.Errorf("extended handshake: port %d out of range", port)
+	}
+	h.P = uint16(port)
+	if h.Reqq, _, err = dictInt(d, "reqq"); err != nil {
+		return nil, fmt.Errorf("extended handshake: %w", err)
+	}
+	if h.MetadataSize, _, err = dictInt(d, "metadata_size"); err != nil {
+		return nil, fmt.Errorf("extended handshake: %w", err)
+	}
+	yourIP, _, err := dictString(d, "yourip")
+	if err != nil {
+		return nil, fmt.Errorf("extended handshake: %w", err)
+	}
+	if ip, ok := netip.AddrFromSlice([]byte(yourIP)); ok {
+		h.YourIP = ip.Unmap()
+	}
+	return h, nil
+}
+
+// update applies a later handshake from the same peer: ids of 0 disable extensions, and other fields are replaced if set.
+func (h *ExtendedHandshake) update(later *ExtendedHandshake) {
+	for name, id := range later.M {
+		if id == 0 {
+			delete(h.M, name)
+		} else {
+			h.M[name] = id
+		}
+	}
+	if later.V != "" {
+		h.V = later.V
+	}
+	if later.P != 0 {
+		h.P = later.P
+	}
+	if later.Reqq != 0 {
+		h.Reqq = later.Reqq
+	}
+	if later.YourIP.IsValid() {
+		h.YourIP = later.YourIP
+	}
+	if later.MetadataSize != 0 {
+		h.MetadataSize = later.MetadataSize
+	}
+}
+
+// ExtensionHandler handles an extended message from p. payload follows the extended message id.
+// Errors disconnect the peer.
+type ExtensionHandler func(p *PeerConn, payload []byte) error
+
+// ExtensionRegistry holds the extensions we support, such as ut_pex, and the ids peers should send them to us as.
+//
+// Ids are assigned from 1 in the order extensions are registered.
+// A nil registry has no extensions.
+type ExtensionRegistry struct {
+	mu       sync.Mutex
+	ids      map[string]uint8
+	handlers map[uint8]ExtensionHandler
+}
+
+func NewExtensionRegistry() *ExtensionRegistry {
+	return &ExtensionRegistry{
+		ids:      make(map[string]uint8),
+		handlers: make(map[uint8]ExtensionHandler),
+	}
+}
+
+// Register adds an extension, returning the id peers will send its messages to us as.
+func (r *ExtensionRegistry) Register(name string, h ExtensionHandler) (uint8, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.ids[name]; ok {
+		return 0, fmt.Errorf("extension %s already registered", name)
+	}
+	if len(r.ids) == 255 {
+		return 0, errors.New("no extension ids left")
+	}
+	id := uint8(len(r.ids) + 1)
+	r.ids[name] = id
+	r.handlers[id] = h
+	return id, nil
+}
+
+// Handshake returns an extended handshake advertising the registered extensions.
+func (r *ExtensionRegistry) Handshake() ExtendedHandshake {
+	h := ExtendedHandshake{M: make(map[string]uint8)}
+	if r == nil {
+		return h
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for name, id := range r.ids {
+		h.M[name] = id
+	}
+	return h
+}
+
+// Dispatch passes an Extended message from p to the handler registered for its id.
+// The extended handshake, handled by PeerConn, and ids we never assigned are ignored.
+func (r *ExtensionRegistry) Dispatch(p *PeerConn, m *Message) error {
+	id, payload, err := m.ExtendedPayload()
+	if err != nil || id == 0 || r == nil {
+		return err
+	}
+	r.mu.Lock()
+	h := r.handlers[id]
+	r.mu.Unlock()
+	if h == nil {
+		return nil
+	}
+	return h(p, payload)
+}
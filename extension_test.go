@@ -0,0 +1,188 @@
+package bt
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestExtendedHandshake(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		Name      string
+		Input     string
+		Want      *ExtendedHandshake
+		WantError bool
+	}{
+		{
+			Name:  "full",
+			Input: "d1:md6:ut_pexi1e11:ut_metadatai2ee1:pi6881e4:reqqi500e1:v6:bt 1.06:yourip4:\x01\x02\x03\x0413:metadata_sizei31235ee",
+			Want: &ExtendedHandshake{
+				M:            map[string]uint8{"ut_pex": 1, "ut_metadata": 2},
+				V:            "bt 1.0",
+				P:            6881,
+				Reqq:         500,
+				YourIP:       netip.MustParseAddr("1.2.3.4"),
+				MetadataSize: 31235,
+			},
+		},
+		{
+			Name:  "empty",
+			Input: "de",
+			Want:  &ExtendedHandshake{M: map[string]uint8{}},
+		},
+		{
+			Name:  "ipv6 yourip",
+			Input: "d6:yourip16:\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01e",
+			Want:  &ExtendedHandshake{M: map[string]uint8{}, YourIP: netip.MustParseAddr("2001:db8::1")},
+		},
+		{
+			Name:  "bad yourip ignored",
+			Input: "d6:yourip3:abce",
+			Want:  &ExtendedHandshake{M: map[string]uint8{}},
+		},
+		{Name: "m not a dict", Input: "d1:mi1ee", WantError: true},
+		{Name: "id out of range", Input: "d1:md6:ut_pexi256eee", WantError: true},
+		{Name: "port out of range", Input: "d1:pi70000ee", WantError: true},
+		{Name: "not a dict", Input: "le", WantError: true},
+	}
+	for _, c := range cases {
+		c := c
+		t.Run(c.Name, func(t *testing.T) {
+			t.Parallel()
+			got, err := ParseExtendedHandshake([]byte(c.Input))
+			if c.WantError {
+				if err == nil {
+					t.Fatal("wanted error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !reflect.DeepEqual(got, c.Want) {
+				t.Fatalf("want %+v, got %+v", c.Want, got)
+			}
+			// And back again
+			bs, err := got.MarshalBinary()
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			again, err := ParseExtendedHandshake(bs)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !reflect.DeepEqual(again, c.Want) {
+				t.Fatalf("want %+v after round trip, got %+v", c.Want, again)
+			}
+		})
+	}
+}
+
+func TestExtendedHandshakeUpdate(t *testing.T) {
+	t.Parallel()
+	h := &ExtendedHandshake{M: map[string]uint8{"ut_pex": 1, "ut_metadata": 2}, V: "bt 1.0", Reqq: 250}
+	h.update(&ExtendedHandshake{M: map[string]uint8{"ut_pex": 0, "lt_donthave": 7}, Reqq: 500})
+	want := &ExtendedHandshake{M: map[string]uint8{"ut_metadata": 2, "lt_donthave": 7}, V: "bt 1.0", Reqq: 500}
+	if !reflect.DeepEqual(h, want) {
+		t.Fatalf("want %+v, got %+v", want, h)
+	}
+}
+
+func TestExtensionRegistry(t *testing.T) {
+	t.Parallel()
+	r := NewExtensionRegistry()
+	got := make(chan string, 1)
+	pexID, err := r.Register("ut_pex", func(p *PeerConn, payload []byte) error {
+		got <- string(payload)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	metaID, err := r.Register("ut_metadata", func(p *PeerConn, payload []byte) error { return nil })
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if pexID != 1 || metaID != 2 {
+		t.Fatalf("want ids 1 and 2, got %d and %d", pexID, metaID)
+	}
+	if _, err := r.Register("ut_pex", nil); err == nil {
+		t.Fatal("wanted error registering twice, got nil")
+	}
+	if h := r.Handshake(); !reflect.DeepEqual(h.M, map[string]uint8{"ut_pex": 1, "ut_metadata": 2}) {
+		t.Fatalf("want both extensions advertised, got %v", h.M)
+	}
+
+	if err := r.Dispatch(nil, NewExtended(pexID, []byte("hello"))); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if payload := <-got; payload != "hello" {
+		t.Fatalf("want hello, got %q", payload)
+	}
+	// Handshakes and unassigned ids aren't dispatched
+	for _, id := range []uint8{0, 9} {
+		if err := r.Dispatch(nil, NewExtended(id, nil)); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	select {
+	case payload := <-got:
+		t.Fatalf("want nothing dispatched, got %q", payload)
+	default:
+	}
+
+	var none *ExtensionRegistry
+	if h := none.Handshake(); len(h.M) != 0 {
+		t.Fatalf("want no extensions from nil registry, got %v", h.M)
+	}
+}
+
+func TestPeerConnExtended(t *testing.T) {
+	var ext Reserved
+	ext.Set(ExtensionProtocolBit)
+	a, b := startPipePair(t, 8, ext, ext)
+	if !a.Extended || !b.Extended {
+		t.Fatal("want Extension Protocol negotiated")
+	}
+	if err := a.SendExtended("ut_pex", nil); err == nil {
+		t.Fatal("wanted error before extended handshake, got nil")
+	}
+
+	// b wants ut_pex as id 3. It's sent before the Bitfield, which is still allowed.
+	h := ExtendedHandshake{M: map[string]uint8{"ut_pex": 3}, V: "test"}
+	payload, _ := h.MarshalBinary()
+	b.Send(NewExtended(0, payload))
+	b.Send(NewBitfieldMessage(bitfieldOf(t, 8, 1)))
+	expectEvent(t, a, Extended)
+	expectEvent(t, a, Bitfield)
+	got, ok := a.PeerExtensions()
+	if !ok || got.V != "test" || got.M["ut_pex"] != 3 {
+		t.Fatalf("want peer's extended handshake, got %+v (%t)", got, ok)
+	}
+	if err := a.SendExtended("ut_pex", []byte("d5:added0:e")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	id, body, err := expectEvent(t, b, Extended).ExtendedPayload()
+	if err != nil || id != 3 || string(body) != "d5:added0:e" {
+		t.Fatalf("want ut_pex message as id 3, got %d %q (%v)", id, body, err)
+	}
+
+	// A later handshake can disable it
+	h = ExtendedHandshake{M: map[string]uint8{"ut_pex": 0}}
+	payload, _ = h.MarshalBinary()
+	b.Send(NewExtended(0, payload))
+	expectEvent(t, a, Extended)
+	if err := a.SendExtended("ut_pex", nil); err == nil {
+		t.Fatal("wanted error after extension disabled, got nil")
+	}
+
+	// Bad handshakes are protocol errors
+	b.Send(NewExtended(0, []byte("garbage")))
+	select {
+	case <-a.Done():
+	case <-time.After(time.Second):
+		t.Fatal("want connection closed after bad extended handshake")
+	}
+}
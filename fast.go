@@ -0,0 +1,41 @@
+package bt
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"net/netip"
+)
+
+// DefaultAllowedFast is the number of pieces a peer may request while choked, see BEP 6.
+const DefaultAllowedFast = 10
+
+// AllowedFastSet computes the k pieces a peer at ip may request from us while choked,
+// using BEP 6's canonical algorithm so both sides arrive at the same set.
+//
+// BEP 6 only defines the set for IPv4, so it's nil for IPv6 peers.
+func AllowedFastSet(ip netip.Addr, infoHash [20]byte, numPieces, k int) []uint32 {
+	ip = ip.Unmap()
+	if !ip.Is4() || numPieces <= 0 {
+		return nil
+	}
+	if k > numPieces {
+		k = numPieces
+	}
+	// The peer's /24, followed by the infohash
+	a := ip.As4()
+	x := append([]byte{a[0], a[1], a[2], 0}, infoHash[:]...)
+	out := make([]uint32, 0, k)
+	seen := make(map[uint32]bool, k)
+	for len(out) < k {
+		sum := sha1.Sum(x)
+		x = sum[:]
+		for i := 0; i < 5 && len(out) < k; i++ {
+			index := binary.BigEndian.Uint32(x[i*4:]) % uint32(numPieces)
+			if !seen[index] {
+				seen[index] = true
+				out = append(out, index)
+			}
+		}
+	}
+	return out
+}
@@ -0,0 +1,41 @@
+package bt
+
+import (
+	"bytes"
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+func TestAllowedFastSet(t *testing.T) {
+	t.Parallel()
+	var infoHash [20]byte
+	copy(infoHash[:], bytes.Repeat([]byte{0xaa}, 20))
+	// Test vectors from BEP 6
+	cases := []struct {
+		name string
+		ip   string
+		k    int
+		want []uint32
+	}{
+		{"seven", "80.4.4.200", 7, []uint32{1059, 431, 808, 1217, 287, 376, 1188}},
+		{"nine", "80.4.4.200", 9, []uint32{1059, 431, 808, 1217, 287, 376, 1188, 353, 508}},
+		{"same subnet", "80.4.4.1", 7, []uint32{1059, 431, 808, 1217, 287, 376, 1188}},
+		{"mapped", "::ffff:80.4.4.200", 7, []uint32{1059, 431, 808, 1217, 287, 376, 1188}},
+		{"ipv6", "2001:db8::1", 7, nil},
+	}
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+			got := AllowedFastSet(netip.MustParseAddr(c.ip), infoHash, 1313, c.k)
+			if !reflect.DeepEqual(got, c.want) {
+				t.Fatalf("want %v, got %v", c.want, got)
+			}
+		})
+	}
+	// Can't have more allowed than there are pieces
+	if got := AllowedFastSet(netip.MustParseAddr("80.4.4.200"), infoHash, 3, 10); len(got) != 3 {
+		t.Fatalf("want all 3 pieces, got %v", got)
+	}
+}
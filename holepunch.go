@@ -0,0 +1,163 @@
+package bt
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+)
+
+// HolepunchExtension is the Extension Protocol name for NAT holepunching, see BEP 55.
+//
+// A peer that can't reach another directly asks a relay connected to both to introduce them (rendezvous).
+// The relay sends each of them a connect with the other's address, and both connect at once,
+// so each one's outgoing packets open its NAT for the other's.
+const HolepunchExtension = "ut_holepunch"
+
+// Holepunch message types
+const (
+	HolepunchRendezvous byte = 0x00
+	HolepunchConnect    byte = 0x01
+	HolepunchErr        byte = 0x02
+)
+
+// HolepunchError is the error code a relay sends when it can't introduce us to a peer.
+type HolepunchError uint32
+
+const (
+	// The target address is invalid
+	HolepunchNoSuchPeer HolepunchError = 0x01
+	// The relay isn't connected to the target
+	HolepunchNotConnected HolepunchError = 0x02
+	// The target doesn't support holepunching
+	HolepunchNoSupport HolepunchError = 0x03
+	// The target is the relay
+	HolepunchNoSelf HolepunchError = 0x04
+)
+
+func (e HolepunchError) Error() string {
+	switch e {
+	case HolepunchNoSuchPeer:
+		return "holepunch: no such peer"
+	case HolepunchNotConnected:
+		return "holepunch: relay not connected to peer"
+	case HolepunchNoSupport:
+		return "holepunch: peer doesn't support holepunching"
+	case HolepunchNoSelf:
+		return "holepunch: peer is the relay"
+	}
+	return fmt.Sprintf("holepunch: error %d", uint32(e))
+}
+
+// HolepunchMessage is the payload of a ut_holepunch message:
+//
+//	msg_type (1 byte), addr_type (1 byte, 0 for IPv4 or 1 for IPv6), addr (4 or 16 bytes), port (2 bytes), err_code (4 bytes)
+//
+// Addr is the peer to meet, for a rendezvous, or to connect to. Err is only set for HolepunchErr.
+type HolepunchMessage struct {
+	Type byte
+	Addr netip.AddrPort
+	Err  HolepunchError
+}
+
+func (m HolepunchMessage) MarshalBinary() ([]byte, error) {
+	ip := m.Addr.Addr().Unmap()
+	if !ip.IsValid() {
+		return nil, errors.New("holepunch: no address")
+	}
+	b := []byte{m.Type, 0}
+	if ip.Is6() {
+		b[1] = 1
+	}
+	b = append(b, ip.AsSlice()...)
+	b = binary.BigEndian.AppendUint16(b, m.Addr.Port())
+	return binary.BigEndian.AppendUint32(b, uint32(m.Err)), nil
+}
+
+// ParseHolepunchMessage parses the payload of a ut_holepunch message.
+func ParseHolepunchMessage(b []byte) (*HolepunchMessage, error) {
+	if len(b) < 2 {
+		return nil, fmt.Errorf("holepunch: message of %d bytes too short", len(b))
+	}
+	ipLen := 4
+	switch b[1] {
+	case 0:
+	case 1:
+		ipLen = 16
+	default:
+		return nil, fmt.Errorf("holepunch: unknown address type %d", b[1])
+	}
+	if len(b) != 2+ipLen+2+4 {
+		return nil, fmt.Errorf("holepunch: want %d byte message, got %d", 2+ipLen+2+4, len(b))
+	}
+	ip, _ := netip.AddrFromSlice(b[2 : 2+ipLen])
+	return &HolepunchMessage{
+		Type: b[0],
+		Addr: netip.AddrPortFrom(ip, binary.BigEndian.Uint16(b[2+ipLen:])),
+		Err:  HolepunchError(binary.BigEndian.Uint32(b[4+ipLen:])),
+	}, nil
+}
+
+// dialHolepunch connects to addr over uTP, from s, and TCP at once, returning the first connection to complete its handshake.
+// The others are closed. s may be nil, for TCP only.
+//
+// Both are made from the port we announce, s being bound to it and port being our TCP listen port (0 for any),
+// so they meet the peer's simultaneous connections to us in the NAT mappings our packets open.
+func dialHolepunch(ctx context.Context, addr netip.AddrPort, s *UTPSocket, port int, local Handshake, numPieces int, policy EncryptionPolicy) (*PeerConn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		p   *PeerConn
+		err error
+	}
+	results := make(chan result, 2)
+	initiate := func(conn net.Conn) {
+		p, err := initiatePeerConn(conn, local, numPieces, policy)
+		if err != nil {
+			conn.Close()
+		}
+		results <- result{p, err}
+	}
+	n := 1
+	go func() {
+		dialer := net.Dialer{LocalAddr: &net.TCPAddr{Port: port}, Control: reusePort}
+		conn, err := dialer.DialContext(ctx, "tcp", addr.String())
+		if err != nil {
+			results <- result{nil, err}
+			return
+		}
+		initiate(conn)
+	}()
+	if s != nil {
+		n++
+		go func() {
+			conn, err := s.Dial(ctx, addr)
+			if err != nil {
+				results <- result{nil, err}
+				return
+			}
+			initiate(conn)
+		}()
+	}
+	var errs []error
+	for i := 0; i < n; i++ {
+		r := <-results
+		if r.err != nil {
+			errs = append(errs, r.err)
+			continue
+		}
+		// Close the slower connections once they're done
+		go func(n int) {
+			for ; n > 0; n-- {
+				if r := <-results; r.p != nil {
+					r.p.Close()
+				}
+			}
+		}(n - i - 1)
+		r.p.Outgoing = true
+		return r.p, nil
+	}
+	return nil, fmt.Errorf("holepunch to %s: %w", addr, errors.Join(errs...))
+}
@@ -0,0 +1,350 @@
+package bt
+
+import (
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHolepunchMessage(t *testing.T) {
+	t.Parallel()
+	cases := []HolepunchMessage{
+		{Type: HolepunchRendezvous, Addr: netip.MustParseAddrPort("192.0.2.1:6881")},
+		{Type: HolepunchConnect, Addr: netip.MustParseAddrPort("[2001:db8::1]:6881")},
+		{Type: HolepunchErr, Addr: netip.MustParseAddrPort("192.0.2.1:6881"), Err: HolepunchNoSupport},
+	}
+	for _, want := range cases {
+		b, err := want.MarshalBinary()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		got, err := ParseHolepunchMessage(b)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if *got != want {
+			t.Fatalf("want %+v, got %+v", want, got)
+		}
+	}
+
+	b, _ := cases[0].MarshalBinary()
+	for _, bad := range [][]byte{nil, b[:len(b)-1], append([]byte{0, 2}, b[2:]...), append(b, 0)} {
+		if _, err := ParseHolepunchMessage(bad); err == nil {
+			t.Errorf("%x: wanted error, got nil", bad)
+		}
+	}
+	if HolepunchNoSelf.Error() != "holepunch: peer is the relay" || HolepunchError(9).Error() != "holepunch: error 9" {
+		t.Fatal("unexpected error strings")
+	}
+}
+
+// connectHolepunchPeer connects a raw PeerConn to d over loopback, advertising listenPort and, if holepunch is set, ut_holepunch.
+func connectHolepunchPeer(t *testing.T, d *Downloader, listenPort uint16, holepunch bool) *PeerConn {
+	t.Helper()
+	ca, cb := newTCPConnPair(t)
+	ours, theirs := startPeerConnPair(t, ca, cb, len(d.MetaInfo.Info.Pieces), d.Handshake().Reserved, d.Handshake().Reserved)
+	go d.handlePeer(ours)
+	m := map[string]uint8{PEXExtension: 1}
+	if holepunch {
+		m[HolepunchExtension] = 2
+	}
+	h, _ := ExtendedHandshake{M: m, P: listenPort}.MarshalBinary()
+	theirs.Send(NewExtended(0, h))
+	expectEvent(t, theirs, Extended)
+	for {
+		if _, ok := ours.PeerExtensions(); ok {
+			return theirs
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// expectHolepunch waits for a ut_holepunch message on p.
+func expectHolepunch(t *testing.T, p *PeerConn) *HolepunchMessage {
+	t.Helper()
+	for {
+		m := <-p.Events()
+		if m == nil {
+			t.Fatalf("connection closed waiting for holepunch message: %v", p.Err())
+		}
+		if m.Type != Extended {
+			continue
+		}
+		id, payload, _ := m.ExtendedPayload()
+		if id != 2 {
+			continue
+		}
+		hp, err := ParseHolepunchMessage(payload)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		return hp
+	}
+}
+
+func TestDownloaderRendezvous(t *testing.T) {
+	info, _ := testTorrent(t, BlockSize, 4*BlockSize)
+	pieces, _ := NewEmptyBitfield(4)
+	d := &Downloader{MetaInfo: MetaInfo{Info: *info}, LocalPort: 6881, pieces: pieces, Candidates: NewPeerPool(), Extensions: NewExtensionRegistry()}
+	d.assembler = NewPieceAssembler(&d.MetaInfo.Info, pieces, d.storePiece)
+	if err := d.registerExtensions(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	a := connectHolepunchPeer(t, d, 7001, true)
+	b := connectHolepunchPeer(t, d, 7002, true)
+	connectHolepunchPeer(t, d, 7003, false)
+
+	rendezvous := func(target string) {
+		payload, _ := HolepunchMessage{Type: HolepunchRendezvous, Addr: netip.MustParseAddrPort(target)}.MarshalBinary()
+		if err := a.SendExtended(HolepunchExtension, payload); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	cases := []struct {
+		Target string
+		Want   HolepunchError
+	}{
+		{"127.0.0.1:0", HolepunchNoSuchPeer},
+		{"127.0.0.1:7004", HolepunchNotConnected},
+		{"127.0.0.1:7003", HolepunchNoSupport},
+		{"127.0.0.1:6881", HolepunchNoSelf},
+	}
+	for _, c := range cases {
+		rendezvous(c.Target)
+		got := expectHolepunch(t, a)
+		if got.Type != HolepunchErr || got.Err != c.Want || got.Addr != netip.MustParseAddrPort(c.Target) {
+			t.Errorf("%s: want %s, got %+v", c.Target, c.Want, got)
+		}
+	}
+
+	// Each is told to connect to the other's listen address
+	rendezvous("127.0.0.1:7002")
+	if got := expectHolepunch(t, a); got.Type != HolepunchConnect || got.Addr != netip.MustParseAddrPort("127.0.0.1:7002") {
+		t.Fatalf("want connect to b, got %+v", got)
+	}
+	if got := expectHolepunch(t, b); got.Type != HolepunchConnect || got.Addr != netip.MustParseAddrPort("127.0.0.1:7001") {
+		t.Fatalf("want connect to a, got %+v", got)
+	}
+
+	// Holepunching peers are flagged in PEX
+	d.sendPEX()
+	for _, p := range expectPEX(t, b).Added {
+		if want := p.Addr.Port() == 7001; p.Flags&PEXHolepunch != 0 != want {
+			t.Errorf("%s: want holepunch flag %t, got flags %x", p.Addr, want, p.Flags)
+		}
+	}
+}
+
+// natConn drops packets from addresses it hasn't sent to, like a NAT in front of it.
+type natConn struct {
+	net.PacketConn
+	mu     sync.Mutex
+	opened map[string]bool
+}
+
+func (c *natConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	c.opened[addr.String()] = true
+	c.mu.Unlock()
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+func (c *natConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, from, err := c.PacketConn.ReadFrom(b)
+		if err != nil {
+			return n, from, err
+		}
+		c.mu.Lock()
+		opened := c.opened[from.String()]
+		c.mu.Unlock()
+		if opened {
+			return n, from, nil
+		}
+	}
+}
+
+// newHolepunchPeer runs a downloader accepting uTP connections on loopback, behind a simulated NAT if nat is set.
+// It has no TCP listener, so TCP connections to it fail.
+func newHolepunchPeer(t *testing.T, name string, nat bool) *Downloader {
+	t.Helper()
+	info, _ := testTorrent(t, BlockSize, 4*BlockSize)
+	pieces, _ := NewEmptyBitfield(4)
+	d := &Downloader{
+		MetaInfo:   MetaInfo{Info: *info, InfoShaSum: sha1.Sum([]byte("torrent"))},
+		PeerId:     sha1.Sum([]byte(name)),
+		pieces:     pieces,
+		Candidates: NewPeerPool(),
+		Extensions: NewExtensionRegistry(),
+	}
+	d.assembler = NewPieceAssembler(&d.MetaInfo.Info, pieces, d.storePiece)
+	if err := d.registerExtensions(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	var pc net.PacketConn = conn
+	if nat {
+		pc = &natConn{PacketConn: conn, opened: make(map[string]bool)}
+	}
+	d.UTP = NewUTPSocket(pc)
+	d.LocalPort = int(netip.MustParseAddrPort(conn.LocalAddr().String()).Port())
+	ctx, cancel := context.WithCancel(context.Background())
+	d.ctx, d.cancel = ctx, cancel
+	go func() {
+		for {
+			conn, err := d.UTP.Accept()
+			if err != nil {
+				return
+			}
+			go d.HandleIncoming(ctx, conn)
+		}
+	}()
+	t.Cleanup(func() {
+		d.UTP.Close()
+		d.Close()
+	})
+	return d
+}
+
+// loopbackAddr is d's listen address on loopback.
+func loopbackAddr(d *Downloader) netip.AddrPort {
+	return netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), uint16(d.LocalPort))
+}
+
+// waitForPeer waits until d has a connection to addr, with its extended handshake.
+func waitForPeer(t *testing.T, d *Downloader, addr netip.AddrPort) *PeerConn {
+	t.Helper()
+	deadline := time.After(10 * time.Second)
+	for {
+		d.mu.Lock()
+		p := d.peers[addr]
+		d.mu.Unlock()
+		if p != nil {
+			if _, ok := p.PeerExtensions(); ok {
+				return p
+			}
+		}
+		select {
+		case <-deadline:
+			t.Fatalf("no connection to %s within 10s", addr)
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+}
+
+func TestHolepunch(t *testing.T) {
+	relay := newHolepunchPeer(t, "relay", false)
+	a := newHolepunchPeer(t, "a", true)
+	b := newHolepunchPeer(t, "b", true)
+
+	// Behind NAT, a and b can reach the relay but not each other
+	for _, d := range []*Downloader{a, b} {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		p, err := dialHolepunch(ctx, loopbackAddr(relay), d.UTP, 0, d.Handshake(), 4, EncryptionDisabled)
+		cancel()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		go d.runPeer(d.ctx, p)
+		waitForPeer(t, relay, loopbackAddr(d))
+		waitForPeer(t, d, loopbackAddr(relay))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	if _, err := a.UTP.Dial(ctx, loopbackAddr(b)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("want %s connecting directly, got %v", context.DeadlineExceeded, err)
+	}
+
+	if err := a.Holepunch(loopbackAddr(relay), loopbackAddr(b)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	pa := waitForPeer(t, a, loopbackAddr(b))
+	pb := waitForPeer(t, b, loopbackAddr(a))
+	if pa.Remote.PeerID != b.PeerId || pb.Remote.PeerID != a.PeerId {
+		t.Fatal("holepunched to the wrong peer")
+	}
+	// Both ends keep the same connection, so it stays up
+	if err := pa.Send(NewHave(1)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := pb.Send(NewHave(2)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case <-pa.Done():
+		t.Fatalf("holepunched connection closed: %v", pa.Err())
+	case <-pb.Done():
+		t.Fatalf("holepunched connection closed: %v", pb.Err())
+	default:
+	}
+	if !pa.PeerHas(2) || !pb.PeerHas(1) {
+		t.Fatal("want messages exchanged over the holepunched connection")
+	}
+
+	if err := a.Holepunch(netip.MustParseAddrPort("127.0.0.1:1"), loopbackAddr(b)); err == nil {
+		t.Fatal("wanted error for an unknown relay, got nil")
+	}
+}
+
+func TestDialHolepunchTCP(t *testing.T) {
+	la, err := listenTCP(0)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer la.Close()
+	lb, err := listenTCP(0)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer lb.Close()
+	port := la.Addr().(*net.TCPAddr).Port
+	ha := Handshake{InfoHash: sha1.Sum([]byte("torrent")), PeerID: sha1.Sum([]byte("a"))}
+	hb := Handshake{InfoHash: ha.InfoHash, PeerID: sha1.Sum([]byte("b"))}
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := lb.Accept()
+		if err != nil {
+			return
+		}
+		AcceptPeer(conn, hb, 4, EncryptionDisabled)
+		accepted <- conn
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	addr := netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), uint16(lb.Addr().(*net.TCPAddr).Port))
+	p, err := dialHolepunch(ctx, addr, nil, port, ha, 4, EncryptionDisabled)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer p.Close()
+	if p.Remote.PeerID != hb.PeerID {
+		t.Fatal("holepunched to the wrong peer")
+	}
+	conn := <-accepted
+	defer conn.Close()
+	// Dialed from our listen port, which still accepts connections
+	if got := conn.RemoteAddr().(*net.TCPAddr).Port; got != port {
+		t.Fatalf("want connection from listen port %d, got %d", port, got)
+	}
+	c, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", fmt.Sprint(port)))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	c.Close()
+	c, err = la.Accept()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	c.Close()
+}
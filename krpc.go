@@ -0,0 +1,204 @@
+package bt
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+)
+
+// KRPC error codes, see BEP 5
+const (
+	KRPCGenericError  = 201
+	KRPCServerError   = 202
+	KRPCProtocolError = 203
+	KRPCMethodUnknown = 204
+	// BEP 44 put errors
+	KRPCMessageTooBig    = 205
+	KRPCInvalidSignature = 206
+	KRPCSaltTooBig       = 207
+	KRPCCASMismatch      = 301
+	KRPCSeqTooLow        = 302
+)
+
+// KRPCError is an error response from a DHT node.
+type KRPCError struct {
+	Code    int
+	Message string
+}
+
+func (e *KRPCError) Error() string {
+	return fmt.Sprintf("krpc error %d: %s", e.Code, e.Message)
+}
+
+// krpcMessage is a DHT message: a query (y=q), response (y=r), or error (y=e). See BEP 5.
+type krpcMessage struct {
+	// Transaction id, echoed in the response
+	T string
+	Y string
+	// Query method and arguments
+	Q string
+	A map[string]any
+	// Response values
+	R map[string]any
+	E *KRPCError
+	// Set by nodes that don't answer queries (BEP 43)
+	ReadOnly bool
+	// The querier's address as seen by the responder, so it can learn its external IP (BEP 42)
+	IP netip.AddrPort
+}
+
+func (m *krpcMessage) MarshalBinary() ([]byte, error) {
+	d := map[string]any{"t": m.T, "y": m.Y}
+	switch m.Y {
+	case "q":
+		d["q"] = m.Q
+		d["a"] = m.A
+		if m.ReadOnly {
+			d["ro"] = 1
+		}
+	case "r":
+		d["r"] = m.R
+	case "e":
+		if m.E == nil {
+			return nil, errors.New("krpc: error message without error")
+		}
+		d["e"] = []any{m.E.Code, m.E.Message}
+	default:
+		return nil, fmt.Errorf("krpc: unknown message type %q", m.Y)
+	}
+	if m.IP.IsValid() {
+		d["ip"] = AppendCompactAddr(nil, m.IP)
+	}
+	return Encode(d)
+}
+
+// parseKRPC parses a single DHT message, checking the keys its type requires.
+func parseKRPC(bs []byte) (*krpcMessage, error) {
+	d, err := ParseDictOnly(bs)
+	if err != nil {
+		return nil, fmt.Errorf("krpc: %w", err)
+	}
+	m := &krpcMessage{}
+	if m.T, _, err = dictString(d, "t"); err != nil {
+		return nil, fmt.Errorf("krpc: %w", err)
+	}
+	y, ok, err := dictString(d, "y")
+	if err != nil || !ok {
+		return nil, fmt.Errorf("krpc: missing or invalid message type: %v", err)
+	}
+	m.Y = y
+	switch y {
+	case "q":
+		if m.Q, ok, err = dictString(d, "q"); err != nil || !ok {
+			return nil, fmt.Errorf("krpc: missing or invalid query method: %v", err)
+		}
+		if m.A, ok = d["a"].(map[string]any); !ok {
+			return nil, errors.New("krpc: query without arguments")
+		}
+		ro, _, _ := dictInt(d, "ro")
+		m.ReadOnly = ro == 1
+	case "r":
+		if m.R, ok = d["r"].(map[string]any); !ok {
+			return nil, errors.New("krpc: response without values")
+		}
+	case "e":
+		e, ok := d["e"].([]any)
+		if !ok || len(e) < 2 {
+			return nil, errors.New("krpc: invalid error")
+		}
+		code, codeOK := e[0].(int)
+		msg, msgOK := e[1].(string)
+		if !codeOK || !msgOK {
+			return nil, errors.New("krpc: invalid error")
+		}
+		m.E = &KRPCError{Code: code, Message: msg}
+	default:
+		return nil, fmt.Errorf("krpc: unknown message type %q", y)
+	}
+	// Ignored if malformed, since it's only advisory
+	if ip, _, _ := dictString(d, "ip"); len(ip) == 6 || len(ip) == 18 {
+		if addr, err := ParseCompactAddr([]byte(ip)); err == nil {
+			m.IP = unmapAddrPort(addr)
+		}
+	}
+	return m, nil
+}
+
+// dictNodeID looks up a 20 byte id, such as a node id or infohash, in a parsed dictionary.
+func dictNodeID(d map[string]any, key string) (NodeID, error) {
+	s, ok, err := dictString(d, key)
+	if err != nil {
+		return NodeID{}, err
+	}
+	if !ok || len(s) != 20 {
+		return NodeID{}, fmt.Errorf("expected 20 byte %s, got %d bytes", key, len(s))
+	}
+	return NodeID([]byte(s)), nil
+}
+
+// appendCompactNodes appends the "compact node info" of each node whose address family matches ipv6:
+// a 20 byte id followed by a compact address, 26 bytes for IPv4 or 38 for IPv6.
+func appendCompactNodes(b []byte, nodes []NodeInfo, ipv6 bool) []byte {
+	for _, n := range nodes {
+		if n.Addr.Addr().Unmap().Is4() == ipv6 {
+			continue
+		}
+		b = append(b, n.ID[:]...)
+		b = AppendCompactAddr(b, n.Addr)
+	}
+	return b
+}
+
+// parseCompactNodes parses a concatenation of compact node infos with ipLen byte IPs (4 or 16).
+func parseCompactNodes(bs []byte, ipLen int) ([]NodeInfo, error) {
+	size := 20 + ipLen + 2
+	if len(bs)%size != 0 {
+		return nil, fmt.Errorf("expected compact nodes to be divisible by %d, got %d", size, len(bs))
+	}
+	nodes := make([]NodeInfo, 0, len(bs)/size)
+	for i := 0; i < len(bs); i += size {
+		addr, err := ParseCompactAddr(bs[i+20 : i+size])
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, NodeInfo{ID: NodeID(bs[i : i+20]), Addr: unmapAddrPort(addr)})
+	}
+	return nodes, nil
+}
+
+// dictNodes returns the nodes in a response's "nodes" and "nodes6" keys.
+func dictNodes(d map[string]any) ([]NodeInfo, error) {
+	var out []NodeInfo
+	for _, k := range []struct {
+		key   string
+		ipLen int
+	}{{"nodes", 4}, {"nodes6", 16}} {
+		s, _, err := dictString(d, k.key)
+		if err != nil {
+			return nil, err
+		}
+		nodes, err := parseCompactNodes([]byte(s), k.ipLen)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", k.key, err)
+		}
+		out = append(out, nodes...)
+	}
+	return out, nil
+}
+
+// dictValues returns the peers in a get_peers response's "values" key: a list of compact addresses.
+// Malformed entries are skipped.
+func dictValues(d map[string]any) []netip.AddrPort {
+	values, _ := d["values"].([]any)
+	var out []netip.AddrPort
+	for _, v := range values {
+		s, ok := v.(string)
+		if !ok {
+			continue
+		}
+		if addr, err := ParseCompactAddr([]byte(s)); err == nil {
+			out = append(out, unmapAddrPort(addr))
+		}
+	}
+	return out
+}
@@ -0,0 +1,131 @@
+package bt
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+func TestParseKRPC(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		Name      string
+		Input     string
+		Want      *krpcMessage
+		WantError bool
+	}{
+		{
+			// Examples from BEP 5
+			Name:  "ping query",
+			Input: "d1:ad2:id20:abcdefghij0123456789e1:q4:ping1:t2:aa1:y1:qe",
+			Want:  &krpcMessage{T: "aa", Y: "q", Q: "ping", A: map[string]any{"id": "abcdefghij0123456789"}},
+		},
+		{
+			Name:  "ping response",
+			Input: "d1:rd2:id20:mnopqrstuvwxyz123456e1:t2:aa1:y1:re",
+			Want:  &krpcMessage{T: "aa", Y: "r", R: map[string]any{"id": "mnopqrstuvwxyz123456"}},
+		},
+		{
+			Name:  "error",
+			Input: "d1:eli201e23:A Generic Error Ocurrede1:t2:aa1:y1:ee",
+			Want:  &krpcMessage{T: "aa", Y: "e", E: &KRPCError{Code: 201, Message: "A Generic Error Ocurred"}},
+		},
+		{
+			Name:  "read only",
+			Input: "d1:ad2:id20:abcdefghij0123456789e1:q4:ping2:roi1e1:t2:aa1:y1:qe",
+			Want:  &krpcMessage{T: "aa", Y: "q", Q: "ping", A: map[string]any{"id": "abcdefghij0123456789"}, ReadOnly: true},
+		},
+		{
+			Name:  "response with ip",
+			Input: "d2:ip6:\x01\x02\x03\x04\x1a\xe11:rd2:id20:mnopqrstuvwxyz123456e1:t2:aa1:y1:re",
+			Want: &krpcMessage{
+				T: "aa", Y: "r", R: map[string]any{"id": "mnopqrstuvwxyz123456"},
+				IP: netip.MustParseAddrPort("1.2.3.4:6881"),
+			},
+		},
+		{Name: "not a dict", Input: "li1ee", WantError: true},
+		{Name: "missing type", Input: "d1:t2:aae", WantError: true},
+		{Name: "unknown type", Input: "d1:t2:aa1:y1:xe", WantError: true},
+		{Name: "query without method", Input: "d1:ade1:t2:aa1:y1:qe", WantError: true},
+		{Name: "query without arguments", Input: "d1:q4:ping1:t2:aa1:y1:qe", WantError: true},
+		{Name: "response without values", Input: "d1:t2:aa1:y1:re", WantError: true},
+		{Name: "short error", Input: "d1:eli201ee1:t2:aa1:y1:ee", WantError: true},
+		{Name: "bad error code", Input: "d1:el3:abc3:abce1:t2:aa1:y1:ee", WantError: true},
+	}
+	for _, c := range cases {
+		c := c
+		t.Run(c.Name, func(t *testing.T) {
+			t.Parallel()
+			got, err := parseKRPC([]byte(c.Input))
+			if c.WantError {
+				if err == nil {
+					t.Fatal("wanted error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !reflect.DeepEqual(got, c.Want) {
+				t.Fatalf("want %+v, got %+v", c.Want, got)
+			}
+			// Round trip
+			bs, err := got.MarshalBinary()
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if string(bs) != c.Input {
+				t.Fatalf("want %q, got %q", c.Input, bs)
+			}
+		})
+	}
+}
+
+func TestCompactNodes(t *testing.T) {
+	t.Parallel()
+	nodes := []NodeInfo{
+		{ID: NodeID{1}, Addr: netip.MustParseAddrPort("1.2.3.4:6881")},
+		{ID: NodeID{2}, Addr: netip.MustParseAddrPort("[2001:db8::1]:6882")},
+		{ID: NodeID{3}, Addr: netip.MustParseAddrPort("[::ffff:5.6.7.8]:6883")},
+	}
+	v4 := appendCompactNodes(nil, nodes, false)
+	if len(v4) != 2*26 {
+		t.Fatalf("want %d bytes, got %d", 2*26, len(v4))
+	}
+	v6 := appendCompactNodes(nil, nodes, true)
+	if len(v6) != 38 {
+		t.Fatalf("want %d bytes, got %d", 38, len(v6))
+	}
+	got, err := dictNodes(map[string]any{"nodes": string(v4), "nodes6": string(v6)})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	want := []NodeInfo{
+		nodes[0],
+		{ID: NodeID{3}, Addr: netip.MustParseAddrPort("5.6.7.8:6883")},
+		nodes[1],
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+	if _, err := dictNodes(map[string]any{"nodes": string(v4[:30])}); err == nil {
+		t.Fatal("wanted error, got nil")
+	}
+}
+
+func TestDictValues(t *testing.T) {
+	t.Parallel()
+	d := map[string]any{"values": []any{
+		"\x01\x02\x03\x04\x1a\xe1",
+		"bad",
+		1,
+		"\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x1a\xe2",
+	}}
+	want := []netip.AddrPort{
+		netip.MustParseAddrPort("1.2.3.4:6881"),
+		netip.MustParseAddrPort("[2001:db8::1]:6882"),
+	}
+	if got := dictValues(d); !reflect.DeepEqual(got, want) {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+}
@@ -0,0 +1,338 @@
+package bt
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Local Service Discovery, see BEP 14.
+//
+// Peers on the same network find each other by multicasting HTTP-like BT-SEARCH messages listing the infohashes they have.
+
+const (
+	// How often each torrent is announced
+	DefaultLSDInterval = 5 * time.Minute
+	// We never announce a torrent more often than this, and expect others not to either
+	minLSDInterval = time.Minute
+	// Announces accepted from each address per minLSDInterval, beyond which they're dropped
+	maxLSDAnnounces = 20
+	// Keep messages within a single unfragmented packet
+	maxLSDMessageSize = 1400
+)
+
+// The multicast groups BT-SEARCH messages are sent to
+var (
+	LSDGroup4 = netip.MustParseAddrPort("239.192.152.143:6771")
+	LSDGroup6 = netip.MustParseAddrPort("[ff15::efc0:988f]:6771")
+)
+
+// LSD announces torrents to and finds peers on the local network.
+//
+// Create one with NewLSD, Start it, then Add the torrents to announce.
+type LSD struct {
+	Interval time.Duration
+	// Groups to announce to and listen on. Defaults to LSDGroup4 and LSDGroup6.
+	Groups []netip.AddrPort
+
+	// Sent with our announces, so we can ignore them when they're looped back to us
+	cookie string
+	conns  []*lsdConn
+	wake   chan struct{}
+	done   chan struct{}
+	wg     sync.WaitGroup
+
+	mu       sync.Mutex
+	torrents map[[20]byte]*lsdTorrent
+	// Announces received from each address since windowStart, for rate limiting
+	received    map[netip.Addr]int
+	windowStart time.Time
+}
+
+// lsdConn is how we listen on and send to one group.
+type lsdConn struct {
+	group  netip.AddrPort
+	listen *net.UDPConn
+	send   *net.UDPConn
+}
+
+type lsdTorrent struct {
+	port     int
+	found    func(Peer)
+	lastSent time.Time
+}
+
+// lsdAnnounce is a parsed BT-SEARCH message.
+type lsdAnnounce struct {
+	Port       int
+	InfoHashes [][20]byte
+	Cookie     string
+}
+
+func NewLSD() *LSD {
+	var cookie [8]byte
+	rand.Read(cookie[:])
+	return &LSD{
+		Interval: DefaultLSDInterval,
+		Groups:   []netip.AddrPort{LSDGroup4, LSDGroup6},
+		cookie:   hex.EncodeToString(cookie[:]),
+		wake:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+		torrents: make(map[[20]byte]*lsdTorrent),
+		received: make(map[netip.Addr]int),
+	}
+}
+
+// Start joins the multicast groups, announcing and listening until ctx is cancelled or Close is called.
+// Groups we can't join, e.g. IPv6 on a host without it, are skipped. It fails only if none can be joined.
+func (l *LSD) Start(ctx context.Context) error {
+	var errs []error
+	for _, group := range l.Groups {
+		c, err := listenLSD(group)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		l.conns = append(l.conns, c)
+	}
+	if len(l.conns) == 0 {
+		return fmt.Errorf("lsd: %w", errors.Join(errs...))
+	}
+	l.wg.Add(len(l.conns) + 1)
+	for _, c := range l.conns {
+		c := c
+		go func() {
+			defer l.wg.Done()
+			l.readLoop(c.listen)
+		}()
+	}
+	go func() {
+		defer l.wg.Done()
+		l.announceLoop()
+	}()
+	go func() {
+		select {
+		case <-ctx.Done():
+			l.Close()
+		case <-l.done:
+		}
+	}()
+	return nil
+}
+
+func listenLSD(group netip.AddrPort) (*lsdConn, error) {
+	network := "udp4"
+	if group.Addr().Is6() {
+		network = "udp6"
+	}
+	listen, err := net.ListenMulticastUDP(network, nil, net.UDPAddrFromAddrPort(group))
+	if err != nil {
+		return nil, err
+	}
+	// Announces go out from their own socket, since multicast loopback is disabled on the listening one,
+	// and other clients on this host should hear us
+	send, err := net.ListenUDP(network, nil)
+	if err != nil {
+		listen.Close()
+		return nil, err
+	}
+	return &lsdConn{group: group, listen: listen, send: send}, nil
+}
+
+// Close stops announcing and leaves the groups.
+func (l *LSD) Close() error {
+	l.mu.Lock()
+	select {
+	case <-l.done:
+		l.mu.Unlock()
+		return nil
+	default:
+	}
+	close(l.done)
+	l.mu.Unlock()
+	var errs []error
+	for _, c := range l.conns {
+		errs = append(errs, c.listen.Close(), c.send.Close())
+	}
+	l.wg.Wait()
+	return errors.Join(errs...)
+}
+
+// Add announces infoHash with our listen port, calling found with each peer on the network that announces it.
+// found may be called concurrently. Call remove to stop.
+func (l *LSD) Add(infoHash [20]byte, port int, found func(Peer)) (remove func()) {
+	t := &lsdTorrent{port: port, found: found}
+	l.mu.Lock()
+	l.torrents[infoHash] = t
+	l.mu.Unlock()
+	select {
+	case l.wake <- struct{}{}:
+	default:
+	}
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if l.torrents[infoHash] == t {
+			delete(l.torrents, infoHash)
+		}
+	}
+}
+
+// announceLoop announces every torrent each Interval, and new torrents as soon as they're added.
+func (l *LSD) announceLoop() {
+	ticker := time.NewTicker(l.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-ticker.C:
+		case <-l.wake:
+		}
+		due := l.due(time.Now())
+		for _, c := range l.conns {
+			for port, infoHashes := range due {
+				for len(infoHashes) > 0 {
+					var msg []byte
+					msg, infoHashes = appendLSDMessage(nil, c.group, port, infoHashes, l.cookie)
+					c.send.WriteToUDPAddrPort(msg, c.group) // Nothing to do if it fails; we'll try again next time
+				}
+			}
+		}
+	}
+}
+
+// due returns the torrents that haven't been announced within minLSDInterval, by port, marking them announced.
+func (l *LSD) due(now time.Time) map[int][][20]byte {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	byPort := make(map[int][][20]byte)
+	for infoHash, t := range l.torrents {
+		if t.port == 0 || now.Sub(t.lastSent) < minLSDInterval {
+			continue
+		}
+		t.lastSent = now
+		byPort[t.port] = append(byPort[t.port], infoHash)
+	}
+	return byPort
+}
+
+// appendLSDMessage appends a BT-SEARCH message announcing as many of infoHashes as fit in maxLSDMessageSize,
+// returning the ones left over.
+func appendLSDMessage(b []byte, group netip.AddrPort, port int, infoHashes [][20]byte, cookie string) ([]byte, [][20]byte) {
+	b = fmt.Appendf(b, "BT-SEARCH * HTTP/1.1\r\nHost: %s\r\nPort: %d\r\n", group, port)
+	// Leave room for the cookie and trailing blank lines
+	limit := maxLSDMessageSize - len("cookie: \r\n\r\n\r\n") - len(cookie)
+	i := 0
+	for ; i < len(infoHashes); i++ {
+		line := fmt.Sprintf("Infohash: %x\r\n", infoHashes[i])
+		if i > 0 && len(b)+len(line) > limit {
+			break
+		}
+		b = append(b, line...)
+	}
+	if cookie != "" {
+		b = fmt.Appendf(b, "cookie: %s\r\n", cookie)
+	}
+	b = append(b, "\r\n\r\n"...)
+	return b, infoHashes[i:]
+}
+
+func parseLSDMessage(b []byte) (*lsdAnnounce, error) {
+	lines := strings.Split(string(bytes.ReplaceAll(b, []byte("\r\n"), []byte("\n"))), "\n")
+	if lines[0] != "BT-SEARCH * HTTP/1.1" {
+		return nil, fmt.Errorf("lsd: expected BT-SEARCH request, got %q", lines[0])
+	}
+	a := &lsdAnnounce{}
+	for _, line := range lines[1:] {
+		if line == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("lsd: malformed header %q", line)
+		}
+		value = strings.TrimSpace(value)
+		switch strings.ToLower(key) {
+		case "port":
+			port, err := strconv.Atoi(value)
+			if err != nil || port <= 0 || port > 65535 {
+				return nil, fmt.Errorf("lsd: invalid port %q", value)
+			}
+			a.Port = port
+		case "infohash":
+			bs, err := hex.DecodeString(value)
+			if err != nil || len(bs) != 20 {
+				return nil, fmt.Errorf("lsd: invalid infohash %q", value)
+			}
+			a.InfoHashes = append(a.InfoHashes, [20]byte(bs))
+		case "cookie":
+			a.Cookie = value
+		}
+	}
+	if a.Port == 0 {
+		return nil, errors.New("lsd: missing port")
+	}
+	if len(a.InfoHashes) == 0 {
+		return nil, errors.New("lsd: missing infohash")
+	}
+	return a, nil
+}
+
+func (l *LSD) readLoop(conn *net.UDPConn) {
+	buf := make([]byte, 2048)
+	for {
+		n, from, err := conn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			select {
+			case <-l.done:
+				return
+			default:
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		l.handle(buf[:n], unmapAddrPort(from), time.Now())
+	}
+}
+
+// handle passes the peer in an announce to the torrents it lists that we've added.
+// Our own announces and those from addresses over the rate limit are ignored.
+func (l *LSD) handle(b []byte, from netip.AddrPort, now time.Time) {
+	a, err := parseLSDMessage(b)
+	if err != nil || a.Cookie == l.cookie {
+		return
+	}
+	l.mu.Lock()
+	if now.Sub(l.windowStart) >= minLSDInterval {
+		l.received = make(map[netip.Addr]int)
+		l.windowStart = now
+	}
+	l.received[from.Addr()]++
+	if l.received[from.Addr()] > maxLSDAnnounces {
+		l.mu.Unlock()
+		return
+	}
+	var found []func(Peer)
+	for _, infoHash := range a.InfoHashes {
+		if t, ok := l.torrents[infoHash]; ok {
+			found = append(found, t.found)
+		}
+	}
+	l.mu.Unlock()
+	peer := Peer{Addr: netip.AddrPortFrom(from.Addr(), uint16(a.Port))}
+	for _, f := range found {
+		f(peer)
+	}
+}
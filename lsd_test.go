@@ -0,0 +1,223 @@
+package bt
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestLSDMessage(t *testing.T) {
+	t.Parallel()
+	infoHashes := make([][20]byte, 50)
+	for i := range infoHashes {
+		infoHashes[i] = [20]byte(RandomNodeID())
+	}
+	var got [][20]byte
+	rest := infoHashes
+	for len(rest) > 0 {
+		var msg []byte
+		msg, rest = appendLSDMessage(nil, LSDGroup6, 6881, rest, "abc")
+		if len(msg) > maxLSDMessageSize {
+			t.Fatalf("want messages of at most %d bytes, got %d", maxLSDMessageSize, len(msg))
+		}
+		a, err := parseLSDMessage(msg)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if a.Port != 6881 || a.Cookie != "abc" {
+			t.Fatalf("want port 6881 and cookie abc, got %d and %s", a.Port, a.Cookie)
+		}
+		got = append(got, a.InfoHashes...)
+	}
+	if len(got) != len(infoHashes) {
+		t.Fatalf("want %d infohashes, got %d", len(infoHashes), len(got))
+	}
+	for i := range got {
+		if got[i] != infoHashes[i] {
+			t.Fatalf("infohash %d: want %x, got %x", i, infoHashes[i], got[i])
+		}
+	}
+}
+
+func TestParseLSDMessage(t *testing.T) {
+	t.Parallel()
+	infoHash := "0123456789abcdef0123456789ABCDEF01234567"
+	cases := []struct {
+		Name      string
+		Input     string
+		WantError bool
+	}{
+		{
+			Name:  "BEP 14",
+			Input: "BT-SEARCH * HTTP/1.1\r\nHost: 239.192.152.143:6771\r\nPort: 6881\r\nInfohash: " + infoHash + "\r\ncookie: x\r\n\r\n\r\n",
+		},
+		{
+			Name:  "bare newlines and lowercase headers",
+			Input: "BT-SEARCH * HTTP/1.1\nhost: 239.192.152.143:6771\nport: 6881\ninfohash: " + infoHash + "\n\n\n",
+		},
+		{
+			Name:      "not BT-SEARCH",
+			Input:     "M-SEARCH * HTTP/1.1\r\nPort: 6881\r\nInfohash: " + infoHash + "\r\n\r\n",
+			WantError: true,
+		},
+		{
+			Name:      "bad port",
+			Input:     "BT-SEARCH * HTTP/1.1\r\nPort: 70000\r\nInfohash: " + infoHash + "\r\n\r\n",
+			WantError: true,
+		},
+		{
+			Name:      "short infohash",
+			Input:     "BT-SEARCH * HTTP/1.1\r\nPort: 6881\r\nInfohash: abcd\r\n\r\n",
+			WantError: true,
+		},
+		{
+			Name:      "missing port",
+			Input:     "BT-SEARCH * HTTP/1.1\r\nInfohash: " + infoHash + "\r\n\r\n",
+			WantError: true,
+		},
+		{
+			Name:      "missing infohash",
+			Input:     "BT-SEARCH * HTTP/1.1\r\nPort: 6881\r\n\r\n",
+			WantError: true,
+		},
+		{
+			Name:      "malformed header",
+			Input:     "BT-SEARCH * HTTP/1.1\r\nPort 6881\r\n\r\n",
+			WantError: true,
+		},
+	}
+	for _, c := range cases {
+		c := c
+		t.Run(c.Name, func(t *testing.T) {
+			t.Parallel()
+			a, err := parseLSDMessage([]byte(c.Input))
+			if c.WantError {
+				if err == nil {
+					t.Fatal("wanted error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if a.Port != 6881 || len(a.InfoHashes) != 1 || a.InfoHashes[0][0] != 0x01 {
+				t.Fatalf("want port 6881 and infohash %s, got %+v", infoHash, a)
+			}
+		})
+	}
+}
+
+func TestLSDHandle(t *testing.T) {
+	t.Parallel()
+	l := NewLSD()
+	infoHash := [20]byte(RandomNodeID())
+	var found []Peer
+	remove := l.Add(infoHash, 6881, func(p Peer) {
+		found = append(found, p)
+	})
+	from := netip.MustParseAddrPort("192.168.1.10:6771")
+	msg := func(cookie string, infoHashes ...[20]byte) []byte {
+		b, _ := appendLSDMessage(nil, LSDGroup4, 51413, infoHashes, cookie)
+		return b
+	}
+	now := time.Now()
+
+	l.handle(msg(l.cookie, infoHash), from, now)
+	if len(found) != 0 {
+		t.Fatalf("want our own announce ignored, got %v", found)
+	}
+	l.handle(msg("other", [20]byte(RandomNodeID())), from, now)
+	if len(found) != 0 {
+		t.Fatalf("want announce for another torrent ignored, got %v", found)
+	}
+	l.handle(msg("other", [20]byte(RandomNodeID()), infoHash), from, now)
+	want := netip.MustParseAddrPort("192.168.1.10:51413")
+	if len(found) != 1 || found[0].Addr != want {
+		t.Fatalf("want peer %s, got %v", want, found)
+	}
+
+	// Two announces were counted above
+	for i := 0; i < maxLSDAnnounces; i++ {
+		l.handle(msg("other", infoHash), from, now)
+	}
+	if len(found) != maxLSDAnnounces-1 {
+		t.Fatalf("want %d peers found before the rate limit, got %d", maxLSDAnnounces-1, len(found))
+	}
+	// Other addresses have their own limits
+	l.handle(msg("other", infoHash), netip.MustParseAddrPort("192.168.1.11:6771"), now)
+	if len(found) != maxLSDAnnounces {
+		t.Fatalf("want announce from another address accepted, got %d peers", len(found))
+	}
+	l.handle(msg("other", infoHash), from, now.Add(minLSDInterval))
+	if len(found) != maxLSDAnnounces+1 {
+		t.Fatalf("want announce accepted once the limit resets, got %d peers", len(found))
+	}
+
+	remove()
+	l.handle(msg("other", infoHash), from, now.Add(minLSDInterval))
+	if len(found) != maxLSDAnnounces+1 {
+		t.Fatalf("want announces ignored once removed, got %d peers", len(found))
+	}
+}
+
+func TestLSDDue(t *testing.T) {
+	t.Parallel()
+	l := NewLSD()
+	a, b, c := [20]byte{1}, [20]byte{2}, [20]byte{3}
+	l.Add(a, 6881, func(Peer) {})
+	l.Add(b, 6881, func(Peer) {})
+	l.Add(c, 0, func(Peer) {}) // Not listening, so nothing to announce
+	now := time.Now()
+	due := l.due(now)
+	if len(due) != 1 || len(due[6881]) != 2 {
+		t.Fatalf("want 2 torrents due on port 6881, got %v", due)
+	}
+	if due := l.due(now.Add(minLSDInterval / 2)); len(due) != 0 {
+		t.Fatalf("want nothing due within %s, got %v", minLSDInterval, due)
+	}
+	if due := l.due(now.Add(minLSDInterval)); len(due[6881]) != 2 {
+		t.Fatalf("want 2 torrents due after %s, got %v", minLSDInterval, due)
+	}
+}
+
+func TestLSD(t *testing.T) {
+	t.Parallel()
+	// Use our own port, so we don't hear or disturb real clients
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	port := uint16(conn.LocalAddr().(*net.UDPAddr).Port)
+	conn.Close()
+	groups := []netip.AddrPort{netip.AddrPortFrom(LSDGroup4.Addr(), port)}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	a, b := NewLSD(), NewLSD()
+	a.Groups, b.Groups = groups, groups
+	if err := a.Start(ctx); err != nil {
+		t.Skipf("multicast unavailable: %s", err)
+	}
+	defer a.Close()
+	if err := b.Start(ctx); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer b.Close()
+
+	infoHash := [20]byte(RandomNodeID())
+	found := make(chan Peer, 10)
+	a.Add(infoHash, 6881, func(p Peer) {
+		found <- p
+	})
+	b.Add(infoHash, 6882, func(Peer) {})
+	select {
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for announce")
+	case p := <-found:
+		if p.Addr.Port() != 6882 {
+			t.Fatalf("want peer on port 6882, got %s", p.Addr)
+		}
+	}
+}
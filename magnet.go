@@ -0,0 +1,82 @@
+package bt
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// See BEP 9 for the magnet URI format:
+// https://www.bittorrent.org/beps/bep_0009.html
+//
+// magnet:?xt=urn:btih:<info-hash>&dn=<name>&tr=<tracker-url>
+
+type Magnet struct {
+	InfoHash [20]byte
+	// dn: display name, may be empty
+	Name string
+	// tr: tracker URLs, may be empty
+	Trackers []string
+}
+
+const btihPrefix = "urn:btih:"
+
+// ParseMagnet parses a magnet URI.
+//
+// The infohash may be 40 hex characters or 32 base32 characters.
+func ParseMagnet(uri string) (*Magnet, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("parsing magnet URI: %w", err)
+	}
+	if u.Scheme != "magnet" {
+		return nil, fmt.Errorf("expected magnet: scheme, got %q", u.Scheme)
+	}
+	q, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return nil, fmt.Errorf("parsing magnet URI query: %w", err)
+	}
+	m := &Magnet{
+		Name:     q.Get("dn"),
+		Trackers: q["tr"],
+	}
+	found := false
+	for _, xt := range q["xt"] {
+		if !strings.HasPrefix(xt, btihPrefix) {
+			continue // e.g. BEP 52's urn:btmh:
+		}
+		ih, err := decodeBTIH(xt[len(btihPrefix):])
+		if err != nil {
+			return nil, err
+		}
+		m.InfoHash = ih
+		found = true
+		break
+	}
+	if !found {
+		return nil, errors.New("magnet URI has no urn:btih: exact topic")
+	}
+	return m, nil
+}
+
+func decodeBTIH(s string) ([20]byte, error) {
+	var ih [20]byte
+	var bs []byte
+	var err error
+	switch len(s) {
+	case 40:
+		bs, err = hex.DecodeString(s)
+	case 32:
+		bs, err = base32.StdEncoding.DecodeString(strings.ToUpper(s))
+	default:
+		return ih, fmt.Errorf("expected 40 hex or 32 base32 characters for infohash, got %d characters", len(s))
+	}
+	if err != nil {
+		return ih, fmt.Errorf("decoding infohash %s: %w", s, err)
+	}
+	copy(ih[:], bs)
+	return ih, nil
+}
@@ -0,0 +1,67 @@
+package bt
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseMagnet(t *testing.T) {
+	t.Parallel()
+	want := &Magnet{
+		InfoHash: [20]byte{0xc1, 0x2f, 0xe1, 0xc0, 0x6b, 0xba, 0x25, 0x4a, 0x9d, 0xc9,
+			0xf5, 0x19, 0xb3, 0x35, 0xaa, 0x7c, 0x13, 0x67, 0xa8, 0x8a},
+		Name:     "test",
+		Trackers: []string{"http://example.com/announce", "udp://example.com:6969"},
+	}
+	cases := []struct {
+		Name      string
+		Input     string
+		Want      *Magnet
+		WantError bool
+	}{
+		{
+			Name:  "parses hex infohash",
+			Input: "magnet:?xt=urn:btih:c12fe1c06bba254a9dc9f519b335aa7c1367a88a&dn=test&tr=http%3A%2F%2Fexample.com%2Fannounce&tr=udp%3A%2F%2Fexample.com%3A6969",
+			Want:  want,
+		},
+		{
+			Name:  "parses base32 infohash",
+			Input: "magnet:?xt=urn:btih:YEX6DQDLXISUVHOJ6UM3GNNKPQJWPKEK&dn=test&tr=http%3A%2F%2Fexample.com%2Fannounce&tr=udp%3A%2F%2Fexample.com%3A6969",
+			Want:  want,
+		},
+		{
+			Name:      "fails without btih",
+			Input:     "magnet:?dn=test",
+			WantError: true,
+		},
+		{
+			Name:      "fails on short infohash",
+			Input:     "magnet:?xt=urn:btih:c12fe1",
+			WantError: true,
+		},
+		{
+			Name:      "fails on other schemes",
+			Input:     "http://example.com/?xt=urn:btih:c12fe1c06bba254a9dc9f519b335aa7c1367a88a",
+			WantError: true,
+		},
+	}
+	for _, c := range cases {
+		c := c
+		t.Run(c.Name, func(t *testing.T) {
+			t.Parallel()
+			got, err := ParseMagnet(c.Input)
+			if c.WantError {
+				if err == nil {
+					t.Fatal("wanted error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !reflect.DeepEqual(c.Want, got) {
+				t.Fatalf("want %#v, got %#v", c.Want, got)
+			}
+		})
+	}
+}
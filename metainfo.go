@@ -5,7 +5,9 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
 	"os"
+	"strconv"
 	"strings"
 )
 
@@ -13,9 +15,15 @@ import (
 
 type MetaInfo struct {
 	Announce string `json:"announce"`
-	Info     Info   `json:"info"`
+	// Tiers of trackers, tried in order, from "announce-list". See BEP 12.
+	AnnounceList [][]string `json:"-"`
+	Info         Info       `json:"info"`
 	// Could just do InfoSha1
 	InfoShaSum [sha1.Size]byte `json:"-"`
+	// The bencoded info dictionary, as hashed for InfoShaSum
+	RawInfo []byte `json:"-"`
+	// DHT nodes for trackerless torrents, as host:port
+	Nodes []string `json:"-"`
 }
 
 type Info struct {
@@ -30,6 +38,8 @@ type Info struct {
 	// Length OR Files. Check if Files is nil?
 	Length *int       `json:"length,omitempty"`
 	Files  []FileInfo `json:"files,omitempty"`
+	// private: 1 if peers should only be found via the tracker, so no PEX or DHT. See BEP 27.
+	Private int `json:"private,omitempty"`
 }
 
 type FileInfo struct {
@@ -92,7 +102,6 @@ func (m *MetaInfo) String() string {
 	if m.Info.Length != nil {
 		length = fmt.Sprint(*m.Info.Length)
 	}
-	fmt.Println(length)
 
 	files := ""
 	if m.Info.Files != nil {
@@ -147,6 +156,18 @@ func parseMetaInfo(bs []byte) (*MetaInfo, error) {
 		return nil, fmt.Errorf("MetaInfo: expected announce value to have type string, got %T", announceAny)
 	}
 
+	// announce-list is optional, and sorts before comment
+	var announceList [][]string
+	if key, afterKey, err := ParseString(rest); err == nil && key == "announce-list" {
+		var value any
+		if value, rest, err = Parse(afterKey); err != nil {
+			return nil, err
+		}
+		if announceList, err = parseAnnounceList(value); err != nil {
+			return nil, err
+		}
+	}
+
 	for _, k := range []string{"comment", "created by", "creation date"} {
 		got, rest, err = ParseString(rest)
 		if err != nil {
@@ -190,9 +211,23 @@ func parseMetaInfo(bs []byte) (*MetaInfo, error) {
 	if err != nil {
 		return nil, err
 	}
-	// We should now be done
-	if len(rest) != 0 {
-		return nil, fmt.Errorf("expected EOF after parsing Info dict, but found %d bytes", len(rest))
+	rawInfo = rawInfo[:len(rawInfo)-len(rest)]
+	// Keys sorting after "info"
+	var nodes []string
+	for len(rest) != 0 {
+		var key any
+		var value any
+		if key, rest, err = ParseString(rest); err != nil {
+			return nil, err
+		}
+		if value, rest, err = Parse(rest); err != nil {
+			return nil, err
+		}
+		if key == "nodes" {
+			if nodes, err = parseMetaInfoNodes(value); err != nil {
+				return nil, err
+			}
+		}
 	}
 
 	// Extract an actual struct
@@ -205,11 +240,100 @@ func parseMetaInfo(bs []byte) (*MetaInfo, error) {
 	if err != nil {
 		return nil, err
 	}
+	// Piece hashes are raw bytes, which the JSON round trip mangles, so take them from the dict instead
+	if info.PiecesString, _, err = dictString(parsedInfo.(map[string]any), "pieces"); err != nil {
+		return nil, fmt.Errorf("MetaInfo:Info: %w", err)
+	}
 
 	// store raw bytes into MetaInfo struct as well
 	return &MetaInfo{
-		Announce:   announce,
-		Info:       info,
-		InfoShaSum: sha1.Sum(rawInfo),
+		Announce:     announce,
+		AnnounceList: announceList,
+		Info:         info,
+		InfoShaSum:   sha1.Sum(rawInfo),
+		RawInfo:      rawInfo,
+		Nodes:        nodes,
 	}, nil
 }
+
+// parseAnnounceList parses the "announce-list" key, a list of tiers that are each a list of tracker URLs. Empty tiers are dropped.
+func parseAnnounceList(v any) ([][]string, error) {
+	list, ok := v.([]any)
+	if !ok {
+		return nil, fmt.Errorf("MetaInfo: expected list for \"announce-list\", got %T", v)
+	}
+	tiers := make([][]string, 0, len(list))
+	for _, t := range list {
+		urls, ok := t.([]any)
+		if !ok {
+			return nil, fmt.Errorf("MetaInfo: expected list of trackers in \"announce-list\", got %v", t)
+		}
+		tier := make([]string, 0, len(urls))
+		for _, u := range urls {
+			url, ok := u.(string)
+			if !ok {
+				return nil, fmt.Errorf("MetaInfo: expected tracker URL in \"announce-list\", got %v", u)
+			}
+			tier = append(tier, url)
+		}
+		if len(tier) > 0 {
+			tiers = append(tiers, tier)
+		}
+	}
+	return tiers, nil
+}
+
+// Tiers returns the tiers of trackers to try in order: AnnounceList, or just Announce if there isn't one.
+func (m *MetaInfo) Tiers() [][]string {
+	if len(m.AnnounceList) > 0 {
+		return m.AnnounceList
+	}
+	if m.Announce == "" {
+		return nil
+	}
+	return [][]string{{m.Announce}}
+}
+
+// parseMetaInfoNodes parses the "nodes" key of a trackerless torrent, a list of [host, port] pairs. See BEP 5.
+func parseMetaInfoNodes(v any) ([]string, error) {
+	list, ok := v.([]any)
+	if !ok {
+		return nil, fmt.Errorf("MetaInfo: expected list for \"nodes\", got %T", v)
+	}
+	nodes := make([]string, 0, len(list))
+	for _, n := range list {
+		pair, ok := n.([]any)
+		if !ok || len(pair) != 2 {
+			return nil, fmt.Errorf("MetaInfo: expected [host, port] in \"nodes\", got %v", n)
+		}
+		host, hostOK := pair[0].(string)
+		port, portOK := pair[1].(int)
+		if !hostOK || !portOK || port <= 0 || port > 65535 {
+			return nil, fmt.Errorf("MetaInfo: expected [host, port] in \"nodes\", got %v", n)
+		}
+		nodes = append(nodes, net.JoinHostPort(host, strconv.Itoa(port)))
+	}
+	return nodes, nil
+}
+
+// TotalLength is the sum of all file lengths in the torrent.
+func (i *Info) TotalLength() int {
+	if i.Length != nil {
+		return *i.Length
+	}
+	total := 0
+	for _, f := range i.Files {
+		total += f.Length
+	}
+	return total
+}
+
+// PieceSize is the length of piece index, accounting for the truncated last piece.
+func (i *Info) PieceSize(index int) int {
+	if index == len(i.Pieces)-1 {
+		if rem := i.TotalLength() % i.PieceLength; rem != 0 {
+			return rem
+		}
+	}
+	return i.PieceLength
+}
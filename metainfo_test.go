@@ -0,0 +1,113 @@
+package bt
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"reflect"
+	"testing"
+)
+
+func TestParseMetaInfoNodes(t *testing.T) {
+	t.Parallel()
+	info := "d6:lengthi3e4:name1:a12:piece lengthi16384e6:pieces20:aaaaaaaaaaaaaaaaaaaae"
+	prefix := "d8:announce0:7:comment0:10:created by0:13:creation datei0e4:info"
+	cases := []struct {
+		Name      string
+		Input     string
+		Want      []string
+		WantError bool
+	}{
+		{Name: "none", Input: prefix + info + "e"},
+		{
+			Name:  "nodes",
+			Input: prefix + info + "5:nodesl" + "l9:127.0.0.1i6881ee" + "l10:router.comi1ee" + "ee",
+			Want:  []string{"127.0.0.1:6881", "router.com:1"},
+		},
+		{
+			Name:  "ipv6",
+			Input: prefix + info + "5:nodesll11:2001:db8::1i6881eee" + "e",
+			Want:  []string{"[2001:db8::1]:6881"},
+		},
+		{Name: "not a list", Input: prefix + info + "5:nodesi1ee", WantError: true},
+		{Name: "bad port", Input: prefix + info + "5:nodesll9:127.0.0.1i0eeee", WantError: true},
+		{Name: "missing port", Input: prefix + info + "5:nodesll9:127.0.0.1eee", WantError: true},
+	}
+	for _, c := range cases {
+		c := c
+		t.Run(c.Name, func(t *testing.T) {
+			t.Parallel()
+			m, err := ParseMetaInfo([]byte(c.Input))
+			if c.WantError {
+				if err == nil {
+					t.Fatal("wanted error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !reflect.DeepEqual(m.Nodes, c.Want) {
+				t.Fatalf("want %v, got %v", c.Want, m.Nodes)
+			}
+			if string(m.RawInfo) != info || m.InfoShaSum != sha1.Sum([]byte(info)) {
+				t.Fatalf("want raw info %q, got %q", info, m.RawInfo)
+			}
+		})
+	}
+}
+
+func TestParseMetaInfoPieces(t *testing.T) {
+	t.Parallel()
+	// Piece hashes aren't valid UTF-8
+	hashes := [][]byte{bytes.Repeat([]byte{0xff}, 20), append([]byte{0xc3, 0x28}, bytes.Repeat([]byte{0x80}, 18)...)}
+	pieces := string(bytes.Join(hashes, nil))
+	input := "d8:announce0:7:comment0:10:created by0:13:creation datei0e4:infod6:lengthi3e4:name1:a12:piece lengthi16384e6:pieces40:" + pieces + "ee"
+	m, err := ParseMetaInfo([]byte(input))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !reflect.DeepEqual(m.Info.Pieces, hashes) {
+		t.Fatalf("want pieces %x, got %x", hashes, m.Info.Pieces)
+	}
+}
+
+func TestParseMetaInfoAnnounceList(t *testing.T) {
+	t.Parallel()
+	rest := "7:comment0:10:created by0:13:creation datei0e4:infod6:lengthi3e4:name1:a12:piece lengthi16384e6:pieces20:aaaaaaaaaaaaaaaaaaaaee"
+	cases := []struct {
+		Name      string
+		Input     string
+		Want      [][]string
+		WantError bool
+	}{
+		{Name: "none", Input: "d8:announce5:a/ann" + rest, Want: [][]string{{"a/ann"}}},
+		{
+			Name:  "tiers",
+			Input: "d8:announce5:a/ann13:announce-listll5:a/ann5:b/annel5:c/annelee" + rest,
+			Want:  [][]string{{"a/ann", "b/ann"}, {"c/ann"}},
+		},
+		{Name: "only empty tiers", Input: "d8:announce5:a/ann13:announce-listllee" + rest, Want: [][]string{{"a/ann"}}},
+		{Name: "not a list", Input: "d8:announce5:a/ann13:announce-listi1e" + rest, WantError: true},
+		{Name: "tier not a list", Input: "d8:announce5:a/ann13:announce-listl5:a/anne" + rest, WantError: true},
+		{Name: "url not a string", Input: "d8:announce5:a/ann13:announce-listlli1eee" + rest, WantError: true},
+	}
+	for _, c := range cases {
+		c := c
+		t.Run(c.Name, func(t *testing.T) {
+			t.Parallel()
+			m, err := ParseMetaInfo([]byte(c.Input))
+			if c.WantError {
+				if err == nil {
+					t.Fatal("wanted error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if got := m.Tiers(); !reflect.DeepEqual(got, c.Want) {
+				t.Fatalf("want %v, got %v", c.Want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,336 @@
+package bt
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"time"
+)
+
+// Message Stream Encryption, also known as Protocol Encryption.
+//
+// Peers agree on a key with Diffie-Hellman, then obfuscate the connection with RC4 so it can't be recognized as BitTorrent.
+// The infohash, which both sides already know, authenticates the exchange and picks the torrent (SKEY):
+//
+//	A->B: Ya, PadA
+//	B->A: Yb, PadB
+//	A->B: HASH('req1', S), HASH('req2', SKEY) xor HASH('req3', S), ENCRYPT(VC, crypto_provide, len(PadC), PadC, len(IA)), ENCRYPT(IA)
+//	B->A: ENCRYPT(VC, crypto_select, len(padD), padD), ENCRYPT2(Payload Stream)
+//	A->B: ENCRYPT2(Payload Stream)
+//
+// ENCRYPT2 is RC4 or nothing, depending on crypto_select. IA is the start of A's payload, usually its BitTorrent handshake.
+
+// EncryptionPolicy decides whether peer connections are encrypted.
+type EncryptionPolicy int
+
+const (
+	// Only plaintext connections
+	EncryptionDisabled EncryptionPolicy = iota
+	// Plaintext outgoing connections, except to peers known to prefer encryption, which are treated as EncryptionPreferred. Accept either.
+	EncryptionEnabled
+	// Encrypt outgoing connections, falling back to plaintext for peers that don't support it. Accept either.
+	EncryptionPreferred
+	// Only encrypted connections
+	EncryptionRequired
+)
+
+// crypto_provide and crypto_select bits
+const (
+	mseCryptoPlaintext uint32 = 0x01
+	mseCryptoRC4       uint32 = 0x02
+)
+
+const (
+	// Most random padding after our public key
+	maxMSEPadding = 512
+	// Most initial payload
+	maxMSEInitialPayload = 65535
+	mseKeyLength         = 96
+)
+
+var (
+	// The 768 bit safe prime from the spec
+	mseP, _ = new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+	mseG    = big.NewInt(2)
+	// Verification constant
+	mseVC = make([]byte, 8)
+)
+
+// ErrEncryptionRequired is returned when a peer wants a plaintext connection and our policy forbids it.
+var ErrEncryptionRequired = errors.New("mse: peer doesn't support encryption")
+
+// mseKeys is one side of a Diffie-Hellman exchange.
+type mseKeys struct {
+	private *big.Int
+	public  []byte
+}
+
+func newMSEKeys() (*mseKeys, error) {
+	// 160 bits is plenty, per the spec
+	x := make([]byte, 20)
+	if _, err := rand.Read(x); err != nil {
+		return nil, fmt.Errorf("failed to read random bytes: %w", err)
+	}
+	private := new(big.Int).SetBytes(x)
+	public := new(big.Int).Exp(mseG, private, mseP)
+	return &mseKeys{private: private, public: public.FillBytes(make([]byte, mseKeyLength))}, nil
+}
+
+// secret returns S, the key shared with the peer whose public key is y.
+func (k *mseKeys) secret(y []byte) ([]byte, error) {
+	Y := new(big.Int).SetBytes(y)
+	// Reject keys that would make S predictable
+	if Y.Cmp(big.NewInt(1)) <= 0 || Y.Cmp(new(big.Int).Sub(mseP, big.NewInt(1))) >= 0 {
+		return nil, errors.New("mse: invalid public key")
+	}
+	return new(big.Int).Exp(Y, k.private, mseP).FillBytes(make([]byte, mseKeyLength)), nil
+}
+
+func mseHash(parts ...[]byte) []byte {
+	h := sha1.New()
+	for _, p := range parts {
+		h.Write(p)
+	}
+	return h.Sum(nil)
+}
+
+// mseCipher is the RC4 stream keyed with the hash of name, S, and SKEY, with the first 1024 bytes discarded.
+func mseCipher(name string, s []byte, skey [20]byte) *rc4.Cipher {
+	c, _ := rc4.NewCipher(mseHash([]byte(name), s, skey[:])) // Can't fail for a 20 byte key
+	discard := make([]byte, 1024)
+	c.XORKeyStream(discard, discard)
+	return c
+}
+
+// msePadding returns up to maxMSEPadding random bytes.
+func msePadding() ([]byte, error) {
+	var n [2]byte
+	if _, err := rand.Read(n[:]); err != nil {
+		return nil, fmt.Errorf("failed to read random bytes: %w", err)
+	}
+	pad := make([]byte, int(binary.BigEndian.Uint16(n[:]))%(maxMSEPadding+1))
+	if _, err := rand.Read(pad); err != nil {
+		return nil, fmt.Errorf("failed to read random bytes: %w", err)
+	}
+	return pad, nil
+}
+
+// mseSync reads from r until it has read want, which must come within limit bytes.
+func mseSync(r *bufio.Reader, want []byte, limit int) error {
+	var window []byte
+	for len(window) < limit+len(want) {
+		b, err := r.ReadByte()
+		if err != nil {
+			return fmt.Errorf("mse: %w", err)
+		}
+		window = append(window, b)
+		if bytes.HasSuffix(window, want) {
+			return nil
+		}
+	}
+	return errors.New("mse: failed to synchronize")
+}
+
+// mseConn reads and writes the payload stream after the MSE handshake, or after peeking to see if there is one.
+type mseConn struct {
+	net.Conn
+	r io.Reader
+	w io.Writer
+	// RC4 was selected
+	encrypted bool
+}
+
+func (c *mseConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *mseConn) Write(b []byte) (int, error) {
+	return c.w.Write(b)
+}
+
+// payloadConn wraps conn after a handshake that selected crypto, reading the rest of the stream from r.
+func payloadConn(conn net.Conn, r io.Reader, crypto uint32, dec, enc *rc4.Cipher) *mseConn {
+	if crypto == mseCryptoPlaintext {
+		return &mseConn{Conn: conn, r: r, w: conn}
+	}
+	return &mseConn{Conn: conn, r: cipher.StreamReader{S: dec, R: r}, w: cipher.StreamWriter{S: enc, W: conn}, encrypted: true}
+}
+
+// mseInitiate performs A's side of the handshake for the torrent infoHash, offering the crypto methods in provide.
+// ia is sent as the initial payload. The returned conn carries the rest of the payload stream.
+func mseInitiate(conn net.Conn, infoHash [20]byte, provide uint32, ia []byte) (net.Conn, error) {
+	if len(ia) > maxMSEInitialPayload {
+		return nil, fmt.Errorf("mse: initial payload of %d bytes longer than %d", len(ia), maxMSEInitialPayload)
+	}
+	conn.SetDeadline(time.Now().Add(peerHandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+	keys, err := newMSEKeys()
+	if err != nil {
+		return nil, err
+	}
+	pad, err := msePadding()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(append(keys.public, pad...)); err != nil {
+		return nil, fmt.Errorf("mse: %w", err)
+	}
+	r := bufio.NewReader(conn)
+	yb := make([]byte, mseKeyLength)
+	if _, err := io.ReadFull(r, yb); err != nil {
+		return nil, fmt.Errorf("mse: reading public key: %w", err)
+	}
+	s, err := keys.secret(yb)
+	if err != nil {
+		return nil, err
+	}
+	enc, dec := mseCipher("keyA", s, infoHash), mseCipher("keyB", s, infoHash)
+
+	msg := mseHash([]byte("req1"), s)
+	req2, req3 := mseHash([]byte("req2"), infoHash[:]), mseHash([]byte("req3"), s)
+	for i := range req2 {
+		req2[i] ^= req3[i]
+	}
+	msg = append(msg, req2...)
+	plain := append([]byte{}, mseVC...)
+	plain = binary.BigEndian.AppendUint32(plain, provide)
+	plain = binary.BigEndian.AppendUint16(plain, 0) // No PadC
+	plain = binary.BigEndian.AppendUint16(plain, uint16(len(ia)))
+	plain = append(plain, ia...)
+	enc.XORKeyStream(plain, plain)
+	if _, err := conn.Write(append(msg, plain...)); err != nil {
+		return nil, fmt.Errorf("mse: %w", err)
+	}
+
+	// B's response starts after PadB with the encrypted VC
+	vc := make([]byte, len(mseVC))
+	dec.XORKeyStream(vc, mseVC)
+	if err := mseSync(r, vc, maxMSEPadding); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 6)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, fmt.Errorf("mse: reading crypto_select: %w", err)
+	}
+	dec.XORKeyStream(buf, buf)
+	selected := binary.BigEndian.Uint32(buf)
+	if (selected != mseCryptoPlaintext && selected != mseCryptoRC4) || selected&provide == 0 {
+		return nil, fmt.Errorf("mse: peer selected crypto %#x, we provided %#x", selected, provide)
+	}
+	padD := make([]byte, binary.BigEndian.Uint16(buf[4:]))
+	if len(padD) > maxMSEPadding {
+		return nil, fmt.Errorf("mse: padding of %d bytes longer than %d", len(padD), maxMSEPadding)
+	}
+	if _, err := io.ReadFull(r, padD); err != nil {
+		return nil, fmt.Errorf("mse: reading padding: %w", err)
+	}
+	dec.XORKeyStream(padD, padD)
+	return payloadConn(conn, r, selected, dec, enc), nil
+}
+
+// mseRespond performs B's side of the handshake, after A's public key has been read from r.
+// A must know infoHash, and provide one of the crypto methods in allow; RC4 is chosen if possible.
+// A's initial payload is returned at the start of the conn's stream.
+func mseRespond(conn net.Conn, r *bufio.Reader, infoHash [20]byte, allow uint32) (net.Conn, error) {
+	conn.SetDeadline(time.Now().Add(peerHandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+	ya := make([]byte, mseKeyLength)
+	if _, err := io.ReadFull(r, ya); err != nil {
+		return nil, fmt.Errorf("mse: reading public key: %w", err)
+	}
+	keys, err := newMSEKeys()
+	if err != nil {
+		return nil, err
+	}
+	s, err := keys.secret(ya)
+	if err != nil {
+		return nil, err
+	}
+	pad, err := msePadding()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(append(keys.public, pad...)); err != nil {
+		return nil, fmt.Errorf("mse: %w", err)
+	}
+
+	if err := mseSync(r, mseHash([]byte("req1"), s), maxMSEPadding); err != nil {
+		return nil, err
+	}
+	req2 := make([]byte, sha1.Size)
+	if _, err := io.ReadFull(r, req2); err != nil {
+		return nil, fmt.Errorf("mse: reading SKEY: %w", err)
+	}
+	req3 := mseHash([]byte("req3"), s)
+	for i := range req2 {
+		req2[i] ^= req3[i]
+	}
+	if !bytes.Equal(req2, mseHash([]byte("req2"), infoHash[:])) {
+		return nil, fmt.Errorf("mse: peer wants a torrent other than %x", infoHash)
+	}
+	dec, enc := mseCipher("keyA", s, infoHash), mseCipher("keyB", s, infoHash)
+
+	buf := make([]byte, 14)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, fmt.Errorf("mse: reading crypto_provide: %w", err)
+	}
+	dec.XORKeyStream(buf, buf)
+	if !bytes.Equal(buf[:8], mseVC) {
+		return nil, errors.New("mse: invalid verification constant")
+	}
+	provide := binary.BigEndian.Uint32(buf[8:])
+	padC := make([]byte, binary.BigEndian.Uint16(buf[12:]))
+	if len(padC) > maxMSEPadding {
+		return nil, fmt.Errorf("mse: padding of %d bytes longer than %d", len(padC), maxMSEPadding)
+	}
+	if _, err := io.ReadFull(r, padC); err != nil {
+		return nil, fmt.Errorf("mse: reading padding: %w", err)
+	}
+	dec.XORKeyStream(padC, padC)
+	if _, err := io.ReadFull(r, buf[:2]); err != nil {
+		return nil, fmt.Errorf("mse: reading initial payload: %w", err)
+	}
+	dec.XORKeyStream(buf[:2], buf[:2])
+	ia := make([]byte, binary.BigEndian.Uint16(buf[:2]))
+	if _, err := io.ReadFull(r, ia); err != nil {
+		return nil, fmt.Errorf("mse: reading initial payload: %w", err)
+	}
+	dec.XORKeyStream(ia, ia)
+
+	var selected uint32
+	switch {
+	case provide&allow&mseCryptoRC4 != 0:
+		selected = mseCryptoRC4
+	case provide&allow&mseCryptoPlaintext != 0:
+		selected = mseCryptoPlaintext
+	default:
+		return nil, fmt.Errorf("mse: peer provided crypto %#x, we allow %#x", provide, allow)
+	}
+	msg := append([]byte{}, mseVC...)
+	msg = binary.BigEndian.AppendUint32(msg, selected)
+	msg = binary.BigEndian.AppendUint16(msg, 0) // No PadD
+	enc.XORKeyStream(msg, msg)
+	if _, err := conn.Write(msg); err != nil {
+		return nil, fmt.Errorf("mse: %w", err)
+	}
+	c := payloadConn(conn, r, selected, dec, enc)
+	c.r = io.MultiReader(bytes.NewReader(ia), c.r)
+	return c, nil
+}
+
+// mseProvide is the crypto_provide we send, or the methods we accept, under policy.
+func mseProvide(policy EncryptionPolicy) uint32 {
+	if policy == EncryptionRequired {
+		return mseCryptoRC4
+	}
+	return mseCryptoRC4 | mseCryptoPlaintext
+}
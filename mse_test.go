@@ -0,0 +1,214 @@
+package bt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestEncryptionPolicies(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		Name          string
+		Dial, Accept  EncryptionPolicy
+		WantError     bool
+		WantEncrypted bool
+	}{
+		{Name: "plaintext", Dial: EncryptionDisabled, Accept: EncryptionDisabled},
+		{Name: "plaintext to preferred", Dial: EncryptionDisabled, Accept: EncryptionPreferred},
+		{Name: "plaintext to required", Dial: EncryptionDisabled, Accept: EncryptionRequired, WantError: true},
+		{Name: "enabled dials plaintext", Dial: EncryptionEnabled, Accept: EncryptionPreferred},
+		{Name: "enabled to required", Dial: EncryptionEnabled, Accept: EncryptionRequired, WantError: true},
+		{Name: "preferred to enabled", Dial: EncryptionPreferred, Accept: EncryptionEnabled, WantEncrypted: true},
+		{Name: "preferred to plaintext falls back", Dial: EncryptionPreferred, Accept: EncryptionDisabled},
+		{Name: "preferred", Dial: EncryptionPreferred, Accept: EncryptionPreferred, WantEncrypted: true},
+		{Name: "preferred to required", Dial: EncryptionPreferred, Accept: EncryptionRequired, WantEncrypted: true},
+		{Name: "required to plaintext", Dial: EncryptionRequired, Accept: EncryptionDisabled, WantError: true},
+		{Name: "required to preferred", Dial: EncryptionRequired, Accept: EncryptionPreferred, WantEncrypted: true},
+		{Name: "required", Dial: EncryptionRequired, Accept: EncryptionRequired, WantEncrypted: true},
+	}
+	for _, c := range cases {
+		c := c
+		t.Run(c.Name, func(t *testing.T) {
+			t.Parallel()
+			ha := Handshake{InfoHash: sha1.Sum([]byte("torrent")), PeerID: sha1.Sum([]byte("a"))}
+			hb := Handshake{InfoHash: ha.InfoHash, PeerID: sha1.Sum([]byte("b"))}
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			defer l.Close()
+			accepted := make(chan *PeerConn, 1)
+			go func() {
+				for {
+					conn, err := l.Accept()
+					if err != nil {
+						return
+					}
+					p, err := AcceptPeer(conn, hb, 8, c.Accept)
+					if err != nil {
+						conn.Close()
+						continue
+					}
+					accepted <- p
+				}
+			}()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			a, err := DialPeer(ctx, netip.MustParseAddrPort(l.Addr().String()), ha, 8, c.Dial)
+			if c.WantError {
+				if err == nil {
+					t.Fatal("wanted error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			b := <-accepted
+			if a.Encrypted != c.WantEncrypted || b.Encrypted != c.WantEncrypted {
+				t.Fatalf("want encrypted %t, got %t and %t", c.WantEncrypted, a.Encrypted, b.Encrypted)
+			}
+			if a.Remote.PeerID != hb.PeerID || b.Remote.PeerID != ha.PeerID {
+				t.Fatal("peer ids not exchanged in handshake")
+			}
+			if !a.Outgoing || b.Outgoing || a.UTP || b.UTP {
+				t.Fatalf("want only the dialed connection outgoing, over TCP, got %t and %t", a.Outgoing, b.Outgoing)
+			}
+			a.Start(ctx)
+			b.Start(ctx)
+			defer a.Close()
+			defer b.Close()
+			a.Send(NewHave(3))
+			b.Send(NewHave(5))
+			if i, _ := expectEvent(t, b, Have).Have(); i != 3 {
+				t.Fatalf("want have 3, got %d", i)
+			}
+			if i, _ := expectEvent(t, a, Have).Have(); i != 5 {
+				t.Fatalf("want have 5, got %d", i)
+			}
+		})
+	}
+}
+
+// recordingConn records what's written to it.
+type recordingConn struct {
+	net.Conn
+	mu      sync.Mutex
+	written bytes.Buffer
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	c.written.Write(b)
+	c.mu.Unlock()
+	return c.Conn.Write(b)
+}
+
+// msePair runs both sides of the MSE handshake over a pipe, A providing provide and B allowing allow.
+func msePair(t *testing.T, skeyA, skeyB [20]byte, provide, allow uint32, ia []byte) (a, b net.Conn, wire *recordingConn, err error) {
+	t.Helper()
+	ca, cb := net.Pipe()
+	t.Cleanup(func() {
+		ca.Close()
+		cb.Close()
+	})
+	wire = &recordingConn{Conn: ca}
+	errs := make(chan error, 1)
+	go func() {
+		var err error
+		b, err = mseRespond(cb, bufio.NewReader(cb), skeyB, allow)
+		if err != nil {
+			cb.Close()
+		}
+		errs <- err
+	}()
+	a, err = mseInitiate(wire, skeyA, provide, ia)
+	if err != nil {
+		ca.Close()
+	}
+	if berr := <-errs; err == nil {
+		err = berr
+	}
+	return a, b, wire, err
+}
+
+func TestMSE(t *testing.T) {
+	t.Parallel()
+	infoHash := sha1.Sum([]byte("torrent"))
+	cases := []struct {
+		Name            string
+		Provide, Allow  uint32
+		WantPlainStream bool
+	}{
+		{Name: "rc4", Provide: mseCryptoRC4 | mseCryptoPlaintext, Allow: mseCryptoRC4 | mseCryptoPlaintext},
+		{Name: "plaintext selected", Provide: mseCryptoRC4 | mseCryptoPlaintext, Allow: mseCryptoPlaintext, WantPlainStream: true},
+	}
+	for _, c := range cases {
+		c := c
+		t.Run(c.Name, func(t *testing.T) {
+			t.Parallel()
+			ia := []byte("\x13BitTorrent protocol, the initial payload")
+			a, b, wire, err := msePair(t, infoHash, infoHash, c.Provide, c.Allow, ia)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			got := make([]byte, len(ia))
+			if _, err := io.ReadFull(b, got); err != nil || !bytes.Equal(got, ia) {
+				t.Fatalf("want initial payload %q, got %q, %v", ia, got, err)
+			}
+			payload := []byte("payload stream")
+			go a.Write(payload)
+			if _, err := io.ReadFull(b, got[:len(payload)]); err != nil || !bytes.Equal(got[:len(payload)], payload) {
+				t.Fatalf("want %q, got %q, %v", payload, got[:len(payload)], err)
+			}
+			go b.Write(payload)
+			if _, err := io.ReadFull(a, got[:len(payload)]); err != nil || !bytes.Equal(got[:len(payload)], payload) {
+				t.Fatalf("want %q, got %q, %v", payload, got[:len(payload)], err)
+			}
+			// The handshake, including the initial payload, is always obfuscated
+			wire.mu.Lock()
+			defer wire.mu.Unlock()
+			if bytes.Contains(wire.written.Bytes(), HandshakePrefix) || bytes.Contains(wire.written.Bytes(), infoHash[:]) {
+				t.Fatal("handshake sent in the clear")
+			}
+			if plain := bytes.Contains(wire.written.Bytes(), payload); plain != c.WantPlainStream {
+				t.Fatalf("want payload in the clear %t, got %t", c.WantPlainStream, plain)
+			}
+		})
+	}
+}
+
+func TestMSEErrors(t *testing.T) {
+	t.Parallel()
+	infoHash := sha1.Sum([]byte("torrent"))
+	if _, _, _, err := msePair(t, infoHash, sha1.Sum([]byte("other")), mseCryptoRC4, mseCryptoRC4, nil); err == nil {
+		t.Fatal("wanted error for another torrent, got nil")
+	}
+	if _, _, _, err := msePair(t, infoHash, infoHash, mseCryptoPlaintext, mseCryptoRC4, nil); err == nil {
+		t.Fatal("wanted error for no common crypto, got nil")
+	}
+
+	// Peers that won't encrypt are rejected before the handshake
+	ca, cb := net.Pipe()
+	defer ca.Close()
+	defer cb.Close()
+	h := Handshake{InfoHash: infoHash}
+	go WriteHandshake(ca, h)
+	if _, err := AcceptPeer(cb, h, 8, EncryptionRequired); !errors.Is(err, ErrEncryptionRequired) {
+		t.Fatalf("want %s, got %v", ErrEncryptionRequired, err)
+	}
+	keys, _ := newMSEKeys()
+	if _, err := keys.secret([]byte{1}); err == nil {
+		t.Fatal("wanted error for invalid public key, got nil")
+	}
+}
@@ -19,15 +19,35 @@ func _() {
 	_ = x[Cancel-8]
 	_ = x[Port-9]
 	_ = x[KeepAlive-10]
+	_ = x[SuggestPiece-13]
+	_ = x[HaveAll-14]
+	_ = x[HaveNone-15]
+	_ = x[RejectRequest-16]
+	_ = x[AllowedFast-17]
+	_ = x[Extended-20]
 }
 
-const _MType_name = "ChokeUnchokeInterestedNotInterestedHaveBitfieldRequestPieceCancelPortKeepAlive"
+const (
+	_MType_name_0 = "ChokeUnchokeInterestedNotInterestedHaveBitfieldRequestPieceCancelPortKeepAlive"
+	_MType_name_1 = "SuggestPieceHaveAllHaveNoneRejectRequestAllowedFast"
+	_MType_name_2 = "Extended"
+)
 
-var _MType_index = [...]uint8{0, 5, 12, 22, 35, 39, 47, 54, 59, 65, 69, 78}
+var (
+	_MType_index_0 = [...]uint8{0, 5, 12, 22, 35, 39, 47, 54, 59, 65, 69, 78}
+	_MType_index_1 = [...]uint8{0, 12, 19, 27, 40, 51}
+)
 
 func (i MType) String() string {
-	if i >= MType(len(_MType_index)-1) {
+	switch {
+	case i <= 10:
+		return _MType_name_0[_MType_index_0[i]:_MType_index_0[i+1]]
+	case 13 <= i && i <= 17:
+		i -= 13
+		return _MType_name_1[_MType_index_1[i]:_MType_index_1[i+1]]
+	case i == 20:
+		return _MType_name_2
+	default:
 		return "MType(" + strconv.FormatInt(int64(i), 10) + ")"
 	}
-	return _MType_name[_MType_index[i]:_MType_index[i+1]]
 }
@@ -1,8 +1,10 @@
 package bt
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -25,21 +27,95 @@ const (
 	KeepAlive // Not an actual message id, but when length=0000
 )
 
-var HandshakePrefix = []byte(`19BitTorrent protocol00000000`)
+// Fast Extension messages. See BEP 6.
+const (
+	SuggestPiece  MType = 0x0D
+	HaveAll       MType = 0x0E
+	HaveNone      MType = 0x0F
+	RejectRequest MType = 0x10
+	AllowedFast   MType = 0x11
+)
 
-func MakeHandshake(infoHash, peerId [20]byte) []byte {
-	out := make([]byte, 69) // 29 + 20 + 20
-	copy(out, HandshakePrefix)
-	copy(out[29:], infoHash[:])
-	copy(out[49:], peerId[:])
-	return out
+// Extended carries Extension Protocol messages, see BEP 10.
+const Extended MType = 20
+
+// HandshakePrefix is the first 20 bytes of every handshake:
+// the length of the protocol string (19) followed by the string itself.
+var HandshakePrefix = []byte("\x13BitTorrent protocol")
+
+const handshakeLength = 68 // 20 + 8 + 20 + 20
+
+// ReservedBit indexes the 64 reserved bits of a handshake, counting from the high bit of the first byte.
+// See BEP 4 for assignments.
+type ReservedBit uint
+
+const (
+	// Extension Protocol, reserved[5] & 0x10. See BEP 10.
+	ExtensionProtocolBit ReservedBit = 43
+	// Fast Extension, reserved[7] & 0x04. See BEP 6.
+	FastBit ReservedBit = 61
+	// DHT, reserved[7] & 0x01. See BEP 5.
+	DHTBit ReservedBit = 63
+)
+
+// Reserved holds the handshake's reserved bytes, used to advertise protocol extensions.
+type Reserved [8]byte
+
+// Has reports whether bit is set
+func (r Reserved) Has(bit ReservedBit) bool {
+	return r[bit/8]&(0x80>>(bit%8)) != 0
+}
+
+// Set sets bit
+func (r *Reserved) Set(bit ReservedBit) {
+	r[bit/8] |= 0x80 >> (bit % 8)
+}
+
+// Handshake is the first message sent in each direction on a peer connection:
+//
+//	<pstrlen=19><pstr="BitTorrent protocol"><reserved: 8><info_hash: 20><peer_id: 20>
+type Handshake struct {
+	Reserved Reserved
+	InfoHash [20]byte
+	PeerID   [20]byte
 }
 
-// Parse 19BitTorrent protocol00000000<infoHash><peerId>
-func ParseHandshake(r io.Reader, infoHash, peerId [20]byte) error {
-	//e := NewStaticExpecter(29) // max(29, 20, 20)
-	buf := make([]byte, 29) // max(29, 20, 20)
-	return ExpectMany(r, buf, HandshakePrefix, infoHash[:], peerId[:])
+// MarshalBinary encodes the handshake as sent on the wire.
+func (h Handshake) MarshalBinary() ([]byte, error) {
+	out := make([]byte, 0, handshakeLength)
+	out = append(out, HandshakePrefix...)
+	out = append(out, h.Reserved[:]...)
+	out = append(out, h.InfoHash[:]...)
+	return append(out, h.PeerID[:]...), nil
+}
+
+// WriteHandshake writes h to w.
+func WriteHandshake(w io.Writer, h Handshake) error {
+	bs, _ := h.MarshalBinary() // Can't fail
+	if _, err := w.Write(bs); err != nil {
+		return fmt.Errorf("writing handshake: %w", err)
+	}
+	return nil
+}
+
+// ReadHandshake reads a handshake from r.
+//
+// The caller is responsible for checking the infohash and peer id,
+// and for deciding what to do with the reserved bits.
+func ReadHandshake(r io.Reader) (*Handshake, error) {
+	buf := make([]byte, handshakeLength)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, fmt.Errorf("reading handshake: %w", err)
+	}
+	if !bytes.Equal(buf[:len(HandshakePrefix)], HandshakePrefix) {
+		return nil, fmt.Errorf("handshake: want protocol %q, got %q", HandshakePrefix, buf[:len(HandshakePrefix)])
+	}
+	h := &Handshake{}
+	rest := buf[len(HandshakePrefix):]
+	copy(h.Reserved[:], rest[:8])
+	copy(h.InfoHash[:], rest[8:28])
+	copy(h.PeerID[:], rest[28:48])
+	return h, nil
 }
 
 func Expect(from io.Reader, buf, want []byte) error {
@@ -72,30 +148,61 @@ type Message struct {
 	Payload []byte
 }
 
-// ParseMessage tries to read a peer message from the reader, returning an error on failure
+// Most Extended message we accept. Metadata pieces (BEP 9) are 16KiB plus a small dictionary.
+const maxExtendedLength = 256 * 1024
+
+// ParseMessage tries to read a peer message from the reader, returning an error on failure.
+// Bitfields are limited to maxExtendedLength, since the number of pieces isn't known. See ReadMessage.
 func ParseMessage(r io.Reader) (*Message, error) {
+	return ReadMessage(r, 8*(maxExtendedLength-1))
+}
+
+// ReadMessage reads a peer message for a torrent with numPieces pieces.
+// Lengths beyond what the message's type allows are rejected before reading the payload,
+// so peers can't make us allocate more than a block.
+func ReadMessage(r io.Reader, numPieces int) (*Message, error) {
 	// Parse length as BigEndian uint32
 	var length uint32
 	err := binary.Read(r, binary.BigEndian, &length)
 	if err != nil {
 		return nil, fmt.Errorf("couldn't parse message length: %w", err)
 	}
-	fmt.Println(length)
 	// if 0000, it's keep-alive
 	if length == 0 {
 		return &Message{Type: KeepAlive}, nil
 	}
-	buf := make([]byte, length)
 	// Parse message id/type (one byte)
-	if _, err = io.ReadFull(r, buf); err != nil {
+	var id [1]byte
+	if _, err = io.ReadFull(r, id[:]); err != nil {
 		return nil, fmt.Errorf("couldn't parse message id byte: %w", err)
 	}
-	mType := MType(buf[0])
+	mType := MType(id[0])
+	if max := maxMessageLength(mType, numPieces); length > max {
+		return nil, fmt.Errorf("%s message of %d bytes exceeds %d", mType, length, max)
+	}
 	if length == 1 {
 		return ValidateMessage(&Message{Type: mType, Length: length})
-	} else {
-		return ValidateMessage(&Message{Type: mType, Length: length, Payload: buf[1:]})
 	}
+	payload := make([]byte, length-1)
+	if _, err = io.ReadFull(r, payload); err != nil {
+		return nil, fmt.Errorf("couldn't read %s payload: %w", mType, err)
+	}
+	return ValidateMessage(&Message{Type: mType, Length: length, Payload: payload})
+}
+
+// maxMessageLength is the longest message of type t we accept, id byte included, for a torrent with numPieces pieces.
+// Fixed length types are checked exactly by ValidateMessage; unknown types fail there too.
+func maxMessageLength(t MType, numPieces int) uint32 {
+	switch t {
+	case Piece:
+		return 9 + BlockSize
+	case Bitfield:
+		return 1 + uint32((numPieces+7)/8)
+	case Extended:
+		return maxExtendedLength
+	}
+	// The longest fixed length message: Request, Cancel and RejectRequest
+	return 13
 }
 
 // ValidateMessage ensures a message's length is appropriate for its type.
@@ -103,15 +210,19 @@ func ParseMessage(r io.Reader) (*Message, error) {
 func ValidateMessage(m *Message) (*Message, error) {
 	want := m.Length
 	switch m.Type {
-	case Choke, Unchoke, Interested, NotInterested: // No payload
+	case Choke, Unchoke, Interested, NotInterested, HaveAll, HaveNone: // No payload
 		want = 1
-	case Have: // Fixed length with payload
+	case Have, SuggestPiece, AllowedFast: // Fixed length with payload: <index>
 		want = 5
-	case Request, Cancel: // Fixed length 13 with payload: <index><begin><length>
+	case Request, Cancel, RejectRequest: // Fixed length 13 with payload: <index><begin><length>
 		want = 13
 	case Port: // Fixed length with payload
 		// (Used in newer versions for DHT tracker)
 		want = 3
+	case Extended: // Variable length: <extended id><payload...> (at least 2)
+		if m.Length < 2 {
+			return nil, fmt.Errorf("expected length >=2 for Extended message, got %d", m.Length)
+		}
 	case Bitfield: // Variable length
 		//TODO validate against length of pieces?
 	case Piece: // Variable length: <index><begin><block...> (at least 9)
@@ -129,3 +240,247 @@ func ValidateMessage(m *Message) (*Message, error) {
 	}
 	return m, nil
 }
+
+// MarshalBinary encodes m as a length-prefixed frame: <length: uint32><id: 1><payload>.
+// KeepAlive is a bare zero length.
+func (m *Message) MarshalBinary() ([]byte, error) {
+	if m.Type == KeepAlive {
+		return []byte{0, 0, 0, 0}, nil
+	}
+	if err := m.validateOutgoing(); err != nil {
+		return nil, err
+	}
+	out := make([]byte, 5, 5+len(m.Payload))
+	binary.BigEndian.PutUint32(out, uint32(1+len(m.Payload)))
+	out[4] = byte(m.Type)
+	return append(out, m.Payload...), nil
+}
+
+// validateOutgoing checks a message we built before it's sent.
+func (m *Message) validateOutgoing() error {
+	_, err := ValidateMessage(&Message{Type: m.Type, Length: uint32(1 + len(m.Payload)), Payload: m.Payload})
+	return err
+}
+
+// NewMessage creates a message of any type. For types without a payload, payload should be nil.
+func NewMessage(t MType, payload []byte) *Message {
+	if t == KeepAlive {
+		return &Message{Type: KeepAlive}
+	}
+	return &Message{Type: t, Length: uint32(1 + len(payload)), Payload: payload}
+}
+
+func NewKeepAlive() *Message {
+	return &Message{Type: KeepAlive}
+}
+
+// NewHave announces that we have piece index
+func NewHave(index uint32) *Message {
+	return NewMessage(Have, binary.BigEndian.AppendUint32(nil, index))
+}
+
+// NewBitfieldMessage creates a Bitfield message from the pieces we have.
+// (NewBitfield already constructs a BField.)
+func NewBitfieldMessage(b *BField) *Message {
+	return NewMessage(Bitfield, b.Bytes())
+}
+
+// BlockRequest identifies a block within a piece: the payload of Request, Cancel, and RejectRequest messages.
+type BlockRequest struct {
+	Index  uint32
+	Begin  uint32
+	Length uint32
+}
+
+func (r BlockRequest) payload() []byte {
+	out := make([]byte, 12)
+	binary.BigEndian.PutUint32(out, r.Index)
+	binary.BigEndian.PutUint32(out[4:], r.Begin)
+	binary.BigEndian.PutUint32(out[8:], r.Length)
+	return out
+}
+
+func NewRequest(index, begin, length uint32) *Message {
+	return NewMessage(Request, BlockRequest{index, begin, length}.payload())
+}
+
+func NewCancel(index, begin, length uint32) *Message {
+	return NewMessage(Cancel, BlockRequest{index, begin, length}.payload())
+}
+
+// NewReject tells the peer we won't serve its request. Requires the Fast Extension.
+func NewReject(index, begin, length uint32) *Message {
+	return NewMessage(RejectRequest, BlockRequest{index, begin, length}.payload())
+}
+
+// NewSuggestPiece suggests the peer download piece index, e.g. because it's in our cache.
+func NewSuggestPiece(index uint32) *Message {
+	return NewMessage(SuggestPiece, binary.BigEndian.AppendUint32(nil, index))
+}
+
+// NewAllowedFast tells the peer it may request piece index even while choked.
+func NewAllowedFast(index uint32) *Message {
+	return NewMessage(AllowedFast, binary.BigEndian.AppendUint32(nil, index))
+}
+
+// NewPiece creates a Piece message carrying block, which starts at offset begin within piece index.
+func NewPiece(index, begin uint32, block []byte) *Message {
+	payload := make([]byte, 8, 8+len(block))
+	binary.BigEndian.PutUint32(payload, index)
+	binary.BigEndian.PutUint32(payload[4:], begin)
+	return NewMessage(Piece, append(payload, block...))
+}
+
+// NewPort advertises the port our DHT node listens on
+func NewPort(port uint16) *Message {
+	return NewMessage(Port, binary.BigEndian.AppendUint16(nil, port))
+}
+
+// NewExtended creates an Extension Protocol message with the receiver's id for the extension.
+// id 0 is the extended handshake.
+func NewExtended(id uint8, payload []byte) *Message {
+	return NewMessage(Extended, append([]byte{id}, payload...))
+}
+
+var errWrongType = errors.New("wrong message type")
+
+func (m *Message) expect(types ...MType) error {
+	for _, t := range types {
+		if m.Type == t {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: want %v, got %s", errWrongType, types, m.Type)
+}
+
+// Have returns the piece index of a Have message.
+func (m *Message) Have() (uint32, error) {
+	if err := m.expect(Have); err != nil {
+		return 0, err
+	}
+	if len(m.Payload) != 4 {
+		return 0, fmt.Errorf("expected 4 byte Have payload, got %d", len(m.Payload))
+	}
+	return binary.BigEndian.Uint32(m.Payload), nil
+}
+
+// PieceIndex returns the piece index of a Have, SuggestPiece, or AllowedFast message.
+func (m *Message) PieceIndex() (uint32, error) {
+	if err := m.expect(Have, SuggestPiece, AllowedFast); err != nil {
+		return 0, err
+	}
+	if len(m.Payload) != 4 {
+		return 0, fmt.Errorf("expected 4 byte %s payload, got %d", m.Type, len(m.Payload))
+	}
+	return binary.BigEndian.Uint32(m.Payload), nil
+}
+
+// BlockRequest returns the block identified by a Request, Cancel, or RejectRequest message.
+func (m *Message) BlockRequest() (BlockRequest, error) {
+	if err := m.expect(Request, Cancel, RejectRequest); err != nil {
+		return BlockRequest{}, err
+	}
+	if len(m.Payload) != 12 {
+		return BlockRequest{}, fmt.Errorf("expected 12 byte %s payload, got %d", m.Type, len(m.Payload))
+	}
+	return BlockRequest{
+		Index:  binary.BigEndian.Uint32(m.Payload),
+		Begin:  binary.BigEndian.Uint32(m.Payload[4:]),
+		Length: binary.BigEndian.Uint32(m.Payload[8:]),
+	}, nil
+}
+
+// BlockPayload returns the piece index, offset, and data of a Piece message.
+// block aliases the message's payload.
+func (m *Message) BlockPayload() (index, begin uint32, block []byte, err error) {
+	if err := m.expect(Piece); err != nil {
+		return 0, 0, nil, err
+	}
+	if len(m.Payload) < 8 {
+		return 0, 0, nil, fmt.Errorf("expected Piece payload of at least 8 bytes, got %d", len(m.Payload))
+	}
+	return binary.BigEndian.Uint32(m.Payload), binary.BigEndian.Uint32(m.Payload[4:]), m.Payload[8:], nil
+}
+
+// ExtendedPayload returns the extended message id and payload of an Extended message.
+// payload aliases the message's payload.
+func (m *Message) ExtendedPayload() (id uint8, payload []byte, err error) {
+	if err := m.expect(Extended); err != nil {
+		return 0, nil, err
+	}
+	if len(m.Payload) < 1 {
+		return 0, nil, errors.New("expected Extended payload of at least 1 byte, got 0")
+	}
+	return m.Payload[0], m.Payload[1:], nil
+}
+
+// PortNumber returns the DHT port of a Port message.
+func (m *Message) PortNumber() (uint16, error) {
+	if err := m.expect(Port); err != nil {
+		return 0, err
+	}
+	if len(m.Payload) != 2 {
+		return 0, fmt.Errorf("expected 2 byte Port payload, got %d", len(m.Payload))
+	}
+	return binary.BigEndian.Uint16(m.Payload), nil
+}
+
+// Bitfield interprets a Bitfield message for a torrent with numPieces pieces.
+//
+// Per BEP 3, the payload must be exactly long enough for numPieces bits, with spare bits cleared.
+func (m *Message) Bitfield(numPieces int) (*BField, error) {
+	if err := m.expect(Bitfield); err != nil {
+		return nil, err
+	}
+	if want := (numPieces + 7) / 8; len(m.Payload) != want {
+		return nil, fmt.Errorf("expected %d byte Bitfield for %d pieces, got %d", want, numPieces, len(m.Payload))
+	}
+	if spare := numPieces % 8; spare != 0 && m.Payload[len(m.Payload)-1]&(0xff>>spare) != 0 {
+		return nil, errors.New("bitfield has spare bits set")
+	}
+	bs := make([]byte, len(m.Payload))
+	copy(bs, m.Payload)
+	return NewBitfield(bs, numPieces)
+}
+
+// MessageWriter frames messages onto an io.Writer.
+//
+// Messages are buffered until Flush, so a batch of small messages (e.g. several Requests)
+// goes out in as few writes as possible.
+type MessageWriter struct {
+	w *bufio.Writer
+}
+
+func NewMessageWriter(w io.Writer) *MessageWriter {
+	return &MessageWriter{w: bufio.NewWriterSize(w, 32*1024)}
+}
+
+// WriteMessage buffers m. It may write to the underlying writer if the buffer fills.
+func (mw *MessageWriter) WriteMessage(m *Message) error {
+	if m.Type == KeepAlive {
+		_, err := mw.w.Write([]byte{0, 0, 0, 0})
+		return err
+	}
+	if err := m.validateOutgoing(); err != nil {
+		return err
+	}
+	// Write the header and payload separately to avoid copying large Piece payloads
+	var header [5]byte
+	binary.BigEndian.PutUint32(header[:], uint32(1+len(m.Payload)))
+	header[4] = byte(m.Type)
+	if _, err := mw.w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := mw.w.Write(m.Payload)
+	return err
+}
+
+// Flush writes any buffered messages to the underlying writer.
+func (mw *MessageWriter) Flush() error {
+	return mw.w.Flush()
+}
+
+// Buffered is the number of bytes waiting to be flushed.
+func (mw *MessageWriter) Buffered() int {
+	return mw.w.Buffered()
+}
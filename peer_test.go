@@ -48,17 +48,59 @@ func TestExpect(t *testing.T) {
 	}
 }
 
-// TestHandshakeSymmetry confirms that MakeHandshake and ParseHandshake are inverses.
+// TestHandshakeSymmetry confirms that WriteHandshake and ReadHandshake are inverses.
 func TestHandshakeSymmetry(t *testing.T) {
 	// sha1.Sum() will give us a [20]byte
-	infoHash := sha1.Sum([]byte("infohash"))
-	peerId := sha1.Sum([]byte("peerid"))
+	want := Handshake{
+		InfoHash: sha1.Sum([]byte("infohash")),
+		PeerID:   sha1.Sum([]byte("peerid")),
+	}
+	want.Reserved.Set(DHTBit)
+	want.Reserved.Set(ExtensionProtocolBit)
 
-	r := bytes.NewReader(MakeHandshake(infoHash, peerId))
-	err := ParseHandshake(r, infoHash, peerId)
+	var buf bytes.Buffer
+	if err := WriteHandshake(&buf, want); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if buf.Len() != 68 {
+		t.Fatalf("want 68 byte handshake, got %d", buf.Len())
+	}
+	got, err := ReadHandshake(&buf)
 	if err != nil {
 		t.Fatalf("Unexpected error: %s", err)
 	}
+	if *got != want {
+		t.Fatalf("want %#v, got %#v", want, *got)
+	}
+}
+
+func TestHandshakeWireFormat(t *testing.T) {
+	h := Handshake{}
+	h.Reserved.Set(ExtensionProtocolBit)
+	h.Reserved.Set(FastBit)
+	h.Reserved.Set(DHTBit)
+	bs, _ := h.MarshalBinary()
+	if bs[0] != 19 || string(bs[1:20]) != "BitTorrent protocol" {
+		t.Fatalf("bad protocol prefix: %q", bs[:20])
+	}
+	wantReserved := []byte{0, 0, 0, 0, 0, 0x10, 0, 0x05}
+	if !bytes.Equal(bs[20:28], wantReserved) {
+		t.Fatalf("want reserved %x, got %x", wantReserved, bs[20:28])
+	}
+	for _, bit := range []ReservedBit{ExtensionProtocolBit, FastBit, DHTBit} {
+		if !h.Reserved.Has(bit) {
+			t.Fatalf("expected bit %d set", bit)
+		}
+	}
+	if h.Reserved.Has(0) {
+		t.Fatal("expected bit 0 unset")
+	}
+
+	// The old ASCII-digit format must be rejected
+	_, err := ReadHandshake(bytes.NewReader([]byte("19BitTorrent protocol00000000" + string(make([]byte, 40)))))
+	if err == nil {
+		t.Fatal("expected error for ASCII handshake prefix, got none")
+	}
 }
 
 func TestParseMessage(t *testing.T) {
@@ -210,3 +252,222 @@ func TestParseMessage(t *testing.T) {
 		})
 	}
 }
+
+func TestReadMessageLimits(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		Name      string
+		Input     []byte
+		NumPieces int
+		WantError bool
+	}{
+		{"huge length", []byte{0xff, 0xff, 0xff, 0xff, 7}, 8, true},
+		{"Piece over a block", []byte{0, 0, 0x40, 0x0a, 7}, 8, true},
+		{"Piece of a block", []byte{0, 0, 0x40, 0x09, 7}, 8, false},
+		{"Bitfield too long", []byte{0, 0, 0, 3, 5}, 8, true},
+		{"Bitfield for 9 pieces", []byte{0, 0, 0, 3, 5}, 9, false},
+		{"Extended over limit", []byte{0, 4, 0, 1, 20}, 8, true},
+		{"Request too long", []byte{0, 0, 0, 14, 6}, 8, true},
+	}
+	for _, c := range cases {
+		c := c
+		t.Run(c.Name, func(t *testing.T) {
+			t.Parallel()
+			// The payload never arrives, so only the length check can fail before reading it
+			r := bytes.NewReader(append(c.Input, 0xff))
+			_, err := ReadMessage(r, c.NumPieces)
+			if !c.WantError {
+				// Within the limit, so we tried to read the payload
+				if err == nil || r.Len() != 0 {
+					t.Fatalf("want payload read to fail, got %v with %d bytes unread", err, r.Len())
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("wanted error, got nil")
+			}
+			// Rejected without reading any further
+			if err = Expect(r, []byte{0}, []byte{0xff}); err != nil {
+				t.Fatalf("next byte from reader doesn't match: %s", err)
+			}
+		})
+	}
+}
+
+func TestMessageRoundTrip(t *testing.T) {
+	t.Parallel()
+	bf, err := NewBitfield([]byte{0b10100000}, 3)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	cases := []struct {
+		Name string
+		Msg  *Message
+		Want []byte
+	}{
+		{Name: "KeepAlive", Msg: NewKeepAlive(), Want: []byte{0, 0, 0, 0}},
+		{Name: "Choke", Msg: NewMessage(Choke, nil), Want: []byte{0, 0, 0, 1, 0}},
+		{Name: "Interested", Msg: NewMessage(Interested, nil), Want: []byte{0, 0, 0, 1, 2}},
+		{Name: "Have", Msg: NewHave(0x01020304), Want: []byte{0, 0, 0, 5, 4, 1, 2, 3, 4}},
+		{Name: "Bitfield", Msg: NewBitfieldMessage(bf), Want: []byte{0, 0, 0, 2, 5, 0b10100000}},
+		{
+			Name: "Request",
+			Msg:  NewRequest(1, 0x4000, 0x4000),
+			Want: []byte{0, 0, 0, 13, 6, 0, 0, 0, 1, 0, 0, 0x40, 0, 0, 0, 0x40, 0},
+		},
+		{
+			Name: "Piece",
+			Msg:  NewPiece(2, 3, []byte("abc")),
+			Want: []byte{0, 0, 0, 12, 7, 0, 0, 0, 2, 0, 0, 0, 3, 'a', 'b', 'c'},
+		},
+		{
+			Name: "Cancel",
+			Msg:  NewCancel(1, 2, 3),
+			Want: []byte{0, 0, 0, 13, 8, 0, 0, 0, 1, 0, 0, 0, 2, 0, 0, 0, 3},
+		},
+		{Name: "Port", Msg: NewPort(6881), Want: []byte{0, 0, 0, 3, 9, 0x1a, 0xe1}},
+		{Name: "SuggestPiece", Msg: NewSuggestPiece(5), Want: []byte{0, 0, 0, 5, 0x0d, 0, 0, 0, 5}},
+		{Name: "HaveAll", Msg: NewMessage(HaveAll, nil), Want: []byte{0, 0, 0, 1, 0x0e}},
+		{Name: "HaveNone", Msg: NewMessage(HaveNone, nil), Want: []byte{0, 0, 0, 1, 0x0f}},
+		{
+			Name: "RejectRequest",
+			Msg:  NewReject(1, 2, 3),
+			Want: []byte{0, 0, 0, 13, 0x10, 0, 0, 0, 1, 0, 0, 0, 2, 0, 0, 0, 3},
+		},
+		{Name: "AllowedFast", Msg: NewAllowedFast(6), Want: []byte{0, 0, 0, 5, 0x11, 0, 0, 0, 6}},
+		{Name: "Extended", Msg: NewExtended(3, []byte("de")), Want: []byte{0, 0, 0, 4, 20, 3, 'd', 'e'}},
+	}
+	for _, c := range cases {
+		c := c
+		t.Run(c.Name, func(t *testing.T) {
+			t.Parallel()
+			got, err := c.Msg.MarshalBinary()
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !bytes.Equal(got, c.Want) {
+				t.Fatalf("want %v, got %v", c.Want, got)
+			}
+			parsed, err := ParseMessage(bytes.NewReader(got))
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if parsed.Type != c.Msg.Type || !bytes.Equal(parsed.Payload, c.Msg.Payload) {
+				t.Fatalf("want %s %v after round trip, got %s %v", c.Msg.Type, c.Msg.Payload, parsed.Type, parsed.Payload)
+			}
+		})
+	}
+}
+
+func TestMarshalInvalidMessage(t *testing.T) {
+	if _, err := NewMessage(Have, []byte{1, 2}).MarshalBinary(); err == nil {
+		t.Fatal("wanted error, got nil")
+	}
+	if _, err := NewMessage(Piece, []byte{1}).MarshalBinary(); err == nil {
+		t.Fatal("wanted error, got nil")
+	}
+	if _, err := NewMessage(Extended, nil).MarshalBinary(); err == nil {
+		t.Fatal("wanted error, got nil")
+	}
+	if _, err := NewMessage(HaveAll, []byte{1}).MarshalBinary(); err == nil {
+		t.Fatal("wanted error, got nil")
+	}
+	if _, err := NewMessage(MType(12), nil).MarshalBinary(); err == nil {
+		t.Fatal("wanted error for unknown type, got nil")
+	}
+}
+
+func TestMessageAccessors(t *testing.T) {
+	t.Parallel()
+	if i, err := NewHave(7).Have(); err != nil || i != 7 {
+		t.Fatalf("want Have 7, got %d (%v)", i, err)
+	}
+	want := BlockRequest{Index: 1, Begin: 2, Length: 3}
+	for _, m := range []*Message{NewRequest(1, 2, 3), NewCancel(1, 2, 3), NewReject(1, 2, 3)} {
+		if got, err := m.BlockRequest(); err != nil || got != want {
+			t.Fatalf("want %v from %s, got %v (%v)", want, m.Type, got, err)
+		}
+	}
+	for _, m := range []*Message{NewHave(8), NewSuggestPiece(8), NewAllowedFast(8)} {
+		if i, err := m.PieceIndex(); err != nil || i != 8 {
+			t.Fatalf("want index 8 from %s, got %d (%v)", m.Type, i, err)
+		}
+	}
+	index, begin, block, err := NewPiece(4, 5, []byte("data")).BlockPayload()
+	if err != nil || index != 4 || begin != 5 || string(block) != "data" {
+		t.Fatalf("want piece 4 at 5 with data, got %d at %d with %q (%v)", index, begin, block, err)
+	}
+	if port, err := NewPort(6881).PortNumber(); err != nil || port != 6881 {
+		t.Fatalf("want port 6881, got %d (%v)", port, err)
+	}
+	if _, err := NewHave(1).PortNumber(); err == nil {
+		t.Fatal("wanted error for wrong message type, got nil")
+	}
+}
+
+func TestMessageBitfield(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		Name      string
+		Payload   []byte
+		NumPieces int
+		WantError bool
+	}{
+		{Name: "exact", Payload: []byte{0xff}, NumPieces: 8},
+		{Name: "spare bits clear", Payload: []byte{0xff, 0x80}, NumPieces: 9},
+		{Name: "spare bits set", Payload: []byte{0xff, 0x40}, NumPieces: 9, WantError: true},
+		{Name: "too short", Payload: []byte{0xff}, NumPieces: 9, WantError: true},
+		{Name: "too long", Payload: []byte{0xff, 0}, NumPieces: 8, WantError: true},
+	}
+	for _, c := range cases {
+		c := c
+		t.Run(c.Name, func(t *testing.T) {
+			t.Parallel()
+			bf, err := NewMessage(Bitfield, c.Payload).Bitfield(c.NumPieces)
+			if c.WantError {
+				if err == nil {
+					t.Fatal("wanted error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if bf.Length() != c.NumPieces {
+				t.Fatalf("want %d pieces, got %d", c.NumPieces, bf.Length())
+			}
+		})
+	}
+}
+
+func TestMessageWriter(t *testing.T) {
+	var out bytes.Buffer
+	mw := NewMessageWriter(&out)
+	for _, m := range []*Message{NewMessage(Interested, nil), NewRequest(0, 0, 16384), NewKeepAlive()} {
+		if err := mw.WriteMessage(m); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	if out.Len() != 0 {
+		t.Fatalf("want nothing written before Flush, got %d bytes", out.Len())
+	}
+	if err := mw.WriteMessage(NewMessage(Have, nil)); err == nil {
+		t.Fatal("wanted error for invalid message, got nil")
+	}
+	if err := mw.Flush(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	want := []MType{Interested, Request, KeepAlive}
+	for _, w := range want {
+		m, err := ParseMessage(&out)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if m.Type != w {
+			t.Fatalf("want %s, got %s", w, m.Type)
+		}
+	}
+	if out.Len() != 0 {
+		t.Fatalf("want %d messages, got %d trailing bytes", len(want), out.Len())
+	}
+}
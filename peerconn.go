@@ -0,0 +1,714 @@
+package bt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Peers send a KeepAlive after this long without sending anything else
+	DefaultKeepAliveInterval = 2 * time.Minute
+	// Connections are dropped after this long without receiving anything, keep-alives included
+	DefaultPeerIdleTimeout = 3 * time.Minute
+	// Time allowed for both sides of the handshake
+	peerHandshakeTimeout = 20 * time.Second
+	// Requests for more than this are a protocol error. Most clients use 16KiB.
+	maxBlockLength = 128 * 1024
+)
+
+// ErrPeerClosed is returned when sending on a closed PeerConn.
+var ErrPeerClosed = errors.New("peer connection closed")
+
+// PeerState is the choke/interest state of a connection, see BEP 3.
+// Connections start out choking and not interested on both sides.
+type PeerState struct {
+	AmChoking      bool
+	AmInterested   bool
+	PeerChoking    bool
+	PeerInterested bool
+}
+
+// PeerConn is an established connection with a single peer.
+//
+// After the handshake (NewPeerConn or DialPeer), Start runs a reader and a writer goroutine.
+// Received messages update the connection's state, then are delivered on Events.
+// Messages queued with Send update our side of the state and are written in batches.
+//
+// If both sides advertise the Fast Extension (BEP 6), requests we won't serve are answered with
+// RejectRequest rather than dropped, and pieces may be requested while choked if they're allowed fast.
+type PeerConn struct {
+	Addr netip.AddrPort
+	// The handshake the peer sent us
+	Remote Handshake
+	// Send a KeepAlive after this long without writing
+	KeepAliveInterval time.Duration
+	// Close the connection after this long without reading
+	IdleTimeout time.Duration
+	// When the handshake completed
+	ConnectedAt time.Time
+	// Both sides support the Fast Extension
+	Fast bool
+	// Both sides support the Extension Protocol (BEP 10)
+	Extended bool
+	// The connection is encrypted with RC4 (MSE)
+	Encrypted bool
+	// The connection is over uTP rather than TCP
+	UTP bool
+	// We connected to the peer, so it accepts incoming connections. Not set for holepunched connections.
+	Outgoing bool
+
+	conn      net.Conn
+	numPieces int
+	outgoing  chan *Message
+	events    chan *Message
+	done      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+	// Block bytes received and sent
+	downloaded atomic.Int64
+	uploaded   atomic.Int64
+	// When we last received a block, in Unix nanoseconds
+	lastBlock atomic.Int64
+
+	mu    sync.Mutex
+	state PeerState
+	// The pieces the peer has, from Bitfield and Have. Guarded by mu.
+	peerPieces *BField
+	// Whether we've received anything after the handshake, since Bitfield must come first
+	gotMessage bool
+	// Requests we've sent that haven't been answered, and when we sent them
+	ourRequests map[BlockRequest]time.Time
+	// Requests the peer has sent that we haven't served
+	peerRequests map[BlockRequest]struct{}
+	// Pieces the peer lets us request while choked, and pieces we let it request
+	allowedFast     map[uint32]struct{}
+	peerAllowedFast map[uint32]struct{}
+	// The peer's extended handshake, or nil if it hasn't sent one
+	peerExtensions *ExtendedHandshake
+	err            error
+}
+
+// DialPeer connects to addr and exchanges handshakes, encrypting the connection according to policy. See NewPeerConn.
+//
+// With EncryptionPreferred, peers that fail the encrypted handshake are redialed in plaintext.
+func DialPeer(ctx context.Context, addr netip.AddrPort, local Handshake, numPieces int, policy EncryptionPolicy) (*PeerConn, error) {
+	dial := func(policy EncryptionPolicy) (*PeerConn, error) {
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", addr.String())
+		if err != nil {
+			return nil, fmt.Errorf("dialing peer %s: %w", addr, err)
+		}
+		p, err := initiatePeerConn(conn, local, numPieces, policy)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return p, nil
+	}
+	p, err := dial(policy)
+	var dialErr *net.OpError
+	if err != nil && policy == EncryptionPreferred && ctx.Err() == nil && !(errors.As(err, &dialErr) && dialErr.Op == "dial") {
+		// Peers that don't support encryption usually just hang up
+		p, err = dial(EncryptionDisabled)
+	}
+	if err != nil {
+		return nil, err
+	}
+	p.Outgoing = true
+	return p, nil
+}
+
+// initiatePeerConn exchanges handshakes over an outgoing conn, first encrypting it unless policy is EncryptionDisabled or EncryptionEnabled.
+// Our handshake is sent as the initial payload of the encryption handshake.
+func initiatePeerConn(conn net.Conn, local Handshake, numPieces int, policy EncryptionPolicy) (*PeerConn, error) {
+	if policy == EncryptionDisabled || policy == EncryptionEnabled {
+		return NewPeerConn(conn, local, numPieces)
+	}
+	hs, _ := local.MarshalBinary() // Can't fail
+	c, err := mseInitiate(conn, local.InfoHash, mseProvide(policy), hs)
+	if err != nil {
+		return nil, err
+	}
+	return newPeerConn(c, local, numPieces, true)
+}
+
+// AcceptPeer exchanges handshakes over an incoming conn, which may be encrypted or plaintext.
+// Connections policy forbids are rejected. conn isn't closed on failure.
+func AcceptPeer(conn net.Conn, local Handshake, numPieces int, policy EncryptionPolicy) (*PeerConn, error) {
+	conn.SetDeadline(time.Now().Add(peerHandshakeTimeout))
+	r := bufio.NewReader(conn)
+	prefix, err := r.Peek(len(HandshakePrefix))
+	if err != nil {
+		return nil, fmt.Errorf("reading handshake: %w", err)
+	}
+	if bytes.Equal(prefix, HandshakePrefix) {
+		if policy == EncryptionRequired {
+			return nil, ErrEncryptionRequired
+		}
+		return NewPeerConn(&mseConn{Conn: conn, r: r, w: conn}, local, numPieces)
+	}
+	if policy == EncryptionDisabled {
+		return nil, errors.New("handshake: peer wants encryption, but it's disabled")
+	}
+	c, err := mseRespond(conn, r, local.InfoHash, mseProvide(policy))
+	if err != nil {
+		return nil, err
+	}
+	return NewPeerConn(c, local, numPieces)
+}
+
+// NewPeerConn exchanges handshakes over conn for a torrent with numPieces pieces.
+//
+// It fails if the peer's infohash doesn't match ours. conn isn't closed on failure.
+func NewPeerConn(conn net.Conn, local Handshake, numPieces int) (*PeerConn, error) {
+	return newPeerConn(conn, local, numPieces, false)
+}
+
+// newPeerConn is NewPeerConn, but doesn't send our handshake if it was already sent.
+func newPeerConn(conn net.Conn, local Handshake, numPieces int, sent bool) (*PeerConn, error) {
+	peerPieces, err := NewEmptyBitfield(numPieces)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(peerHandshakeTimeout))
+	// Write concurrently, so neither side blocks on an unbuffered conn
+	writeErr := make(chan error, 1)
+	go func() {
+		if sent {
+			writeErr <- nil
+			return
+		}
+		writeErr <- WriteHandshake(conn, local)
+	}()
+	remote, err := ReadHandshake(conn)
+	if err == nil {
+		err = <-writeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	if remote.InfoHash != local.InfoHash {
+		return nil, fmt.Errorf("handshake: want infohash %x, got %x", local.InfoHash, remote.InfoHash)
+	}
+	conn.SetDeadline(time.Time{})
+
+	// Zero for connections without an address, like net.Pipe
+	addr, _ := addrPortFromNet(conn.RemoteAddr())
+	mc, encrypted := conn.(*mseConn)
+	inner := conn
+	if encrypted {
+		inner = mc.Conn
+	}
+	_, utp := inner.(*UTPConn)
+	return &PeerConn{
+		Addr:              addr,
+		Remote:            *remote,
+		KeepAliveInterval: DefaultKeepAliveInterval,
+		IdleTimeout:       DefaultPeerIdleTimeout,
+		ConnectedAt:       time.Now(),
+		Fast:              local.Reserved.Has(FastBit) && remote.Reserved.Has(FastBit),
+		Extended:          local.Reserved.Has(ExtensionProtocolBit) && remote.Reserved.Has(ExtensionProtocolBit),
+		Encrypted:         encrypted && mc.encrypted,
+		UTP:               utp,
+		conn:              conn,
+		numPieces:         numPieces,
+		outgoing:          make(chan *Message, 128),
+		events:            make(chan *Message, 64),
+		done:              make(chan struct{}),
+		state:             PeerState{AmChoking: true, PeerChoking: true},
+		peerPieces:        peerPieces,
+		ourRequests:       make(map[BlockRequest]time.Time),
+		peerRequests:      make(map[BlockRequest]struct{}),
+		allowedFast:       make(map[uint32]struct{}),
+		peerAllowedFast:   make(map[uint32]struct{}),
+	}, nil
+}
+
+// Start runs the connection until ctx is cancelled, Close is called, or an error occurs.
+func (p *PeerConn) Start(ctx context.Context) {
+	p.wg.Add(2)
+	go p.readLoop()
+	go p.writeLoop()
+	go func() {
+		select {
+		case <-ctx.Done():
+			p.closeWithError(ctx.Err())
+		case <-p.done:
+		}
+	}()
+}
+
+// Events receives each message from the peer, except keep-alives, after the state has been updated.
+// Have messages for pieces the peer already announced aren't delivered.
+// It's closed when the connection ends.
+func (p *PeerConn) Events() <-chan *Message {
+	return p.events
+}
+
+// Done is closed when the connection ends.
+func (p *PeerConn) Done() <-chan struct{} {
+	return p.done
+}
+
+// Err returns why the connection ended, or nil if it's still open.
+func (p *PeerConn) Err() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+// Close ends the connection and waits for its goroutines to exit.
+func (p *PeerConn) Close() error {
+	p.closeWithError(ErrPeerClosed)
+	p.wg.Wait()
+	return nil
+}
+
+func (p *PeerConn) closeWithError(err error) {
+	p.closeOnce.Do(func() {
+		p.mu.Lock()
+		p.err = err
+		p.mu.Unlock()
+		close(p.done)
+		p.conn.Close()
+	})
+}
+
+// State returns a snapshot of the choke/interest state.
+func (p *PeerConn) State() PeerState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.state
+}
+
+// PeerHas reports whether the peer has announced piece index.
+func (p *PeerConn) PeerHas(index int) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	has, _ := p.peerPieces.Get(index)
+	return has
+}
+
+// PeerPieces returns a copy of the pieces the peer has announced.
+func (p *PeerConn) PeerPieces() *BField {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	b, _ := NewBitfield(p.peerPieces.Bytes(), p.peerPieces.Length())
+	return b
+}
+
+// Requestable returns the pieces we may request from the peer now:
+// all of its pieces if it isn't choking us, or otherwise just those it has allowed fast.
+func (p *PeerConn) Requestable() *BField {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	b, _ := NewBitfield(p.peerPieces.Bytes(), p.peerPieces.Length())
+	if !p.state.PeerChoking {
+		return b
+	}
+	for i := 0; i < b.Length(); i++ {
+		if _, ok := p.allowedFast[uint32(i)]; !ok {
+			b.Set(i, false)
+		}
+	}
+	return b
+}
+
+// PeerExtensions returns a copy of the peer's extended handshake, updated by any it has sent since.
+// ok is false until the first one arrives.
+func (p *PeerConn) PeerExtensions() (h ExtendedHandshake, ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.peerExtensions == nil {
+		return ExtendedHandshake{}, false
+	}
+	h = *p.peerExtensions
+	h.M = make(map[string]uint8, len(p.peerExtensions.M))
+	for name, id := range p.peerExtensions.M {
+		h.M[name] = id
+	}
+	return h, true
+}
+
+// Client identifies the peer's client from its peer id, or failing that, the client name in its extended handshake.
+// It's the zero PeerClient if neither says.
+func (p *PeerConn) Client() PeerClient {
+	if c, ok := ParsePeerID(p.Remote.PeerID); ok {
+		return c
+	}
+	if h, ok := p.PeerExtensions(); ok {
+		return PeerClient{Name: h.V}
+	}
+	return PeerClient{}
+}
+
+// SendExtended sends payload as the named extension, using the id the peer asked for in its extended handshake.
+// It returns ErrExtensionUnsupported if the peer hasn't advertised the extension.
+func (p *PeerConn) SendExtended(name string, payload []byte) error {
+	p.mu.Lock()
+	var id uint8
+	if p.peerExtensions != nil {
+		id = p.peerExtensions.M[name]
+	}
+	p.mu.Unlock()
+	if id == 0 {
+		return fmt.Errorf("%s: %w", name, ErrExtensionUnsupported)
+	}
+	return p.Send(NewExtended(id, payload))
+}
+
+// Downloaded is the number of block bytes received from the peer.
+func (p *PeerConn) Downloaded() int64 {
+	return p.downloaded.Load()
+}
+
+// Uploaded is the number of block bytes sent to the peer.
+func (p *PeerConn) Uploaded() int64 {
+	return p.uploaded.Load()
+}
+
+// LastBlock is when the peer last sent us a block, or the zero Time if it never has.
+func (p *PeerConn) LastBlock() time.Time {
+	if ns := p.lastBlock.Load(); ns != 0 {
+		return time.Unix(0, ns)
+	}
+	return time.Time{}
+}
+
+// PendingRequests is the number of our requests the peer hasn't answered.
+func (p *PeerConn) PendingRequests() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.ourRequests)
+}
+
+// PeerRequests returns the peer's requests that we haven't served or had cancelled.
+func (p *PeerConn) PeerRequests() []BlockRequest {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	out := make([]BlockRequest, 0, len(p.peerRequests))
+	for r := range p.peerRequests {
+		out = append(out, r)
+	}
+	return out
+}
+
+// Requested reports whether the peer is still waiting on r: it hasn't been served, cancelled, rejected, or dropped by a Choke.
+func (p *PeerConn) Requested(r BlockRequest) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, ok := p.peerRequests[r]
+	return ok
+}
+
+// Send queues m to be written, updating our side of the state.
+//
+// With the Fast Extension, a Choke is followed by a RejectRequest for each of the peer's pending requests,
+// except those for pieces we've allowed fast.
+func (p *PeerConn) Send(m *Message) error {
+	select {
+	case <-p.done:
+		return ErrPeerClosed
+	default:
+	}
+	var rejects []*Message
+	p.mu.Lock()
+	switch m.Type {
+	case Choke:
+		p.state.AmChoking = true
+		// Choking discards the peer's pending requests
+		for r := range p.peerRequests {
+			if _, ok := p.peerAllowedFast[r.Index]; ok && p.Fast {
+				continue
+			}
+			delete(p.peerRequests, r)
+			if p.Fast {
+				rejects = append(rejects, NewReject(r.Index, r.Begin, r.Length))
+			}
+		}
+	case Unchoke:
+		p.state.AmChoking = false
+	case Interested:
+		p.state.AmInterested = true
+	case NotInterested:
+		p.state.AmInterested = false
+	case Request:
+		if r, err := m.BlockRequest(); err == nil {
+			p.ourRequests[r] = time.Now()
+		}
+	case Cancel:
+		if r, err := m.BlockRequest(); err == nil {
+			delete(p.ourRequests, r)
+		}
+	case Piece:
+		if index, begin, block, err := m.BlockPayload(); err == nil {
+			delete(p.peerRequests, BlockRequest{index, begin, uint32(len(block))})
+			p.uploaded.Add(int64(len(block)))
+		}
+	case RejectRequest:
+		if r, err := m.BlockRequest(); err == nil {
+			delete(p.peerRequests, r)
+		}
+	case AllowedFast:
+		if index, err := m.PieceIndex(); err == nil {
+			p.peerAllowedFast[index] = struct{}{}
+		}
+	}
+	p.mu.Unlock()
+	return p.enqueue(append([]*Message{m}, rejects...)...)
+}
+
+// enqueue queues messages for writeLoop without touching the state.
+func (p *PeerConn) enqueue(ms ...*Message) error {
+	for _, m := range ms {
+		select {
+		case p.outgoing <- m:
+		case <-p.done:
+			return ErrPeerClosed
+		}
+	}
+	return nil
+}
+
+// SetChoking chokes or unchokes the peer, if that changes anything.
+func (p *PeerConn) SetChoking(choking bool) error {
+	if p.State().AmChoking == choking {
+		return nil
+	}
+	if choking {
+		return p.Send(NewMessage(Choke, nil))
+	}
+	return p.Send(NewMessage(Unchoke, nil))
+}
+
+// SetInterested tells the peer whether we're interested, if that changes anything.
+func (p *PeerConn) SetInterested(interested bool) error {
+	if p.State().AmInterested == interested {
+		return nil
+	}
+	if interested {
+		return p.Send(NewMessage(Interested, nil))
+	}
+	return p.Send(NewMessage(NotInterested, nil))
+}
+
+func (p *PeerConn) readLoop() {
+	defer p.wg.Done()
+	defer close(p.events)
+	for {
+		p.conn.SetReadDeadline(time.Now().Add(p.IdleTimeout))
+		m, err := ReadMessage(p.conn, p.numPieces)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				err = fmt.Errorf("peer idle for %s", p.IdleTimeout)
+			}
+			p.closeWithError(err)
+			return
+		}
+		if m.Type == KeepAlive {
+			continue
+		}
+		deliver, replies, err := p.handleMessage(m)
+		if err != nil {
+			p.closeWithError(fmt.Errorf("peer %s: %w", p.Addr, err))
+			return
+		}
+		if p.enqueue(replies...) != nil {
+			return
+		}
+		if !deliver {
+			continue
+		}
+		select {
+		case p.events <- m:
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// handleMessage applies a received message to the state, reporting whether it should be delivered,
+// and any replies to send (RejectRequest, with the Fast Extension).
+// Errors are protocol violations that end the connection.
+func (p *PeerConn) handleMessage(m *Message) (deliver bool, replies []*Message, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	first := !p.gotMessage
+	// The extended handshake, and sometimes Port, are sent before Bitfield
+	if m.Type != Extended && m.Type != Port {
+		p.gotMessage = true
+	}
+	switch m.Type {
+	case SuggestPiece, HaveAll, HaveNone, RejectRequest, AllowedFast:
+		if !p.Fast {
+			return false, nil, fmt.Errorf("%s without the Fast Extension", m.Type)
+		}
+	case Extended:
+		if !p.Extended {
+			return false, nil, errors.New("Extended without the Extension Protocol")
+		}
+	}
+	switch m.Type {
+	case Choke:
+		p.state.PeerChoking = true
+		// Being choked discards our pending requests, unless the peer will reject them explicitly
+		if !p.Fast {
+			p.ourRequests = make(map[BlockRequest]time.Time)
+		}
+	case Unchoke:
+		p.state.PeerChoking = false
+	case Interested:
+		p.state.PeerInterested = true
+	case NotInterested:
+		p.state.PeerInterested = false
+	case Have:
+		index, err := m.Have()
+		if err != nil {
+			return false, nil, err
+		}
+		if int(index) >= p.numPieces {
+			return false, nil, fmt.Errorf("Have for piece %d of %d", index, p.numPieces)
+		}
+		if had, _ := p.peerPieces.Get(int(index)); had {
+			return false, nil, nil // Not news, so availability counts aren't inflated
+		}
+		p.peerPieces.Set(int(index), true)
+	case Bitfield:
+		if !first {
+			return false, nil, errors.New("Bitfield must be the first message")
+		}
+		b, err := m.Bitfield(p.numPieces)
+		if err != nil {
+			return false, nil, err
+		}
+		p.peerPieces = b
+	case HaveAll:
+		if !first {
+			return false, nil, errors.New("HaveAll must be the first message")
+		}
+		for i := 0; i < p.numPieces; i++ {
+			p.peerPieces.Set(i, true)
+		}
+	case HaveNone:
+		if !first {
+			return false, nil, errors.New("HaveNone must be the first message")
+		}
+	case Request:
+		r, err := m.BlockRequest()
+		if err != nil {
+			return false, nil, err
+		}
+		if r.Length > maxBlockLength {
+			return false, nil, fmt.Errorf("request for %d bytes exceeds %d", r.Length, maxBlockLength)
+		}
+		if p.state.AmChoking {
+			if !p.Fast {
+				return false, nil, nil // Ignored, per BEP 3
+			}
+			if _, ok := p.peerAllowedFast[r.Index]; !ok {
+				return false, []*Message{NewReject(r.Index, r.Begin, r.Length)}, nil
+			}
+		}
+		p.peerRequests[r] = struct{}{}
+	case Cancel:
+		r, err := m.BlockRequest()
+		if err != nil {
+			return false, nil, err
+		}
+		if _, ok := p.peerRequests[r]; ok && p.Fast {
+			// A cancelled request must still be answered
+			replies = append(replies, NewReject(r.Index, r.Begin, r.Length))
+		}
+		delete(p.peerRequests, r)
+	case RejectRequest:
+		r, err := m.BlockRequest()
+		if err != nil {
+			return false, nil, err
+		}
+		// Delivered even if we've forgotten it, since it may have crossed paths with a Cancel
+		delete(p.ourRequests, r)
+	case SuggestPiece, AllowedFast:
+		index, err := m.PieceIndex()
+		if err != nil {
+			return false, nil, err
+		}
+		if int(index) >= p.numPieces {
+			return false, nil, fmt.Errorf("%s for piece %d of %d", m.Type, index, p.numPieces)
+		}
+		if m.Type == AllowedFast {
+			p.allowedFast[index] = struct{}{}
+		}
+	case Extended:
+		id, payload, err := m.ExtendedPayload()
+		if err != nil {
+			return false, nil, err
+		}
+		if id != 0 {
+			break
+		}
+		h, err := ParseExtendedHandshake(payload)
+		if err != nil {
+			return false, nil, err
+		}
+		if p.peerExtensions == nil {
+			p.peerExtensions = h
+		} else {
+			p.peerExtensions.update(h)
+		}
+	case Piece:
+		index, begin, block, err := m.BlockPayload()
+		if err != nil {
+			return false, nil, err
+		}
+		// Delivered even if unrequested, since it may have crossed paths with a Cancel
+		delete(p.ourRequests, BlockRequest{index, begin, uint32(len(block))})
+		p.downloaded.Add(int64(len(block)))
+		p.lastBlock.Store(time.Now().UnixNano())
+	}
+	return true, replies, nil
+}
+
+func (p *PeerConn) writeLoop() {
+	defer p.wg.Done()
+	mw := NewMessageWriter(p.conn)
+	keepAlive := time.NewTimer(p.KeepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		var m *Message
+		select {
+		case <-p.done:
+			return
+		case <-keepAlive.C:
+			m = NewKeepAlive()
+		case m = <-p.outgoing:
+		}
+		err := mw.WriteMessage(m)
+		// Batch up whatever else is queued before flushing
+		for more := true; more && err == nil; {
+			select {
+			case next := <-p.outgoing:
+				err = mw.WriteMessage(next)
+			default:
+				more = false
+			}
+		}
+		if err == nil {
+			p.conn.SetWriteDeadline(time.Now().Add(p.IdleTimeout))
+			err = mw.Flush()
+		}
+		if err != nil {
+			p.closeWithError(fmt.Errorf("writing to peer %s: %w", p.Addr, err))
+			return
+		}
+		resetTimer(keepAlive, p.KeepAliveInterval)
+	}
+}
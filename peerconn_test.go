@@ -0,0 +1,345 @@
+package bt
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"net"
+	"testing"
+	"time"
+)
+
+// newPeerConnPair handshakes two PeerConns over an in-memory connection and starts them.
+func newPeerConnPair(t *testing.T, numPieces int) (a, b *PeerConn) {
+	t.Helper()
+	return startPipePair(t, numPieces, Reserved{}, Reserved{})
+}
+
+// newFastPeerConnPair is newPeerConnPair with the Fast Extension negotiated.
+func newFastPeerConnPair(t *testing.T, numPieces int) (a, b *PeerConn) {
+	t.Helper()
+	var fast Reserved
+	fast.Set(FastBit)
+	return startPipePair(t, numPieces, fast, fast)
+}
+
+// startPipePair is newPeerConnPair, advertising ra and rb.
+func startPipePair(t *testing.T, numPieces int, ra, rb Reserved) (a, b *PeerConn) {
+	t.Helper()
+	ca, cb := net.Pipe()
+	return startPeerConnPair(t, ca, cb, numPieces, ra, rb)
+}
+
+// startPeerConnPair handshakes over ca and cb, advertising ra and rb, and starts both PeerConns.
+func startPeerConnPair(t *testing.T, ca, cb net.Conn, numPieces int, ra, rb Reserved) (a, b *PeerConn) {
+	t.Helper()
+	ha := Handshake{Reserved: ra, InfoHash: sha1.Sum([]byte("torrent")), PeerID: sha1.Sum([]byte("a"))}
+	hb := Handshake{Reserved: rb, InfoHash: ha.InfoHash, PeerID: sha1.Sum([]byte("b"))}
+	errs := make(chan error, 1)
+	go func() {
+		var err error
+		b, err = NewPeerConn(cb, hb, numPieces)
+		errs <- err
+	}()
+	a, err := NewPeerConn(ca, ha, numPieces)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if a.Remote.PeerID != hb.PeerID || b.Remote.PeerID != ha.PeerID {
+		t.Fatal("peer ids not exchanged in handshake")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	a.Start(ctx)
+	b.Start(ctx)
+	return a, b
+}
+
+func expectEvent(t *testing.T, p *PeerConn, want MType) *Message {
+	t.Helper()
+	select {
+	case m, ok := <-p.Events():
+		if !ok {
+			t.Fatalf("connection closed waiting for %s: %v", want, p.Err())
+		}
+		if m.Type != want {
+			t.Fatalf("want %s, got %s", want, m.Type)
+		}
+		return m
+	case <-time.After(time.Second):
+		t.Fatalf("no %s within 1s", want)
+	}
+	return nil
+}
+
+func TestPeerConnHandshakeMismatch(t *testing.T) {
+	ca, cb := net.Pipe()
+	defer ca.Close()
+	defer cb.Close()
+	go WriteHandshake(cb, Handshake{InfoHash: sha1.Sum([]byte("other"))})
+	go ReadHandshake(cb)
+	if _, err := NewPeerConn(ca, Handshake{InfoHash: sha1.Sum([]byte("torrent"))}, 8); err == nil {
+		t.Fatal("wanted error for infohash mismatch, got nil")
+	}
+}
+
+func TestPeerConnState(t *testing.T) {
+	a, b := newPeerConnPair(t, 10)
+
+	bf, _ := NewEmptyBitfield(10)
+	bf.Set(3, true)
+	if err := a.Send(NewBitfieldMessage(bf)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	a.Send(NewHave(7))
+	if err := b.SetInterested(true); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expectEvent(t, b, Bitfield)
+	expectEvent(t, b, Have)
+	if !b.PeerHas(3) || !b.PeerHas(7) || b.PeerHas(4) {
+		t.Fatal("want peer to have pieces 3 and 7 only")
+	}
+	expectEvent(t, a, Interested)
+	if got := a.State(); !got.PeerInterested || !got.AmChoking {
+		t.Fatalf("want peer interested and choked, got %+v", got)
+	}
+
+	// Requests while choked are ignored. The Have confirms a has read the Request.
+	b.Send(NewRequest(3, 0, 16384))
+	b.Send(NewHave(0))
+	expectEvent(t, a, Have)
+	if len(a.PeerRequests()) != 0 {
+		t.Fatalf("want request ignored while choked, got %v", a.PeerRequests())
+	}
+	a.SetChoking(false)
+	expectEvent(t, b, Unchoke)
+	if b.State().PeerChoking {
+		t.Fatal("want peer unchoking after Unchoke")
+	}
+	b.Send(NewRequest(3, 16384, 16384))
+	expectEvent(t, a, Request)
+	if len(a.PeerRequests()) != 1 {
+		t.Fatalf("want 1 peer request, got %v", a.PeerRequests())
+	}
+	if b.PendingRequests() != 2 {
+		t.Fatalf("want 2 pending requests, got %d", b.PendingRequests())
+	}
+
+	a.Send(NewPiece(3, 16384, make([]byte, 16384)))
+	expectEvent(t, b, Piece)
+	if b.PendingRequests() != 1 || len(a.PeerRequests()) != 0 {
+		t.Fatalf("want served request removed, got %d pending and %v", b.PendingRequests(), a.PeerRequests())
+	}
+	a.SetChoking(true)
+	expectEvent(t, b, Choke)
+	if b.PendingRequests() != 0 {
+		t.Fatalf("want requests dropped on Choke, got %d", b.PendingRequests())
+	}
+}
+
+func TestPeerConnProtocolErrors(t *testing.T) {
+	cases := []struct {
+		Name string
+		Send []*Message
+	}{
+		{Name: "late Bitfield", Send: []*Message{NewHave(0), NewMessage(Bitfield, []byte{0})}},
+		{Name: "Have out of range", Send: []*Message{NewHave(8)}},
+		{Name: "oversized Request", Send: []*Message{NewRequest(0, 0, 1<<20)}},
+		{Name: "HaveAll without Fast Extension", Send: []*Message{NewMessage(HaveAll, nil)}},
+		{Name: "RejectRequest without Fast Extension", Send: []*Message{NewReject(0, 0, 1)}},
+		{Name: "Extended without Extension Protocol", Send: []*Message{NewExtended(0, []byte("de"))}},
+	}
+	for _, c := range cases {
+		c := c
+		t.Run(c.Name, func(t *testing.T) {
+			t.Parallel()
+			a, b := newPeerConnPair(t, 8)
+			for _, m := range c.Send {
+				a.Send(m)
+			}
+			select {
+			case <-b.Done():
+			case <-time.After(time.Second):
+				t.Fatal("want connection closed after protocol error")
+			}
+			if b.Err() == nil {
+				t.Fatal("wanted error, got nil")
+			}
+		})
+	}
+}
+
+func TestPeerConnKeepAlive(t *testing.T) {
+	ca, cb := net.Pipe()
+	h := Handshake{InfoHash: sha1.Sum([]byte("torrent"))}
+	go NewPeerConn(cb, h, 8)
+	p, err := NewPeerConn(ca, h, 8)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	p.KeepAliveInterval = 10 * time.Millisecond
+	p.IdleTimeout = 100 * time.Millisecond
+	p.Start(context.Background())
+	defer p.Close()
+
+	// The raw side sees keep-alives, but never sends any
+	for i := 0; i < 2; i++ {
+		m, err := ParseMessage(cb)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if m.Type != KeepAlive {
+			t.Fatalf("want KeepAlive, got %s", m.Type)
+		}
+	}
+	go func() {
+		for {
+			if _, err := ParseMessage(cb); err != nil {
+				return
+			}
+		}
+	}()
+	select {
+	case <-p.Done():
+	case <-time.After(time.Second):
+		t.Fatal("want idle connection closed")
+	}
+}
+
+func TestPeerConnContextCancel(t *testing.T) {
+	ca, cb := net.Pipe()
+	defer cb.Close()
+	h := Handshake{InfoHash: sha1.Sum([]byte("torrent"))}
+	go NewPeerConn(cb, h, 8)
+	p, err := NewPeerConn(ca, h, 8)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	p.Start(ctx)
+	cancel()
+	if _, ok := <-p.Events(); ok {
+		t.Fatal("want Events closed after cancel")
+	}
+	if p.Err() != context.Canceled {
+		t.Fatalf("want context.Canceled, got %v", p.Err())
+	}
+	if err := p.Send(NewKeepAlive()); err != ErrPeerClosed {
+		t.Fatalf("want ErrPeerClosed, got %v", err)
+	}
+}
+
+func TestPeerConnFastNegotiation(t *testing.T) {
+	var fast Reserved
+	fast.Set(FastBit)
+	cases := []struct {
+		Name string
+		A, B Reserved
+		Want bool
+	}{
+		{Name: "both", A: fast, B: fast, Want: true},
+		{Name: "only us", A: fast, Want: false},
+		{Name: "only them", B: fast, Want: false},
+	}
+	for _, c := range cases {
+		c := c
+		t.Run(c.Name, func(t *testing.T) {
+			t.Parallel()
+			a, b := startPipePair(t, 8, c.A, c.B)
+			if a.Fast != c.Want || b.Fast != c.Want {
+				t.Fatalf("want Fast %t, got %t and %t", c.Want, a.Fast, b.Fast)
+			}
+		})
+	}
+}
+
+func TestPeerConnFastProtocolErrors(t *testing.T) {
+	cases := []struct {
+		Name string
+		Send []*Message
+	}{
+		{Name: "late HaveAll", Send: []*Message{NewHave(0), NewMessage(HaveAll, nil)}},
+		{Name: "late HaveNone", Send: []*Message{NewMessage(HaveAll, nil), NewMessage(HaveNone, nil)}},
+		{Name: "AllowedFast out of range", Send: []*Message{NewAllowedFast(8)}},
+	}
+	for _, c := range cases {
+		c := c
+		t.Run(c.Name, func(t *testing.T) {
+			t.Parallel()
+			a, b := newFastPeerConnPair(t, 8)
+			for _, m := range c.Send {
+				a.Send(m)
+			}
+			select {
+			case <-b.Done():
+			case <-time.After(time.Second):
+				t.Fatal("want connection closed after protocol error")
+			}
+			if b.Err() == nil {
+				t.Fatal("wanted error, got nil")
+			}
+		})
+	}
+}
+
+func TestPeerConnFastReject(t *testing.T) {
+	a, b := newFastPeerConnPair(t, 8)
+	a.Send(NewMessage(HaveAll, nil))
+	a.Send(NewAllowedFast(2))
+	expectEvent(t, b, HaveAll)
+	expectEvent(t, b, AllowedFast)
+	if !b.PeerHas(7) {
+		t.Fatal("want peer to have every piece after HaveAll")
+	}
+	if got := b.Requestable(); !bytes.Equal(got.Bytes(), bitfieldOf(t, 8, 2).Bytes()) {
+		t.Fatalf("want only allowed fast piece 2 requestable while choked, got %v", got.Bytes())
+	}
+
+	// Requests while choked are rejected, unless the piece is allowed fast
+	b.Send(NewRequest(1, 0, 16384))
+	b.Send(NewRequest(2, 0, 16384))
+	if r, _ := expectEvent(t, b, RejectRequest).BlockRequest(); r != (BlockRequest{1, 0, 16384}) {
+		t.Fatalf("want request for piece 1 rejected, got %v", r)
+	}
+	expectEvent(t, a, Request)
+	if got := a.PeerRequests(); len(got) != 1 || got[0].Index != 2 {
+		t.Fatalf("want allowed fast request kept, got %v", got)
+	}
+	if b.PendingRequests() != 1 {
+		t.Fatalf("want rejected request forgotten, got %d pending", b.PendingRequests())
+	}
+
+	// Choking rejects pending requests explicitly, other than allowed fast ones
+	a.SetChoking(false)
+	expectEvent(t, b, Unchoke)
+	if got := b.Requestable(); !bytes.Equal(got.Bytes(), bitfieldOf(t, 8, 0, 1, 2, 3, 4, 5, 6, 7).Bytes()) {
+		t.Fatalf("want every piece requestable once unchoked, got %v", got.Bytes())
+	}
+	b.Send(NewRequest(3, 0, 16384))
+	b.Send(NewRequest(4, 0, 16384))
+	expectEvent(t, a, Request)
+	expectEvent(t, a, Request)
+	a.SetChoking(true)
+	expectEvent(t, b, Choke)
+	if b.PendingRequests() != 3 {
+		t.Fatalf("want requests kept until rejected, got %d pending", b.PendingRequests())
+	}
+	expectEvent(t, b, RejectRequest)
+	expectEvent(t, b, RejectRequest)
+	if got := a.PeerRequests(); len(got) != 1 || got[0].Index != 2 {
+		t.Fatalf("want only allowed fast request kept after Choke, got %v", got)
+	}
+
+	// A cancelled request is answered with a Reject
+	b.Send(NewCancel(2, 0, 16384))
+	if r, _ := expectEvent(t, b, RejectRequest).BlockRequest(); r.Index != 2 {
+		t.Fatalf("want cancelled request rejected, got %v", r)
+	}
+	if len(a.PeerRequests()) != 0 || b.PendingRequests() != 0 {
+		t.Fatalf("want no requests left, got %v and %d pending", a.PeerRequests(), b.PendingRequests())
+	}
+}
@@ -0,0 +1,296 @@
+package bt
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// PeerClient is the client that generated a peer id, see ParsePeerID.
+type PeerClient struct {
+	Name string
+	// Empty if the id doesn't say
+	Version string
+}
+
+func (c PeerClient) String() string {
+	if c.Version == "" {
+		return c.Name
+	}
+	return c.Name + " " + c.Version
+}
+
+// Version digits in peer ids, counting 10 to 35 as A to Z.
+// Shadow-style ids carry on with a to z, then '.' for 62.
+const (
+	versionDigits       = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	shadowVersionDigits = versionDigits + "abcdefghijklmnopqrstuvwxyz."
+)
+
+// azureusClients are the clients using Azureus-style ids (-XX1234-), by their two character code.
+// See https://wiki.theory.org/BitTorrentSpecification#peer_id
+var azureusClients = map[string]string{
+	"7T": "aTorrent",
+	"A~": "Ares",
+	"AG": "Ares",
+	"AR": "Arctic",
+	"AT": "Artemis",
+	"AV": "Avicora",
+	"AX": "BitPump",
+	"AZ": "Azureus",
+	"BB": "BitBuddy",
+	"BC": "BitComet",
+	"BE": "Baretorrent",
+	"BF": "Bitflu",
+	"BG": "BTG",
+	"BI": "BiglyBT",
+	"BL": "BitBlinder",
+	"BP": "BitTorrent Pro",
+	"BR": "BitRocket",
+	"BS": "BTSlave",
+	"BT": "BitTorrent",
+	"BW": "BitWombat",
+	"BX": "BitTorrent X",
+	"CD": "Enhanced CTorrent",
+	"CT": "CTorrent",
+	"DE": "Deluge",
+	"DP": "Propagate Data Client",
+	"EB": "EBit",
+	"EE": "eenblam/bt",
+	"ES": "electric sheep",
+	"FC": "FileCroc",
+	"FD": "Free Download Manager",
+	"FT": "FoxTorrent",
+	"FW": "FrostWire",
+	"FX": "Freebox BitTorrent",
+	"GS": "GSTorrent",
+	"HK": "Hekate",
+	"HL": "Halite",
+	"HM": "hMule",
+	"HN": "Hydranode",
+	"IL": "iLivid",
+	"JS": "Justseed.it",
+	"JT": "JavaTorrent",
+	"KG": "KGet",
+	"KT": "KTorrent",
+	"LC": "LeechCraft",
+	"LH": "LH-ABC",
+	"LP": "Lphant",
+	"LT": "libtorrent",
+	"lt": "libTorrent",
+	"LW": "LimeWire",
+	"MK": "Meerkat",
+	"MO": "MonoTorrent",
+	"MP": "MooPolice",
+	"MR": "Miro",
+	"MT": "MoonlightTorrent",
+	"NB": "Net::BitTorrent",
+	"NX": "Net Transport",
+	"OS": "OneSwarm",
+	"OT": "OmegaTorrent",
+	"PB": "Protocol::BitTorrent",
+	"PD": "Pando",
+	"PI": "PicoTorrent",
+	"PT": "PHPTracker",
+	"qB": "qBittorrent",
+	"QD": "QQDownload",
+	"QT": "Qt 4 Torrent example",
+	"RT": "Retriever",
+	"RZ": "RezTorrent",
+	"S~": "Shareaza",
+	"SB": "Swiftbit",
+	"SD": "Thunder",
+	"SM": "SoMud",
+	"SP": "BitSpirit",
+	"SS": "SwarmScope",
+	"st": "sharktorrent",
+	"ST": "SymTorrent",
+	"SZ": "Shareaza",
+	"TB": "Torch",
+	"TE": "terasaur Seed Bank",
+	"TL": "Tribler",
+	"TN": "TorrentDotNET",
+	"TR": "Transmission",
+	"TS": "Torrentstorm",
+	"TT": "TuoTu",
+	"UE": "µTorrent Embedded",
+	"UL": "uLeecher!",
+	"UM": "µTorrent Mac",
+	"UT": "µTorrent",
+	"UW": "µTorrent Web",
+	"VG": "Vagaa",
+	"WD": "WebTorrent Desktop",
+	"WT": "BitLet",
+	"WW": "WebTorrent",
+	"WY": "FireTorrent",
+	"XF": "Xfplay",
+	"XL": "Xunlei",
+	"XS": "XSwifter",
+	"XT": "XanTorrent",
+	"XX": "Xtorrent",
+	"ZT": "ZipTorrent",
+}
+
+// shadowClients are the clients using Shadow-style ids (S58B-----), by their first character.
+var shadowClients = map[byte]string{
+	'A': "ABC",
+	'O': "Osprey Permaseed",
+	'Q': "BTQueue",
+	'R': "Tribler",
+	'S': "Shadow",
+	'T': "BitTornado",
+	'U': "UPnP NAT Bit Torrent",
+}
+
+// mainlineClients are the clients using Mainline-style ids (M4-20-8-), by their first character.
+var mainlineClients = map[byte]string{
+	'M': "Mainline",
+	'Q': "Queen Bee",
+}
+
+// ParsePeerID identifies the client that generated a peer id, see BEP 20. ok is false for ids in no style we know.
+//
+// Azureus-style ids are '-', a two character client code, four version digits and '-', like -UT355S-.
+// Codes we don't know are returned as the name.
+// Shadow-style ids are a client character, up to five version digits and "---", like S58B-----.
+// Mainline-style ids are a client character and a version separated by dashes, like M4-20-8- or M7-4-0--.
+// A few clients have formats of their own.
+func ParsePeerID(id [20]byte) (c PeerClient, ok bool) {
+	if c, ok := parseAzureusID(id); ok {
+		return c, true
+	}
+	if c, ok := parseOddballID(id); ok {
+		return c, true
+	}
+	if name, ok := mainlineClients[id[0]]; ok {
+		if version, rest, ok := parseDashedVersion(string(id[1:8])); ok && strings.Trim(rest, "-") == "" {
+			return PeerClient{Name: name, Version: version}, true
+		}
+	}
+	return parseShadowID(id)
+}
+
+func parseAzureusID(id [20]byte) (PeerClient, bool) {
+	if id[0] != '-' || id[7] != '-' || !azureusCodeByte(id[1]) || !azureusCodeByte(id[2]) {
+		return PeerClient{}, false
+	}
+	digits := make([]int, 4)
+	for i, b := range id[3:7] {
+		digits[i] = strings.IndexByte(versionDigits, upper(b))
+		if digits[i] < 0 {
+			return PeerClient{}, false
+		}
+	}
+	code := string(id[1:3])
+	c := PeerClient{Name: azureusClients[code]}
+	if c.Name == "" {
+		c.Name = code
+	}
+	switch code {
+	case "TR":
+		// Transmission has been X.YZ since 1.0, with a trailing Z or X for development builds
+		c.Version = fmt.Sprintf("%c.%s", id[3], id[4:6])
+		if id[6] == 'Z' || id[6] == 'X' {
+			c.Version += "+"
+		}
+	default:
+		// The last digit is often a letter for the build type, like B for beta, which we leave out
+		parts := []string{strconv.Itoa(digits[0]), strconv.Itoa(digits[1]), strconv.Itoa(digits[2])}
+		if id[6] >= '1' && id[6] <= '9' {
+			parts = append(parts, string(id[6]))
+		}
+		c.Version = strings.Join(parts, ".")
+	}
+	return c, true
+}
+
+func parseShadowID(id [20]byte) (PeerClient, bool) {
+	name, ok := shadowClients[id[0]]
+	if !ok {
+		return PeerClient{}, false
+	}
+	var parts []string
+	i := 1
+	for ; i < 6 && id[i] != '-'; i++ {
+		n := strings.IndexByte(shadowVersionDigits, id[i])
+		if n < 0 {
+			return PeerClient{}, false
+		}
+		parts = append(parts, strconv.Itoa(n))
+	}
+	if len(parts) == 0 || string(id[i:i+3]) != "---" {
+		return PeerClient{}, false
+	}
+	return PeerClient{Name: name, Version: strings.Join(parts, ".")}, true
+}
+
+// parseDashedVersion parses three numbers from the start of s, each followed by a dash, returning what's left of s.
+func parseDashedVersion(s string) (version, rest string, ok bool) {
+	parts := make([]string, 3)
+	for i := range parts {
+		var found bool
+		parts[i], s, found = strings.Cut(s, "-")
+		if !found || !isDigits(parts[i]) {
+			return "", "", false
+		}
+	}
+	return strings.Join(parts, "."), s, true
+}
+
+// parseOddballID recognizes clients with formats of their own.
+func parseOddballID(id [20]byte) (PeerClient, bool) {
+	s := string(id[:])
+	switch {
+	case strings.HasPrefix(s, "exbc"):
+		name := "BitComet"
+		if s[6:10] == "LORD" {
+			name = "BitLord"
+		}
+		return PeerClient{Name: name, Version: fmt.Sprintf("%d.%02d", id[4], id[5])}, true
+	case strings.HasPrefix(s, "XBT") && isDigits(s[3:6]):
+		return PeerClient{Name: "XBT Client", Version: fmt.Sprintf("%c.%c.%c", s[3], s[4], s[5])}, true
+	case strings.HasPrefix(s, "OP") && isDigits(s[2:6]):
+		return PeerClient{Name: "Opera", Version: s[2:6]}, true
+	case strings.HasPrefix(s, "-ML"):
+		if version, _, ok := strings.Cut(s[3:], "-"); ok && version != "" {
+			return PeerClient{Name: "MLDonkey", Version: version}, true
+		}
+	case strings.HasPrefix(s, "AZ2500BT"):
+		return PeerClient{Name: "BitTyrant"}, true
+	case strings.HasPrefix(s, "turbobt"):
+		return PeerClient{Name: "TurboBT", Version: strings.TrimRight(s[7:12], "\x00-")}, true
+	case strings.HasPrefix(s, "A2-"):
+		if version, _, ok := parseDashedVersion(s[3:]); ok {
+			return PeerClient{Name: "aria2", Version: version}, true
+		}
+	case s[2:4] == "BS":
+		// The version is in the second byte, with 0 for version 1
+		version := int(id[1])
+		if version == 0 {
+			version = 1
+		}
+		return PeerClient{Name: "BitSpirit", Version: strconv.Itoa(version)}, true
+	}
+	return PeerClient{}, false
+}
+
+// azureusCodeByte reports whether b can be part of a client code: printable, and not the dash that ends the prefix.
+func azureusCodeByte(b byte) bool {
+	return b > ' ' && b < 0x7f && b != '-'
+}
+
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+func upper(b byte) byte {
+	if b >= 'a' && b <= 'z' {
+		return b - ('a' - 'A')
+	}
+	return b
+}
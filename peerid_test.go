@@ -0,0 +1,114 @@
+package bt
+
+import (
+	"testing"
+)
+
+// peerID pads prefix to a peer id with random-looking bytes.
+func peerID(prefix string) [20]byte {
+	var id [20]byte
+	copy(id[:], prefix+"\x8a\x13\xf0\x02\xb7\x5c\x91\x4e\x0d\x66\xa2\x3b\xc8\x17\xe9\x70\x55\x01\x9f\xd4")
+	return id
+}
+
+func TestParsePeerID(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		Name   string
+		Prefix string
+		Want   string
+	}{
+		{"azureus", "-AZ5750-", "Azureus 5.7.5"},
+		{"build letter", "-UT355S-", "µTorrent 3.5.5"},
+		{"fourth digit", "-qB4251-", "qBittorrent 4.2.5.1"},
+		{"letter digits", "-LT12D0-", "libtorrent 1.2.13"},
+		{"lowercase code", "-lt0D60-", "libTorrent 0.13.6"},
+		{"transmission", "-TR2940-", "Transmission 2.94"},
+		{"transmission development", "-TR300Z-", "Transmission 3.00+"},
+		{"ours", "-EE0120-", "eenblam/bt 0.1.2"},
+		{"unknown code", "-Yz1000-", "Yz 1.0.0"},
+		{"shadow", "S58B-----", "Shadow 5.8.11"},
+		{"shadow lowercase digits", "T03a.----", "BitTornado 0.3.36.62"},
+		{"mainline", "M4-20-8-", "Mainline 4.20.8"},
+		{"mainline padded", "M7-4-0--", "Mainline 7.4.0"},
+		{"queen bee", "Q1-0-0--", "Queen Bee 1.0.0"},
+		{"bitcomet", "exbc\x00\x38", "BitComet 0.56"},
+		{"bitlord", "exbc\x00\x38LORD", "BitLord 0.56"},
+		{"xbt", "XBT054d", "XBT Client 0.5.4"},
+		{"opera", "OP7685", "Opera 7685"},
+		{"mldonkey", "-ML2.7.2-", "MLDonkey 2.7.2"},
+		{"bittyrant", "AZ2500BT", "BitTyrant"},
+		{"aria2", "A2-1-34-0-", "aria2 1.34.0"},
+		{"bitspirit", "\x00\x03BS", "BitSpirit 3"},
+	}
+	for _, c := range cases {
+		c := c
+		t.Run(c.Name, func(t *testing.T) {
+			t.Parallel()
+			got, ok := ParsePeerID(peerID(c.Prefix))
+			if !ok {
+				t.Fatalf("%q not recognized", c.Prefix)
+			}
+			if got.String() != c.Want {
+				t.Fatalf("want %s, got %s", c.Want, got)
+			}
+		})
+	}
+
+	for _, prefix := range []string{"", "-AZ57\x0050-", "-A-5750-", "S---", "SZZZZZZ--", "M4-20-8x", "M4-x-8--", "A2-1-x-0-", "exb"} {
+		if got, ok := ParsePeerID(peerID(prefix)); ok {
+			t.Errorf("%q: want unrecognized, got %s", prefix, got)
+		}
+	}
+}
+
+func TestPeerPrefix(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		Version string
+		Want    string
+	}{
+		{"0.0.0", "-EE0000-"},
+		{"1.2.3", "-EE1230-"},
+		{"1.2.3.4", "-EE1234-"},
+		{"0.12.35", "-EE0CZ0-"},
+		{"2.99.1-rc.1+build", "-EE2Z10-"},
+		{"1", "-EE1000-"},
+		{"nonsense", "-EE0000-"},
+	}
+	for _, c := range cases {
+		if got := azureusPrefix("EE", c.Version); string(got[:]) != c.Want {
+			t.Errorf("%s: want %s, got %s", c.Version, c.Want, got[:])
+		}
+	}
+
+	// Our own ids identify us
+	id, err := GenPeerId()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if c, ok := ParsePeerID(id); !ok || c.Name != "eenblam/bt" || c.Version != buildVersion() {
+		t.Fatalf("want eenblam/bt %s, got %s", buildVersion(), c)
+	}
+}
+
+func TestPeerConnClient(t *testing.T) {
+	t.Parallel()
+	var ext Reserved
+	ext.Set(ExtensionProtocolBit)
+	a, b := startPipePair(t, 8, ext, ext)
+	// Neither side's id is recognizable, so the extended handshake names the client
+	if c := a.Client(); c != (PeerClient{}) {
+		t.Fatalf("want unknown client, got %s", c)
+	}
+	h, _ := ExtendedHandshake{V: "Example 1.0"}.MarshalBinary()
+	b.Send(NewExtended(0, h))
+	expectEvent(t, a, Extended)
+	if c := a.Client(); c.String() != "Example 1.0" {
+		t.Fatalf("want Example 1.0, got %s", c)
+	}
+	a.Remote.PeerID = peerID("-UT355S-")
+	if c := a.Client(); c.String() != "µTorrent 3.5.5" {
+		t.Fatalf("want µTorrent 3.5.5, got %s", c)
+	}
+}
@@ -0,0 +1,152 @@
+package bt
+
+import (
+	"net/netip"
+	"sync"
+)
+
+// PeerSource records where we learned of a peer.
+type PeerSource string
+
+const (
+	SourceTracker  PeerSource = "tracker"
+	SourceIncoming PeerSource = "incoming"
+	SourcePEX      PeerSource = "pex"
+	SourceDHT      PeerSource = "dht"
+	SourceLSD      PeerSource = "lsd"
+)
+
+// Candidates that fail this many times in a row are forgotten
+const maxPeerFailures = 3
+
+type candidate struct {
+	peer   Peer
+	source PeerSource
+	// Dialing or connected
+	inUse    bool
+	failures int
+	// Added by MarkInUse for an incoming connection, whose source port usually isn't one we can dial
+	inbound bool
+}
+
+// PeerPool holds every peer we've heard of for a torrent, whether or not we're connected to it.
+//
+// Peers are handed out for dialing in the order they were learned,
+// and returned to the back of the queue when their connections end.
+type PeerPool struct {
+	mu    sync.Mutex
+	known map[netip.AddrPort]*candidate
+	// Candidates not in use, oldest first
+	queue []netip.AddrPort
+	inUse int
+}
+
+func NewPeerPool() *PeerPool {
+	return &PeerPool{known: make(map[netip.AddrPort]*candidate)}
+}
+
+// Add records peers learned from source, returning how many weren't already known.
+func (p *PeerPool) Add(source PeerSource, peers ...Peer) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	added := 0
+	for _, peer := range peers {
+		addr := unmapAddrPort(peer.Addr)
+		if !addr.IsValid() || addr.Port() == 0 {
+			continue
+		}
+		if c, ok := p.known[addr]; ok {
+			if c.peer.Peer == "" {
+				c.peer.Peer = peer.Peer
+			}
+			c.peer.Crypto = c.peer.Crypto || peer.Crypto
+			continue
+		}
+		peer.Addr = addr
+		p.known[addr] = &candidate{peer: peer, source: source}
+		p.queue = append(p.queue, addr)
+		added++
+	}
+	return added
+}
+
+// Next hands out the next candidate to dial, marking it in use. ok is false if none are available.
+func (p *PeerPool) Next() (peer Peer, ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for len(p.queue) > 0 {
+		addr := p.queue[0]
+		p.queue = p.queue[1:]
+		c, known := p.known[addr]
+		if !known || c.inUse {
+			continue
+		}
+		c.inUse = true
+		p.inUse++
+		return c.peer, true
+	}
+	return Peer{}, false
+}
+
+// MarkInUse records an inbound connection from addr, so it won't be handed out by Next.
+// Addresses we didn't already know are forgotten on Release, rather than queued for dialing.
+func (p *PeerPool) MarkInUse(peer Peer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	addr := unmapAddrPort(peer.Addr)
+	c, ok := p.known[addr]
+	if !ok {
+		peer.Addr = addr
+		c = &candidate{peer: peer, source: SourceIncoming, inbound: true}
+		p.known[addr] = c
+	}
+	if !c.inUse {
+		c.inUse = true
+		p.inUse++
+	}
+}
+
+// Release returns a candidate after its connection ends or its dial fails,
+// returning the number of candidates still in use.
+//
+// Candidates that fail repeatedly are forgotten. Only a release with failed unset, for a connection that worked, resets the count.
+func (p *PeerPool) Release(addr netip.AddrPort, failed bool) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	addr = unmapAddrPort(addr)
+	c, ok := p.known[addr]
+	if !ok || !c.inUse {
+		return p.inUse
+	}
+	c.inUse = false
+	p.inUse--
+	if c.inbound {
+		delete(p.known, addr)
+		return p.inUse
+	}
+	if failed {
+		c.failures++
+	} else {
+		c.failures = 0
+	}
+	if c.failures >= maxPeerFailures {
+		delete(p.known, addr)
+	} else {
+		p.queue = append(p.queue, addr)
+	}
+	return p.inUse
+}
+
+// InUse is the number of candidates currently being dialed or connected.
+func (p *PeerPool) InUse() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.inUse
+}
+
+// Len is the number of known candidates.
+func (p *PeerPool) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.known)
+}
@@ -0,0 +1,231 @@
+package bt
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// Tracker announce events. The empty string is a regular, periodic announce.
+const (
+	EventNone      = ""
+	EventStarted   = "started"
+	EventCompleted = "completed"
+	EventStopped   = "stopped"
+)
+
+// TrackedPeer is a peer as seen by a tracker.
+type TrackedPeer struct {
+	ID   [20]byte
+	Addr netip.AddrPort
+	// Bytes left to download. Zero for seeders.
+	Left     int64
+	LastSeen time.Time
+}
+
+// PeerStore holds the swarms known to a TrackerServer.
+//
+// Implementations must be safe for concurrent use.
+// MemoryPeerStore is the default; other implementations can persist swarms elsewhere.
+type PeerStore interface {
+	// Announce records an announce from p. EventStopped removes the peer,
+	// and EventCompleted counts towards the swarm's Downloaded statistic.
+	Announce(infoHash [20]byte, p TrackedPeer, event string) error
+	// Peers returns up to n peers for infoHash, excluding the peer with id exclude.
+	// If leechersOnly is true, seeders are omitted.
+	Peers(infoHash [20]byte, n int, exclude [20]byte, leechersOnly bool) ([]TrackedPeer, error)
+	// Stats returns scrape statistics for infoHash. ok is false if the infohash isn't tracked.
+	Stats(infoHash [20]byte) (f ScrapeFile, ok bool, err error)
+	// InfoHashes lists every tracked infohash
+	InfoHashes() ([][20]byte, error)
+	// Expire removes peers last seen before t, and swarms left with no peers and no completions.
+	Expire(before time.Time) error
+}
+
+type swarm struct {
+	Peers map[[20]byte]TrackedPeer
+	// Count of "completed" events
+	Downloaded int
+}
+
+// MemoryPeerStore is an in-memory PeerStore.
+//
+// Its contents can be saved and restored with WriteSnapshot and ReadSnapshot.
+type MemoryPeerStore struct {
+	mu     sync.Mutex
+	swarms map[[20]byte]*swarm
+}
+
+func NewMemoryPeerStore() *MemoryPeerStore {
+	return &MemoryPeerStore{swarms: make(map[[20]byte]*swarm)}
+}
+
+func (s *MemoryPeerStore) Announce(infoHash [20]byte, p TrackedPeer, event string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sw, ok := s.swarms[infoHash]
+	if !ok {
+		if event == EventStopped {
+			return nil
+		}
+		sw = &swarm{Peers: make(map[[20]byte]TrackedPeer)}
+		s.swarms[infoHash] = sw
+	}
+	switch event {
+	case EventStopped:
+		delete(sw.Peers, p.ID)
+		return nil
+	case EventCompleted:
+		// Repeated completed announces, or from a peer we already knew was seeding, aren't new downloads
+		if prev, ok := sw.Peers[p.ID]; !ok || prev.Left > 0 {
+			sw.Downloaded++
+		}
+	}
+	sw.Peers[p.ID] = p
+	return nil
+}
+
+func (s *MemoryPeerStore) Peers(infoHash [20]byte, n int, exclude [20]byte, leechersOnly bool) ([]TrackedPeer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sw, ok := s.swarms[infoHash]
+	if !ok {
+		return nil, nil
+	}
+	peers := make([]TrackedPeer, 0, len(sw.Peers))
+	for id, p := range sw.Peers {
+		if id == exclude || (leechersOnly && p.Left == 0) {
+			continue
+		}
+		peers = append(peers, p)
+	}
+	// Map order isn't random enough to spread load across the swarm
+	rand.Shuffle(len(peers), func(i, j int) { peers[i], peers[j] = peers[j], peers[i] })
+	if len(peers) > n {
+		peers = peers[:n]
+	}
+	return peers, nil
+}
+
+func (s *MemoryPeerStore) Stats(infoHash [20]byte) (ScrapeFile, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sw, ok := s.swarms[infoHash]
+	if !ok {
+		return ScrapeFile{}, false, nil
+	}
+	f := ScrapeFile{Downloaded: sw.Downloaded}
+	for _, p := range sw.Peers {
+		if p.Left == 0 {
+			f.Complete++
+		} else {
+			f.Incomplete++
+		}
+	}
+	return f, true, nil
+}
+
+func (s *MemoryPeerStore) InfoHashes() ([][20]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([][20]byte, 0, len(s.swarms))
+	for ih := range s.swarms {
+		out = append(out, ih)
+	}
+	return out, nil
+}
+
+func (s *MemoryPeerStore) Expire(before time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for ih, sw := range s.swarms {
+		for id, p := range sw.Peers {
+			if p.LastSeen.Before(before) {
+				delete(sw.Peers, id)
+			}
+		}
+		if len(sw.Peers) == 0 && sw.Downloaded == 0 {
+			delete(s.swarms, ih)
+		}
+	}
+	return nil
+}
+
+// WriteSnapshot writes the store's contents to w as JSON.
+func (s *MemoryPeerStore) WriteSnapshot(w io.Writer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// JSON object keys must be strings
+	out := make(map[string]snapshotSwarm, len(s.swarms))
+	for ih, sw := range s.swarms {
+		ss := snapshotSwarm{Downloaded: sw.Downloaded}
+		for _, p := range sw.Peers {
+			ss.Peers = append(ss.Peers, snapshotPeer{
+				ID:       hex.EncodeToString(p.ID[:]),
+				Addr:     p.Addr,
+				Left:     p.Left,
+				LastSeen: p.LastSeen,
+			})
+		}
+		out[hex.EncodeToString(ih[:])] = ss
+	}
+	return json.NewEncoder(w).Encode(out)
+}
+
+// ReadSnapshot replaces the store's contents with a snapshot written by WriteSnapshot.
+func (s *MemoryPeerStore) ReadSnapshot(r io.Reader) error {
+	var in map[string]snapshotSwarm
+	if err := json.NewDecoder(r).Decode(&in); err != nil {
+		return fmt.Errorf("decoding peer store snapshot: %w", err)
+	}
+	swarms := make(map[[20]byte]*swarm, len(in))
+	for k, ss := range in {
+		ih, err := decodeHex20(k)
+		if err != nil {
+			return fmt.Errorf("peer store snapshot: infohash: %w", err)
+		}
+		sw := &swarm{Peers: make(map[[20]byte]TrackedPeer, len(ss.Peers)), Downloaded: ss.Downloaded}
+		for _, sp := range ss.Peers {
+			id, err := decodeHex20(sp.ID)
+			if err != nil {
+				return fmt.Errorf("peer store snapshot: peer id: %w", err)
+			}
+			sw.Peers[id] = TrackedPeer{ID: id, Addr: sp.Addr, Left: sp.Left, LastSeen: sp.LastSeen}
+		}
+		swarms[ih] = sw
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.swarms = swarms
+	return nil
+}
+
+type snapshotSwarm struct {
+	Peers      []snapshotPeer `json:"peers"`
+	Downloaded int            `json:"downloaded"`
+}
+
+type snapshotPeer struct {
+	ID       string         `json:"id"`
+	Addr     netip.AddrPort `json:"addr"`
+	Left     int64          `json:"left"`
+	LastSeen time.Time      `json:"last_seen"`
+}
+
+func decodeHex20(s string) ([20]byte, error) {
+	var out [20]byte
+	bs, err := hex.DecodeString(s)
+	if err != nil {
+		return out, err
+	}
+	if len(bs) != 20 {
+		return out, fmt.Errorf("expected 20 bytes, got %d", len(bs))
+	}
+	copy(out[:], bs)
+	return out, nil
+}
@@ -0,0 +1,144 @@
+package bt
+
+import (
+	"fmt"
+	"net/netip"
+	"time"
+)
+
+// PEXExtension is the Extension Protocol name for Peer Exchange, see BEP 11.
+const PEXExtension = "ut_pex"
+
+// Peers are sent PEX messages no more than this often
+const DefaultPEXInterval = time.Minute
+
+// Most peers added or dropped in a single PEX message, as in other clients
+const maxPEXPeers = 50
+
+// PEX flags describe each added peer
+const (
+	PEXPrefersEncryption byte = 0x01
+	PEXSeed              byte = 0x02
+	PEXSupportsUTP       byte = 0x04
+	PEXHolepunch         byte = 0x08
+	// We connected to it, so it accepts incoming connections
+	PEXReachable byte = 0x10
+)
+
+// PEXPeer is a peer added in a PEX message.
+type PEXPeer struct {
+	Addr  netip.AddrPort
+	Flags byte
+}
+
+// PEXMessage is the payload of a ut_pex message: the peers the sender has connected to or dropped since its last message.
+type PEXMessage struct {
+	Added   []PEXPeer
+	Dropped []netip.AddrPort
+}
+
+// MarshalBinary bencodes m, splitting peers into the IPv4 keys (added, added.f, dropped)
+// and IPv6 keys (added6, added6.f, dropped6).
+func (m PEXMessage) MarshalBinary() ([]byte, error) {
+	var added, addedFlags, added6, added6Flags, dropped, dropped6 []byte
+	for _, p := range m.Added {
+		if p.Addr.Addr().Unmap().Is4() {
+			added = AppendCompactAddr(added, p.Addr)
+			addedFlags = append(addedFlags, p.Flags)
+		} else {
+			added6 = AppendCompactAddr(added6, p.Addr)
+			added6Flags = append(added6Flags, p.Flags)
+		}
+	}
+	for _, a := range m.Dropped {
+		if a.Addr().Unmap().Is4() {
+			dropped = AppendCompactAddr(dropped, a)
+		} else {
+			dropped6 = AppendCompactAddr(dropped6, a)
+		}
+	}
+	return Encode(map[string]any{
+		"added":    added,
+		"added.f":  addedFlags,
+		"added6":   added6,
+		"added6.f": added6Flags,
+		"dropped":  dropped,
+		"dropped6": dropped6,
+	})
+}
+
+// ParsePEXMessage parses the payload of a ut_pex message.
+// Missing keys are empty. Flags are ignored unless there's exactly one per added peer.
+func ParsePEXMessage(bs []byte) (*PEXMessage, error) {
+	d, err := ParseDictOnly(bs)
+	if err != nil {
+		return nil, fmt.Errorf("pex: %w", err)
+	}
+	m := &PEXMessage{}
+	for _, keys := range []struct {
+		added, flags, dropped string
+		ipLen                 int
+	}{
+		{"added", "added.f", "dropped", 4},
+		{"added6", "added6.f", "dropped6", 16},
+	} {
+		added, err := pexAddrs(d, keys.added, keys.ipLen)
+		if err != nil {
+			return nil, err
+		}
+		flags, _, err := dictString(d, keys.flags)
+		if err != nil {
+			return nil, fmt.Errorf("pex: %w", err)
+		}
+		for i, a := range added {
+			p := PEXPeer{Addr: a}
+			if len(flags) == len(added) {
+				p.Flags = flags[i]
+			}
+			m.Added = append(m.Added, p)
+		}
+		dropped, err := pexAddrs(d, keys.dropped, keys.ipLen)
+		if err != nil {
+			return nil, err
+		}
+		m.Dropped = append(m.Dropped, dropped...)
+	}
+	return m, nil
+}
+
+func pexAddrs(d map[string]any, key string, ipLen int) ([]netip.AddrPort, error) {
+	s, _, err := dictString(d, key)
+	if err != nil {
+		return nil, fmt.Errorf("pex: %w", err)
+	}
+	addrs, err := ParseCompactAddrs([]byte(s), ipLen)
+	if err != nil {
+		return nil, fmt.Errorf("pex: %s: %w", key, err)
+	}
+	return addrs, nil
+}
+
+// pexDelta compares the peers we're connected to with those we last told a peer about,
+// returning up to maxPEXPeers additions and drops. sent is updated to match what's reported.
+func pexDelta(current map[netip.AddrPort]byte, sent map[netip.AddrPort]struct{}) PEXMessage {
+	var m PEXMessage
+	for addr, flags := range current {
+		if len(m.Added) == maxPEXPeers {
+			break
+		}
+		if _, ok := sent[addr]; !ok {
+			m.Added = append(m.Added, PEXPeer{Addr: addr, Flags: flags})
+			sent[addr] = struct{}{}
+		}
+	}
+	for addr := range sent {
+		if len(m.Dropped) == maxPEXPeers {
+			break
+		}
+		if _, ok := current[addr]; !ok {
+			m.Dropped = append(m.Dropped, addr)
+			delete(sent, addr)
+		}
+	}
+	return m
+}
@@ -0,0 +1,110 @@
+package bt
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+func TestPEXMessage(t *testing.T) {
+	t.Parallel()
+	m := PEXMessage{
+		Added: []PEXPeer{
+			{Addr: netip.MustParseAddrPort("1.2.3.4:6881"), Flags: PEXSeed | PEXReachable},
+			{Addr: netip.MustParseAddrPort("[2001:db8::1]:6882"), Flags: PEXSupportsUTP},
+			{Addr: netip.MustParseAddrPort("5.6.7.8:6883")},
+		},
+		Dropped: []netip.AddrPort{
+			netip.MustParseAddrPort("9.9.9.9:1"),
+			netip.MustParseAddrPort("[2001:db8::2]:2"),
+		},
+	}
+	bs, err := m.MarshalBinary()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	got, err := ParsePEXMessage(bs)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	// IPv4 peers come first
+	want := &PEXMessage{
+		Added:   []PEXPeer{m.Added[0], m.Added[2], m.Added[1]},
+		Dropped: m.Dropped,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("want %+v, got %+v", want, got)
+	}
+}
+
+func TestParsePEXMessage(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		Name      string
+		Input     string
+		Want      *PEXMessage
+		WantError bool
+	}{
+		{Name: "empty", Input: "de", Want: &PEXMessage{}},
+		{
+			Name:  "flags mismatch ignored",
+			Input: "d5:added12:\x01\x02\x03\x04\x1a\xe1\x05\x06\x07\x08\x1a\xe27:added.f1:\x02e",
+			Want: &PEXMessage{Added: []PEXPeer{
+				{Addr: netip.MustParseAddrPort("1.2.3.4:6881")},
+				{Addr: netip.MustParseAddrPort("5.6.7.8:6882")},
+			}},
+		},
+		{Name: "bad compact length", Input: "d5:added5:abcdee", WantError: true},
+		{Name: "wrong type", Input: "d7:droppedi1ee", WantError: true},
+	}
+	for _, c := range cases {
+		c := c
+		t.Run(c.Name, func(t *testing.T) {
+			t.Parallel()
+			got, err := ParsePEXMessage([]byte(c.Input))
+			if c.WantError {
+				if err == nil {
+					t.Fatal("wanted error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !reflect.DeepEqual(got, c.Want) {
+				t.Fatalf("want %+v, got %+v", c.Want, got)
+			}
+		})
+	}
+}
+
+func TestPEXDelta(t *testing.T) {
+	t.Parallel()
+	a := netip.MustParseAddrPort("10.0.0.1:1")
+	b := netip.MustParseAddrPort("10.0.0.2:2")
+	c := netip.MustParseAddrPort("10.0.0.3:3")
+	sent := make(map[netip.AddrPort]struct{})
+	m := pexDelta(map[netip.AddrPort]byte{a: PEXSeed, b: 0}, sent)
+	if len(m.Added) != 2 || len(m.Dropped) != 0 || len(sent) != 2 {
+		t.Fatalf("want a and b added, got %+v", m)
+	}
+	m = pexDelta(map[netip.AddrPort]byte{b: 0, c: 0}, sent)
+	if !reflect.DeepEqual(m, PEXMessage{Added: []PEXPeer{{Addr: c}}, Dropped: []netip.AddrPort{a}}) {
+		t.Fatalf("want c added and a dropped, got %+v", m)
+	}
+	if m = pexDelta(map[netip.AddrPort]byte{b: 0, c: 0}, sent); len(m.Added) != 0 || len(m.Dropped) != 0 {
+		t.Fatalf("want nothing new, got %+v", m)
+	}
+
+	// Large changes are spread over several messages
+	many := make(map[netip.AddrPort]byte)
+	for i := 0; i < 120; i++ {
+		many[netip.AddrPortFrom(netip.AddrFrom4([4]byte{10, 1, 0, byte(i)}), 6881)] = 0
+	}
+	sent = make(map[netip.AddrPort]struct{})
+	for _, want := range []int{50, 50, 20} {
+		if m := pexDelta(many, sent); len(m.Added) != want {
+			t.Fatalf("want %d added, got %d", want, len(m.Added))
+		}
+	}
+}
@@ -0,0 +1,365 @@
+package bt
+
+import (
+	"fmt"
+	"math/bits"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Priority controls which files are downloaded first. Pieces take the highest priority of the files they overlap.
+type Priority int8
+
+const (
+	// Not downloaded at all
+	PrioritySkip Priority = iota
+	PriorityNormal
+	PriorityHigh
+)
+
+// DefaultRandomFirst is how many pieces are picked at random before switching to rarest-first.
+//
+// Rare pieces are slow to come by, and a new peer has nothing to trade until it finishes a piece.
+const DefaultRandomFirst = 4
+
+type pieceState uint8
+
+const (
+	pieceWanted pieceState = iota
+	piecePartial
+	pieceHave
+)
+
+// PiecePicker chooses which piece to download next, rarest-first.
+//
+// It counts how many connected peers have each piece, from their Bitfield and Have messages.
+// Wanted pieces are kept in buckets by priority and availability, so updates are O(1)
+// and a pick only scans the rarest bucket containing a piece the peer has.
+// Ties are broken by starting each scan at a random offset.
+//
+// Pieces move from wanted, to partial when Started, to have when Completed (or back to wanted on Reset).
+// Pieces with PrioritySkip are never picked.
+type PiecePicker struct {
+	// Pieces picked at random, before switching to rarest-first
+	RandomFirst int
+
+	mu    sync.Mutex
+	rng   *rand.Rand
+	info  *Info
+	avail []int32
+	state []pieceState
+	prio  []Priority
+	// buckets[priority][availability] holds the wanted pieces of that priority and availability
+	buckets [PriorityHigh + 1][][]int32
+	// Position of each wanted piece within its bucket
+	pos []int32
+	// Partially downloaded pieces
+	partial map[int]struct{}
+	// Pieces completed since we started, for random-first
+	completed int
+	// Byte offset at which each file starts, for mapping file priorities to pieces
+	fileOffsets  []int64
+	filePriority []Priority
+}
+
+// NewPiecePicker creates a picker for info's pieces, excluding those in have.
+func NewPiecePicker(info *Info, have *BField) *PiecePicker {
+	n := len(info.Pieces)
+	p := &PiecePicker{
+		RandomFirst: DefaultRandomFirst,
+		rng:         rand.New(rand.NewSource(time.Now().UnixNano())),
+		info:        info,
+		avail:       make([]int32, n),
+		state:       make([]pieceState, n),
+		prio:        make([]Priority, n),
+		pos:         make([]int32, n),
+		partial:     make(map[int]struct{}),
+	}
+	if info.Files != nil {
+		var off int64
+		for _, f := range info.Files {
+			p.fileOffsets = append(p.fileOffsets, off)
+			p.filePriority = append(p.filePriority, PriorityNormal)
+			off += int64(f.Length)
+		}
+	} else {
+		p.fileOffsets = []int64{0}
+		p.filePriority = []Priority{PriorityNormal}
+	}
+	for i := 0; i < n; i++ {
+		p.prio[i] = PriorityNormal
+		if has, _ := have.Get(i); has {
+			p.state[i] = pieceHave
+			continue
+		}
+		p.insert(i)
+	}
+	return p
+}
+
+// insert adds a wanted piece to its bucket. Must hold p.mu.
+func (p *PiecePicker) insert(i int) {
+	if p.state[i] != pieceWanted || p.prio[i] == PrioritySkip {
+		return
+	}
+	byAvail := &p.buckets[p.prio[i]]
+	for int(p.avail[i]) >= len(*byAvail) {
+		*byAvail = append(*byAvail, nil)
+	}
+	bucket := &(*byAvail)[p.avail[i]]
+	p.pos[i] = int32(len(*bucket))
+	*bucket = append(*bucket, int32(i))
+}
+
+// remove takes a piece out of its bucket, if it's in one. Must hold p.mu.
+func (p *PiecePicker) remove(i int) {
+	if p.state[i] != pieceWanted || p.prio[i] == PrioritySkip {
+		return
+	}
+	bucket := &p.buckets[p.prio[i]][p.avail[i]]
+	last := (*bucket)[len(*bucket)-1]
+	(*bucket)[p.pos[i]] = last
+	p.pos[last] = p.pos[i]
+	*bucket = (*bucket)[:len(*bucket)-1]
+}
+
+// changeAvailability adds delta to the availability of piece i. Must hold p.mu.
+func (p *PiecePicker) changeAvailability(i int, delta int32) {
+	if p.avail[i]+delta < 0 {
+		return // A peer gone that we never counted
+	}
+	p.remove(i)
+	p.avail[i] += delta
+	p.insert(i)
+}
+
+// PeerHave records that a connected peer announced piece index.
+func (p *PiecePicker) PeerHave(index int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if index >= 0 && index < len(p.avail) {
+		p.changeAvailability(index, 1)
+	}
+}
+
+// PeerBitfield records a newly connected peer's pieces.
+func (p *PiecePicker) PeerBitfield(b *BField) {
+	p.updateBitfield(b, 1)
+}
+
+// PeerGone removes a disconnected peer's pieces: its Bitfield along with any Haves since.
+func (p *PiecePicker) PeerGone(b *BField) {
+	p.updateBitfield(b, -1)
+}
+
+func (p *PiecePicker) updateBitfield(b *BField, delta int32) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := len(p.avail)
+	if b.Length() < n {
+		n = b.Length()
+	}
+	for byteIndex, x := range b.bs {
+		for ; x != 0; x &= x - 1 { // Clear the lowest set bit
+			i := byteIndex*8 + 7 - bits.TrailingZeros8(x)
+			if i < n {
+				p.changeAvailability(i, delta)
+			}
+		}
+	}
+}
+
+// Availability is the number of connected peers with piece index.
+func (p *PiecePicker) Availability(index int) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return int(p.avail[index])
+}
+
+// SetFilePriority sets the priority of a file, by its index in Info.Files (0 for single-file torrents).
+func (p *PiecePicker) SetFilePriority(file int, prio Priority) error {
+	if prio < PrioritySkip || prio > PriorityHigh {
+		return fmt.Errorf("invalid priority %d", prio)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if file < 0 || file >= len(p.filePriority) {
+		return fmt.Errorf("file %d out of range, torrent has %d files", file, len(p.filePriority))
+	}
+	p.filePriority[file] = prio
+	first, last := p.filePieces(file)
+	for i := first; i <= last; i++ {
+		p.remove(i)
+		p.prio[i] = p.piecePriority(i)
+		p.insert(i)
+	}
+	return nil
+}
+
+// filePieces returns the range of pieces overlapping file. Must hold p.mu.
+func (p *PiecePicker) filePieces(file int) (first, last int) {
+	start := p.fileOffsets[file]
+	end := int64(p.info.TotalLength())
+	if file+1 < len(p.fileOffsets) {
+		end = p.fileOffsets[file+1]
+	}
+	pieceLength := int64(p.info.PieceLength)
+	first = int(start / pieceLength)
+	last = int((end - 1) / pieceLength)
+	if end == start { // Empty file
+		last = first - 1
+	}
+	return first, last
+}
+
+// piecePriority is the highest priority of the files overlapping piece i. Must hold p.mu.
+func (p *PiecePicker) piecePriority(i int) Priority {
+	start := int64(i) * int64(p.info.PieceLength)
+	end := start + int64(p.info.PieceSize(i))
+	// The last file starting at or before the piece
+	file := sort.Search(len(p.fileOffsets), func(f int) bool { return p.fileOffsets[f] > start }) - 1
+	prio := PrioritySkip
+	for ; file < len(p.fileOffsets) && p.fileOffsets[file] < end; file++ {
+		if p.filePriority[file] > prio {
+			prio = p.filePriority[file]
+		}
+	}
+	return prio
+}
+
+// Pick chooses a new piece to download from a peer with peerHas, without starting it.
+//
+// The first RandomFirst pieces are chosen at random, then the rarest of the highest priority pieces.
+func (p *PiecePicker) Pick(peerHas *BField) (int, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.completed < p.RandomFirst {
+		return p.pickRandom(peerHas)
+	}
+	for prio := PriorityHigh; prio > PrioritySkip; prio-- {
+		// Nobody has the pieces with availability 0
+		for avail := 1; avail < len(p.buckets[prio]); avail++ {
+			bucket := p.buckets[prio][avail]
+			if len(bucket) == 0 {
+				continue
+			}
+			start := p.rng.Intn(len(bucket))
+			for j := range bucket {
+				i := int(bucket[(start+j)%len(bucket)])
+				if has, _ := peerHas.Get(i); has {
+					return i, true
+				}
+			}
+		}
+	}
+	return 0, false
+}
+
+// pickRandom chooses any wanted piece the peer has. Must hold p.mu.
+func (p *PiecePicker) pickRandom(peerHas *BField) (int, bool) {
+	n := len(p.state)
+	if n == 0 {
+		return 0, false
+	}
+	start := p.rng.Intn(n)
+	for j := 0; j < n; j++ {
+		i := (start + j) % n
+		if p.state[i] != pieceWanted || p.prio[i] == PrioritySkip {
+			continue
+		}
+		if has, _ := peerHas.Get(i); has {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// Unstarted is the number of wanted pieces that haven't been started, whether or not any peer has them.
+func (p *PiecePicker) Unstarted() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := 0
+	for prio := PrioritySkip + 1; prio <= PriorityHigh; prio++ {
+		for _, bucket := range p.buckets[prio] {
+			n += len(bucket)
+		}
+	}
+	return n
+}
+
+// Interesting reports whether the peer has any piece we still want.
+func (p *PiecePicker) Interesting(peerHas *BField) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, state := range p.state {
+		if state == pieceHave || p.prio[i] == PrioritySkip {
+			continue
+		}
+		if has, _ := peerHas.Get(i); has {
+			return true
+		}
+	}
+	return false
+}
+
+// Partial returns the partially downloaded pieces the peer has, rarest first.
+// These should be finished before starting new pieces, so they can be verified and shared sooner.
+func (p *PiecePicker) Partial(peerHas *BField) []int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var out []int
+	for i := range p.partial {
+		if has, _ := peerHas.Get(i); has {
+			out = append(out, i)
+		}
+	}
+	sort.Slice(out, func(a, b int) bool {
+		if p.avail[out[a]] != p.avail[out[b]] {
+			return p.avail[out[a]] < p.avail[out[b]]
+		}
+		return out[a] < out[b]
+	})
+	return out
+}
+
+// Started records that we've begun downloading piece index.
+func (p *PiecePicker) Started(index int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.state[index] != pieceWanted {
+		return
+	}
+	p.remove(index)
+	p.state[index] = piecePartial
+	p.partial[index] = struct{}{}
+}
+
+// Completed records that piece index has been verified.
+func (p *PiecePicker) Completed(index int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.state[index] == pieceHave {
+		return
+	}
+	p.remove(index)
+	delete(p.partial, index)
+	p.state[index] = pieceHave
+	p.completed++
+}
+
+// Reset returns piece index to be picked again, e.g. after it fails its hash check.
+func (p *PiecePicker) Reset(index int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.state[index] == pieceWanted {
+		return
+	}
+	if p.state[index] == pieceHave {
+		p.completed--
+	}
+	delete(p.partial, index)
+	p.state[index] = pieceWanted
+	p.insert(index)
+}
@@ -0,0 +1,229 @@
+package bt
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// bitfieldOf returns a bitfield of length n with the given pieces set
+func bitfieldOf(t testing.TB, n int, pieces ...int) *BField {
+	t.Helper()
+	b, err := NewEmptyBitfield(n)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	for _, i := range pieces {
+		b.Set(i, true)
+	}
+	return b
+}
+
+// newTestPicker creates a rarest-first picker for a single file torrent of n pieces
+func newTestPicker(t testing.TB, n int) *PiecePicker {
+	t.Helper()
+	length := n * BlockSize
+	info := &Info{PieceLength: BlockSize, Length: &length, Pieces: make([][]byte, n)}
+	p := NewPiecePicker(info, bitfieldOf(t, n))
+	p.RandomFirst = 0
+	return p
+}
+
+func TestPiecePickerRarestFirst(t *testing.T) {
+	t.Parallel()
+	p := newTestPicker(t, 6)
+	p.PeerBitfield(bitfieldOf(t, 6, 0, 1, 2, 3, 4))
+	p.PeerBitfield(bitfieldOf(t, 6, 0, 1, 2, 3))
+	p.PeerBitfield(bitfieldOf(t, 6, 0, 1, 2))
+	p.PeerHave(1)
+	// Availability: 0:3 1:4 2:3 3:2 4:1 5:0
+	for i, want := range []int{3, 4, 3, 2, 1, 0} {
+		if got := p.Availability(i); got != want {
+			t.Fatalf("piece %d: want availability %d, got %d", i, want, got)
+		}
+	}
+
+	seeder := bitfieldOf(t, 6, 0, 1, 2, 3, 4, 5)
+	var order []int
+	for {
+		i, ok := p.Pick(seeder)
+		if !ok {
+			break
+		}
+		order = append(order, i)
+		p.Started(i)
+	}
+	// 5 is rarest, but nobody we know of has it. 0 and 2 are tied.
+	if len(order) != 5 || order[0] != 4 || order[1] != 3 || order[4] != 1 {
+		t.Fatalf("want pieces picked rarest first as [4 3 (0|2) (2|0) 1], got %v", order)
+	}
+
+	// Only pieces the peer has
+	p.Reset(3)
+	p.Reset(1)
+	if i, ok := p.Pick(bitfieldOf(t, 6, 1)); !ok || i != 1 {
+		t.Fatalf("want piece 1, got %d (%t)", i, ok)
+	}
+	p.PeerGone(bitfieldOf(t, 6, 0, 1, 2, 3, 4))
+	if got := p.Availability(3); got != 1 {
+		t.Fatalf("want availability 1 after peer left, got %d", got)
+	}
+}
+
+func TestPiecePickerTieBreaking(t *testing.T) {
+	t.Parallel()
+	seen := make(map[int]bool)
+	for trial := 0; trial < 50; trial++ {
+		p := newTestPicker(t, 20)
+		p.PeerBitfield(bitfieldOf(t, 20, 0, 1, 2, 3, 4, 5, 6, 7, 8, 9))
+		i, _ := p.Pick(bitfieldOf(t, 20, 0, 1, 2, 3, 4, 5, 6, 7, 8, 9))
+		seen[i] = true
+	}
+	if len(seen) < 3 {
+		t.Fatalf("want ties broken randomly, only picked %v", seen)
+	}
+}
+
+func TestPiecePickerRandomFirst(t *testing.T) {
+	t.Parallel()
+	p := newTestPicker(t, 50)
+	p.RandomFirst = 2
+	all := make([]int, 50)
+	for i := range all {
+		all[i] = i
+	}
+	p.PeerBitfield(bitfieldOf(t, 50, all...))
+	// Piece 49 is uniquely rarest
+	p.PeerBitfield(bitfieldOf(t, 50, all[:49]...))
+
+	seeder := bitfieldOf(t, 50, all...)
+	for done := 0; done < 2; done++ {
+		picked := make(map[int]bool)
+		for trial := 0; trial < 20; trial++ {
+			i, _ := p.Pick(seeder)
+			picked[i] = true
+		}
+		if len(picked) < 2 {
+			t.Fatalf("want random picks before %d pieces complete, got %v", p.RandomFirst, picked)
+		}
+		// Not the rarest piece, which a random pick could land on
+		p.Started(done)
+		p.Completed(done)
+	}
+	if i, _ := p.Pick(seeder); i != 49 {
+		t.Fatalf("want rarest piece 49 after random-first, got %d", i)
+	}
+}
+
+func TestPiecePickerPartial(t *testing.T) {
+	t.Parallel()
+	p := newTestPicker(t, 4)
+	p.PeerBitfield(bitfieldOf(t, 4, 0, 1, 2, 3))
+	p.PeerBitfield(bitfieldOf(t, 4, 0, 1, 2))
+	p.PeerBitfield(bitfieldOf(t, 4, 0, 1))
+	for _, i := range []int{0, 2, 3} {
+		p.Started(i)
+	}
+	got := p.Partial(bitfieldOf(t, 4, 0, 1, 2))
+	if len(got) != 2 || got[0] != 2 || got[1] != 0 {
+		t.Fatalf("want partial pieces the peer has, rarest first [2 0], got %v", got)
+	}
+	p.Completed(2)
+	if got := p.Partial(bitfieldOf(t, 4, 0, 1, 2, 3)); len(got) != 2 {
+		t.Fatalf("want 2 partial pieces after completing one, got %v", got)
+	}
+	if i, ok := p.Pick(bitfieldOf(t, 4, 0, 1, 2, 3)); !ok || i != 1 {
+		t.Fatalf("want only unstarted piece 1 picked, got %d (%t)", i, ok)
+	}
+}
+
+func TestPiecePickerFilePriority(t *testing.T) {
+	t.Parallel()
+	// Pieces of 10 bytes. File a is in pieces 0-1, b in 1-2, and c in 2-4.
+	info := &Info{
+		PieceLength: 10,
+		Pieces:      make([][]byte, 5),
+		Files:       []FileInfo{{Length: 15, Path: []string{"a"}}, {Length: 10, Path: []string{"b"}}, {Length: 25, Path: []string{"c"}}},
+	}
+	p := NewPiecePicker(info, bitfieldOf(t, 5))
+	p.RandomFirst = 0
+	seeder := bitfieldOf(t, 5, 0, 1, 2, 3, 4)
+	p.PeerBitfield(seeder)
+	p.PeerBitfield(bitfieldOf(t, 5, 2, 3, 4)) // c is the most common
+
+	if err := p.SetFilePriority(0, PrioritySkip); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := p.SetFilePriority(2, PriorityHigh); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := p.SetFilePriority(3, PriorityHigh); err == nil {
+		t.Fatal("wanted error for out of range file, got nil")
+	}
+	var order []int
+	for {
+		i, ok := p.Pick(seeder)
+		if !ok {
+			break
+		}
+		order = append(order, i)
+		p.Started(i)
+	}
+	// Piece 0 is only in skipped file a. Piece 1 is shared with b, so it's still wanted.
+	if len(order) != 4 || order[0] < 2 || order[1] < 2 || order[2] < 2 || order[3] != 1 {
+		t.Fatalf("want high priority pieces 2-4 first, then 1, got %v", order)
+	}
+	if p.Interesting(bitfieldOf(t, 5, 0)) {
+		t.Fatal("want peer with only skipped pieces uninteresting")
+	}
+}
+
+// A large torrent with many peers, each with a random half of the pieces
+func benchmarkPicker(b *testing.B, numPieces, numPeers int) (*PiecePicker, []*BField) {
+	p := newTestPicker(b, numPieces)
+	rng := rand.New(rand.NewSource(1))
+	peers := make([]*BField, numPeers)
+	for i := range peers {
+		peers[i] = bitfieldOf(b, numPieces)
+		for j := 0; j < numPieces; j++ {
+			if rng.Intn(2) == 0 {
+				peers[i].Set(j, true)
+			}
+		}
+		p.PeerBitfield(peers[i])
+	}
+	return p, peers
+}
+
+func BenchmarkPiecePickerPick(b *testing.B) {
+	p, peers := benchmarkPicker(b, 100_000, 300)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		i, ok := p.Pick(peers[n%len(peers)])
+		if !ok {
+			b.Fatal("nothing to pick")
+		}
+		p.Started(i)
+		if n%2 == 0 {
+			p.Completed(i)
+		} else {
+			p.Reset(i)
+		}
+	}
+}
+
+func BenchmarkPiecePickerHave(b *testing.B) {
+	p, _ := benchmarkPicker(b, 100_000, 300)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		p.PeerHave(n % 100_000)
+	}
+}
+
+func BenchmarkPiecePickerPeerBitfield(b *testing.B) {
+	p, peers := benchmarkPicker(b, 100_000, 300)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		p.PeerGone(peers[n%len(peers)])
+		p.PeerBitfield(peers[n%len(peers)])
+	}
+}
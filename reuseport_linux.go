@@ -0,0 +1,6 @@
+//go:build linux && !(mips || mipsle || mips64 || mips64le)
+
+package bt
+
+// SO_REUSEPORT, which syscall doesn't define on Linux. It's different on mips, where we go without.
+const soReusePort = 0xf
@@ -0,0 +1,10 @@
+//go:build !(darwin || dragonfly || freebsd || netbsd || openbsd || (linux && !(mips || mipsle || mips64 || mips64le)))
+
+package bt
+
+import "syscall"
+
+// reusePort does nothing here, so holepunched TCP connections are dialed from any port instead of our listen port.
+func reusePort(network, address string, c syscall.RawConn) error {
+	return nil
+}
@@ -0,0 +1,167 @@
+package bt
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+/*
+Scraping asks a tracker for swarm statistics without announcing ourselves.
+See BEP 48: https://www.bittorrent.org/beps/bep_0048.html
+
+By convention, the scrape URL is derived from the announce URL by replacing
+the text "announce" immediately following the last '/' with "scrape".
+If the announce URL doesn't follow this convention, the tracker doesn't support scraping.
+
+The response is a bencoded dictionary whose "files" key maps each raw 20-byte infohash
+to a dictionary with keys complete (seeders), downloaded, and incomplete (leechers).
+*/
+
+// ErrScrapeUnsupported is returned when an announce URL has no conventional scrape URL.
+var ErrScrapeUnsupported = errors.New("tracker does not support scrape")
+
+// ScrapeFile holds the swarm statistics for a single infohash.
+type ScrapeFile struct {
+	// Number of peers with the entire file, i.e. seeders
+	Complete int
+	// Total number of times the tracker has registered a completion ("event=complete")
+	Downloaded int
+	// Number of non-seeder peers, i.e. leechers
+	Incomplete int
+	// Optional. The torrent's name, as specified by the "name" field in the info dict.
+	Name string
+}
+
+type ScrapeResponse struct {
+	Reason *string
+	Files  map[[20]byte]ScrapeFile
+}
+
+// ScrapeURL derives the scrape URL from an announce URL, per BEP 48.
+//
+// UDP trackers (BEP 15) scrape over the same endpoint they announce on,
+// so udp:// URLs are returned unchanged.
+func ScrapeURL(announce string) (string, error) {
+	u, err := url.Parse(announce)
+	if err != nil {
+		return "", fmt.Errorf("parsing announce URL %s: %w", announce, err)
+	}
+	switch u.Scheme {
+	case "udp":
+		return announce, nil
+	case "http", "https":
+	default:
+		return "", fmt.Errorf("unsupported tracker scheme %q", u.Scheme)
+	}
+	i := strings.LastIndex(u.Path, "/")
+	if i == -1 || !strings.HasPrefix(u.Path[i+1:], "announce") {
+		return "", ErrScrapeUnsupported
+	}
+	u.Path = u.Path[:i+1] + "scrape" + u.Path[i+1+len("announce"):]
+	u.RawPath = ""
+	return u.String(), nil
+}
+
+// ParseScrapeResponse parses a bencoded scrape response.
+func ParseScrapeResponse(bs []byte) (*ScrapeResponse, error) {
+	d, err := ParseDictOnly(bs)
+	if err != nil {
+		return nil, err
+	}
+	reason, ok, err := dictString(d, "failure reason")
+	if err != nil {
+		return nil, fmt.Errorf("ScrapeResponse: %w", err)
+	}
+	if ok {
+		return &ScrapeResponse{Reason: &reason}, nil
+	}
+	filesAny, ok := d["files"]
+	if !ok {
+		return nil, errors.New("ScrapeResponse: missing \"files\" dictionary")
+	}
+	files, ok := filesAny.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("ScrapeResponse: expected \"files\" to be a dictionary, got %T", filesAny)
+	}
+	out := &ScrapeResponse{Files: make(map[[20]byte]ScrapeFile, len(files))}
+	for k, v := range files {
+		if len(k) != 20 {
+			return nil, fmt.Errorf("ScrapeResponse: expected 20 byte infohash key, got %d bytes", len(k))
+		}
+		stats, ok := v.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("ScrapeResponse: expected dictionary for infohash %x, got %T", k, v)
+		}
+		var f ScrapeFile
+		for key, dst := range map[string]*int{
+			"complete":   &f.Complete,
+			"downloaded": &f.Downloaded,
+			"incomplete": &f.Incomplete,
+		} {
+			// Missing counts are left as zero; some trackers omit downloaded.
+			if *dst, _, err = dictInt(stats, key); err != nil {
+				return nil, fmt.Errorf("ScrapeResponse: infohash %x: %w", k, err)
+			}
+		}
+		if f.Name, _, err = dictString(stats, "name"); err != nil {
+			return nil, fmt.Errorf("ScrapeResponse: infohash %x: %w", k, err)
+		}
+		var ih [20]byte
+		copy(ih[:], k)
+		out.Files[ih] = f
+	}
+	return out, nil
+}
+
+// Scrape requests swarm statistics for the given infohashes from the tracker at announce.
+//
+// The scrape URL is derived from announce, and both HTTP(S) and UDP trackers are supported.
+// Trackers may omit infohashes they don't track from the response.
+func Scrape(announce string, infoHashes ...[20]byte) (*ScrapeResponse, error) {
+	if len(infoHashes) == 0 {
+		return nil, errors.New("Scrape: no infohashes provided")
+	}
+	u, err := ScrapeURL(announce)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(u, "udp://") {
+		c, err := DialUDPTracker(u)
+		if err != nil {
+			return nil, err
+		}
+		defer c.Close()
+		return c.Scrape(infoHashes...)
+	}
+	return ScrapeHTTP(u, infoHashes...)
+}
+
+// ScrapeHTTP issues a scrape request to an HTTP(S) scrape URL.
+func ScrapeHTTP(scrapeURL string, infoHashes ...[20]byte) (*ScrapeResponse, error) {
+	v := url.Values{}
+	for _, ih := range infoHashes {
+		v.Add("info_hash", string(ih[:]))
+	}
+	sep := "?"
+	if strings.Contains(scrapeURL, "?") {
+		sep = "&"
+	}
+	u := scrapeURL + sep + v.Encode()
+	r, err := trackerClient.Get(u)
+	if err != nil {
+		return nil, fmt.Errorf("GET %s: %w", scrapeURL, err)
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: expected 200 OK, got %s", scrapeURL, r.Status)
+	}
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, fmt.Errorf("GET %s: reading body: %w", scrapeURL, err)
+	}
+	return ParseScrapeResponse(data)
+}
@@ -0,0 +1,191 @@
+package bt
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestScrapeURL(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		Name      string
+		Input     string
+		Want      string
+		WantError error
+	}{
+		{
+			Name:  "converts plain announce",
+			Input: "http://example.com/announce",
+			Want:  "http://example.com/scrape",
+		},
+		{
+			Name:  "converts announce with suffix",
+			Input: "http://example.com/x/announce.php",
+			Want:  "http://example.com/x/scrape.php",
+		},
+		{
+			Name:  "keeps query",
+			Input: "https://example.com/announce?passkey=abc",
+			Want:  "https://example.com/scrape?passkey=abc",
+		},
+		{
+			Name:  "leaves UDP unchanged",
+			Input: "udp://example.com:6969/announce",
+			Want:  "udp://example.com:6969/announce",
+		},
+		{
+			Name:      "fails when announce isn't after last slash",
+			Input:     "http://example.com/announce/x",
+			WantError: ErrScrapeUnsupported,
+		},
+		{
+			Name:      "fails for unconventional path",
+			Input:     "http://example.com/a",
+			WantError: ErrScrapeUnsupported,
+		},
+	}
+	for _, c := range cases {
+		c := c
+		t.Run(c.Name, func(t *testing.T) {
+			t.Parallel()
+			got, err := ScrapeURL(c.Input)
+			if c.WantError != nil {
+				if !errors.Is(err, c.WantError) {
+					t.Fatalf("want error %s, got %v", c.WantError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if got != c.Want {
+				t.Fatalf("want %s, got %s", c.Want, got)
+			}
+		})
+	}
+}
+
+func TestParseScrapeResponse(t *testing.T) {
+	ih := sha1.Sum([]byte("infohash"))
+	input := []byte(fmt.Sprintf("d5:filesd20:%sd8:completei5e10:downloadedi50e10:incompletei10eeee", ih[:]))
+	want := &ScrapeResponse{
+		Files: map[[20]byte]ScrapeFile{
+			ih: {Complete: 5, Downloaded: 50, Incomplete: 10},
+		},
+	}
+	got, err := ParseScrapeResponse(input)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Fatalf("want %#v, got %#v", want, got)
+	}
+
+	// Infohash keys must be 20 bytes
+	_, err = ParseScrapeResponse([]byte(`d5:filesd3:abcd8:completei5eeee`))
+	if err == nil {
+		t.Fatal("expected error for short infohash, got none")
+	}
+}
+
+func TestScrapeHTTP(t *testing.T) {
+	ih1 := sha1.Sum([]byte("one"))
+	ih2 := sha1.Sum([]byte("two"))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/scrape" {
+			http.NotFound(w, r)
+			return
+		}
+		hashes := r.URL.Query()["info_hash"]
+		if len(hashes) != 2 || hashes[0] != string(ih1[:]) || hashes[1] != string(ih2[:]) {
+			t.Errorf("unexpected info_hash params: %x", hashes)
+		}
+		fmt.Fprintf(w, "d5:filesd20:%sd8:completei1e10:downloadedi2e10:incompletei3ee20:%sd8:completei4e10:downloadedi5e10:incompletei6eeee",
+			ih1[:], ih2[:])
+	}))
+	defer srv.Close()
+
+	got, err := Scrape(srv.URL+"/announce", ih1, ih2)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	want := map[[20]byte]ScrapeFile{
+		ih1: {Complete: 1, Downloaded: 2, Incomplete: 3},
+		ih2: {Complete: 4, Downloaded: 5, Incomplete: 6},
+	}
+	if !reflect.DeepEqual(want, got.Files) {
+		t.Fatalf("want %#v, got %#v", want, got.Files)
+	}
+}
+
+// fakeUDPTracker answers connect and scrape requests with fixed statistics.
+func fakeUDPTracker(t *testing.T, conn *net.UDPConn) {
+	const connID = 0x1234
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		req := buf[:n]
+		action := binary.BigEndian.Uint32(req[8:])
+		resp := make([]byte, 8, 16)
+		binary.BigEndian.PutUint32(resp, action)
+		copy(resp[4:8], req[12:16])
+		switch action {
+		case udpActionConnect:
+			if binary.BigEndian.Uint64(req) != udpProtocolID {
+				t.Errorf("connect: wrong protocol id %x", req[:8])
+			}
+			resp = binary.BigEndian.AppendUint64(resp, connID)
+		case udpActionScrape:
+			if binary.BigEndian.Uint64(req) != connID {
+				t.Errorf("scrape: wrong connection id %x", req[:8])
+			}
+			for i := 16; i < n; i += 20 {
+				resp = binary.BigEndian.AppendUint32(resp, 7)
+				resp = binary.BigEndian.AppendUint32(resp, 8)
+				resp = binary.BigEndian.AppendUint32(resp, 9)
+			}
+		}
+		conn.WriteToUDP(resp, addr)
+	}
+}
+
+func TestScrapeUDP(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer conn.Close()
+	go fakeUDPTracker(t, conn)
+
+	c, err := DialUDPTracker(fmt.Sprintf("udp://%s/announce", conn.LocalAddr()))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer c.Close()
+	c.Timeout = time.Second
+
+	ih1 := sha1.Sum([]byte("one"))
+	ih2 := sha1.Sum([]byte("two"))
+	got, err := c.Scrape(ih1, ih2)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	want := map[[20]byte]ScrapeFile{
+		ih1: {Complete: 7, Downloaded: 8, Incomplete: 9},
+		ih2: {Complete: 7, Downloaded: 8, Incomplete: 9},
+	}
+	if !reflect.DeepEqual(want, got.Files) {
+		t.Fatalf("want %#v, got %#v", want, got.Files)
+	}
+}
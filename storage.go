@@ -0,0 +1,54 @@
+package bt
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Storage holds the verified pieces of a torrent.
+type Storage interface {
+	// WritePiece stores a complete, verified piece.
+	WritePiece(index int, data []byte) error
+	// ReadBlock fills buf from piece index, starting at offset begin.
+	ReadBlock(index, begin int, buf []byte) error
+}
+
+// PieceDirStorage stores each piece as its own file in Dir, named by its index.
+//
+// This is what SetupStorage prepares a directory for. Pieces still need to be joined into the torrent's files.
+type PieceDirStorage struct {
+	Dir string
+}
+
+func (s *PieceDirStorage) path(index int) string {
+	return filepath.Join(s.Dir, fmt.Sprint(index))
+}
+
+// WritePiece writes to a temporary file first, so a piece file is either complete or absent.
+func (s *PieceDirStorage) WritePiece(index int, data []byte) error {
+	tmp := s.path(index) + ".part"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("writing piece %d: %w", index, err)
+	}
+	if err := os.Rename(tmp, s.path(index)); err != nil {
+		return fmt.Errorf("writing piece %d: %w", index, err)
+	}
+	return nil
+}
+
+func (s *PieceDirStorage) ReadBlock(index, begin int, buf []byte) error {
+	f, err := os.Open(s.path(index))
+	if err != nil {
+		return fmt.Errorf("reading piece %d: %w", index, err)
+	}
+	defer f.Close()
+	if _, err := f.ReadAt(buf, int64(begin)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return fmt.Errorf("reading piece %d at %d: %w", index, begin, err)
+	}
+	return nil
+}
@@ -1,11 +1,10 @@
 package bt
 
 import (
-	"encoding/binary"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"net"
+	"log"
+	"net/netip"
 )
 
 /*
@@ -26,121 +25,209 @@ Note that downloaders may rerequest on nonscheduled times if an event happens or
 
 More commonly is that trackers return a compact representation of the peer list, see BEP 23.
 https://www.bittorrent.org/beps/bep_0023.html
+
+IPv6 peers are returned under a separate `peers6` key in compact form (18 bytes per peer),
+or mixed in with IPv4 peers in the classic list. See BEP 7.
+https://www.bittorrent.org/beps/bep_0007.html
+
+Trackers commonly include a few optional keys as well:
+`warning message` is like `failure reason`, but the response is otherwise processed normally.
+`min interval` is the minimum time clients should wait between announces.
+`tracker id` should be sent back as `trackerid` on subsequent announces.
+`complete` and `incomplete` are the number of seeders and leechers.
+`external ip` is the client's address as seen by the tracker, see BEP 24.
+`crypto_flags` has one byte per compact peer, 1 if the peer prefers encrypted connections.
 */
 
 type TrackerResponse struct {
 	// Don't love defining these as pointer,
 	// but I'm not sure how best to check if they were provided otherwise.
-	Reason   *string `json:"failure reason,omitempty"`
-	Interval *int    `json:"interval,omitempty"`
-	Peers    []Peer  `json:"peers,omitempty"`
+	Reason      *string
+	Warning     *string
+	Interval    *int
+	MinInterval *int
+	TrackerID   *string
+	Complete    *int
+	Incomplete  *int
+	// Our address as seen by the tracker. Zero if not provided.
+	ExternalIP netip.Addr
+	Peers      []Peer
 }
 
 type Peer struct {
-	Peer string `json:"peer id"` // string???
-	//TODO add a non-JSON address generated from these?
-	// i.e. ParseTrackerResponse should try to create it, and error if the address can't be created.
-	IP   string `json:"ip"`
-	Port int    `json:"port"`
+	// Peer's self-selected ID. Empty in the compact format.
+	Peer string
+	Addr netip.AddrPort
+	// Peer prefers encrypted connections, per the tracker's crypto_flags
+	Crypto bool
 }
 
-// Parses a TrackerResponse from the JSON representation of a bencoded dictionary.
-func ParseClassicTrackerResponse(jsonBytes []byte) (*TrackerResponse, error) {
-	var tr TrackerResponse
-	err := json.Unmarshal(jsonBytes, &tr)
+// ParseTrackerResponse parses a bencoded tracker response.
+//
+// "peers" may be either a classic list of dictionaries or a compact string,
+// and compact IPv6 peers from "peers6" are appended after them.
+func ParseTrackerResponse(bs []byte) (*TrackerResponse, error) {
+	d, err := ParseDictOnly(bs)
+	if err != nil {
+		return nil, err
+	}
+	reason, ok, err := dictString(d, "failure reason")
+	if err != nil {
+		return nil, fmt.Errorf("TrackerResponse: %w", err)
+	}
+	if ok {
+		// Don't care about unpacking Peers if failure
+		return &TrackerResponse{Reason: &reason}, nil
+	}
+	// Interval and Peers must both be present if Reason is absent
+	interval, ok, err := dictInt(d, "interval")
+	if err != nil {
+		return nil, fmt.Errorf("TrackerResponse: %w", err)
+	}
+	if !ok {
+		return nil, errors.New("TrackerResponse: Interval cannot be missing when Reason is missing")
+	}
+	peersAny, hasPeers := d["peers"]
+	peers6, hasPeers6, err := dictString(d, "peers6")
 	if err != nil {
-		return &tr, err
+		return nil, fmt.Errorf("TrackerResponse: %w", err)
 	}
-	// Interval and Peers must both be non-nil if Reason is nil
-	if tr.Reason == nil {
-		if tr.Interval == nil {
-			return nil, errors.New("TrackerResponse: Interval cannot be nil when Reason is nil")
+	if !hasPeers && !hasPeers6 {
+		return nil, errors.New("TrackerResponse: Peers cannot be missing when Reason is missing")
+	}
+
+	peers := []Peer{}
+	switch p := peersAny.(type) {
+	case nil: // Only peers6
+	case string:
+		if peers, err = parseCompactPeers([]byte(p), 4); err != nil {
+			return nil, fmt.Errorf("TrackerResponse: peers: %w", err)
 		}
-		if tr.Peers == nil {
-			return nil, errors.New("TrackerResponse: Peers cannot be nil when Reason is nil")
+		flags, ok, err := dictString(d, "crypto_flags")
+		if err != nil {
+			return nil, fmt.Errorf("TrackerResponse: %w", err)
 		}
+		if ok {
+			if len(flags) != len(peers) {
+				return nil, fmt.Errorf("TrackerResponse: expected %d crypto_flags, got %d", len(peers), len(flags))
+			}
+			for i := range peers {
+				peers[i].Crypto = flags[i] == 1
+			}
+		}
+	case []any:
+		if peers, err = parseClassicPeers(p); err != nil {
+			return nil, fmt.Errorf("TrackerResponse: peers: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("TrackerResponse: expected peers to be a string or list, got %T", peersAny)
 	}
-	//TODO parse peers into net.IP addresses
-	return &tr, nil
-}
-
-type CompactTrackerResponse struct {
-	Reason   *string `json:"failure reason,omitempty"`
-	Interval *int    `json:"interval,omitempty"`
-	Peers    string  `json:"peers,omitempty"`
+	if hasPeers6 {
+		ps, err := parseCompactPeers([]byte(peers6), 16)
+		if err != nil {
+			return nil, fmt.Errorf("TrackerResponse: peers6: %w", err)
+		}
+		peers = append(peers, ps...)
+	}
+	tr := &TrackerResponse{Interval: &interval, Peers: peers}
+	if err := parseOptionalTrackerKeys(d, tr); err != nil {
+		return nil, fmt.Errorf("TrackerResponse: %w", err)
+	}
+	return tr, nil
 }
 
-// Parses a compact TrackerResponse from the JSON representation of a bencoded dictionary.
-func ParseCompactTrackerResponse(jsonBytes []byte) (*TrackerResponse, error) {
-	var tr CompactTrackerResponse
-	err := json.Unmarshal(jsonBytes, &tr)
-	if err != nil {
-		return nil, err
-	}
-	if tr.Reason != nil {
-		// Don't care about unpacking Peers if failure
-		return &TrackerResponse{Reason: tr.Reason}, nil
+// parseOptionalTrackerKeys fills in the optional keys of a successful response.
+func parseOptionalTrackerKeys(d map[string]any, tr *TrackerResponse) error {
+	for key, dst := range map[string]**string{
+		"warning message": &tr.Warning,
+		"tracker id":      &tr.TrackerID,
+	} {
+		v, ok, err := dictString(d, key)
+		if err != nil {
+			return err
+		}
+		if ok {
+			*dst = &v
+		}
 	}
-	// Interval and Peers must both be non-nil if Reason is nil
-	if tr.Reason == nil {
-		if tr.Interval == nil {
-			return nil, errors.New("TrackerResponse: Interval cannot be nil when Reason is nil")
+	for key, dst := range map[string]**int{
+		"min interval": &tr.MinInterval,
+		"complete":     &tr.Complete,
+		"incomplete":   &tr.Incomplete,
+	} {
+		v, ok, err := dictInt(d, key)
+		if err != nil {
+			return err
 		}
-		if tr.Peers == "" {
-			return nil, errors.New("TrackerResponse: Peers cannot be missing when Reason is nil")
+		if ok {
+			*dst = &v
 		}
 	}
-
-	// Parse Peers string into a list
-	if len(tr.Peers)%6 != 0 {
-		return nil, fmt.Errorf("expected Peers string to be divisible by 6, got %d", len(tr.Peers))
+	ip, ok, err := dictString(d, "external ip")
+	if err != nil {
+		return err
 	}
-	// Parse
-	peers := []Peer{}
-	var (
-		p          Peer
-		ipBytes    = make([]byte, 4)
-		ipUint32   uint32
-		ip         string
-		portUint16 uint16
-		port       int
-	)
-	for i := 0; i < len(tr.Peers); i += 6 {
-		// Need to read as network byte order (big endian) and convert to little endian
-		ipUint32 = binary.BigEndian.Uint32([]byte(tr.Peers[i : i+4]))
-		binary.LittleEndian.PutUint32(ipBytes, ipUint32)
-		ip = net.IPv4(ipBytes[0], ipBytes[1], ipBytes[2], ipBytes[3]).String()
-
-		portUint16 = binary.BigEndian.Uint16([]byte(tr.Peers[i+4 : i+6]))
-		port = int(portUint16)
-		//TODO convert from bytes to address
-
-		p = Peer{
-			Peer: "", // Ignored in compact format
-			IP:   ip,
-			Port: port,
+	if ok {
+		// Raw 4 or 16 byte address, see BEP 24
+		addr, ok := netip.AddrFromSlice([]byte(ip))
+		if !ok {
+			return fmt.Errorf("expected external ip of 4 or 16 bytes, got %d", len(ip))
 		}
-		peers = append(peers, p)
+		tr.ExternalIP = addr.Unmap()
 	}
-
-	return &TrackerResponse{Interval: tr.Interval, Peers: peers}, nil
+	return nil
 }
 
-func ParseTrackerResponse(bs []byte) (*TrackerResponse, error) {
-	v, _, err := Parse(bs)
-	if err != nil {
-		return nil, err
+// parseClassicPeers parses a list of peer dictionaries, each with keys peer id, ip, and port.
+//
+// The ip may be IPv4 or IPv6. Peers given by DNS name are skipped, since we only deal in addresses.
+func parseClassicPeers(list []any) ([]Peer, error) {
+	peers := []Peer{}
+	for i, v := range list {
+		d, ok := v.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("peer %d: expected dictionary, got %T", i, v)
+		}
+		id, _, err := dictString(d, "peer id")
+		if err != nil {
+			return nil, fmt.Errorf("peer %d: %w", i, err)
+		}
+		ipString, ok, err := dictString(d, "ip")
+		if err != nil {
+			return nil, fmt.Errorf("peer %d: %w", i, err)
+		}
+		if !ok {
+			return nil, fmt.Errorf("peer %d: missing ip", i)
+		}
+		port, ok, err := dictInt(d, "port")
+		if err != nil {
+			return nil, fmt.Errorf("peer %d: %w", i, err)
+		}
+		if !ok || port < 0 || port > 65535 {
+			return nil, fmt.Errorf("peer %d: missing or invalid port", i)
+		}
+		ip, err := netip.ParseAddr(ipString)
+		if err != nil {
+			log.Printf("TrackerResponse: skipping peer with non-IP address %q", ipString)
+			continue
+		}
+		peers = append(peers, Peer{
+			Peer: id,
+			Addr: netip.AddrPortFrom(ip.Unmap(), uint16(port)),
+		})
 	}
-	js, err := json.Marshal(v)
+	return peers, nil
+}
+
+// parseCompactPeers parses a compact peer list with addresses of ipLen bytes (4 or 16).
+func parseCompactPeers(bs []byte, ipLen int) ([]Peer, error) {
+	addrs, err := ParseCompactAddrs(bs, ipLen)
 	if err != nil {
 		return nil, err
 	}
-
-	// Try Classic
-	tr, err := ParseClassicTrackerResponse(js)
-	if err == nil {
-		return tr, nil
+	peers := make([]Peer, len(addrs))
+	for i, a := range addrs {
+		peers[i] = Peer{Addr: a}
 	}
-	// Failed - try compact
-	return ParseCompactTrackerResponse(js)
+	return peers, nil
 }
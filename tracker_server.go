@@ -0,0 +1,346 @@
+package bt
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TrackerServer is a BitTorrent tracker.
+//
+// It serves HTTP announces and scrapes as an http.Handler (see BEP 3, 23, 48)
+// and UDP announces and scrapes via ServeUDP (see BEP 15).
+// Create one with NewTrackerServer, then adjust its exported fields before serving.
+type TrackerServer struct {
+	Store PeerStore
+	// Allowlist restricts which infohashes are tracked. nil tracks every infohash.
+	Allowlist *Allowlist
+	// Interval and MinInterval are returned to clients as "interval" and "min interval".
+	Interval    time.Duration
+	MinInterval time.Duration
+	// Peers that haven't announced within PeerTTL are dropped from their swarms.
+	PeerTTL time.Duration
+	// Number of peers returned when a client doesn't specify numwant, and the most it may ask for.
+	DefaultNumWant int
+	MaxNumWant     int
+
+	expireMu   sync.Mutex
+	lastExpiry time.Time
+	// Secret for UDP connection ids, see udpConnectionID
+	udpSecret [16]byte
+}
+
+func NewTrackerServer(store PeerStore) *TrackerServer {
+	s := &TrackerServer{
+		Store:          store,
+		Interval:       30 * time.Minute,
+		MinInterval:    5 * time.Minute,
+		PeerTTL:        45 * time.Minute,
+		DefaultNumWant: 50,
+		MaxNumWant:     200,
+	}
+	s.initUDP()
+	return s
+}
+
+// Allowlist is a concurrency-safe set of infohashes a TrackerServer will track.
+type Allowlist struct {
+	mu         sync.RWMutex
+	infoHashes map[[20]byte]struct{}
+}
+
+func NewAllowlist(infoHashes ...[20]byte) *Allowlist {
+	a := &Allowlist{infoHashes: make(map[[20]byte]struct{}, len(infoHashes))}
+	for _, ih := range infoHashes {
+		a.infoHashes[ih] = struct{}{}
+	}
+	return a
+}
+
+func (a *Allowlist) Add(infoHash [20]byte) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.infoHashes[infoHash] = struct{}{}
+}
+
+func (a *Allowlist) Remove(infoHash [20]byte) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.infoHashes, infoHash)
+}
+
+// Allowed reports whether infoHash is in the list. A nil Allowlist allows everything.
+func (a *Allowlist) Allowed(infoHash [20]byte) bool {
+	if a == nil {
+		return true
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	_, ok := a.infoHashes[infoHash]
+	return ok
+}
+
+// errTrackerRequest is a client error, reported back to the client as a failure reason.
+type errTrackerRequest struct {
+	reason string
+}
+
+func (e errTrackerRequest) Error() string {
+	return e.reason
+}
+
+// announceRequest is an announce, independent of whether it came over HTTP or UDP.
+type announceRequest struct {
+	InfoHash [20]byte
+	PeerID   [20]byte
+	Addr     netip.AddrPort
+	Left     int64
+	Event    string
+	// Negative for the default
+	NumWant int
+}
+
+type announceResult struct {
+	Peers []TrackedPeer
+	Stats ScrapeFile
+}
+
+// announce handles an announce request, returning the peers to hand back to the client.
+func (s *TrackerServer) announce(req announceRequest) (*announceResult, error) {
+	if !s.Allowlist.Allowed(req.InfoHash) {
+		return nil, errTrackerRequest{"infohash not allowed"}
+	}
+	switch req.Event {
+	case EventNone, EventStarted, EventCompleted, EventStopped:
+	default:
+		return nil, errTrackerRequest{fmt.Sprintf("unknown event %q", req.Event)}
+	}
+	now := time.Now()
+	if err := s.maybeExpire(now); err != nil {
+		return nil, err
+	}
+	p := TrackedPeer{ID: req.PeerID, Addr: req.Addr, Left: req.Left, LastSeen: now}
+	if err := s.Store.Announce(req.InfoHash, p, req.Event); err != nil {
+		return nil, err
+	}
+	res := &announceResult{}
+	if req.Event != EventStopped {
+		numWant := req.NumWant
+		if numWant < 0 {
+			numWant = s.DefaultNumWant
+		}
+		if numWant > s.MaxNumWant {
+			numWant = s.MaxNumWant
+		}
+		// Seeders have no use for each other
+		peers, err := s.Store.Peers(req.InfoHash, numWant, req.PeerID, req.Left == 0)
+		if err != nil {
+			return nil, err
+		}
+		res.Peers = peers
+	}
+	stats, _, err := s.Store.Stats(req.InfoHash)
+	if err != nil {
+		return nil, err
+	}
+	res.Stats = stats
+	return res, nil
+}
+
+// scrape collects statistics for the given infohashes, or every tracked infohash if none are given.
+//
+// Infohashes that aren't tracked or aren't allowed are omitted.
+func (s *TrackerServer) scrape(infoHashes [][20]byte) (map[[20]byte]ScrapeFile, error) {
+	if len(infoHashes) == 0 {
+		all, err := s.Store.InfoHashes()
+		if err != nil {
+			return nil, err
+		}
+		infoHashes = all
+	}
+	files := make(map[[20]byte]ScrapeFile, len(infoHashes))
+	for _, ih := range infoHashes {
+		if !s.Allowlist.Allowed(ih) {
+			continue
+		}
+		f, ok, err := s.Store.Stats(ih)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			files[ih] = f
+		}
+	}
+	return files, nil
+}
+
+// maybeExpire drops stale peers, at most once every PeerTTL/4
+func (s *TrackerServer) maybeExpire(now time.Time) error {
+	s.expireMu.Lock()
+	if now.Sub(s.lastExpiry) < s.PeerTTL/4 {
+		s.expireMu.Unlock()
+		return nil
+	}
+	s.lastExpiry = now
+	s.expireMu.Unlock()
+	return s.Store.Expire(now.Add(-s.PeerTTL))
+}
+
+// ServeHTTP routes paths ending in /announce and /scrape.
+func (s *TrackerServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/announce"):
+		s.serveAnnounce(w, r)
+	case strings.HasSuffix(r.URL.Path, "/scrape"):
+		s.serveScrape(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *TrackerServer) serveAnnounce(w http.ResponseWriter, r *http.Request) {
+	req, err := parseAnnounceQuery(r)
+	if err != nil {
+		writeTrackerFailure(w, err.Error())
+		return
+	}
+	res, err := s.announce(*req)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+	q := r.URL.Query()
+	resp := map[string]any{
+		"interval":     int(s.Interval / time.Second),
+		"min interval": int(s.MinInterval / time.Second),
+		"complete":     res.Stats.Complete,
+		"incomplete":   res.Stats.Incomplete,
+		// BEP 24
+		"external ip": req.Addr.Addr().AsSlice(),
+	}
+	// Compact unless explicitly asked otherwise, see BEP 23.
+	if q.Get("compact") == "0" {
+		noPeerID := q.Get("no_peer_id") == "1"
+		peers := make([]map[string]any, len(res.Peers))
+		for i, p := range res.Peers {
+			d := map[string]any{
+				"ip":   p.Addr.Addr().Unmap().String(),
+				"port": p.Addr.Port(),
+			}
+			if !noPeerID {
+				d["peer id"] = p.ID[:]
+			}
+			peers[i] = d
+		}
+		resp["peers"] = peers
+	} else {
+		var peers, peers6 []byte
+		for _, p := range res.Peers {
+			if p.Addr.Addr().Unmap().Is4() {
+				peers = AppendCompactAddr(peers, p.Addr)
+			} else {
+				peers6 = AppendCompactAddr(peers6, p.Addr)
+			}
+		}
+		resp["peers"] = peers
+		if len(peers6) > 0 {
+			resp["peers6"] = peers6
+		}
+	}
+	writeBencoded(w, resp)
+}
+
+// parseAnnounceQuery reads the announce parameters from an HTTP request.
+//
+// The peer's address is taken from the connection; the ip parameter is ignored,
+// since honoring it would let anyone announce arbitrary hosts into a swarm.
+func parseAnnounceQuery(r *http.Request) (*announceRequest, error) {
+	q := r.URL.Query()
+	req := &announceRequest{NumWant: -1, Event: q.Get("event")}
+	for name, dst := range map[string]*[20]byte{"info_hash": &req.InfoHash, "peer_id": &req.PeerID} {
+		v := q.Get(name)
+		if len(v) != 20 {
+			return nil, fmt.Errorf("invalid %s", name)
+		}
+		copy(dst[:], v)
+	}
+	port, err := strconv.ParseUint(q.Get("port"), 10, 16)
+	if err != nil || port == 0 {
+		return nil, errors.New("invalid port")
+	}
+	if req.Left, err = strconv.ParseInt(q.Get("left"), 10, 64); err != nil || req.Left < 0 {
+		return nil, errors.New("invalid left")
+	}
+	if v := q.Get("numwant"); v != "" {
+		if req.NumWant, err = strconv.Atoi(v); err != nil || req.NumWant < 0 {
+			return nil, errors.New("invalid numwant")
+		}
+	}
+	remote, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid remote address %s", r.RemoteAddr)
+	}
+	req.Addr = netip.AddrPortFrom(remote.Addr().Unmap(), uint16(port))
+	return req, nil
+}
+
+func (s *TrackerServer) serveScrape(w http.ResponseWriter, r *http.Request) {
+	var infoHashes [][20]byte
+	for _, v := range r.URL.Query()["info_hash"] {
+		if len(v) != 20 {
+			writeTrackerFailure(w, "invalid info_hash")
+			return
+		}
+		var ih [20]byte
+		copy(ih[:], v)
+		infoHashes = append(infoHashes, ih)
+	}
+	files, err := s.scrape(infoHashes)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+	filesDict := make(map[string]any, len(files))
+	for ih, f := range files {
+		filesDict[string(ih[:])] = map[string]any{
+			"complete":   f.Complete,
+			"downloaded": f.Downloaded,
+			"incomplete": f.Incomplete,
+		}
+	}
+	writeBencoded(w, map[string]any{"files": filesDict})
+}
+
+// writeError reports client errors as failure reasons, and anything else as a 500.
+func (s *TrackerServer) writeError(w http.ResponseWriter, err error) {
+	var reqErr errTrackerRequest
+	if errors.As(err, &reqErr) {
+		writeTrackerFailure(w, reqErr.reason)
+		return
+	}
+	log.Printf("TrackerServer: %s", err)
+	http.Error(w, "internal error", http.StatusInternalServerError)
+}
+
+// writeTrackerFailure writes a "failure reason" response.
+// Per BEP 3, failures are still sent with 200 OK so clients will read the reason.
+func writeTrackerFailure(w http.ResponseWriter, reason string) {
+	writeBencoded(w, map[string]any{"failure reason": reason})
+}
+
+func writeBencoded(w http.ResponseWriter, v map[string]any) {
+	bs, err := Encode(v)
+	if err != nil {
+		log.Printf("TrackerServer: encoding response: %s", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(bs)
+}
@@ -0,0 +1,268 @@
+package bt
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// announceHTTP sends a bare announce to a TrackerServer, returning the parsed response.
+func announceHTTP(t *testing.T, base string, infoHash, peerID [20]byte, port, left int, extra url.Values) *TrackerResponse {
+	t.Helper()
+	v := url.Values{}
+	for k, vs := range extra {
+		v[k] = vs
+	}
+	v.Set("info_hash", string(infoHash[:]))
+	v.Set("peer_id", string(peerID[:]))
+	v.Set("port", fmt.Sprint(port))
+	v.Set("left", fmt.Sprint(left))
+	r, err := http.Get(base + "/announce?" + v.Encode())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer r.Body.Close()
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	tr, err := ParseTrackerResponse(body)
+	if err != nil {
+		t.Fatalf("parsing %q: %s", body, err)
+	}
+	return tr
+}
+
+func TestTrackerServerAnnounce(t *testing.T) {
+	ts := NewTrackerServer(NewMemoryPeerStore())
+	srv := httptest.NewServer(ts)
+	defer srv.Close()
+
+	ih := sha1.Sum([]byte("infohash"))
+	leecher := sha1.Sum([]byte("leecher"))
+	seeder := sha1.Sum([]byte("seeder"))
+
+	tr := announceHTTP(t, srv.URL, ih, leecher, 1111, 100, url.Values{"event": {EventStarted}})
+	if tr.Reason != nil {
+		t.Fatalf("unexpected failure: %s", *tr.Reason)
+	}
+	if len(tr.Peers) != 0 {
+		t.Fatalf("expected no peers for first announce, got %v", tr.Peers)
+	}
+
+	// Compact by default
+	tr = announceHTTP(t, srv.URL, ih, seeder, 2222, 0, nil)
+	want := []Peer{{Addr: netip.MustParseAddrPort("127.0.0.1:1111")}}
+	if !reflect.DeepEqual(want, tr.Peers) {
+		t.Fatalf("want %v, got %v", want, tr.Peers)
+	}
+	if *tr.Interval != 1800 {
+		t.Fatalf("want interval 1800, got %d", *tr.Interval)
+	}
+
+	// Dictionary peers with peer ids on request
+	tr = announceHTTP(t, srv.URL, ih, leecher, 1111, 50, url.Values{"compact": {"0"}})
+	want = []Peer{{Peer: string(seeder[:]), Addr: netip.MustParseAddrPort("127.0.0.1:2222")}}
+	if !reflect.DeepEqual(want, tr.Peers) {
+		t.Fatalf("want %v, got %v", want, tr.Peers)
+	}
+
+	// numwant=0 returns nobody
+	tr = announceHTTP(t, srv.URL, ih, leecher, 1111, 50, url.Values{"numwant": {"0"}})
+	if len(tr.Peers) != 0 {
+		t.Fatalf("expected no peers for numwant=0, got %v", tr.Peers)
+	}
+
+	// Stopped peers are dropped
+	announceHTTP(t, srv.URL, ih, seeder, 2222, 0, url.Values{"event": {EventStopped}})
+	tr = announceHTTP(t, srv.URL, ih, leecher, 1111, 50, nil)
+	if len(tr.Peers) != 0 {
+		t.Fatalf("expected stopped peer to be dropped, got %v", tr.Peers)
+	}
+}
+
+func TestTrackerServerScrape(t *testing.T) {
+	ts := NewTrackerServer(NewMemoryPeerStore())
+	srv := httptest.NewServer(ts)
+	defer srv.Close()
+
+	ih := sha1.Sum([]byte("infohash"))
+	other := sha1.Sum([]byte("untracked"))
+	announceHTTP(t, srv.URL, ih, sha1.Sum([]byte("a")), 1, 100, nil)
+	// A repeated completed announce isn't another download
+	announceHTTP(t, srv.URL, ih, sha1.Sum([]byte("b")), 2, 0, url.Values{"event": {EventCompleted}})
+	announceHTTP(t, srv.URL, ih, sha1.Sum([]byte("b")), 2, 0, url.Values{"event": {EventCompleted}})
+
+	got, err := Scrape(srv.URL+"/announce", ih, other)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	want := map[[20]byte]ScrapeFile{ih: {Complete: 1, Downloaded: 1, Incomplete: 1}}
+	if !reflect.DeepEqual(want, got.Files) {
+		t.Fatalf("want %v, got %v", want, got.Files)
+	}
+
+	// A leecher finishing is
+	announceHTTP(t, srv.URL, ih, sha1.Sum([]byte("a")), 1, 0, url.Values{"event": {EventCompleted}})
+	if got, err = Scrape(srv.URL+"/announce", ih); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	want = map[[20]byte]ScrapeFile{ih: {Complete: 2, Downloaded: 2}}
+	if !reflect.DeepEqual(want, got.Files) {
+		t.Fatalf("want %v, got %v", want, got.Files)
+	}
+}
+
+func TestTrackerServerAllowlist(t *testing.T) {
+	allowed := sha1.Sum([]byte("allowed"))
+	denied := sha1.Sum([]byte("denied"))
+	ts := NewTrackerServer(NewMemoryPeerStore())
+	ts.Allowlist = NewAllowlist(allowed)
+	srv := httptest.NewServer(ts)
+	defer srv.Close()
+
+	peer := sha1.Sum([]byte("peer"))
+	if tr := announceHTTP(t, srv.URL, allowed, peer, 1, 1, nil); tr.Reason != nil {
+		t.Fatalf("unexpected failure: %s", *tr.Reason)
+	}
+	if tr := announceHTTP(t, srv.URL, denied, peer, 1, 1, nil); tr.Reason == nil {
+		t.Fatal("expected failure for infohash not in allowlist")
+	}
+	ts.Allowlist.Add(denied)
+	if tr := announceHTTP(t, srv.URL, denied, peer, 1, 1, nil); tr.Reason != nil {
+		t.Fatalf("unexpected failure after adding to allowlist: %s", *tr.Reason)
+	}
+}
+
+func TestMemoryPeerStoreExpireAndSnapshot(t *testing.T) {
+	s := NewMemoryPeerStore()
+	ih := sha1.Sum([]byte("infohash"))
+	now := time.Now().UTC().Truncate(time.Second)
+	old := TrackedPeer{ID: sha1.Sum([]byte("old")), Addr: netip.MustParseAddrPort("1.1.1.1:1"), Left: 1, LastSeen: now.Add(-time.Hour)}
+	fresh := TrackedPeer{ID: sha1.Sum([]byte("fresh")), Addr: netip.MustParseAddrPort("[::2]:2"), Left: 0, LastSeen: now}
+	s.Announce(ih, old, EventStarted)
+	s.Announce(ih, fresh, EventCompleted)
+
+	s.Expire(now.Add(-time.Minute))
+	peers, _ := s.Peers(ih, 10, [20]byte{}, false)
+	if !reflect.DeepEqual([]TrackedPeer{fresh}, peers) {
+		t.Fatalf("want only fresh peer, got %v", peers)
+	}
+
+	var buf bytes.Buffer
+	if err := s.WriteSnapshot(&buf); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	restored := NewMemoryPeerStore()
+	if err := restored.ReadSnapshot(&buf); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !reflect.DeepEqual(s.swarms, restored.swarms) {
+		t.Fatalf("snapshot round trip mismatch:\nwant %v\ngot  %v", s.swarms, restored.swarms)
+	}
+}
+
+func TestTrackerServerUDP(t *testing.T) {
+	ts := NewTrackerServer(NewMemoryPeerStore())
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer conn.Close()
+	go ts.ServeUDP(conn)
+
+	ih := sha1.Sum([]byte("infohash"))
+	ts.Store.Announce(ih, TrackedPeer{
+		ID:       sha1.Sum([]byte("other")),
+		Addr:     netip.MustParseAddrPort("10.0.0.1:6881"),
+		Left:     0,
+		LastSeen: time.Now(),
+	}, EventStarted)
+
+	c, err := DialUDPTracker(fmt.Sprintf("udp://%s", conn.LocalAddr()))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer c.Close()
+	c.Timeout = time.Second
+	if err := c.connect(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	req := make([]byte, udpAnnounceRequestLength)
+	binary.BigEndian.PutUint64(req, c.connID)
+	binary.BigEndian.PutUint32(req[8:], udpActionAnnounce)
+	copy(req[16:], ih[:])
+	copy(req[36:], []byte("-XX0000-123456789012"))
+	binary.BigEndian.PutUint64(req[64:], 100)        // left
+	binary.BigEndian.PutUint32(req[80:], 2)          // started
+	binary.BigEndian.PutUint32(req[92:], 0xffffffff) // numwant -1
+	binary.BigEndian.PutUint16(req[96:], 7777)
+	resp, err := c.roundTrip(context.Background(), req, udpActionAnnounce)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	leechers, seeders := binary.BigEndian.Uint32(resp[12:]), binary.BigEndian.Uint32(resp[16:])
+	if leechers != 1 || seeders != 1 {
+		t.Fatalf("want 1 leecher and 1 seeder, got %d and %d", leechers, seeders)
+	}
+	peers, err := ParseCompactAddrs(resp[20:], 4)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if want := []netip.AddrPort{netip.MustParseAddrPort("10.0.0.1:6881")}; !reflect.DeepEqual(want, peers) {
+		t.Fatalf("want %v, got %v", want, peers)
+	}
+
+	sr, err := c.Scrape(ih)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if want := (ScrapeFile{Complete: 1, Incomplete: 1}); sr.Files[ih] != want {
+		t.Fatalf("want %v, got %v", want, sr.Files[ih])
+	}
+
+	// Bogus connection ids are rejected
+	binary.BigEndian.PutUint64(req, c.connID+1)
+	if _, err := c.roundTrip(context.Background(), req, udpActionAnnounce); err == nil {
+		t.Fatal("expected error for bad connection id")
+	}
+}
+
+// TestDownloaderQueryTracker runs the Downloader's tracker client against an in-process tracker.
+func TestDownloaderQueryTracker(t *testing.T) {
+	srv := httptest.NewServer(NewTrackerServer(NewMemoryPeerStore()))
+	defer srv.Close()
+
+	ih := sha1.Sum([]byte("infohash"))
+	announceHTTP(t, srv.URL, ih, sha1.Sum([]byte("leecher")), 4321, 100, nil)
+
+	peerID, err := GenPeerId()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	d := &Downloader{
+		MetaInfo:  MetaInfo{Announce: srv.URL + "/announce", InfoShaSum: ih},
+		PeerId:    peerID,
+		LocalPort: 6881,
+	}
+	tr, err := d.QueryTracker()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	want := []Peer{{Addr: netip.MustParseAddrPort("127.0.0.1:4321")}}
+	if !reflect.DeepEqual(want, tr.Peers) {
+		t.Fatalf("want %v, got %v", want, tr.Peers)
+	}
+}
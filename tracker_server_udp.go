@@ -0,0 +1,190 @@
+package bt
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"net/netip"
+	"time"
+)
+
+// UDP announce requests are 98 bytes:
+//
+//	<connection_id: int64><action: int32><transaction_id: int32>
+//	<info_hash: 20><peer_id: 20><downloaded: int64><left: int64><uploaded: int64>
+//	<event: int32><IP address: int32><key: int32><num_want: int32><port: int16>
+const udpAnnounceRequestLength = 98
+
+// UDP announce event codes, see BEP 15
+var udpEvents = []string{EventNone, EventCompleted, EventStarted, EventStopped}
+
+func (s *TrackerServer) initUDP() {
+	if _, err := rand.Read(s.udpSecret[:]); err != nil {
+		panic(err) // Only fails if the system's randomness source is broken
+	}
+}
+
+// udpConnectionID derives a connection id from the client address and the current minute,
+// so that the server doesn't need to remember the ids it has handed out.
+func (s *TrackerServer) udpConnectionID(addr netip.AddrPort, minute int64) uint64 {
+	mac := hmac.New(sha256.New, s.udpSecret[:])
+	b, _ := addr.MarshalBinary()
+	mac.Write(b)
+	binary.Write(mac, binary.BigEndian, minute)
+	return binary.BigEndian.Uint64(mac.Sum(nil))
+}
+
+// validUDPConnectionID accepts ids from the current or previous minute,
+// giving clients between one and two minutes to use them.
+func (s *TrackerServer) validUDPConnectionID(addr netip.AddrPort, id uint64, now time.Time) bool {
+	minute := now.Unix() / 60
+	return id == s.udpConnectionID(addr, minute) || id == s.udpConnectionID(addr, minute-1)
+}
+
+// ServeUDP answers BEP 15 requests on conn until it's closed.
+func (s *TrackerServer) ServeUDP(conn net.PacketConn) error {
+	buf := make([]byte, udpMaxPacketSize)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		addr, err := addrPortFromNet(from)
+		if err != nil {
+			continue
+		}
+		resp := s.handleUDP(buf[:n], addr, time.Now())
+		if resp == nil {
+			continue
+		}
+		if _, err := conn.WriteTo(resp, from); err != nil {
+			log.Printf("TrackerServer: UDP reply to %s: %s", addr, err)
+		}
+	}
+}
+
+// handleUDP returns the response to a single request, or nil if it should be ignored.
+func (s *TrackerServer) handleUDP(req []byte, addr netip.AddrPort, now time.Time) []byte {
+	if len(req) < 16 {
+		return nil
+	}
+	connID := binary.BigEndian.Uint64(req)
+	action := binary.BigEndian.Uint32(req[8:])
+	resp := make([]byte, 8, 20)
+	binary.BigEndian.PutUint32(resp, action)
+	copy(resp[4:8], req[12:16]) // transaction_id
+	if action == udpActionConnect {
+		if connID != udpProtocolID {
+			return nil
+		}
+		return binary.BigEndian.AppendUint64(resp, s.udpConnectionID(addr, now.Unix()/60))
+	}
+	if !s.validUDPConnectionID(addr, connID, now) {
+		return udpErrorResponse(resp, "invalid connection id")
+	}
+	switch action {
+	case udpActionAnnounce:
+		return s.handleUDPAnnounce(req, resp, addr)
+	case udpActionScrape:
+		return s.handleUDPScrape(req, resp)
+	default:
+		return udpErrorResponse(resp, "unknown action")
+	}
+}
+
+func (s *TrackerServer) handleUDPAnnounce(req, resp []byte, addr netip.AddrPort) []byte {
+	if len(req) < udpAnnounceRequestLength {
+		return udpErrorResponse(resp, "announce too short")
+	}
+	eventCode := binary.BigEndian.Uint32(req[80:])
+	if eventCode >= uint32(len(udpEvents)) {
+		return udpErrorResponse(resp, "unknown event")
+	}
+	ar := announceRequest{
+		Left:  int64(binary.BigEndian.Uint64(req[64:])),
+		Event: udpEvents[eventCode],
+		// The IP address field is ignored, as with HTTP's ip parameter
+		NumWant: int(int32(binary.BigEndian.Uint32(req[92:]))),
+		Addr:    netip.AddrPortFrom(addr.Addr(), binary.BigEndian.Uint16(req[96:])),
+	}
+	copy(ar.InfoHash[:], req[16:36])
+	copy(ar.PeerID[:], req[36:56])
+	res, err := s.announce(ar)
+	if err != nil {
+		var reqErr errTrackerRequest
+		if errors.As(err, &reqErr) {
+			return udpErrorResponse(resp, reqErr.reason)
+		}
+		log.Printf("TrackerServer: %s", err)
+		return udpErrorResponse(resp, "internal error")
+	}
+	// <interval: int32><leechers: int32><seeders: int32>, then compact peers
+	resp = binary.BigEndian.AppendUint32(resp, uint32(s.Interval/time.Second))
+	resp = binary.BigEndian.AppendUint32(resp, uint32(res.Stats.Incomplete))
+	resp = binary.BigEndian.AppendUint32(resp, uint32(res.Stats.Complete))
+	// Only peers of the requester's address family fit the response format
+	want4 := addr.Addr().Is4()
+	for _, p := range res.Peers {
+		if p.Addr.Addr().Unmap().Is4() != want4 {
+			continue
+		}
+		if len(resp)+18 > udpMaxPacketSize {
+			break
+		}
+		resp = AppendCompactAddr(resp, p.Addr)
+	}
+	return resp
+}
+
+func (s *TrackerServer) handleUDPScrape(req, resp []byte) []byte {
+	body := req[16:]
+	if len(body)%20 != 0 || len(body)/20 > udpMaxScrapeHashes {
+		return udpErrorResponse(resp, "invalid scrape")
+	}
+	for i := 0; i < len(body); i += 20 {
+		var ih [20]byte
+		copy(ih[:], body[i:])
+		var f ScrapeFile
+		if s.Allowlist.Allowed(ih) {
+			var err error
+			if f, _, err = s.Store.Stats(ih); err != nil {
+				log.Printf("TrackerServer: %s", err)
+				return udpErrorResponse(resp, "internal error")
+			}
+		}
+		resp = binary.BigEndian.AppendUint32(resp, uint32(f.Complete))
+		resp = binary.BigEndian.AppendUint32(resp, uint32(f.Downloaded))
+		resp = binary.BigEndian.AppendUint32(resp, uint32(f.Incomplete))
+	}
+	return resp
+}
+
+// udpErrorResponse rewrites the header in resp as an error with the given message
+func udpErrorResponse(resp []byte, message string) []byte {
+	binary.BigEndian.PutUint32(resp, udpActionError)
+	return append(resp[:8], message...)
+}
+
+// unmapAddrPort strips IPv4-mapped IPv6 prefixes, as found on dual-stack sockets.
+func unmapAddrPort(a netip.AddrPort) netip.AddrPort {
+	return netip.AddrPortFrom(a.Addr().Unmap(), a.Port())
+}
+
+// addrPortFromNet converts a net.Addr from a UDP or TCP socket to a netip.AddrPort.
+func addrPortFromNet(a net.Addr) (netip.AddrPort, error) {
+	switch x := a.(type) {
+	case *net.UDPAddr:
+		return unmapAddrPort(x.AddrPort()), nil
+	case *net.TCPAddr:
+		return unmapAddrPort(x.AddrPort()), nil
+	default:
+		return netip.ParseAddrPort(a.String())
+	}
+}
@@ -1,6 +1,7 @@
 package bt
 
 import (
+	"net/netip"
 	"reflect"
 	"testing"
 )
@@ -13,8 +14,7 @@ func TestParseClassicTrackerResponse(t *testing.T) {
 		Peers: []Peer{
 			{
 				Peer: "testpeer",
-				IP:   "1.2.3.4",
-				Port: 3333,
+				Addr: netip.MustParseAddrPort("1.2.3.4:3333"),
 			},
 		},
 	}
@@ -27,8 +27,32 @@ func TestParseClassicTrackerResponse(t *testing.T) {
 	}
 }
 
+func TestParseClassicTrackerResponseMixed(t *testing.T) {
+	// IPv4 and IPv6 peers may share the classic list (BEP 7). DNS names are skipped.
+	testInput := []byte(`d8:intervali10e5:peersl` +
+		`d7:peer id5:peer42:ip7:1.2.3.44:porti3333ee` +
+		`d7:peer id5:peer62:ip11:2001:db8::14:porti4444ee` +
+		`d7:peer id5:peerd2:ip11:example.com4:porti5555ee` +
+		`ee`)
+	ten := 10
+	testWant := &TrackerResponse{
+		Interval: &ten,
+		Peers: []Peer{
+			{Peer: "peer4", Addr: netip.MustParseAddrPort("1.2.3.4:3333")},
+			{Peer: "peer6", Addr: netip.MustParseAddrPort("[2001:db8::1]:4444")},
+		},
+	}
+	got, err := ParseTrackerResponse(testInput)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !reflect.DeepEqual(testWant, got) {
+		t.Fatalf("want %#v, got %#v", testWant, got)
+	}
+}
+
 func TestParseTrackerResponseFailure(t *testing.T) {
-	// No Interval. Neither sub-parser should pass.
+	// Missing the required "interval" key
 	testInput := []byte(`d5:peersld7:peer id8:testpeer2:ip7:1.2.3.44:porti3333eeee`)
 	_, err := ParseTrackerResponse(testInput)
 	if err == nil {
@@ -38,10 +62,8 @@ func TestParseTrackerResponseFailure(t *testing.T) {
 
 func TestParseCompactTrackerResponse(t *testing.T) {
 	peersBytes := []byte{'1', '2', ':', // 12: (length)
-		//0x01, 0x02, 0x03, 0x04, 0x0d, 0x05, // 1.2.3.4:3333
-		//0x10, 0x20, 0x30, 0x40, 0x05, 0x0d, // 16.32.48.64:1293
-		4, 3, 2, 1, 0x0d, 0x05, // 1.2.3.4:3333 in network byte order
-		1, 2, 3, 4, 0x05, 0x0d, // 4.3.2.1:1293 in network byte order
+		1, 2, 3, 4, 0x0d, 0x05, // 1.2.3.4:3333 in network byte order
+		4, 3, 2, 1, 0x05, 0x0d, // 4.3.2.1:1293 in network byte order
 	}
 	testInput := append([]byte(`d8:intervali10e5:peers`)[:],
 		peersBytes[:]...)
@@ -50,14 +72,8 @@ func TestParseCompactTrackerResponse(t *testing.T) {
 	testWant := &TrackerResponse{
 		Interval: &ten,
 		Peers: []Peer{
-			{
-				IP:   "1.2.3.4",
-				Port: 3333,
-			},
-			{
-				IP:   "4.3.2.1",
-				Port: 1293,
-			},
+			{Addr: netip.MustParseAddrPort("1.2.3.4:3333")},
+			{Addr: netip.MustParseAddrPort("4.3.2.1:1293")},
 		},
 	}
 	got, err := ParseTrackerResponse(testInput)
@@ -68,3 +84,68 @@ func TestParseCompactTrackerResponse(t *testing.T) {
 		t.Fatalf("\nwant\n\t%#v\ngot\n\t%#v", testWant, got)
 	}
 }
+
+func TestParseCompactTrackerResponsePeers6(t *testing.T) {
+	// Bytes above 0x7f aren't valid UTF-8 on their own, which used to break the JSON round trip.
+	peers := AppendCompactAddr(nil, netip.MustParseAddrPort("200.100.50.25:51413"))
+	peers6 := AppendCompactAddr(nil, netip.MustParseAddrPort("[2001:db8::ff]:6881"))
+	testInput := []byte("d8:intervali10e5:peers6:" + string(peers) + "6:peers618:" + string(peers6) + "e")
+	ten := 10
+	testWant := &TrackerResponse{
+		Interval: &ten,
+		Peers: []Peer{
+			{Addr: netip.MustParseAddrPort("200.100.50.25:51413")},
+			{Addr: netip.MustParseAddrPort("[2001:db8::ff]:6881")},
+		},
+	}
+	got, err := ParseTrackerResponse(testInput)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !reflect.DeepEqual(testWant, got) {
+		t.Fatalf("\nwant\n\t%#v\ngot\n\t%#v", testWant, got)
+	}
+
+	// peers6 entries must be 18 bytes
+	_, err = ParseTrackerResponse([]byte("d8:intervali10e6:peers66:" + string(peers) + "e"))
+	if err == nil {
+		t.Fatal("expected error, got none")
+	}
+}
+
+func TestParseTrackerResponseOptionalKeys(t *testing.T) {
+	peers := AppendCompactAddr(nil, netip.MustParseAddrPort("1.2.3.4:1"))
+	peers = AppendCompactAddr(peers, netip.MustParseAddrPort("5.6.7.8:2"))
+	testInput := []byte("d8:completei3e12:crypto_flags2:\x00\x01" +
+		"11:external ip4:\xcb\x00\x71\x07" +
+		"10:incompletei4e8:intervali10e12:min intervali5e5:peers12:" + string(peers) +
+		"10:tracker id3:xyz15:warning message7:careful" + "e")
+	got, err := ParseTrackerResponse(testInput)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	ten, five, three, four := 10, 5, 3, 4
+	warning, trackerID := "careful", "xyz"
+	want := &TrackerResponse{
+		Warning:     &warning,
+		Interval:    &ten,
+		MinInterval: &five,
+		TrackerID:   &trackerID,
+		Complete:    &three,
+		Incomplete:  &four,
+		ExternalIP:  netip.MustParseAddr("203.0.113.7"),
+		Peers: []Peer{
+			{Addr: netip.MustParseAddrPort("1.2.3.4:1")},
+			{Addr: netip.MustParseAddrPort("5.6.7.8:2"), Crypto: true},
+		},
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Fatalf("\nwant\n\t%#v\ngot\n\t%#v", want, got)
+	}
+
+	// crypto_flags must match the number of peers
+	_, err = ParseTrackerResponse([]byte("d12:crypto_flags1:\x008:intervali10e5:peers12:" + string(peers) + "e"))
+	if err == nil {
+		t.Fatal("expected error for mismatched crypto_flags, got none")
+	}
+}
@@ -0,0 +1,160 @@
+package bt
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Packets each protocol's reader can fall behind by before they're dropped
+const udpMuxBacklog = 256
+
+// UDPMux shares one UDP socket between the DHT and uTP, so both can use the port peers already know us by.
+// Packets are told apart by their first byte: KRPC messages are bencoded dictionaries, starting with 'd',
+// which can't be the type and version byte of a uTP packet.
+//
+//	mux := NewUDPMux(conn)
+//	dht := NewDHT(mux.DHT())
+//	utp := NewUTPSocket(mux.UTP())
+type UDPMux struct {
+	conn     net.PacketConn
+	dht, utp *muxConn
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+func NewUDPMux(conn net.PacketConn) *UDPMux {
+	m := &UDPMux{conn: conn, done: make(chan struct{})}
+	m.dht, m.utp = newMuxConn(m), newMuxConn(m)
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		m.readLoop()
+	}()
+	return m
+}
+
+// DHT returns the connection carrying KRPC messages.
+func (m *UDPMux) DHT() net.PacketConn {
+	return m.dht
+}
+
+// UTP returns the connection carrying uTP packets.
+func (m *UDPMux) UTP() net.PacketConn {
+	return m.utp
+}
+
+// Close closes the socket, and both protocols' connections with it.
+func (m *UDPMux) Close() error {
+	select {
+	case <-m.done:
+		return nil
+	default:
+	}
+	close(m.done)
+	err := m.conn.Close()
+	m.wg.Wait()
+	m.dht.Close()
+	m.utp.Close()
+	return err
+}
+
+func (m *UDPMux) readLoop() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, from, err := m.conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			select {
+			case <-m.done:
+				return
+			default:
+				continue
+			}
+		}
+		c := m.dht
+		if utpLooksLike(buf[:n]) {
+			c = m.utp
+		}
+		c.deliver(append([]byte(nil), buf[:n]...), from)
+	}
+}
+
+type muxPacket struct {
+	b    []byte
+	from net.Addr
+}
+
+// muxConn is one protocol's view of a UDPMux's socket. Closing it only stops reads; the socket stays open for the other.
+type muxConn struct {
+	m       *UDPMux
+	packets chan muxPacket
+	done    chan struct{}
+
+	mu           sync.Mutex
+	closed       bool
+	readDeadline *utpDeadline
+}
+
+func newMuxConn(m *UDPMux) *muxConn {
+	return &muxConn{m: m, packets: make(chan muxPacket, udpMuxBacklog), done: make(chan struct{}), readDeadline: newUTPDeadline()}
+}
+
+func (c *muxConn) deliver(b []byte, from net.Addr) {
+	select {
+	case c.packets <- muxPacket{b, from}:
+	default: // Dropped, like a full socket buffer
+	}
+}
+
+func (c *muxConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case p := <-c.packets:
+		return copy(b, p.b), p.from, nil
+	case <-c.done:
+		return 0, nil, net.ErrClosed
+	case <-c.readDeadline.wait():
+		return 0, nil, os.ErrDeadlineExceeded
+	}
+}
+
+func (c *muxConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.done:
+		return 0, net.ErrClosed
+	default:
+	}
+	return c.m.conn.WriteTo(b, addr)
+}
+
+func (c *muxConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.closed {
+		c.closed = true
+		close(c.done)
+	}
+	return nil
+}
+
+func (c *muxConn) LocalAddr() net.Addr {
+	return c.m.conn.LocalAddr()
+}
+
+func (c *muxConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *muxConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+// Writes go straight to the socket, so they have no deadline of their own
+func (c *muxConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,264 @@
+package bt
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+)
+
+/*
+UDP tracker protocol, see BEP 15: https://www.bittorrent.org/beps/bep_0015.html
+
+Every request starts with the same 16 bytes:
+	<connection_id: int64><action: int32><transaction_id: int32>
+and every response starts with:
+	<action: int32><transaction_id: int32>
+
+The client first sends a connect request (using udpProtocolID as the connection id)
+to obtain a connection id, which may then be used for one minute.
+*/
+
+const (
+	udpProtocolID uint64 = 0x41727101980
+
+	udpActionConnect  uint32 = 0
+	udpActionAnnounce uint32 = 1
+	udpActionScrape   uint32 = 2
+	udpActionError    uint32 = 3
+
+	// How long a connection id may be used after it was received
+	udpConnectionIDLifetime = time.Minute
+	// BEP 15 limits a scrape to about 74 infohashes to fit in a single packet
+	udpMaxScrapeHashes = 74
+	udpMaxPacketSize   = 2048
+)
+
+// UDPTrackerClient speaks the BEP 15 protocol with a single UDP tracker.
+type UDPTrackerClient struct {
+	// Timeout for the first attempt of each request. Doubled on each retry, per BEP 15.
+	Timeout time.Duration
+	// Number of retransmissions before giving up. BEP 15 suggests up to 8,
+	// but that amounts to about an hour with the default timeout.
+	Retries int
+
+	conn         *net.UDPConn
+	connID       uint64
+	connIDExpiry time.Time
+}
+
+// DialUDPTracker resolves and connects to a udp:// tracker URL.
+func DialUDPTracker(rawURL string) (*UDPTrackerClient, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing tracker URL %s: %w", rawURL, err)
+	}
+	if u.Scheme != "udp" {
+		return nil, fmt.Errorf("expected udp:// tracker URL, got %s", rawURL)
+	}
+	addr, err := net.ResolveUDPAddr("udp", u.Host)
+	if err != nil {
+		return nil, fmt.Errorf("resolving tracker %s: %w", u.Host, err)
+	}
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return nil, fmt.Errorf("dialing tracker %s: %w", u.Host, err)
+	}
+	return &UDPTrackerClient{
+		Timeout: 15 * time.Second,
+		Retries: 2,
+		conn:    conn,
+	}, nil
+}
+
+// Close the underlying UDP socket
+func (c *UDPTrackerClient) Close() error {
+	return c.conn.Close()
+}
+
+// Scrape requests swarm statistics for up to 74 infohashes.
+//
+// Unlike HTTP scrapes, the response carries no infohashes; counts are returned in request order.
+func (c *UDPTrackerClient) Scrape(infoHashes ...[20]byte) (*ScrapeResponse, error) {
+	if len(infoHashes) == 0 {
+		return nil, errors.New("UDP scrape: no infohashes provided")
+	}
+	if len(infoHashes) > udpMaxScrapeHashes {
+		return nil, fmt.Errorf("UDP scrape: at most %d infohashes per request, got %d", udpMaxScrapeHashes, len(infoHashes))
+	}
+	ctx := context.Background()
+	if err := c.connect(ctx); err != nil {
+		return nil, err
+	}
+	req := make([]byte, 16+20*len(infoHashes))
+	binary.BigEndian.PutUint64(req, c.connID)
+	binary.BigEndian.PutUint32(req[8:], udpActionScrape)
+	for i, ih := range infoHashes {
+		copy(req[16+20*i:], ih[:])
+	}
+	resp, err := c.roundTrip(ctx, req, udpActionScrape)
+	if err != nil {
+		return nil, err
+	}
+	// <seeders: int32><completed: int32><leechers: int32> for each infohash
+	body := resp[8:]
+	if len(body) != 12*len(infoHashes) {
+		return nil, fmt.Errorf("UDP scrape: expected %d bytes of statistics, got %d", 12*len(infoHashes), len(body))
+	}
+	out := &ScrapeResponse{Files: make(map[[20]byte]ScrapeFile, len(infoHashes))}
+	for i, ih := range infoHashes {
+		stats := body[12*i:]
+		out.Files[ih] = ScrapeFile{
+			Complete:   int(binary.BigEndian.Uint32(stats)),
+			Downloaded: int(binary.BigEndian.Uint32(stats[4:])),
+			Incomplete: int(binary.BigEndian.Uint32(stats[8:])),
+		}
+	}
+	return out, nil
+}
+
+// Announce sends an announce, returning the peers of the same address family as the tracker.
+// Retransmissions stop when ctx is cancelled.
+func (c *UDPTrackerClient) Announce(ctx context.Context, p AnnounceParams) (*TrackerResponse, error) {
+	eventCode := -1
+	for i, e := range udpEvents {
+		if e == p.Event {
+			eventCode = i
+		}
+	}
+	if eventCode == -1 {
+		return nil, fmt.Errorf("UDP announce: unknown event %q", p.Event)
+	}
+	if err := c.connect(ctx); err != nil {
+		return nil, err
+	}
+	req := make([]byte, udpAnnounceRequestLength)
+	binary.BigEndian.PutUint64(req, c.connID)
+	binary.BigEndian.PutUint32(req[8:], udpActionAnnounce)
+	copy(req[16:], p.InfoHash[:])
+	copy(req[36:], p.PeerID[:])
+	binary.BigEndian.PutUint64(req[56:], uint64(p.Downloaded))
+	binary.BigEndian.PutUint64(req[64:], uint64(p.Left))
+	binary.BigEndian.PutUint64(req[72:], uint64(p.Uploaded))
+	binary.BigEndian.PutUint32(req[80:], uint32(eventCode))
+	// IP address left as 0: the tracker uses the packet's source address
+	binary.BigEndian.PutUint32(req[88:], p.Key)
+	binary.BigEndian.PutUint32(req[92:], uint32(int32(p.NumWant)))
+	binary.BigEndian.PutUint16(req[96:], uint16(p.Port))
+	resp, err := c.roundTrip(ctx, req, udpActionAnnounce)
+	if err != nil {
+		return nil, err
+	}
+	// <interval: int32><leechers: int32><seeders: int32>, then compact peers
+	if len(resp) < 20 {
+		return nil, fmt.Errorf("UDP announce: expected at least 20 bytes, got %d", len(resp))
+	}
+	interval := int(binary.BigEndian.Uint32(resp[8:]))
+	leechers := int(binary.BigEndian.Uint32(resp[12:]))
+	seeders := int(binary.BigEndian.Uint32(resp[16:]))
+	ipLen := 4
+	if c.conn.RemoteAddr().(*net.UDPAddr).IP.To4() == nil {
+		ipLen = 16
+	}
+	peers, err := parseCompactPeers(resp[20:], ipLen)
+	if err != nil {
+		return nil, fmt.Errorf("UDP announce: %w", err)
+	}
+	return &TrackerResponse{
+		Interval:   &interval,
+		Complete:   &seeders,
+		Incomplete: &leechers,
+		Peers:      peers,
+	}, nil
+}
+
+// connect obtains a fresh connection id if the current one has expired.
+func (c *UDPTrackerClient) connect(ctx context.Context) error {
+	if time.Now().Before(c.connIDExpiry) {
+		return nil
+	}
+	req := make([]byte, 16)
+	binary.BigEndian.PutUint64(req, udpProtocolID)
+	binary.BigEndian.PutUint32(req[8:], udpActionConnect)
+	resp, err := c.roundTrip(ctx, req, udpActionConnect)
+	if err != nil {
+		return err
+	}
+	if len(resp) < 16 {
+		return fmt.Errorf("UDP connect: expected 16 byte response, got %d", len(resp))
+	}
+	c.connID = binary.BigEndian.Uint64(resp[8:])
+	c.connIDExpiry = time.Now().Add(udpConnectionIDLifetime)
+	return nil
+}
+
+// roundTrip fills in a random transaction id, sends req, and waits for the matching response,
+// retransmitting with exponential backoff.
+//
+// Error responses (action 3) are returned as errors. Cancelling ctx interrupts the wait for a response.
+func (c *UDPTrackerClient) roundTrip(ctx context.Context, req []byte, action uint32) ([]byte, error) {
+	if _, err := rand.Read(req[12:16]); err != nil {
+		return nil, fmt.Errorf("failed to read random bytes: %w", err)
+	}
+	tid := binary.BigEndian.Uint32(req[12:])
+	buf := make([]byte, udpMaxPacketSize)
+	// Wake up a blocked read when ctx is cancelled
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.conn.SetReadDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+	timeout := c.Timeout
+	for attempt := 0; attempt <= c.Retries; attempt++ {
+		if _, err := c.conn.Write(req); err != nil {
+			return nil, fmt.Errorf("UDP tracker: sending request: %w", err)
+		}
+		deadline := time.Now().Add(timeout)
+		timeout *= 2
+		if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+			deadline = d
+		}
+		if err := c.conn.SetReadDeadline(deadline); err != nil {
+			return nil, err
+		}
+		// Checked after setting the deadline, so a cancellation can't be overwritten
+		if err := ctx.Err(); err != nil {
+			return nil, fmt.Errorf("UDP tracker: %w", err)
+		}
+		for {
+			n, err := c.conn.Read(buf)
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				if err := ctx.Err(); err != nil {
+					return nil, fmt.Errorf("UDP tracker: %w", err)
+				}
+				break // retransmit
+			}
+			if err != nil {
+				return nil, fmt.Errorf("UDP tracker: reading response: %w", err)
+			}
+			if n < 8 || binary.BigEndian.Uint32(buf[4:]) != tid {
+				continue // Stale or garbage packet
+			}
+			resp := make([]byte, n)
+			copy(resp, buf[:n])
+			switch got := binary.BigEndian.Uint32(resp); got {
+			case action:
+				return resp, nil
+			case udpActionError:
+				return nil, fmt.Errorf("UDP tracker: %s", resp[8:])
+			default:
+				return nil, fmt.Errorf("UDP tracker: expected action %d, got %d", action, got)
+			}
+		}
+	}
+	return nil, fmt.Errorf("UDP tracker: no response after %d attempts", c.Retries+1)
+}
@@ -0,0 +1,945 @@
+package bt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+)
+
+// The Micro Transport Protocol, see BEP 29.
+//
+// uTP is a reliable, ordered stream over UDP, like TCP, but with LEDBAT congestion control:
+// it measures the one-way queuing delay its packets see, and backs off before it fills buffers,
+// so BitTorrent traffic yields to everything else on the link.
+
+const (
+	// Largest payload we send, so packets fit the common path MTU
+	utpMaxPayload = 1200
+	// LEDBAT's target queuing delay
+	utpTargetDelay = 100 * time.Millisecond
+	// Most the congestion window grows per round trip
+	utpMaxWindowIncrease = 3000
+	// Congestion window limits
+	utpMinWindow     = utpMaxPayload
+	utpMaxWindow     = 1024 * 1024
+	utpInitialWindow = 3 * utpMaxPayload
+	// Bytes of received data we'll buffer for reading
+	utpReceiveBuffer = 1024 * 1024
+	// Bytes of written data we'll buffer before it's sent
+	utpSendBuffer = 64 * 1024
+	// Out of order packets further ahead than this are dropped
+	utpReorderLimit = 1024
+	// Most bytes of selective ACK bitmask we send
+	utpMaxSACK = 32
+	// Retransmission timeout bounds, and the timeout before we've measured the round trip
+	utpMinTimeout     = 500 * time.Millisecond
+	utpMaxTimeout     = 30 * time.Second
+	utpInitialTimeout = time.Second
+	// Consecutive timeouts before a connection fails
+	utpMaxTimeouts = 6
+	// Duplicate or selective ACKs past a packet before it's considered lost
+	utpDupAckThreshold = 3
+	// How often connections check for timeouts
+	utpTickInterval = 50 * time.Millisecond
+	// Incoming connections waiting for Accept
+	utpAcceptBacklog = 32
+)
+
+var (
+	ErrUTPReset   = errors.New("utp: connection reset by peer")
+	ErrUTPTimeout = errors.New("utp: connection timed out")
+)
+
+// UTPSocket multiplexes uTP connections over a single UDP socket.
+// It's a net.Listener, accepting incoming connections, and dials outgoing ones.
+type UTPSocket struct {
+	conn   net.PacketConn
+	accept chan *UTPConn
+	done   chan struct{}
+	wg     sync.WaitGroup
+
+	mu sync.Mutex
+	// Connections by remote address and the connection id they send us. Guarded by mu.
+	conns map[utpConnKey]*UTPConn
+}
+
+type utpConnKey struct {
+	addr netip.AddrPort
+	id   uint16
+}
+
+// ListenUTP listens for uTP connections on the UDP address addr.
+func ListenUTP(network, addr string) (*UTPSocket, error) {
+	conn, err := net.ListenPacket(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewUTPSocket(conn), nil
+}
+
+// NewUTPSocket runs uTP over conn until Close. conn may be shared with other protocols through a UDPMux.
+func NewUTPSocket(conn net.PacketConn) *UTPSocket {
+	s := &UTPSocket{
+		conn:   conn,
+		accept: make(chan *UTPConn, utpAcceptBacklog),
+		done:   make(chan struct{}),
+		conns:  make(map[utpConnKey]*UTPConn),
+	}
+	s.wg.Add(2)
+	go func() {
+		defer s.wg.Done()
+		s.readLoop()
+	}()
+	go func() {
+		defer s.wg.Done()
+		s.tickLoop()
+	}()
+	return s
+}
+
+// Accept waits for an incoming connection.
+func (s *UTPSocket) Accept() (net.Conn, error) {
+	select {
+	case c := <-s.accept:
+		return c, nil
+	case <-s.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Addr is the UDP address we're listening on.
+func (s *UTPSocket) Addr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// Close fails every connection and closes the UDP socket.
+func (s *UTPSocket) Close() error {
+	s.mu.Lock()
+	select {
+	case <-s.done:
+		s.mu.Unlock()
+		return nil
+	default:
+	}
+	close(s.done)
+	conns := make([]*UTPConn, 0, len(s.conns))
+	for _, c := range s.conns {
+		conns = append(conns, c)
+	}
+	s.mu.Unlock()
+	for _, c := range conns {
+		c.mu.Lock()
+		c.fail(net.ErrClosed)
+		c.mu.Unlock()
+	}
+	err := s.conn.Close()
+	s.wg.Wait()
+	return err
+}
+
+// Dial connects to the uTP socket at addr.
+func (s *UTPSocket) Dial(ctx context.Context, addr netip.AddrPort) (*UTPConn, error) {
+	addr = unmapAddrPort(addr)
+	s.mu.Lock()
+	var c *UTPConn
+	for {
+		// The peer sends us recvID, and we send it recvID+1
+		id := uint16(rand.Intn(1 << 16))
+		key := utpConnKey{addr, id}
+		if _, ok := s.conns[key]; !ok && id != 0xffff {
+			c = newUTPConn(s, addr, id, id+1)
+			s.conns[key] = c
+			break
+		}
+	}
+	s.mu.Unlock()
+
+	c.mu.Lock()
+	c.seq = 1
+	c.queue(utpSyn, nil)
+	c.flush(time.Now())
+	c.mu.Unlock()
+	select {
+	case <-c.connected:
+		return c, nil
+	case <-c.done:
+		return nil, fmt.Errorf("utp: dialing %s: %w", addr, c.Err())
+	case <-ctx.Done():
+		c.mu.Lock()
+		c.fail(ctx.Err())
+		c.mu.Unlock()
+		return nil, fmt.Errorf("utp: dialing %s: %w", addr, ctx.Err())
+	}
+}
+
+func (s *UTPSocket) readLoop() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, from, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-s.done:
+				return
+			default:
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		addr, err := addrPortFromNet(from)
+		if err != nil {
+			continue
+		}
+		p, err := parseUTPPacket(buf[:n])
+		if err != nil {
+			continue
+		}
+		// The payload is kept in reorder and read buffers, so it can't alias buf
+		p.Payload = append([]byte(nil), p.Payload...)
+		s.handle(p, addr, time.Now())
+	}
+}
+
+func (s *UTPSocket) handle(p *utpPacket, from netip.AddrPort, now time.Time) {
+	if p.Type == utpSyn {
+		s.handleSyn(p, from, now)
+		return
+	}
+	s.mu.Lock()
+	c, ok := s.conns[utpConnKey{from, p.ConnID}]
+	s.mu.Unlock()
+	if !ok {
+		if p.Type != utpReset {
+			s.reset(p, from)
+		}
+		return
+	}
+	c.mu.Lock()
+	c.receive(p, now)
+	c.mu.Unlock()
+}
+
+// handleSyn creates a connection for a SYN, or repeats our answer if the SYN was retransmitted.
+func (s *UTPSocket) handleSyn(p *utpPacket, from netip.AddrPort, now time.Time) {
+	key := utpConnKey{from, p.ConnID + 1}
+	s.mu.Lock()
+	c, ok := s.conns[key]
+	if !ok {
+		if len(s.accept) == cap(s.accept) {
+			s.mu.Unlock()
+			return // They'll retry
+		}
+		c = newUTPConn(s, from, p.ConnID+1, p.ConnID)
+		s.conns[key] = c
+	}
+	s.mu.Unlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !ok {
+		c.seq = uint16(rand.Intn(1 << 16))
+		c.ack = p.Seq
+		c.setConnected()
+		s.accept <- c // Room was checked above, and only handleSyn sends
+	}
+	c.replyMicro = utpMicros(now) - p.Timestamp
+	c.sendState()
+}
+
+// reset tells the sender of p that we don't know its connection.
+func (s *UTPSocket) reset(p *utpPacket, to netip.AddrPort) {
+	b, _ := (&utpPacket{Type: utpReset, ConnID: p.ConnID, Timestamp: utpMicros(time.Now()), Ack: p.Seq}).MarshalBinary()
+	s.conn.WriteTo(b, net.UDPAddrFromAddrPort(to))
+}
+
+func (s *UTPSocket) remove(c *UTPConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := utpConnKey{c.remote, c.recvID}
+	if s.conns[key] == c {
+		delete(s.conns, key)
+	}
+}
+
+func (s *UTPSocket) tickLoop() {
+	ticker := time.NewTicker(utpTickInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case now := <-ticker.C:
+			s.mu.Lock()
+			conns := make([]*UTPConn, 0, len(s.conns))
+			for _, c := range s.conns {
+				conns = append(conns, c)
+			}
+			s.mu.Unlock()
+			for _, c := range conns {
+				c.mu.Lock()
+				c.tick(now)
+				c.mu.Unlock()
+			}
+		}
+	}
+}
+
+// utpMicros is a uTP timestamp: microseconds, wrapping around.
+func utpMicros(t time.Time) uint32 {
+	return uint32(t.UnixMicro())
+}
+
+// UTPConn is a uTP connection. It's a net.Conn, so PeerConn can run over it unchanged.
+type UTPConn struct {
+	s              *UTPSocket
+	remote         netip.AddrPort
+	recvID, sendID uint16
+	// Closed once the handshake completes
+	connected chan struct{}
+	// Closed by Close or when the connection fails
+	done chan struct{}
+	// Signalled when there's something to read, or room to write
+	readable, writable chan struct{}
+	readDeadline       *utpDeadline
+	writeDeadline      *utpDeadline
+
+	mu     sync.Mutex
+	state  int
+	closed bool
+	err    error
+	// Next sequence number we'll send, and the last one we've received in order
+	seq, ack uint16
+	// Packets sent and not yet acknowledged, in order, and the bytes of them in flight
+	outgoing []*utpOutgoing
+	inFlight int
+	// Written data not yet packetized, waiting for room in the window
+	pending []byte
+	// Received data waiting for Read, and packets received out of order
+	readBuf []byte
+	reorder map[uint16]*utpPacket
+	// The peer's FIN has been received, and everything before it
+	eof bool
+	// Congestion window in bytes, and the peer's receive window
+	window  float64
+	peerWnd uint32
+	// Round trip time estimates, and the retransmission timeout derived from them
+	rtt, rttVar time.Duration
+	timeout     time.Duration
+	// When the oldest unacknowledged packet times out
+	timeoutAt time.Time
+	// Consecutive timeouts
+	timeouts int
+	// ACKs repeating the same ack_nr
+	dupAcks  int
+	lastAck  uint16
+	lastLoss time.Time
+	// The lowest one-way delay seen in the current and previous minutes, as our baseline without queuing
+	baseDelay      [2]uint32
+	baseDelayStart time.Time
+	// Echoed to the peer as timestamp_difference: how long its last packet took to reach us, by our clocks
+	replyMicro uint32
+	// The window we last advertised was too small for a packet
+	windowClosed bool
+}
+
+const (
+	utpSynSent = iota
+	utpConnected
+	// Our FIN has been sent
+	utpFinSent
+	utpDone
+)
+
+type utpOutgoing struct {
+	typ     byte
+	seq     uint16
+	payload []byte
+	sentAt  time.Time
+	// Times sent, and whether it's waiting to be sent again
+	transmissions int
+	resend        bool
+	// Selective ACKs for later packets, counting towards fast retransmit
+	skipped int
+}
+
+func newUTPConn(s *UTPSocket, remote netip.AddrPort, recvID, sendID uint16) *UTPConn {
+	return &UTPConn{
+		s:             s,
+		remote:        remote,
+		recvID:        recvID,
+		sendID:        sendID,
+		connected:     make(chan struct{}),
+		done:          make(chan struct{}),
+		readable:      make(chan struct{}, 1),
+		writable:      make(chan struct{}, 1),
+		readDeadline:  newUTPDeadline(),
+		writeDeadline: newUTPDeadline(),
+		reorder:       make(map[uint16]*utpPacket),
+		window:        utpInitialWindow,
+		peerWnd:       utpMaxPayload,
+		timeout:       utpInitialTimeout,
+	}
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+func (c *UTPConn) Read(b []byte) (int, error) {
+	for {
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			return 0, net.ErrClosed
+		}
+		if len(c.readBuf) > 0 {
+			n := copy(b, c.readBuf)
+			c.readBuf = c.readBuf[n:]
+			// Let the peer know it can send again
+			if c.windowClosed && c.receiveWindow() >= utpMaxPayload && c.err == nil {
+				c.sendState()
+			}
+			c.mu.Unlock()
+			return n, nil
+		}
+		if c.eof {
+			c.mu.Unlock()
+			return 0, io.EOF
+		}
+		if c.err != nil {
+			err := c.err
+			c.mu.Unlock()
+			return 0, err
+		}
+		c.mu.Unlock()
+		select {
+		case <-c.readable:
+		case <-c.done:
+		case <-c.readDeadline.wait():
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+// Write queues b to be sent, waiting while the send buffer is full.
+func (c *UTPConn) Write(b []byte) (int, error) {
+	n := 0
+	for {
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			return n, net.ErrClosed
+		}
+		if c.err != nil {
+			err := c.err
+			c.mu.Unlock()
+			return n, err
+		}
+		if room := utpSendBuffer - len(c.pending); room > 0 {
+			k := len(b) - n
+			if k > room {
+				k = room
+			}
+			c.pending = append(c.pending, b[n:n+k]...)
+			n += k
+			c.flush(time.Now())
+		}
+		c.mu.Unlock()
+		if n == len(b) {
+			return n, nil
+		}
+		select {
+		case <-c.writable:
+		case <-c.done:
+		case <-c.writeDeadline.wait():
+			return n, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+// Close sends any data still buffered, followed by a FIN. It doesn't wait for them to be acknowledged.
+func (c *UTPConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	if c.err != nil {
+		return nil
+	}
+	if c.state == utpSynSent {
+		c.fail(net.ErrClosed)
+		return nil
+	}
+	close(c.done)
+	c.flush(time.Now())
+	return nil
+}
+
+// Err returns why the connection failed, if it has.
+func (c *UTPConn) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+func (c *UTPConn) LocalAddr() net.Addr {
+	return c.s.conn.LocalAddr()
+}
+
+func (c *UTPConn) RemoteAddr() net.Addr {
+	return net.UDPAddrFromAddrPort(c.remote)
+}
+
+func (c *UTPConn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
+
+func (c *UTPConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+func (c *UTPConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return nil
+}
+
+// fail ends the connection with err. Must hold c.mu.
+func (c *UTPConn) fail(err error) {
+	if c.err != nil || c.state == utpDone {
+		return
+	}
+	c.err = err
+	c.state = utpDone
+	select {
+	case <-c.done: // Already closed
+	default:
+		close(c.done)
+	}
+	c.s.remove(c)
+	notify(c.readable)
+	notify(c.writable)
+}
+
+func (c *UTPConn) setConnected() {
+	c.state = utpConnected
+	close(c.connected)
+}
+
+// receiveWindow is how much more data we can buffer. Must hold c.mu.
+func (c *UTPConn) receiveWindow() int {
+	buffered := len(c.readBuf)
+	for _, p := range c.reorder {
+		buffered += len(p.Payload)
+	}
+	if buffered > utpReceiveBuffer {
+		return 0
+	}
+	return utpReceiveBuffer - buffered
+}
+
+// send writes a packet to the peer, filling in our connection id, timestamps, window, and ack. Must hold c.mu.
+func (c *UTPConn) send(p *utpPacket, now time.Time) {
+	p.ConnID = c.sendID
+	if p.Type == utpSyn {
+		p.ConnID = c.recvID
+	}
+	p.Timestamp = utpMicros(now)
+	p.TimestampDiff = c.replyMicro
+	wnd := c.receiveWindow()
+	c.windowClosed = wnd < utpMaxPayload
+	p.WndSize = uint32(wnd)
+	p.Ack = c.ack
+	b, _ := p.MarshalBinary() // Can't fail, since SACKs we build are a multiple of 4
+	// Lost packets are retransmitted
+	c.s.conn.WriteTo(b, net.UDPAddrFromAddrPort(c.remote))
+}
+
+// sendState acknowledges what we've received, selectively acknowledging packets received out of order.
+func (c *UTPConn) sendState() {
+	p := &utpPacket{Type: utpState, Seq: c.seq}
+	if len(c.reorder) > 0 {
+		var sack [utpMaxSACK]byte
+		n := 0
+		for seq := range c.reorder {
+			i := int(seq - c.ack - 2)
+			if i < 0 || i >= 8*utpMaxSACK {
+				continue
+			}
+			sack[i/8] |= 1 << (i % 8)
+			if size := (i/32 + 1) * 4; size > n {
+				n = size
+			}
+		}
+		p.SACK = sack[:n]
+	}
+	c.send(p, time.Now())
+}
+
+// queue adds a packet to be sent as the window allows. Must hold c.mu.
+func (c *UTPConn) queue(typ byte, payload []byte) {
+	c.outgoing = append(c.outgoing, &utpOutgoing{typ: typ, seq: c.seq, payload: payload, resend: true})
+	c.seq++
+}
+
+// flush sends what the windows allow: retransmissions first, then new data from pending, then a FIN once closed.
+// Must hold c.mu.
+func (c *UTPConn) flush(now time.Time) {
+	if c.state == utpDone {
+		return
+	}
+	window := int(c.window)
+	if int(c.peerWnd) < window {
+		window = int(c.peerWnd)
+	}
+	fits := func(n int) bool {
+		// One packet may always be in flight, so a zero window doesn't stall us
+		return c.inFlight == 0 || c.inFlight+n <= window
+	}
+	for _, o := range c.outgoing {
+		if !o.resend {
+			continue
+		}
+		if !fits(len(o.payload)) {
+			return
+		}
+		c.transmit(o, now)
+	}
+	if c.state == utpSynSent {
+		return
+	}
+	for len(c.pending) > 0 {
+		n := len(c.pending)
+		if n > utpMaxPayload {
+			n = utpMaxPayload
+		}
+		if !fits(n) {
+			return
+		}
+		payload := append([]byte(nil), c.pending[:n]...)
+		c.pending = c.pending[n:]
+		c.queue(utpData, payload)
+		c.transmit(c.outgoing[len(c.outgoing)-1], now)
+		notify(c.writable)
+	}
+	if c.closed && c.state == utpConnected {
+		c.state = utpFinSent
+		c.queue(utpFin, nil)
+		c.transmit(c.outgoing[len(c.outgoing)-1], now)
+	}
+}
+
+func (c *UTPConn) transmit(o *utpOutgoing, now time.Time) {
+	if len(c.outgoing) > 0 && o == c.outgoing[0] || c.timeoutAt.IsZero() {
+		c.timeoutAt = now.Add(c.timeout)
+	}
+	o.resend = false
+	o.transmissions++
+	o.sentAt = now
+	c.inFlight += len(o.payload)
+	c.send(&utpPacket{Type: o.typ, Seq: o.seq, Payload: o.payload}, now)
+}
+
+// receive handles a packet for this connection. Must hold c.mu.
+func (c *UTPConn) receive(p *utpPacket, now time.Time) {
+	if c.state == utpDone {
+		return
+	}
+	if p.Type == utpReset {
+		c.fail(ErrUTPReset)
+		return
+	}
+	c.replyMicro = utpMicros(now) - p.Timestamp
+	c.peerWnd = p.WndSize
+	if c.state == utpSynSent {
+		if p.Type != utpState {
+			return
+		}
+		// The peer's first data packet will carry the seq_nr in its answer to our SYN
+		c.ack = p.Seq - 1
+		c.setConnected()
+	}
+	c.handleAck(p, now)
+	if p.Type == utpData || p.Type == utpFin {
+		c.handleData(p)
+	}
+	c.flush(now)
+	if c.state == utpFinSent && len(c.outgoing) == 0 {
+		// Our FIN was acknowledged
+		c.state = utpDone
+		c.s.remove(c)
+	}
+}
+
+// handleAck removes acknowledged packets, updating the round trip time and congestion window,
+// and marks packets for fast retransmission if later ones were acknowledged instead. Must hold c.mu.
+func (c *UTPConn) handleAck(p *utpPacket, now time.Time) {
+	if len(c.outgoing) == 0 {
+		c.lastAck = p.Ack
+		return
+	}
+	// Ignore ACKs for packets we haven't sent
+	if seqLess(c.seq-1, p.Ack) {
+		return
+	}
+	acked := 0
+	kept := c.outgoing[:0]
+	for _, o := range c.outgoing {
+		if !seqLess(p.Ack, o.seq) || utpSACKed(p, o.seq) {
+			acked += len(o.payload)
+			if !o.resend {
+				c.inFlight -= len(o.payload)
+			}
+			if o.transmissions == 1 {
+				c.updateRTT(now.Sub(o.sentAt))
+			}
+			continue
+		}
+		kept = append(kept, o)
+	}
+	for i := len(kept); i < len(c.outgoing); i++ {
+		c.outgoing[i] = nil
+	}
+	c.outgoing = kept
+
+	lost := false
+	if acked > 0 {
+		c.timeouts = 0
+		c.timeoutAt = now.Add(c.timeout)
+		c.dupAcks = 0
+		c.ledbat(p, acked, now)
+		notify(c.writable)
+	} else if p.Type == utpState && p.Ack == c.lastAck && len(c.outgoing) > 0 {
+		c.dupAcks++
+		if c.dupAcks == utpDupAckThreshold {
+			lost = c.retransmit(c.outgoing[0])
+		}
+	}
+	c.lastAck = p.Ack
+	// Packets with several later packets selectively acknowledged are lost
+	if len(p.SACK) > 0 {
+		for _, o := range c.outgoing {
+			if !seqLess(o.seq, p.Ack+2+uint16(8*len(p.SACK))) {
+				break
+			}
+			later := 0
+			for i := 0; i < 8*len(p.SACK); i++ {
+				if p.SACK[i/8]&(1<<(i%8)) != 0 && seqLess(o.seq, p.Ack+2+uint16(i)) {
+					later++
+				}
+			}
+			if later >= utpDupAckThreshold && o.skipped < utpDupAckThreshold {
+				o.skipped = later
+				lost = c.retransmit(o) || lost
+			}
+		}
+	}
+	if lost && now.Sub(c.lastLoss) > c.rtt {
+		// Halve the window, at most once per round trip
+		c.setWindow(c.window / 2)
+		c.lastLoss = now
+	}
+	if len(c.outgoing) == 0 {
+		c.timeoutAt = time.Time{}
+	}
+}
+
+// retransmit marks o to be sent again, reporting whether it was in flight.
+func (c *UTPConn) retransmit(o *utpOutgoing) bool {
+	if o.resend {
+		return false
+	}
+	o.resend = true
+	c.inFlight -= len(o.payload)
+	return true
+}
+
+func utpSACKed(p *utpPacket, seq uint16) bool {
+	i := int(seq - p.Ack - 2)
+	return i >= 0 && i < 8*len(p.SACK) && p.SACK[i/8]&(1<<(i%8)) != 0
+}
+
+// updateRTT folds a round trip sample into our estimates, like TCP.
+func (c *UTPConn) updateRTT(sample time.Duration) {
+	if c.rtt == 0 {
+		c.rtt, c.rttVar = sample, sample/2
+	} else {
+		delta := c.rtt - sample
+		if delta < 0 {
+			delta = -delta
+		}
+		c.rttVar += (delta - c.rttVar) / 4
+		c.rtt += (sample - c.rtt) / 8
+	}
+	c.timeout = c.rtt + 4*c.rttVar
+	if c.timeout < utpMinTimeout {
+		c.timeout = utpMinTimeout
+	}
+	if c.timeout > utpMaxTimeout {
+		c.timeout = utpMaxTimeout
+	}
+}
+
+// ledbat adjusts the congestion window towards keeping utpTargetDelay of queuing delay, after acked bytes were acknowledged.
+func (c *UTPConn) ledbat(p *utpPacket, acked int, now time.Time) {
+	if p.TimestampDiff == 0 {
+		return // The peer hasn't measured a delay yet
+	}
+	if now.Sub(c.baseDelayStart) >= time.Minute {
+		c.baseDelay[1], c.baseDelay[0] = c.baseDelay[0], p.TimestampDiff
+		c.baseDelayStart = now
+	}
+	// Timestamps wrap around, so compare differences
+	if int32(p.TimestampDiff-c.baseDelay[0]) < 0 {
+		c.baseDelay[0] = p.TimestampDiff
+	}
+	base := c.baseDelay[0]
+	if c.baseDelay[1] != 0 && int32(c.baseDelay[1]-base) < 0 {
+		base = c.baseDelay[1]
+	}
+	queuing := time.Duration(p.TimestampDiff-base) * time.Microsecond
+	offTarget := float64(utpTargetDelay-queuing) / float64(utpTargetDelay)
+	windowFactor := float64(acked) / c.window
+	if windowFactor > 1 {
+		windowFactor = 1
+	}
+	c.setWindow(c.window + utpMaxWindowIncrease*offTarget*windowFactor)
+}
+
+// setWindow sets the congestion window, within its limits.
+func (c *UTPConn) setWindow(w float64) {
+	if w < utpMinWindow {
+		w = utpMinWindow
+	}
+	if w > utpMaxWindow {
+		w = utpMaxWindow
+	}
+	c.window = w
+}
+
+// handleData adds a data or FIN packet to the stream, or holds on to it until the packets before it arrive,
+// then acknowledges it. Must hold c.mu.
+func (c *UTPConn) handleData(p *utpPacket) {
+	ahead := p.Seq - c.ack - 1
+	switch {
+	case ahead == 0:
+		if len(p.Payload) > c.receiveWindow() {
+			return // No room; it'll be sent again
+		}
+		c.deliver(p)
+		for {
+			next, ok := c.reorder[c.ack+1]
+			if !ok {
+				break
+			}
+			delete(c.reorder, c.ack+1)
+			c.deliver(next)
+		}
+	case ahead < utpReorderLimit && len(p.Payload) <= c.receiveWindow():
+		c.reorder[p.Seq] = p
+	}
+	c.sendState()
+}
+
+func (c *UTPConn) deliver(p *utpPacket) {
+	c.ack = p.Seq
+	if c.eof {
+		return
+	}
+	if p.Type == utpFin {
+		c.eof = true
+		c.reorder = make(map[uint16]*utpPacket)
+	}
+	c.readBuf = append(c.readBuf, p.Payload...)
+	notify(c.readable)
+}
+
+// tick retransmits after a timeout, shrinking the window, and fails the connection after too many. Must hold c.mu.
+func (c *UTPConn) tick(now time.Time) {
+	if c.state == utpDone || c.timeoutAt.IsZero() || now.Before(c.timeoutAt) {
+		return
+	}
+	if len(c.outgoing) == 0 {
+		c.timeoutAt = time.Time{}
+		return
+	}
+	c.timeouts++
+	if c.timeouts >= utpMaxTimeouts {
+		c.fail(ErrUTPTimeout)
+		return
+	}
+	c.window = utpMinWindow
+	c.timeout *= 2
+	if c.timeout > utpMaxTimeout {
+		c.timeout = utpMaxTimeout
+	}
+	for _, o := range c.outgoing {
+		c.retransmit(o)
+	}
+	c.inFlight = 0
+	c.timeoutAt = time.Time{}
+	c.flush(now)
+}
+
+// utpDeadline is a read or write deadline: a channel closed once it passes.
+type utpDeadline struct {
+	mu     sync.Mutex
+	timer  *time.Timer
+	passed chan struct{}
+}
+
+func newUTPDeadline() *utpDeadline {
+	return &utpDeadline{passed: make(chan struct{})}
+}
+
+func (d *utpDeadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.passed // Wait for the timer to fire, so it doesn't close the new channel
+	}
+	d.timer = nil
+	closed := false
+	select {
+	case <-d.passed:
+		closed = true
+	default:
+	}
+	if t.IsZero() {
+		if closed {
+			d.passed = make(chan struct{})
+		}
+		return
+	}
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.passed = make(chan struct{})
+		}
+		passed := d.passed
+		d.timer = time.AfterFunc(dur, func() { close(passed) })
+		return
+	}
+	if !closed {
+		close(d.passed)
+	}
+}
+
+func (d *utpDeadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.passed
+}
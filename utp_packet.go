@@ -0,0 +1,121 @@
+package bt
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// uTP packet types
+const (
+	utpData  byte = 0
+	utpFin   byte = 1
+	utpState byte = 2
+	utpReset byte = 3
+	utpSyn   byte = 4
+)
+
+const (
+	utpVersion      = 1
+	utpHeaderLength = 20
+	// Extension carrying a selective ACK bitmask
+	utpExtSelectiveAck = 1
+)
+
+// utpPacket is a uTP packet, see BEP 29:
+//
+//	0       4       8               16              24              32
+//	+-------+-------+---------------+---------------+---------------+
+//	| type  | ver   | extension     | connection_id                 |
+//	+-------+-------+---------------+---------------+---------------+
+//	| timestamp_microseconds                                        |
+//	+---------------+---------------+---------------+---------------+
+//	| timestamp_difference_microseconds                             |
+//	+---------------+---------------+---------------+---------------+
+//	| wnd_size                                                      |
+//	+---------------+---------------+---------------+---------------+
+//	| seq_nr                        | ack_nr                        |
+//	+---------------+---------------+---------------+---------------+
+type utpPacket struct {
+	Type   byte
+	ConnID uint16
+	// When the packet was sent, and the sender's latest one-way delay measurement
+	Timestamp     uint32
+	TimestampDiff uint32
+	// Bytes the sender can receive
+	WndSize uint32
+	Seq     uint16
+	Ack     uint16
+	// Selective ACK: bit i of the mask acknowledges Ack+2+i. A multiple of 4 bytes, or empty.
+	SACK    []byte
+	Payload []byte
+}
+
+func (p *utpPacket) MarshalBinary() ([]byte, error) {
+	if len(p.SACK)%4 != 0 {
+		return nil, fmt.Errorf("utp: selective ACK of %d bytes isn't a multiple of 4", len(p.SACK))
+	}
+	b := make([]byte, utpHeaderLength, utpHeaderLength+2+len(p.SACK)+len(p.Payload))
+	b[0] = p.Type<<4 | utpVersion
+	binary.BigEndian.PutUint16(b[2:], p.ConnID)
+	binary.BigEndian.PutUint32(b[4:], p.Timestamp)
+	binary.BigEndian.PutUint32(b[8:], p.TimestampDiff)
+	binary.BigEndian.PutUint32(b[12:], p.WndSize)
+	binary.BigEndian.PutUint16(b[16:], p.Seq)
+	binary.BigEndian.PutUint16(b[18:], p.Ack)
+	if len(p.SACK) > 0 {
+		b[1] = utpExtSelectiveAck
+		b = append(b, 0, byte(len(p.SACK)))
+		b = append(b, p.SACK...)
+	}
+	return append(b, p.Payload...), nil
+}
+
+// parseUTPPacket parses a packet. The payload is a slice of b.
+func parseUTPPacket(b []byte) (*utpPacket, error) {
+	if len(b) < utpHeaderLength {
+		return nil, fmt.Errorf("utp: packet of %d bytes shorter than header", len(b))
+	}
+	if b[0]&0x0f != utpVersion {
+		return nil, fmt.Errorf("utp: unsupported version %d", b[0]&0x0f)
+	}
+	p := &utpPacket{
+		Type:          b[0] >> 4,
+		ConnID:        binary.BigEndian.Uint16(b[2:]),
+		Timestamp:     binary.BigEndian.Uint32(b[4:]),
+		TimestampDiff: binary.BigEndian.Uint32(b[8:]),
+		WndSize:       binary.BigEndian.Uint32(b[12:]),
+		Seq:           binary.BigEndian.Uint16(b[16:]),
+		Ack:           binary.BigEndian.Uint16(b[18:]),
+	}
+	if p.Type > utpSyn {
+		return nil, fmt.Errorf("utp: unknown packet type %d", p.Type)
+	}
+	// Extensions are a linked list: each names the type of the next
+	next, rest := b[1], b[utpHeaderLength:]
+	for next != 0 {
+		if len(rest) < 2 || len(rest) < 2+int(rest[1]) {
+			return nil, errors.New("utp: truncated extension")
+		}
+		ext, data := next, rest[2:2+rest[1]]
+		next, rest = rest[0], rest[2+len(data):]
+		if ext == utpExtSelectiveAck {
+			if len(data) == 0 || len(data)%4 != 0 {
+				return nil, fmt.Errorf("utp: selective ACK of %d bytes isn't a multiple of 4", len(data))
+			}
+			p.SACK = data
+		}
+	}
+	p.Payload = rest
+	return p, nil
+}
+
+// utpLooksLike reports whether b could be a uTP packet, to tell them apart from other protocols on the same port.
+func utpLooksLike(b []byte) bool {
+	return len(b) >= utpHeaderLength && b[0]&0x0f == utpVersion && b[0]>>4 <= utpSyn
+}
+
+// seqLess compares sequence numbers, which wrap around.
+func seqLess(a, b uint16) bool {
+	return int16(a-b) < 0
+}
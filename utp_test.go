@@ -0,0 +1,418 @@
+package bt
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"errors"
+	"io"
+	mrand "math/rand"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestUTPPacket(t *testing.T) {
+	t.Parallel()
+	p := &utpPacket{
+		Type:          utpData,
+		ConnID:        12345,
+		Timestamp:     1,
+		TimestampDiff: 2,
+		WndSize:       3,
+		Seq:           4,
+		Ack:           5,
+		SACK:          []byte{1, 2, 3, 4},
+		Payload:       []byte("payload"),
+	}
+	b, err := p.MarshalBinary()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !utpLooksLike(b) {
+		t.Fatal("want packet recognized as uTP")
+	}
+	got, err := parseUTPPacket(b)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got.Type != p.Type || got.ConnID != p.ConnID || got.Timestamp != p.Timestamp || got.TimestampDiff != p.TimestampDiff ||
+		got.WndSize != p.WndSize || got.Seq != p.Seq || got.Ack != p.Ack || !bytes.Equal(got.SACK, p.SACK) || !bytes.Equal(got.Payload, p.Payload) {
+		t.Fatalf("want %+v, got %+v", p, got)
+	}
+
+	cases := []struct {
+		Name  string
+		Input []byte
+	}{
+		{"short", b[:10]},
+		{"bad version", append([]byte{0x02}, b[1:]...)},
+		{"bad type", append([]byte{0x51}, b[1:]...)},
+		{"truncated extension", b[:utpHeaderLength+3]},
+		{"bad selective ACK", append(append([]byte{}, b[:utpHeaderLength]...), 0, 3, 1, 2, 3)},
+	}
+	for _, c := range cases {
+		if _, err := parseUTPPacket(c.Input); err == nil {
+			t.Errorf("%s: wanted error, got nil", c.Name)
+		}
+	}
+	if utpLooksLike([]byte("d1:ad2:id20:abcdefghij0123456789e1:q4:ping1:t2:aa1:y1:qe")) {
+		t.Fatal("want KRPC message not recognized as uTP")
+	}
+}
+
+// lossyConn drops and delays some of the packets written to it.
+type lossyConn struct {
+	net.PacketConn
+	loss float64
+	mu   sync.Mutex
+	rand *mrand.Rand
+}
+
+func (c *lossyConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	drop, delay := c.rand.Float64() < c.loss, c.rand.Float64() < c.loss
+	c.mu.Unlock()
+	if drop {
+		return len(b), nil
+	}
+	if delay {
+		// Delivered out of order
+		b = append([]byte(nil), b...)
+		time.AfterFunc(5*time.Millisecond, func() { c.PacketConn.WriteTo(b, addr) })
+		return len(b), nil
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+func newTestUTPSocket(t *testing.T, loss float64) *UTPSocket {
+	t.Helper()
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	var pc net.PacketConn = conn
+	if loss > 0 {
+		pc = &lossyConn{PacketConn: conn, loss: loss, rand: mrand.New(mrand.NewSource(1))}
+	}
+	s := NewUTPSocket(pc)
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// utpPair connects a and b.
+func utpPair(t *testing.T, a, b *UTPSocket) (ca, cb net.Conn) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, _ := b.Accept()
+		accepted <- c
+	}()
+	ca, err := a.Dial(ctx, netip.MustParseAddrPort(b.Addr().String()))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	cb = <-accepted
+	if cb == nil {
+		t.Fatal("no connection accepted")
+	}
+	return ca, cb
+}
+
+func TestUTPTransfer(t *testing.T) {
+	t.Parallel()
+	cases := []struct {
+		Name string
+		Loss float64
+		Size int
+	}{
+		{"clean", 0, 1 << 20},
+		{"lossy", 0.05, 256 * 1024},
+	}
+	for _, c := range cases {
+		c := c
+		t.Run(c.Name, func(t *testing.T) {
+			t.Parallel()
+			ca, cb := utpPair(t, newTestUTPSocket(t, c.Loss), newTestUTPSocket(t, c.Loss))
+			ca.SetDeadline(time.Now().Add(20 * time.Second))
+			cb.SetDeadline(time.Now().Add(20 * time.Second))
+			want := make([]byte, c.Size)
+			rand.Read(want)
+
+			// Both directions at once
+			errs := make(chan error, 2)
+			for _, w := range []net.Conn{ca, cb} {
+				w := w
+				go func() {
+					_, err := w.Write(want)
+					errs <- err
+				}()
+			}
+			for _, r := range []net.Conn{cb, ca} {
+				got := make([]byte, c.Size)
+				if _, err := io.ReadFull(r, got); err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				if !bytes.Equal(got, want) {
+					t.Fatal("received data differs from sent")
+				}
+			}
+			for i := 0; i < 2; i++ {
+				if err := <-errs; err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+			}
+
+			// Data written before Close still arrives, followed by EOF
+			ca.Write([]byte("bye"))
+			ca.Close()
+			got, err := io.ReadAll(cb)
+			if err != nil || string(got) != "bye" {
+				t.Fatalf("want bye and EOF, got %q, %v", got, err)
+			}
+			if _, err := ca.Write([]byte("x")); !errors.Is(err, net.ErrClosed) {
+				t.Fatalf("want %s, got %v", net.ErrClosed, err)
+			}
+		})
+	}
+}
+
+func TestUTPPeerConn(t *testing.T) {
+	t.Parallel()
+	ca, cb := utpPair(t, newTestUTPSocket(t, 0), newTestUTPSocket(t, 0))
+	a, b := startPeerConnPair(t, ca, cb, 8, Reserved{}, Reserved{})
+	defer a.Close()
+	defer b.Close()
+	if a.Addr != netip.MustParseAddrPort(cb.LocalAddr().String()) {
+		t.Fatalf("want peer address %s, got %s", cb.LocalAddr(), a.Addr)
+	}
+	if !a.UTP || !b.UTP {
+		t.Fatal("want uTP connections marked as such")
+	}
+	a.Send(NewHave(3))
+	if i, _ := expectEvent(t, b, Have).Have(); i != 3 {
+		t.Fatalf("want have 3, got %d", i)
+	}
+
+	// Including when encrypted
+	ca, cb = utpPair(t, newTestUTPSocket(t, 0), newTestUTPSocket(t, 0))
+	h := Handshake{InfoHash: sha1.Sum([]byte("torrent"))}
+	accepted := make(chan *PeerConn, 1)
+	go func() {
+		p, _ := AcceptPeer(cb, h, 8, EncryptionRequired)
+		accepted <- p
+	}()
+	p, err := initiatePeerConn(ca, h, 8, EncryptionRequired)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if q := <-accepted; !p.Encrypted || !p.UTP || q == nil || !q.UTP {
+		t.Fatal("want encrypted uTP connections marked as uTP")
+	}
+}
+
+func TestUDPMux(t *testing.T) {
+	t.Parallel()
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	mux := NewUDPMux(conn)
+	defer mux.Close()
+	d := NewDHT(mux.DHT())
+	d.Start(context.Background())
+	s := NewUTPSocket(mux.UTP())
+
+	// A DHT node and a uTP peer can both reach us on the one port
+	other := newTestDHT(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := other.Ping(ctx, d.Addr()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	ca, cb := utpPair(t, newTestUTPSocket(t, 0), s)
+	ca.Write([]byte("hello"))
+	got := make([]byte, 5)
+	cb.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(cb, got); err != nil || string(got) != "hello" {
+		t.Fatalf("want hello, got %q, %v", got, err)
+	}
+
+	s.Close()
+	d.Close()
+	if _, _, err := mux.UTP().ReadFrom(got); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("want %s, got %v", net.ErrClosed, err)
+	}
+}
+
+func TestUTPReset(t *testing.T) {
+	t.Parallel()
+	s := newTestUTPSocket(t, 0)
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer conn.Close()
+	b, _ := (&utpPacket{Type: utpData, ConnID: 999, Seq: 7, Payload: []byte("x")}).MarshalBinary()
+	if _, err := conn.WriteTo(b, s.Addr()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1500)
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	p, err := parseUTPPacket(buf[:n])
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if p.Type != utpReset || p.ConnID != 999 || p.Ack != 7 {
+		t.Fatalf("want reset for connection 999, got %+v", p)
+	}
+
+	// Connections that are reset fail
+	ca, _ := utpPair(t, newTestUTPSocket(t, 0), s)
+	c := ca.(*UTPConn)
+	c.mu.Lock()
+	c.receive(&utpPacket{Type: utpReset}, time.Now())
+	c.mu.Unlock()
+	if _, err := ca.Read(buf); !errors.Is(err, ErrUTPReset) {
+		t.Fatalf("want %s, got %v", ErrUTPReset, err)
+	}
+}
+
+func TestUTPTimeout(t *testing.T) {
+	t.Parallel()
+	a := newTestUTPSocket(t, 0)
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	lossy := &lossyConn{PacketConn: conn, rand: mrand.New(mrand.NewSource(1))}
+	b := NewUTPSocket(lossy)
+	defer b.Close()
+	ca, _ := utpPair(t, b, a)
+	c := ca.(*UTPConn)
+	// From now on everything we send is lost
+	lossy.mu.Lock()
+	lossy.loss = 1
+	lossy.mu.Unlock()
+	ca.Write([]byte("lost"))
+	now := time.Now()
+	c.mu.Lock()
+	for i := 0; i < utpMaxTimeouts; i++ {
+		now = now.Add(utpMaxTimeout)
+		c.tick(now)
+		if i == 0 && c.window != utpMinWindow {
+			t.Errorf("want window reset to %d after a timeout, got %f", utpMinWindow, c.window)
+		}
+	}
+	c.mu.Unlock()
+	if _, err := ca.Write([]byte("x")); !errors.Is(err, ErrUTPTimeout) {
+		t.Fatalf("want %s, got %v", ErrUTPTimeout, err)
+	}
+
+	// Dialing a socket that doesn't answer fails
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := b.Dial(ctx, netip.MustParseAddrPort(a.Addr().String())); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("want %s, got %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestUTPDeadline(t *testing.T) {
+	t.Parallel()
+	ca, _ := utpPair(t, newTestUTPSocket(t, 0), newTestUTPSocket(t, 0))
+	ca.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, err := ca.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("want %s, got %v", os.ErrDeadlineExceeded, err)
+	}
+	// Clearing the deadline lets reads block again
+	ca.SetReadDeadline(time.Time{})
+	select {
+	case <-ca.(*UTPConn).readDeadline.wait():
+		t.Fatal("want deadline cleared")
+	default:
+	}
+}
+
+func TestUTPLEDBAT(t *testing.T) {
+	t.Parallel()
+	c := newUTPConn(nil, netip.AddrPort{}, 1, 2)
+	now := time.Now()
+	base := uint32(50000)
+	c.ledbat(&utpPacket{TimestampDiff: base}, utpMaxPayload, now)
+	grown := c.window
+	if grown <= utpInitialWindow {
+		t.Fatalf("want window grown without queuing delay, got %f", grown)
+	}
+	// Twice the target delay shrinks the window
+	c.ledbat(&utpPacket{TimestampDiff: base + uint32(2*utpTargetDelay/time.Microsecond)}, utpMaxPayload, now)
+	if c.window >= grown {
+		t.Fatalf("want window shrunk with queuing delay, got %f", c.window)
+	}
+	for i := 0; i < 1000; i++ {
+		c.ledbat(&utpPacket{TimestampDiff: base + uint32(time.Second/time.Microsecond)}, utpMaxPayload, now)
+	}
+	if c.window != utpMinWindow {
+		t.Fatalf("want window at least %d, got %f", utpMinWindow, c.window)
+	}
+}
+
+func TestUTPSelectiveAck(t *testing.T) {
+	t.Parallel()
+	ca, cb := utpPair(t, newTestUTPSocket(t, 0), newTestUTPSocket(t, 0))
+	b := cb.(*UTPConn)
+	// Packets after a gap are held and selectively acknowledged
+	b.mu.Lock()
+	first := b.ack + 1
+	for _, seq := range []uint16{first + 1, first + 2, first + 9} {
+		b.handleData(&utpPacket{Type: utpData, Seq: seq, Payload: []byte{byte(seq - first)}})
+	}
+	if len(b.readBuf) != 0 || len(b.reorder) != 3 {
+		t.Fatalf("want 3 packets held, got %d buffered and %d held", len(b.readBuf), len(b.reorder))
+	}
+	b.handleData(&utpPacket{Type: utpData, Seq: first, Payload: []byte{0}})
+	if !bytes.Equal(b.readBuf, []byte{0, 1, 2}) || len(b.reorder) != 1 {
+		t.Fatalf("want 3 packets delivered in order, got %v", b.readBuf)
+	}
+	b.mu.Unlock()
+
+	a := ca.(*UTPConn)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for i := 0; i < 5; i++ {
+		a.queue(utpData, []byte{byte(i)})
+		a.transmit(a.outgoing[len(a.outgoing)-1], time.Now())
+	}
+	// The first is lost, the rest arrive
+	ack := a.outgoing[0].seq - 1
+	a.handleAck(&utpPacket{Type: utpState, Ack: ack, SACK: []byte{0x0f, 0, 0, 0}}, time.Now())
+	if len(a.outgoing) != 1 || !a.outgoing[0].resend {
+		t.Fatalf("want the first packet marked for retransmission, got %d outgoing", len(a.outgoing))
+	}
+}
+
+func TestUTPAddrOfPeerConn(t *testing.T) {
+	t.Parallel()
+	// PeerConn takes its address from the conn, whatever its transport
+	ca, cb := net.Pipe()
+	defer ca.Close()
+	defer cb.Close()
+	h := Handshake{InfoHash: sha1.Sum([]byte("torrent"))}
+	go NewPeerConn(cb, h, 8)
+	p, err := NewPeerConn(ca, h, 8)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if p.Addr.IsValid() {
+		t.Fatalf("want no address for a pipe, got %s", p.Addr)
+	}
+}
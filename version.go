@@ -0,0 +1,67 @@
+package bt
+
+import (
+	"runtime/debug"
+	"strconv"
+	"strings"
+)
+
+// modulePath is this module, for finding our version in the build info.
+const modulePath = "github.com/eenblam/bt"
+
+// Version is our release, like 1.2.3. PeerPrefix and ClientVersion are derived from it.
+//
+// Set it when building with
+//
+//	go build -ldflags "-X github.com/eenblam/bt.Version=1.2.3"
+//
+// Otherwise it's the module version from the build info, when built as a dependency or installed with go install ...@v1.2.3.
+var Version string
+
+// buildVersion is Version, or the module version from the build info, or 0.0.0 for development builds.
+func buildVersion() string {
+	if Version != "" {
+		return strings.TrimPrefix(Version, "v")
+	}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "0.0.0"
+	}
+	version := info.Main.Version
+	if info.Main.Path != modulePath {
+		version = ""
+		for _, dep := range info.Deps {
+			if dep.Path == modulePath {
+				version = dep.Version
+			}
+		}
+	}
+	// Development builds are "(devel)", and untagged commits get pseudo-versions like v0.0.0-20230102150405-abcdef123456
+	if version == "" || version == "(devel)" || strings.Count(version, "-") >= 2 {
+		return "0.0.0"
+	}
+	return strings.TrimPrefix(version, "v")
+}
+
+// azureusPrefix is the Azureus-style peer id prefix for client code and version: -XXabcd-.
+// The first four parts of the version become a digit each, counting 10 to 35 as A to Z.
+// Pre-release and build suffixes are ignored.
+func azureusPrefix(code string, version string) [8]byte {
+	prefix := [8]byte{'-', code[0], code[1], '0', '0', '0', '0', '-'}
+	version, _, _ = strings.Cut(version, "-")
+	version, _, _ = strings.Cut(version, "+")
+	for i, part := range strings.SplitN(version, ".", 5) {
+		if i == 4 {
+			break
+		}
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			continue
+		}
+		if n > 35 {
+			n = 35
+		}
+		prefix[3+i] = versionDigits[n]
+	}
+	return prefix
+}